@@ -0,0 +1,94 @@
+package archivedb
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// accessTableSize is how many keys, or key prefixes, the access statistics
+// track. Past it, the least read one gives way to each new one sampled.
+const accessTableSize = 256
+
+// KeyAccess is the sampled read frequency of a key or key prefix.
+type KeyAccess struct {
+	// Key is the key, or its first bytes when AccessStatsOption sets a
+	// prefix length.
+	Key []byte
+	// Reads estimates the Gets of Key: its samples times the sample rate.
+	Reads int64
+	// Overcount bounds how much of Reads may belong to keys tracked in its
+	// place before, which were dropped to make room for it.
+	Overcount int64
+}
+
+// accessTable counts sampled reads by key with the Space-Saving algorithm,
+// which keeps the most read keys of a skewed workload in a fixed amount
+// of memory.
+type accessTable struct {
+	rate   int
+	prefix int
+	reads  int64 // atomic
+
+	mu     sync.Mutex
+	counts map[string]*accessCount
+}
+
+// accessCount counts the samples of a key, over of which may belong to the
+// keys it replaced.
+type accessCount struct {
+	n, over int64
+}
+
+func newAccessTable(rate, prefix int) *accessTable {
+	return &accessTable{rate: rate, prefix: prefix, counts: make(map[string]*accessCount)}
+}
+
+// sample counts one in every rate reads of key.
+func (t *accessTable) sample(key []byte) {
+	if atomic.AddInt64(&t.reads, 1)%int64(t.rate) != 0 {
+		return
+	}
+	if t.prefix > 0 && len(key) > t.prefix {
+		key = key[:t.prefix]
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c, ok := t.counts[string(key)]; ok {
+		c.n++
+		return
+	} else if len(t.counts) < accessTableSize {
+		t.counts[string(key)] = &accessCount{n: 1}
+		return
+	}
+	var min string
+	var c *accessCount
+	for k, kc := range t.counts {
+		if c == nil || kc.n < c.n {
+			min, c = k, kc
+		}
+	}
+	delete(t.counts, min)
+	t.counts[string(key)] = &accessCount{n: c.n + 1, over: c.n}
+}
+
+// top returns the keys tracked, most read first.
+func (t *accessTable) top() []KeyAccess {
+	t.mu.Lock()
+	keys := make([]KeyAccess, 0, len(t.counts))
+	for k, c := range t.counts {
+		keys = append(keys, KeyAccess{
+			Key:       []byte(k),
+			Reads:     c.n * int64(t.rate),
+			Overcount: c.over * int64(t.rate),
+		})
+	}
+	t.mu.Unlock()
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Reads != keys[j].Reads {
+			return keys[i].Reads > keys[j].Reads
+		}
+		return string(keys[i].Key) < string(keys[j].Key)
+	})
+	return keys
+}
@@ -0,0 +1,84 @@
+package archivedb
+
+// Reader reads values by key. *DB implements it; code that only reads can
+// depend on Reader to be tested against a fake.
+type Reader interface {
+	// Get returns the value of key, ErrKeyNotFound if it was never
+	// written or ErrKeyDeleted if it was deleted.
+	Get(key []byte) ([]byte, error)
+	// NewIterator returns an iterator over the live keys.
+	NewIterator() Iterator
+}
+
+// Writer writes values by key. *DB implements it.
+type Writer interface {
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	// NewBatch returns an empty batch of writes.
+	NewBatch() Batch
+}
+
+// ReadWriter is a Reader and a Writer.
+type ReadWriter interface {
+	Reader
+	Writer
+}
+
+// Batch buffers writes to commit them together. *WriteBatch implements it.
+type Batch interface {
+	Put(key, value []byte)
+	Delete(key []byte)
+	Len() int
+	Reset()
+	Commit() error
+}
+
+// Iterator is a cursor over keys in ascending order. A new iterator is
+// positioned before the first key, so Next moves to the first key, and
+// moving past either end leaves it there:
+//
+//	it := db.NewIterator()
+//	defer it.Close()
+//	for ok := it.Seek(start); ok; ok = it.Next() {
+//		use(it.Key(), it.Value())
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type Iterator interface {
+	// First and Last move to the first and last key, returning false if
+	// there is none or an error occurred.
+	First() bool
+	Last() bool
+	// Seek moves to the first key at or after key, returning false if
+	// there is none or an error occurred.
+	Seek(key []byte) bool
+	// Next moves to the next key, returning false when there are no more
+	// or an error occurred.
+	Next() bool
+	// Prev moves to the previous key, returning false when there are no
+	// more or an error occurred.
+	Prev() bool
+	// Valid returns true if the iterator is positioned at a key.
+	Valid() bool
+	// Key and Value return the current key and value, or nil if the
+	// iterator isn't valid. They are only valid until the iterator moves.
+	Key() []byte
+	Value() []byte
+	// Err returns the error that stopped the iteration, if any.
+	Err() error
+	// Close releases the iterator.
+	Close() error
+}
+
+var (
+	_ ReadWriter = (*DB)(nil)
+	_ Batch      = (*WriteBatch)(nil)
+	_ Iterator   = (*iterator)(nil)
+)
+
+// NewBatch returns an empty batch of writes to db. It is NewWriteBatch for
+// code written against Writer.
+func (db *DB) NewBatch() Batch {
+	return db.NewWriteBatch()
+}
@@ -0,0 +1,305 @@
+// Package archivedbtest provides an in-memory implementation of the
+// archivedb interfaces, for testing code that uses a database without
+// touching the filesystem.
+package archivedbtest
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/millken/archivedb"
+	"github.com/millken/archivedb/format"
+)
+
+// Fake is an in-memory archivedb.ReadWriter with the same semantics as
+// *archivedb.DB: deleted keys return archivedb.ErrKeyDeleted rather than
+// archivedb.ErrKeyNotFound, expired keys return archivedb.ErrKeyExpired,
+// keys are checked against the same limits and values against the one
+// set with SetMaxValueSize, and iterators walk keys in ascending order. It
+// is safe for concurrent use.
+type Fake struct {
+	mu      sync.RWMutex
+	entries map[string]fakeEntry
+	clock   archivedb.Clock
+	// maxValueSize is the largest value a put accepts, or zero if values
+	// aren't limited.
+	maxValueSize uint32
+	closed       bool
+}
+
+// fakeEntry is the current value of a key, or its tombstone.
+type fakeEntry struct {
+	value   []byte
+	deleted bool
+	expires time.Time // zero if the value doesn't expire
+}
+
+// live returns true if e holds a value at now.
+func (e fakeEntry) live(now time.Time) bool {
+	return !e.deleted && (e.expires.IsZero() || now.Before(e.expires))
+}
+
+var _ archivedb.ReadWriter = (*Fake)(nil)
+
+// NewFake returns an empty Fake.
+func NewFake() *Fake {
+	return &Fake{entries: make(map[string]fakeEntry), clock: archivedb.SystemClock}
+}
+
+// SetClock sets the clock TTLs are measured with, as ClockOption does for
+// a DB. The default is archivedb.SystemClock.
+func (f *Fake) SetClock(c archivedb.Clock) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.clock = c
+}
+
+// SetMaxValueSize lowers the largest value size a put accepts to n, as
+// MaxValueSizeOption does for a DB, counting the expiry stored with a TTL.
+// Without it, values aren't limited, as a DB chunks values too large for
+// a segment.
+func (f *Fake) SetMaxValueSize(n uint32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.maxValueSize = n
+}
+
+// Get returns a copy of the value of key.
+func (f *Fake) Get(key []byte) ([]byte, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return nil, archivedb.ErrDatabaseClosed
+	} else if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	e, ok := f.entries[string(key)]
+	if !ok {
+		return nil, archivedb.ErrKeyNotFound
+	} else if e.deleted {
+		return nil, archivedb.ErrKeyDeleted
+	} else if !e.live(f.clock.Now()) {
+		return nil, archivedb.ErrKeyExpired
+	}
+	return append([]byte{}, e.value...), nil
+}
+
+func (f *Fake) Put(key, value []byte) error {
+	return f.write([]fakeOp{{key: key, value: value}})
+}
+
+// PutWithTTL puts the value of key, expiring once ttl has passed on the
+// clock of f. A zero ttl never expires.
+func (f *Fake) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	if ttl < 0 {
+		return archivedb.ErrInvalidTTL
+	}
+	return f.write([]fakeOp{{key: key, value: value, ttl: ttl}})
+}
+
+func (f *Fake) Delete(key []byte) error {
+	return f.write([]fakeOp{{key: key, delete: true}})
+}
+
+// Close makes later calls fail with archivedb.ErrDatabaseClosed.
+func (f *Fake) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+// Len returns the number of live, unexpired keys.
+func (f *Fake) Len() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	now := f.clock.Now()
+	n := 0
+	for _, e := range f.entries {
+		if e.live(now) {
+			n++
+		}
+	}
+	return n
+}
+
+// fakeOp is a put or delete.
+type fakeOp struct {
+	key    []byte
+	value  []byte
+	delete bool
+	ttl    time.Duration
+}
+
+// write checks every op, then applies them all.
+func (f *Fake) write(ops []fakeOp) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return archivedb.ErrDatabaseClosed
+	}
+	for _, op := range ops {
+		if err := checkKey(op.key); err != nil {
+			return err
+		} else if err := f.checkValue(op); err != nil {
+			return err
+		}
+	}
+	now := f.clock.Now()
+	for _, op := range ops {
+		e := fakeEntry{
+			value:   append([]byte{}, op.value...),
+			deleted: op.delete,
+		}
+		if op.ttl != 0 {
+			e.expires = now.Add(op.ttl)
+		}
+		f.entries[string(op.key)] = e
+	}
+	return nil
+}
+
+func checkKey(key []byte) error {
+	if len(key) == 0 {
+		return archivedb.ErrEmptyKey
+	} else if len(key) > archivedb.MaxKeySize {
+		return archivedb.ErrKeyTooLarge
+	}
+	return nil
+}
+
+// checkValue returns archivedb.ErrValueTooLarge if op puts a value larger
+// than SetMaxValueSize allows. The caller must hold f.mu.
+func (f *Fake) checkValue(op fakeOp) error {
+	if op.delete || f.maxValueSize == 0 {
+		return nil
+	}
+	size := len(op.value)
+	if op.ttl != 0 {
+		size += format.ExpirySize
+	}
+	if size > int(f.maxValueSize) {
+		return archivedb.ErrValueTooLarge
+	}
+	return nil
+}
+
+// NewBatch returns an empty batch of writes to f. Unlike a batch committed
+// to a DB, it is applied atomically.
+func (f *Fake) NewBatch() archivedb.Batch {
+	return &fakeBatch{fake: f}
+}
+
+type fakeBatch struct {
+	fake *Fake
+	ops  []fakeOp
+}
+
+func (b *fakeBatch) Put(key, value []byte) {
+	b.ops = append(b.ops, fakeOp{key: append([]byte{}, key...), value: append([]byte{}, value...)})
+}
+
+func (b *fakeBatch) Delete(key []byte) {
+	b.ops = append(b.ops, fakeOp{key: append([]byte{}, key...), delete: true})
+}
+
+func (b *fakeBatch) Len() int { return len(b.ops) }
+func (b *fakeBatch) Reset()   { b.ops = nil }
+
+func (b *fakeBatch) Commit() error {
+	if err := b.fake.write(b.ops); err != nil {
+		return err
+	}
+	b.Reset()
+	return nil
+}
+
+// NewIterator returns an iterator over the keys live in f, in ascending
+// order. Like a DB iterator, it skips keys deleted after it was created and
+// yields the current value of keys overwritten since.
+func (f *Fake) NewIterator() archivedb.Iterator {
+	it := &fakeIterator{fake: f, pos: -1}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		it.err = archivedb.ErrDatabaseClosed
+		return it
+	}
+	now := f.clock.Now()
+	for k, e := range f.entries {
+		if e.live(now) {
+			it.keys = append(it.keys, []byte(k))
+		}
+	}
+	sort.Slice(it.keys, func(i, j int) bool {
+		return bytes.Compare(it.keys[i], it.keys[j]) < 0
+	})
+	return it
+}
+
+type fakeIterator struct {
+	fake  *Fake
+	keys  [][]byte
+	pos   int
+	key   []byte
+	value []byte
+	err   error
+}
+
+func (it *fakeIterator) First() bool {
+	it.pos = -1
+	return it.step(1)
+}
+
+func (it *fakeIterator) Last() bool {
+	it.pos = len(it.keys)
+	return it.step(-1)
+}
+
+func (it *fakeIterator) Seek(key []byte) bool {
+	it.pos = sort.Search(len(it.keys), func(i int) bool {
+		return bytes.Compare(it.keys[i], key) >= 0
+	}) - 1
+	return it.step(1)
+}
+
+func (it *fakeIterator) Next() bool { return it.step(1) }
+func (it *fakeIterator) Prev() bool { return it.step(-1) }
+
+// step moves by dir, skipping keys deleted or expired since the iterator
+// was created, until it finds a live key or runs off an end.
+func (it *fakeIterator) step(dir int) bool {
+	it.key, it.value = nil, nil
+	for it.err == nil {
+		it.pos += dir
+		if it.pos < 0 {
+			it.pos = -1
+			return false
+		} else if it.pos >= len(it.keys) {
+			it.pos = len(it.keys)
+			return false
+		}
+		v, err := it.fake.Get(it.keys[it.pos])
+		if err == archivedb.ErrKeyNotFound || err == archivedb.ErrKeyDeleted || err == archivedb.ErrKeyExpired {
+			continue
+		} else if err != nil {
+			it.err = err
+			return false
+		}
+		it.key, it.value = it.keys[it.pos], v
+		return true
+	}
+	return false
+}
+
+func (it *fakeIterator) Valid() bool   { return it.key != nil }
+func (it *fakeIterator) Key() []byte   { return it.key }
+func (it *fakeIterator) Value() []byte { return it.value }
+func (it *fakeIterator) Err() error    { return it.err }
+
+func (it *fakeIterator) Close() error {
+	it.keys, it.key, it.value = nil, nil, nil
+	return nil
+}
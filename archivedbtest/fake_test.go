@@ -0,0 +1,184 @@
+package archivedbtest_test
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/millken/archivedb"
+	"github.com/millken/archivedb/archivedbtest"
+	"github.com/stretchr/testify/require"
+)
+
+// TestFake runs the same operations against a Fake and a DB, checking both
+// behave the same.
+func TestFake(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archivedbtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := archivedb.Open(dir)
+	require.NoError(t, err)
+	defer db.Close()
+
+	for name, rw := range map[string]archivedb.ReadWriter{
+		"DB":   db,
+		"Fake": archivedbtest.NewFake(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+			_, err := rw.Get([]byte("foo"))
+			require.ErrorIs(err, archivedb.ErrKeyNotFound)
+			require.ErrorIs(rw.Put(nil, []byte("bar")), archivedb.ErrEmptyKey)
+			require.ErrorIs(rw.Put(make([]byte, archivedb.MaxKeySize+1), nil), archivedb.ErrKeyTooLarge)
+
+			require.NoError(rw.Put([]byte("foo"), []byte("bar")))
+			v, err := rw.Get([]byte("foo"))
+			require.NoError(err)
+			require.Equal([]byte("bar"), v)
+			require.NoError(rw.Delete([]byte("foo")))
+			_, err = rw.Get([]byte("foo"))
+			require.ErrorIs(err, archivedb.ErrKeyDeleted)
+
+			b := rw.NewBatch()
+			b.Put([]byte("b"), []byte("1"))
+			b.Put([]byte("a"), []byte("1"))
+			b.Put([]byte("c"), []byte("1"))
+			b.Put([]byte("a"), []byte("2"))
+			require.Equal(4, b.Len())
+			require.NoError(b.Commit())
+			require.Zero(b.Len())
+			b.Put([]byte("d"), []byte("1"))
+			b.Delete(nil)
+			require.ErrorIs(b.Commit(), archivedb.ErrEmptyKey)
+			_, err = rw.Get([]byte("d"))
+			require.ErrorIs(err, archivedb.ErrKeyNotFound)
+
+			it := rw.NewIterator()
+			defer it.Close()
+			require.NoError(rw.Delete([]byte("b")))
+			var got []string
+			for it.Next() {
+				got = append(got, string(it.Key())+"="+string(it.Value()))
+			}
+			require.NoError(it.Err())
+			require.Equal([]string{"a=2", "c=1"}, got)
+			require.False(it.Valid())
+			require.True(it.Prev())
+			require.Equal([]byte("c"), it.Key())
+			require.True(it.Seek([]byte("b")))
+			require.Equal([]byte("c"), it.Key())
+			require.True(it.First())
+			require.Equal([]byte("a"), it.Key())
+			require.False(it.Prev())
+			require.True(it.Last())
+			require.Equal([]byte("1"), it.Value())
+		})
+	}
+}
+
+func TestFake_Close(t *testing.T) {
+	require := require.New(t)
+	f := archivedbtest.NewFake()
+	require.NoError(f.Put([]byte("foo"), []byte("bar")))
+	require.Equal(1, f.Len())
+	require.NoError(f.Close())
+	_, err := f.Get([]byte("foo"))
+	require.ErrorIs(err, archivedb.ErrDatabaseClosed)
+	require.ErrorIs(f.Put([]byte("foo"), nil), archivedb.ErrDatabaseClosed)
+	require.False(f.NewIterator().Next())
+}
+
+// stepClock is an archivedb.Clock moved by hand.
+type stepClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *stepClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *stepClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// TestFake_PutWithTTL checks a Fake expires keys as a DB does.
+func TestFake_PutWithTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archivedbtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	clock := &stepClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	db, err := archivedb.Open(dir, archivedb.ClockOption(clock))
+	require.NoError(t, err)
+	defer db.Close()
+	fake := archivedbtest.NewFake()
+	fake.SetClock(clock)
+
+	type ttlWriter interface {
+		archivedb.ReadWriter
+		PutWithTTL(key, value []byte, ttl time.Duration) error
+	}
+	for name, rw := range map[string]ttlWriter{"DB": db, "Fake": fake} {
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+			require.ErrorIs(rw.PutWithTTL([]byte("a"), nil, -time.Second), archivedb.ErrInvalidTTL)
+			require.NoError(rw.PutWithTTL([]byte("foo"), []byte("bar"), time.Minute))
+			require.NoError(rw.Put([]byte("keep"), []byte("1")))
+			v, err := rw.Get([]byte("foo"))
+			require.NoError(err)
+			require.Equal([]byte("bar"), v)
+		})
+	}
+	clock.Add(time.Minute)
+	for name, rw := range map[string]archivedb.ReadWriter{"DB": db, "Fake": fake} {
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+			_, err := rw.Get([]byte("foo"))
+			require.ErrorIs(err, archivedb.ErrKeyExpired)
+			it := rw.NewIterator()
+			defer it.Close()
+			require.True(it.First())
+			require.Equal([]byte("keep"), it.Key())
+			require.False(it.Next())
+		})
+	}
+	require.Equal(t, 1, fake.Len())
+}
+
+func TestFake_SetMaxValueSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archivedbtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := archivedb.Open(dir, archivedb.MaxValueSizeOption(16))
+	require.NoError(t, err)
+	defer db.Close()
+	fake := archivedbtest.NewFake()
+	fake.SetMaxValueSize(16)
+
+	type ttlWriter interface {
+		archivedb.ReadWriter
+		PutWithTTL(key, value []byte, ttl time.Duration) error
+	}
+	for name, rw := range map[string]ttlWriter{"DB": db, "Fake": fake} {
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+			require.NoError(rw.Put([]byte("a"), make([]byte, 16)))
+			require.ErrorIs(rw.Put([]byte("a"), make([]byte, 17)), archivedb.ErrValueTooLarge)
+			// The expiry stored with a TTL counts towards the limit.
+			require.ErrorIs(rw.PutWithTTL([]byte("a"), make([]byte, 16), time.Minute), archivedb.ErrValueTooLarge)
+			b := rw.NewBatch()
+			b.Put([]byte("b"), nil)
+			b.Put([]byte("c"), make([]byte, 17))
+			require.ErrorIs(b.Commit(), archivedb.ErrValueTooLarge)
+			_, err := rw.Get([]byte("b"))
+			require.ErrorIs(err, archivedb.ErrKeyNotFound)
+			require.NoError(rw.Delete([]byte("a")))
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package archivedb
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// AuditRecord is the line written to the audit log for every mutation.
+type AuditRecord struct {
+	Seq     uint64    `json:"seq"`      // position of the entry in the database's write history
+	Time    time.Time `json:"time"`     // when the write was applied
+	Op      string    `json:"op"`       // "put" or "delete"
+	KeyHash string    `json:"key_hash"` // hex hash of the stored key, so keys aren't disclosed
+	Size    int       `json:"size"`     // value size in bytes
+	Tag     uint32    `json:"tag,omitempty"`
+}
+
+// audit writes the record of the entry just written, if an audit log is
+// set. The entry is already stored when this fails, so the error tells the
+// caller the trail is incomplete rather than that the write was lost. The
+// caller must hold db.mu.
+func (db *DB) audit(flag uint8, hashKey uint64, size int, tag uint32) error {
+	if db.opts.auditLog == nil {
+		return nil
+	}
+	op := "put"
+	if flag == EntryDeleteFlag {
+		op = "delete"
+	}
+	buf, err := json.Marshal(AuditRecord{
+		Seq:     db.seq,
+		Time:    db.now(),
+		Op:      op,
+		KeyHash: strconv.FormatUint(hashKey, 16),
+		Size:    size,
+		Tag:     tag,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := db.opts.auditLog.Write(append(buf, '\n')); err != nil {
+		return errors.Wrap(err, "write audit log")
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package archivedb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditLogOption(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	var log bytes.Buffer
+	db, err := Open(dir, AuditLogOption(&log))
+	require.NoError(err)
+	require.NoError(db.Put([]byte("a"), []byte("123")))
+	require.NoError(db.Delete([]byte("a")))
+	require.NoError(db.Close())
+
+	// The sequence continues after reopening.
+	db, err = Open(dir, AuditLogOption(&log))
+	require.NoError(err)
+	defer db.Close()
+	require.NoError(db.Put([]byte("b"), []byte("1")))
+
+	var records []AuditRecord
+	sc := bufio.NewScanner(&log)
+	for sc.Scan() {
+		var r AuditRecord
+		require.NoError(json.Unmarshal(sc.Bytes(), &r))
+		records = append(records, r)
+	}
+	require.Len(records, 3)
+	for i, r := range records {
+		require.Equal(uint64(i+1), r.Seq)
+		require.False(r.Time.IsZero())
+	}
+	require.Equal("put", records[0].Op)
+	require.Equal(3, records[0].Size)
+	require.Equal(strconv.FormatUint(DefaultHashFunc([]byte("a")), 16), records[0].KeyHash)
+	require.Equal("delete", records[1].Op)
+	require.Equal(records[0].KeyHash, records[1].KeyHash)
+}
@@ -0,0 +1,369 @@
+package archivedb
+
+import (
+	"archive/tar"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrBackupCorrupt = errors.New("backup corrupt")
+
+// PAX records of the entries of an incremental backup stream.
+const (
+	// PAXSince holds the watermark the backup starts at, on every entry.
+	PAXSince = "ARCHIVEDB.since"
+	// PAXOffset holds the offset in its segment file the data of a
+	// segment entry starts at.
+	PAXOffset = "ARCHIVEDB.offset"
+)
+
+// Watermark is a position in the log: the offset in a segment the next
+// entry would be written at.
+type Watermark struct {
+	Segment uint32 `json:"segment"`
+	Offset  uint32 `json:"offset"`
+}
+
+// String returns w as "segment:offset", the form ParseWatermark reads.
+func (w Watermark) String() string {
+	return fmt.Sprintf("%d:%d", w.Segment, w.Offset)
+}
+
+// ParseWatermark parses a watermark written by Watermark.String.
+func ParseWatermark(s string) (Watermark, error) {
+	var w Watermark
+	for i := 0; i < len(s); i++ {
+		if s[i] != ':' {
+			continue
+		}
+		id, err := strconv.ParseUint(s[:i], 10, 32)
+		if err != nil {
+			break
+		}
+		off, err := strconv.ParseUint(s[i+1:], 10, 32)
+		if err != nil {
+			break
+		}
+		return Watermark{Segment: uint32(id), Offset: uint32(off)}, nil
+	}
+	return w, errors.Errorf("invalid watermark %q", s)
+}
+
+// item returns the index item of the entry at w.
+func (w Watermark) item() item { return item{w.Segment, w.Offset} }
+
+// VerifyBackups checks that every sealed segment recorded in the manifest is
+// present in dir with matching contents. dir is typically a copy of the
+// database directory; the active segment isn't checked since it may have
+// changed after the copy was made. If dir holds a manifest, it must carry
+// the ID of this database.
+func (db *DB) VerifyBackups(dir string) error {
+	db.mu.RLock()
+	id := db.manifest.ID
+	sealed := append([]SegmentChecksum(nil), db.manifest.Segments...)
+	db.mu.RUnlock()
+
+	m, err := readManifest(filepath.Join(dir, ManifestFileName))
+	if err != nil {
+		return errors.Wrapf(ErrBackupCorrupt, "manifest: %v", err)
+	} else if m != nil && m.ID != id {
+		return errors.Wrapf(ErrBackupCorrupt, "backup of database %q, not %q", m.ID, id)
+	}
+
+	for _, sc := range sealed {
+		if sc.Detached {
+			continue
+		}
+		if err := verifySegmentFile(filepath.Join(dir, sc.Dir, segmentFilename(sc.ID)), sc); err != nil {
+			return errors.Wrapf(ErrBackupCorrupt, "segment %s: %v", segmentFilename(sc.ID), err)
+		}
+	}
+	return nil
+}
+
+// verifySegmentFile compares the checksum of the first sc.Size bytes of the
+// file at path with sc.
+func verifySegmentFile(path string, sc SegmentChecksum) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := crc32.New(CastagnoliCrcTable)
+	if n, err := io.CopyN(h, f, int64(sc.Size)); err != nil {
+		return errors.Errorf("short segment: read %d of %d bytes", n, sc.Size)
+	} else if sum := h.Sum32(); sum != sc.Checksum {
+		return errors.Errorf("checksum %08x, want %08x", sum, sc.Checksum)
+	}
+	return nil
+}
+
+// Backup writes a consistent copy of the database to w as a tar stream,
+// while reads and writes go on: the manifest, every segment and the index
+// as they were when Backup was called. Extracting the stream into an empty
+// directory gives a database Open accepts. Segments hold only their data,
+// without the room preallocated for appends; Open restores it. The Merkle
+// log, if any, is rebuilt by Open.
+//
+// Writes pause only while the snapshot is taken, which reads the index
+// file. Compaction and detaching skip the segments until the copy is done.
+// BackupSince makes incremental backups.
+func (db *DB) Backup(w io.Writer) error {
+	b, err := db.startBackup(Watermark{})
+	if err != nil {
+		return err
+	}
+	defer db.finishBackup(b)
+	return b.writeTar(w)
+}
+
+// BackupSince writes an incremental backup to w: a tar stream of what was
+// written after the watermark since, which a previous call returned, and
+// returns the watermark to pass next time. The zero Watermark gives the
+// same stream as Backup, so a chain of backups starts with
+// BackupSince(w, Watermark{}).
+//
+// Every entry of an incremental stream has a PAXSince record. It holds the
+// current manifest, which replaces the old one; for each segment written to
+// since, the data after the watermark, to be written at the offset in its
+// PAXOffset record; and an index file whose records, for the keys written
+// since, go after the last record of the old index file. Segments compacted
+// since are emptied by Open, and segments PunchHoles changed since have
+// their checksums recorded again by Open. Keys PurgeExpired removed since
+// aren't removed from the old index, so they read as expired rather than
+// not found until they are purged again.
+func (db *DB) BackupSince(w io.Writer, since Watermark) (Watermark, error) {
+	b, err := db.startBackup(since)
+	if err != nil {
+		return since, err
+	}
+	defer db.finishBackup(b)
+	if err := b.writeTar(w); err != nil {
+		return since, err
+	}
+	return b.watermark, nil
+}
+
+// writeTar writes b to w as a tar stream.
+func (b *backup) writeTar(w io.Writer) error {
+	tw := tar.NewWriter(w)
+	add := func(name string, size int64, off int64, write func(io.Writer) error) error {
+		hdr := &tar.Header{
+			Name:    filepath.ToSlash(name),
+			Mode:    0644,
+			Size:    size,
+			ModTime: b.time,
+		}
+		if b.since != (Watermark{}) {
+			hdr.Format = tar.FormatPAX
+			hdr.PAXRecords = map[string]string{PAXSince: b.since.String()}
+			if off > 0 {
+				hdr.PAXRecords[PAXOffset] = strconv.FormatInt(off, 10)
+			}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		return write(tw)
+	}
+	if err := add(ManifestFileName, int64(len(b.manifest)), 0, func(w io.Writer) error {
+		_, err := w.Write(b.manifest)
+		return err
+	}); err != nil {
+		return err
+	}
+	for _, f := range b.segments {
+		if err := add(f.name, f.size-f.off, f.off, f.copyTo); err != nil {
+			return errors.Wrapf(err, "segment %s", f.name)
+		}
+	}
+	size := IndexHeaderSize + int64(len(b.index))*indexItemSize
+	if err := add("index", size, 0, func(w io.Writer) error {
+		_, err := writeIndex(w, b.index)
+		return err
+	}); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// BackupTo writes the copy Backup makes into dir as a database directory,
+// creating it if needed. dir must not hold a database already. The manifest
+// is written last and every file is synced, so a backup with a manifest is
+// complete.
+func (db *DB) BackupTo(dir string) error {
+	if _, err := os.Stat(filepath.Join(dir, ManifestFileName)); err == nil {
+		return errors.Wrapf(os.ErrExist, "%s holds a database", dir)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	b, err := db.startBackup(Watermark{})
+	if err != nil {
+		return err
+	}
+	defer db.finishBackup(b)
+
+	create := func(name string, write func(io.Writer) error) error {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			return err
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := write(f); err != nil {
+			return err
+		} else if err := f.Sync(); err != nil {
+			return err
+		}
+		return f.Close()
+	}
+	for _, f := range b.segments {
+		if err := create(f.name, f.copyTo); err != nil {
+			return errors.Wrapf(err, "segment %s", f.name)
+		}
+	}
+	if err := writeIndexFile(filepath.Join(dir, "index"), b.index); err != nil {
+		return errors.Wrap(err, "index")
+	}
+	return create(ManifestFileName, func(w io.Writer) error {
+		_, err := w.Write(b.manifest)
+		return err
+	})
+}
+
+// backup is the snapshot of the database a backup copies.
+type backup struct {
+	time      time.Time
+	since     Watermark // zero for a full backup
+	watermark Watermark // end of the log at the snapshot
+	manifest  []byte
+	index     map[uint64]item
+	segments  []backupSegment
+}
+
+// backupSegment is the data of a segment at the time of a backup.
+type backupSegment struct {
+	id   uint32
+	name string // relative to the database directory
+	f    *os.File
+	off  int64 // start of the data copied
+	size int64
+}
+
+func (s backupSegment) copyTo(w io.Writer) error {
+	if _, err := s.f.Seek(s.off, io.SeekStart); err != nil {
+		return err
+	}
+	n, err := io.CopyN(w, s.f, s.size-s.off)
+	if err == io.EOF {
+		return errors.Errorf("short segment: read %d of %d bytes", s.off+n, s.size)
+	}
+	return err
+}
+
+// startBackup takes the snapshot a backup copies, of what was written
+// after since, holding its segments until release.
+func (db *DB) startBackup(since Watermark) (b *backup, err error) {
+	db.lockFor(lockWrite)
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil, ErrDatabaseClosed
+	} else if db.opts.at != nil {
+		// The index file doesn't match the index rebuilt at the watermark.
+		return nil, errors.New("can't back up a database opened with OpenAt")
+	}
+	active := db.activeSegment()
+	b = &backup{
+		time:      db.now(),
+		since:     since,
+		watermark: Watermark{Segment: active.ID(), Offset: active.Size()},
+	}
+	if b.watermark.item().before(since.item()) {
+		return nil, errors.Errorf("watermark %s is past the end of the log at %s", since, b.watermark)
+	}
+	defer func() {
+		if err != nil {
+			b.release(db)
+		}
+	}()
+	if b.manifest, err = db.backupManifest(since); err != nil {
+		return nil, err
+	} else if b.index, err = db.index.Persisted(); err != nil {
+		return nil, err
+	}
+	for k, it := range b.index {
+		if it.before(since.item()) {
+			delete(b.index, k)
+		}
+	}
+	for _, s := range db.segments[since.Segment:] {
+		bs := backupSegment{id: s.ID(), name: segmentFilename(s.ID()), size: int64(s.Size())}
+		if sc, ok := db.manifest.sealed(s.ID()); ok {
+			bs.name = filepath.Join(sc.Dir, bs.name)
+			bs.size = int64(sc.Size)
+		}
+		if s.ID() == since.Segment {
+			bs.off = int64(since.Offset)
+		}
+		if s.missing {
+			continue
+		} else if bs.off >= bs.size && bs.off > 0 {
+			// Nothing was written since, or the segment was compacted.
+			continue
+		} else if bs.f, err = os.Open(s.path); os.IsNotExist(err) && s.detached {
+			// The detached partition was archived elsewhere.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		db.holdSegment(s.ID())
+		b.segments = append(b.segments, bs)
+	}
+	return b, nil
+}
+
+// finishBackup releases the segments of b.
+func (db *DB) finishBackup(b *backup) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	b.release(db)
+}
+
+// release closes the segment files of b and lets them be compacted again.
+// The caller must hold db.mu for writing.
+func (b *backup) release(db *DB) {
+	for _, s := range b.segments {
+		db.releaseSegment(s.id)
+		s.f.Close()
+	}
+	b.segments = nil
+}
+
+// backupManifest encodes the manifest for a backup of what was written
+// after since. The segments up to since that PunchHoles changed are
+// marked as being punched, so Open records their checksums again: the
+// backup doesn't hold their new contents. The caller must hold db.mu.
+func (db *DB) backupManifest(since Watermark) ([]byte, error) {
+	if since == (Watermark{}) {
+		return db.manifest.encode()
+	}
+	m := *db.manifest
+	m.Segments = append([]SegmentChecksum(nil), m.Segments...)
+	for i := range m.Segments {
+		if sc := &m.Segments[i]; sc.ID <= since.Segment && sc.Punched > 0 {
+			sc.Punching = true
+		}
+	}
+	return m.encode()
+}
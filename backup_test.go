@@ -0,0 +1,229 @@
+package archivedb
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_VerifyBackups(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	backup, cleanupBackup := MustTempDir()
+	defer cleanupBackup()
+
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	require.NoError(db.Put([]byte("foo"), []byte("bar")))
+	mustRollover(t, db)
+	require.NoError(db.Put([]byte("foo"), []byte("baz")))
+
+	sealed := db.manifest.Segments
+	require.Len(sealed, 1)
+	require.Equal(uint32(SegmentHeaderSize+EntryHeaderSize+6), sealed[0].Size)
+
+	// Segment files are sparse; copy only the data region.
+	name := segmentFilename(0)
+	f, err := os.Open(filepath.Join(dir, name))
+	require.NoError(err)
+	buf := make([]byte, sealed[0].Size)
+	_, err = f.ReadAt(buf, 0)
+	require.NoError(err)
+	require.NoError(f.Close())
+
+	require.ErrorIs(db.VerifyBackups(backup), ErrBackupCorrupt)
+	require.NoError(ioutil.WriteFile(filepath.Join(backup, name), buf, 0644))
+	require.NoError(db.VerifyBackups(backup))
+
+	buf[len(buf)-1] ^= 0xff
+	require.NoError(ioutil.WriteFile(filepath.Join(backup, name), buf, 0644))
+	require.ErrorIs(db.VerifyBackups(backup), ErrBackupCorrupt)
+
+	require.NoError(ioutil.WriteFile(filepath.Join(backup, name), buf[:10], 0644))
+	require.ErrorIs(db.VerifyBackups(backup), ErrBackupCorrupt)
+
+	// A manifest from another database is rejected even if segments match.
+	buf[len(buf)-1] ^= 0xff
+	require.NoError(ioutil.WriteFile(filepath.Join(backup, name), buf, 0644))
+	manifest := *db.manifest
+	require.NoError(manifest.Write(filepath.Join(backup, ManifestFileName)))
+	require.NoError(db.VerifyBackups(backup))
+	manifest.ID = newDatabaseID()
+	require.NoError(manifest.Write(filepath.Join(backup, ManifestFileName)))
+	require.ErrorIs(db.VerifyBackups(backup), ErrBackupCorrupt)
+}
+
+func TestDB_BackupTo(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	backup, cleanupBackup := MustTempDir()
+	defer cleanupBackup()
+
+	db, err := Open(dir, PartitionOption(true))
+	require.NoError(err)
+	defer db.Close()
+	require.NoError(db.Put([]byte("foo"), []byte("bar")))
+	mustRollover(t, db)
+	require.NoError(db.Put([]byte("baz"), []byte("qux")))
+	require.NoError(db.BackupTo(backup))
+	require.ErrorIs(db.BackupTo(backup), os.ErrExist)
+	require.NoError(db.VerifyBackups(backup))
+
+	// Writes after the backup aren't in it.
+	require.NoError(db.Put([]byte("foo"), []byte("new")))
+	require.NoError(db.Put([]byte("later"), []byte("v")))
+
+	restored, err := Open(backup)
+	require.NoError(err)
+	defer restored.Close()
+	require.Equal(db.ID(), restored.ID())
+	for k, v := range map[string]string{"foo": "bar", "baz": "qux"} {
+		got, err := restored.Get([]byte(k))
+		require.NoError(err)
+		require.Equal(v, string(got))
+	}
+	_, err = restored.Get([]byte("later"))
+	require.ErrorIs(err, ErrKeyNotFound)
+	// The restored active segment takes appends.
+	require.NoError(restored.Put([]byte("later"), []byte("v")))
+	require.NoError(restored.Close())
+	restored, err = Open(backup)
+	require.NoError(err)
+	defer restored.Close()
+	v, err := restored.Get([]byte("later"))
+	require.NoError(err)
+	require.Equal("v", string(v))
+}
+
+func TestDB_Backup(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	restoreDir, cleanupRestore := MustTempDir()
+	defer cleanupRestore()
+
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("before")))
+	}
+	mustRollover(t, db)
+
+	// Writes go on while the backup is copied.
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 100; i++ {
+			if err := db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("during")); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	var buf bytes.Buffer
+	require.NoError(db.Backup(&buf))
+	require.NoError(<-done)
+
+	// Extract the stream.
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(err)
+		names = append(names, hdr.Name)
+		b, err := ioutil.ReadAll(tr)
+		require.NoError(err)
+		require.NoError(ioutil.WriteFile(filepath.Join(restoreDir, hdr.Name), b, 0644))
+	}
+	require.Equal([]string{ManifestFileName, segmentFilename(0), segmentFilename(1), "index"}, names)
+
+	restored, err := Open(restoreDir)
+	require.NoError(err)
+	defer restored.Close()
+	for i := 0; i < 100; i++ {
+		v, err := restored.Get([]byte(fmt.Sprintf("key%d", i)))
+		require.NoError(err)
+		require.Contains([]string{"before", "during"}, string(v))
+	}
+	report, err := restored.Verify(nil)
+	require.NoError(err)
+	require.Empty(report.Corrupt)
+}
+
+func TestDB_BackupSince(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	restoreDir, cleanupRestore := MustTempDir()
+	defer cleanupRestore()
+
+	db, err := Open(dir, CompactionRatioOption(0.1))
+	require.NoError(err)
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("v1")))
+	}
+	var buf bytes.Buffer
+	w, err := db.BackupSince(&buf, Watermark{})
+	require.NoError(err)
+	require.Equal(Watermark{0, db.activeSegment().Size()}, w)
+	require.NoError(Restore(restoreDir, &buf))
+
+	// Nothing was written since.
+	buf.Reset()
+	next, err := db.BackupSince(&buf, w)
+	require.NoError(err)
+	require.Equal(w, next)
+
+	// The first segment gets more entries, is sealed and compacted.
+	require.NoError(db.Put([]byte("key0"), []byte("v2")))
+	require.NoError(db.Delete([]byte("key1")))
+	mustRollover(t, db)
+	for i := 2; i < 10; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("v2")))
+	}
+	require.NoError(db.Compact())
+	require.NoError(db.Put([]byte("new"), []byte("v")))
+	buf.Reset()
+	w, err = db.BackupSince(&buf, w)
+	require.NoError(err)
+	require.NoError(Restore(restoreDir, &buf))
+
+	_, err = db.BackupSince(&buf, Watermark{w.Segment + 1, SegmentHeaderSize})
+	require.Error(err)
+	p, err := ParseWatermark(w.String())
+	require.NoError(err)
+	require.Equal(w, p)
+	_, err = ParseWatermark("1")
+	require.Error(err)
+
+	restored, err := Open(restoreDir)
+	require.NoError(err)
+	defer restored.Close()
+	require.Equal(db.Seq(), restored.Seq())
+	for k, want := range map[string]string{"key0": "v2", "key2": "v2", "key9": "v2", "new": "v"} {
+		v, err := restored.Get([]byte(k))
+		require.NoError(err, k)
+		require.Equal(want, string(v), k)
+	}
+	_, err = restored.Get([]byte("key1"))
+	require.Error(err)
+	report, err := restored.Verify(nil)
+	require.NoError(err)
+	require.Empty(report.Corrupt)
+	require.NoError(db.VerifyBackups(restoreDir))
+}
@@ -0,0 +1,178 @@
+package archivedb
+
+import "time"
+
+// WriteBatch buffers puts and deletes to commit them together, under one
+// acquisition of the database lock and with one sync when fsync is on,
+// which makes bulk loads much faster than calling Put in a loop. A
+// WriteBatch is not safe for concurrent use.
+//
+// A batch is not atomic: if Commit fails or the process crashes while it
+// runs, a prefix of the batch may have been written.
+type WriteBatch struct {
+	db  *DB
+	ops []batchOp
+}
+
+// batchOp is a buffered write.
+type batchOp struct {
+	flag  uint8
+	key   []byte
+	value []byte
+	tag   uint32
+}
+
+// NewWriteBatch returns an empty batch of writes to db.
+func (db *DB) NewWriteBatch() *WriteBatch {
+	return &WriteBatch{db: db}
+}
+
+// Put adds a put of the value of key to the batch. Key and value are
+// copied.
+func (b *WriteBatch) Put(key, value []byte) {
+	b.PutTagged(key, value, 0)
+}
+
+// PutTagged adds a put of the value of key to the batch, tagged as by
+// DB.PutTagged.
+func (b *WriteBatch) PutTagged(key, value []byte, tag uint32) {
+	b.ops = append(b.ops, batchOp{
+		flag:  EntryInsertFlag,
+		key:   append([]byte(nil), key...),
+		value: append([]byte(nil), value...),
+		tag:   tag,
+	})
+}
+
+// Delete adds a delete of key to the batch.
+func (b *WriteBatch) Delete(key []byte) {
+	b.ops = append(b.ops, batchOp{flag: EntryDeleteFlag, key: append([]byte(nil), key...)})
+}
+
+// Len returns the number of writes in the batch.
+func (b *WriteBatch) Len() int { return len(b.ops) }
+
+// Reset empties the batch so it can be reused.
+func (b *WriteBatch) Reset() {
+	for i := range b.ops {
+		b.ops[i] = batchOp{}
+	}
+	b.ops = b.ops[:0]
+}
+
+// Commit writes the batch in order, so the last write to a key wins, and
+// empties it. Every key and value is checked before anything is written;
+// if one is invalid, nothing is written and the batch is kept.
+func (b *WriteBatch) Commit() error {
+	if len(b.ops) == 0 {
+		return nil
+	}
+	db := b.db
+	writes, err := db.appendBatch(b.ops)
+	// Entries are stored and recorded in the index file, so make them
+	// visible even if a later step failed.
+	for i, w := range writes {
+		if w.skipped {
+			continue
+		}
+		db.index.Publish(w.hashKey, w.segment.ID(), w.offset)
+		if tag := b.ops[i].tag; tag != 0 {
+			db.addTag(tag, w.hashKey)
+		}
+	}
+	if len(writes) > 0 {
+		b.ops = b.ops[len(writes):]
+		defer db.waitWatches()
+	}
+	if err != nil {
+		return err
+	}
+	b.Reset()
+	// Once a write calls for a sync, every later write does too.
+	if !writes[len(writes)-1].sync {
+		return nil
+	}
+	db.rlockFor(lockSync)
+	defer db.mu.RUnlock()
+	if db.closed {
+		return ErrDatabaseClosed
+	}
+	defer db.checkStall("batch sync", time.Now())
+	// A batch spanning a rollover leaves entries in sealed segments too.
+	for i, w := range writes {
+		if i == len(writes)-1 || w.segment != writes[i+1].segment {
+			if err := db.flushSegment(w.segment); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// appendBatch writes the entries of ops under one acquisition of the write
+// lock. It returns the writes made, which are a prefix of ops if err is
+// not nil. With SkipUnchangedOption, a put of the value its key already
+// held before the batch is skipped as by Put, and its write points at the
+// stored entry instead.
+func (db *DB) appendBatch(ops []batchOp) (writes []*pendingWrite, err error) {
+	start := time.Now()
+	db.lockFor(lockWrite)
+	defer db.mu.Unlock()
+	defer db.checkStall("batch write", start)
+	if err := db.checkWritable(); err != nil {
+		return nil, err
+	}
+	keys := make([][]byte, len(ops))
+	for i, op := range ops {
+		if keys[i], err = db.checkEntry(op.key, op.value, op.flag, 0); err != nil {
+			return nil, err
+		}
+	}
+	writes = make([]*pendingWrite, 0, len(ops))
+	// Keys written earlier in the batch aren't published yet, so the
+	// index can't tell whether a later put of them changes anything.
+	var written map[uint64]bool
+	if db.opts.skipUnchanged {
+		written = make(map[uint64]bool, len(ops))
+	}
+	for i, op := range ops {
+		if w := db.skipBatchOp(keys[i], op, written, writes); w != nil {
+			writes = append(writes, w)
+			continue
+		}
+		w, err := db.writeEntry(keys[i], op.value, op.flag, op.tag, 0)
+		if w != nil {
+			writes = append(writes, w)
+			if written != nil {
+				written[w.hashKey] = true
+			}
+		}
+		if err != nil {
+			return writes, err
+		}
+	}
+	return writes, nil
+}
+
+// skipBatchOp returns the skipped write of op, whose key is encoded as
+// key, if SkipUnchangedOption is on and the key isn't in written and
+// already holds the value, or nil. The caller must hold db.mu for
+// writing.
+func (db *DB) skipBatchOp(key []byte, op batchOp, written map[uint64]bool, writes []*pendingWrite) *pendingWrite {
+	if op.flag != EntryInsertFlag || written == nil {
+		return nil
+	}
+	hashKey := db.opts.hashFunc(key)
+	if written[hashKey] || !db.unchanged(key, op.value, op.tag, 0) {
+		return nil
+	}
+	it, _ := db.index.Get(hashKey)
+	return &pendingWrite{
+		hashKey: hashKey,
+		segment: db.segment(it.ID()),
+		offset:  it.Offset(),
+		// The stored entry may not be synced yet.
+		sync:    db.opts.fsync || len(writes) > 0 && writes[len(writes)-1].sync,
+		skipped: true,
+	}
+}
@@ -0,0 +1,110 @@
+package archivedb
+
+import (
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteBatch(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	require.NoError(db.Put([]byte("old"), []byte("1")))
+
+	b := db.NewWriteBatch()
+	require.NoError(b.Commit())
+	key := []byte("foo")
+	b.Put(key, []byte("1"))
+	key[0] = 'g' // the batch keeps its own copy
+	b.Put([]byte("foo"), []byte("2"))
+	b.PutTagged([]byte("bar"), []byte("3"), 5)
+	b.Delete([]byte("old"))
+	require.Equal(4, b.Len())
+	require.NoError(b.Commit())
+	require.Zero(b.Len())
+
+	v, err := db.Get([]byte("foo"))
+	require.NoError(err)
+	require.Equal([]byte("2"), v)
+	_, err = db.Get([]byte("goo"))
+	require.ErrorIs(err, ErrKeyNotFound)
+	_, err = db.Get([]byte("old"))
+	require.ErrorIs(err, ErrKeyDeleted)
+	require.NoError(db.LookupTag(5, func(key, value []byte) error {
+		require.Equal([]byte("bar"), key)
+		return nil
+	}))
+	require.Equal(uint64(5), db.Seq())
+
+	// An invalid write fails the batch before anything is written.
+	b.Put([]byte("baz"), []byte("4"))
+	b.Put(nil, []byte("5"))
+	require.ErrorIs(b.Commit(), ErrEmptyKey)
+	require.Equal(2, b.Len())
+	require.Equal(uint64(5), db.Seq())
+	b.Reset()
+	require.Zero(b.Len())
+
+	require.NoError(db.Close())
+	b.Put([]byte("baz"), []byte("4"))
+	require.ErrorIs(b.Commit(), ErrDatabaseClosed)
+}
+
+func TestWriteBatch_Sync(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	var fault *faultFile
+	injectFaults(t, func(_ string, f *faultFile) { fault = f })
+	db, err := Open(dir, FsyncOption(true))
+	require.NoError(err)
+	defer db.Close()
+
+	fault.syncErr = syscall.EIO
+	b := db.NewWriteBatch()
+	b.Put([]byte("foo"), []byte("bar"))
+	require.ErrorIs(b.Commit(), syscall.EIO)
+	// The entry was written before the sync failed.
+	require.Zero(b.Len())
+	v, err := db.Get([]byte("foo"))
+	require.NoError(err)
+	require.Equal([]byte("bar"), v)
+}
+
+func BenchmarkDB_WriteBatch(b *testing.B) {
+	for _, size := range []int{1, 100, 1000} {
+		for name, fsync := range map[string]bool{"NoSync": false, "Sync": true} {
+			b.Run(strconv.Itoa(size)+name, func(b *testing.B) {
+				dir, cleanup := MustTempDir()
+				defer cleanup()
+				db, err := Open(dir, FsyncOption(fsync))
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer db.Close()
+
+				value := []byte(strings.Repeat(" ", 128))
+				batch := db.NewWriteBatch()
+				b.SetBytes(int64(size * len(value)))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					for j := 0; j < size; j++ {
+						batch.Put([]byte(strconv.Itoa(j)), value)
+					}
+					if err := batch.Commit(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
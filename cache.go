@@ -0,0 +1,109 @@
+package archivedb
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+)
+
+// valueCache is an LRU cache of values read by Get, shared by the
+// databases of an Env and bounded by the bytes of the values it holds.
+// Values are cached by where their entry is stored and checked against
+// the checksum in the entry header there, so compaction, hole punching and
+// detaching, which replace what is stored, need not invalidate them.
+type valueCache struct {
+	mu    sync.Mutex
+	max   int64
+	size  int64
+	lru   *list.List // of *cachedValue, most recently used first
+	items map[cacheKey]*list.Element
+}
+
+// cacheKey identifies an entry of a database registered with an Env.
+type cacheKey struct {
+	db      uint64
+	segment uint32
+	offset  uint32
+}
+
+type cachedValue struct {
+	key      cacheKey
+	entry    []byte // encoded key of the entry
+	checksum uint32 // of the value, from the entry header
+	value    []byte
+	expires  int64
+}
+
+func newValueCache(max int64) *valueCache {
+	return &valueCache{max: max, lru: list.New(), items: make(map[cacheKey]*list.Element)}
+}
+
+// get returns the value cached for the entry of the encoded key at k whose
+// header has checksum.
+func (c *valueCache) get(k cacheKey, key []byte, checksum uint32) (value []byte, expires int64, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[k]
+	if !ok {
+		return nil, 0, false
+	}
+	v := el.Value.(*cachedValue)
+	if v.checksum != checksum || !bytes.Equal(v.entry, key) {
+		return nil, 0, false
+	}
+	c.lru.MoveToFront(el)
+	return v.value, v.expires, true
+}
+
+// add caches a copy of the value of the entry of the encoded key at k,
+// evicting the least recently used values to make room. Values larger
+// than the cache are not cached.
+func (c *valueCache) add(k cacheKey, key []byte, checksum uint32, value []byte, expires int64) {
+	size := int64(len(key) + len(value))
+	if size > c.max {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.items[k]; ok {
+		return
+	}
+	v := &cachedValue{
+		key:      k,
+		entry:    append([]byte(nil), key...),
+		checksum: checksum,
+		value:    append([]byte(nil), value...),
+		expires:  expires,
+	}
+	c.items[k] = c.lru.PushFront(v)
+	for c.size += size; c.size > c.max; {
+		c.remove(c.lru.Back())
+	}
+}
+
+// removeDB drops the values of database db.
+func (c *valueCache) removeDB(db uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		if el.Value.(*cachedValue).key.db == db {
+			c.remove(el)
+		}
+		el = next
+	}
+}
+
+// remove drops the value at el. The caller must hold c.mu.
+func (c *valueCache) remove(el *list.Element) {
+	v := c.lru.Remove(el).(*cachedValue)
+	delete(c.items, v.key)
+	c.size -= int64(len(v.entry) + len(v.value))
+}
+
+// bytes returns the bytes of the values cached.
+func (c *valueCache) bytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
@@ -0,0 +1,38 @@
+package archivedb
+
+// indexCheckpointMin is the fewest records the index file must hold before
+// Close checkpoints it.
+const indexCheckpointMin = 1 << 14
+
+// CheckpointIndex rewrites the index file to hold a single record for
+// every key, dropping the records of overwritten and removed keys, so the
+// next Open loads the index without replaying them. The new file is
+// written aside and renamed over the old one, so a crash leaves one or the
+// other. Close checkpoints the index by itself once most of its records
+// are stale. Followers pick up the new file on their next Refresh.
+func (db *DB) CheckpointIndex() error {
+	db.lockFor(lockWrite)
+	defer db.mu.Unlock()
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	return db.checkpointIndex()
+}
+
+// checkpointIndex is CheckpointIndex for a caller holding db.mu.
+func (db *DB) checkpointIndex() error {
+	// Writes whose index records are appended but not yet published are
+	// only seen in the index file.
+	items, err := db.index.Persisted()
+	if err != nil {
+		return err
+	}
+	return db.degrade(db.index.Rewrite(items))
+}
+
+// indexStale returns true if most records in the index file are for
+// overwritten or removed keys. The caller must hold db.mu.
+func (db *DB) indexStale() bool {
+	records := db.index.Length()
+	return records >= indexCheckpointMin && records > 2*db.index.Items()
+}
@@ -0,0 +1,105 @@
+package archivedb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_CheckpointIndex(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 3; j++ {
+			require.NoError(db.Put([]byte(fmt.Sprintf("key%d", j)), []byte(fmt.Sprint(i))))
+		}
+	}
+	require.NoError(db.Delete([]byte("key2")))
+	require.Equal(int64(31), db.index.Length())
+	require.NoError(db.CheckpointIndex())
+	require.Equal(int64(3), db.index.Length())
+	require.NoError(db.Put([]byte("key3"), []byte("new")))
+
+	check := func(db *DB) {
+		for key, want := range map[string]string{"key0": "9", "key1": "9", "key3": "new"} {
+			v, err := db.Get([]byte(key))
+			require.NoError(err, key)
+			require.Equal(want, string(v), key)
+		}
+		_, err := db.Get([]byte("key2"))
+		require.ErrorIs(err, ErrKeyDeleted)
+	}
+	check(db)
+	require.NoError(db.Close())
+	db, err = Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	check(db)
+	require.Equal(int64(4), db.RecoveryReport().IndexItems)
+}
+
+func TestDB_Close_CheckpointsIndex(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	for i := 0; i < indexCheckpointMin; i++ {
+		require.NoError(db.Put([]byte("foo"), []byte(fmt.Sprint(i))))
+	}
+	require.NoError(db.Close())
+
+	db, err = Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	require.Equal(int64(1), db.RecoveryReport().IndexItems)
+	v, err := db.Get([]byte("foo"))
+	require.NoError(err)
+	require.Equal([]byte(fmt.Sprint(indexCheckpointMin-1)), v)
+}
+
+// TestOpen_SealedSegmentCounts checks Open takes the entries of sealed
+// segments from the manifest, and scans those sealed before they were
+// recorded.
+func TestOpen_SealedSegmentCounts(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	require.NoError(db.Put([]byte("foo"), []byte("bar")))
+	require.NoError(db.Delete([]byte("foo")))
+	mustRollover(t, db)
+	require.NoError(db.Put([]byte("baz"), []byte("qux")))
+	require.Equal(SegmentChecksum{Entries: 2, Tombstones: 1}, SegmentChecksum{
+		Entries:    db.manifest.Segments[0].Entries,
+		Tombstones: db.manifest.Segments[0].Tombstones,
+	})
+
+	// Pretend the counts are off, which only Open trusting them shows.
+	db.manifest.Segments[0].Entries = 5
+	require.NoError(db.saveManifest())
+	require.NoError(db.Close())
+	db, err = Open(dir)
+	require.NoError(err)
+	require.Equal(int64(6), db.RecoveryReport().Entries)
+	require.Equal(uint64(6), db.Seq())
+
+	db.manifest.Segments[0].Entries, db.manifest.Segments[0].Tombstones = 0, 0
+	require.NoError(db.saveManifest())
+	require.NoError(db.Close())
+	db, err = Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	require.Equal(int64(3), db.RecoveryReport().Entries)
+	require.Equal(int64(1), db.RecoveryReport().Tombstones)
+	v, err := db.Get([]byte("baz"))
+	require.NoError(err)
+	require.Equal([]byte("qux"), v)
+}
@@ -0,0 +1,119 @@
+package archivedb
+
+import (
+	"hash/crc32"
+	"sync/atomic"
+
+	"github.com/millken/archivedb/format"
+	"github.com/pkg/errors"
+)
+
+// ErrInvalidChunk is returned when a chunk of a value doesn't match the
+// chunk list of the value.
+var ErrInvalidChunk = errors.New("invalid value chunk")
+
+// chunkSize is the largest value written as a single entry; larger values
+// are split into chunks of this size. It leaves room in a segment for the
+// attribute fields and the growth from encryption. Tests lower it.
+var chunkSize = int(MaxValueSize) - 64
+
+// writeChunks appends value to the log in chunks of key and returns the
+// encoded chunk list to store as the value of key. The caller must hold
+// db.mu for writing.
+func (db *DB) writeChunks(key, value []byte) ([]byte, error) {
+	list := format.ChunkList{
+		Size:     uint64(len(value)),
+		Checksum: crc32.Checksum(value, CastagnoliCrcTable),
+	}
+	for len(value) > 0 {
+		n := chunkSize
+		if n > len(value) {
+			n = len(value)
+		}
+		ref, err := db.writeChunk(key, value[:n])
+		if err != nil {
+			return nil, err
+		}
+		list.Chunks = append(list.Chunks, ref)
+		value = value[n:]
+	}
+	return list.Encode(), nil
+}
+
+// writeChunk appends a chunk of key holding data to the log and returns
+// its reference. The caller must hold db.mu for writing.
+func (db *DB) writeChunk(key, data []byte) (format.ChunkRef, error) {
+	stored, f, attrs, err := db.encodeValue(EntryChunkFlag, key, data, nil, nil)
+	if err != nil {
+		return format.ChunkRef{}, err
+	}
+	e := createEntryWithFields(EntryChunkFlag, key, stored, attrs, f)
+	segment, err := db.appendToLog(e)
+	if err != nil {
+		return format.ChunkRef{}, err
+	}
+	off := segment.Size() - e.Size()
+	atomic.AddInt64(&db.stats.physicalBytes, int64(e.Size()))
+	// The entry of the value syncs the chunks if they reach the limit.
+	db.addUnsynced(int64(e.Size()))
+	db.seq++
+	ref := format.ChunkRef{Segment: segment.ID(), Offset: off, Checksum: e.hdr.Checksum}
+	return ref, db.appendMerkleLog(segment.ID(), off, e)
+}
+
+// chunkList decodes the chunk list held by e, whose data is decrypted and
+// decompressed.
+func chunkList(e *entry) (format.ChunkList, error) {
+	l, err := format.ParseChunkList(e.data)
+	if err != nil {
+		return l, errors.Wrapf(ErrInvalidChunk, "chunk list: %v", err)
+	} else if l.Size > uint64(len(l.Chunks))*uint64(MaxValueSize) {
+		// Don't size a buffer by a corrupt list.
+		return l, errors.Wrapf(ErrInvalidChunk, "chunk list: size %d for %d chunks", l.Size, len(l.Chunks))
+	}
+	return l, nil
+}
+
+// readChunks replaces the data of e, a chunk list, with the value it
+// lists, checking every chunk and the whole value against their checksums.
+// The caller must hold db.mu.
+func (db *DB) readChunks(e *entry) error {
+	l, err := chunkList(e)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, 0, l.Size)
+	for i, ref := range l.Chunks {
+		c, err := db.readChunk(ref, e.key)
+		if err != nil {
+			return errors.Wrapf(err, "chunk %d of %d", i+1, len(l.Chunks))
+		}
+		data = append(data, c.data...)
+	}
+	if uint64(len(data)) != l.Size || crc32.Checksum(data, CastagnoliCrcTable) != l.Checksum {
+		atomic.AddInt64(&db.stats.checksums, 1)
+		return errors.Wrap(ErrChecksumFailed, "chunked value")
+	}
+	e.data = data
+	return nil
+}
+
+// readChunk reads and decodes the chunk of key at ref. The caller must
+// hold db.mu.
+func (db *DB) readChunk(ref format.ChunkRef, key []byte) (entry, error) {
+	s := db.segment(ref.Segment)
+	if s == nil {
+		return entry{}, ErrSegmentNotFound
+	} else if s.detached {
+		return entry{}, ErrSegmentDetached
+	}
+	c, err := s.ReadEntry(ref.Offset)
+	if err != nil {
+		return entry{}, err
+	} else if c.hdr.Flag != EntryChunkFlag || c.hdr.Checksum != ref.Checksum {
+		return entry{}, ErrInvalidChunk
+	} else if err := c.verify(key); err != nil {
+		return entry{}, err
+	}
+	return c, db.decodeValue(&c)
+}
@@ -0,0 +1,120 @@
+package archivedb
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// withChunkSize lowers the chunk size for the duration of a test.
+func withChunkSize(t *testing.T, n int) {
+	old := chunkSize
+	chunkSize = n
+	t.Cleanup(func() { chunkSize = old })
+}
+
+func TestDB_ChunkedValue(t *testing.T) {
+	require := require.New(t)
+	withChunkSize(t, 64)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	secret := bytes.Repeat([]byte{7}, 16)
+	db, err := Open(dir, EncryptionOption(secret), CompressionOption(DeflateCodec, 32))
+	require.NoError(err)
+	defer db.Close()
+
+	big := bytes.Repeat([]byte("plaintext chunk "), 40)
+	require.NoError(db.Put([]byte("small"), []byte("value")))
+	require.NoError(db.Put([]byte("big"), big))
+	// The 640 byte value takes 10 chunks and its chunk list.
+	require.Equal(uint64(12), db.Seq())
+
+	check := func(db *DB) {
+		v, err := db.Get([]byte("big"))
+		require.NoError(err)
+		require.Equal(big, v)
+		var keys []string
+		require.NoError(db.ForEachRaw(EntryFilter{}, func(e RawEntry) error {
+			keys = append(keys, string(e.Key))
+			if string(e.Key) == "big" {
+				require.Equal(big, e.Value)
+			}
+			return nil
+		}))
+		require.Equal([]string{"small", "big"}, keys)
+	}
+	check(db)
+	requireNotOnDisk(t, dir, "plaintext")
+
+	require.NoError(db.Close())
+	db, err = Open(dir, EncryptionOption(secret))
+	require.NoError(err)
+	defer db.Close()
+	check(db)
+	report, err := db.Verify(nil)
+	require.NoError(err)
+	require.Empty(report.Corrupt)
+	require.Equal(int64(12), report.Entries)
+}
+
+func TestDB_ChunkedValueCorrupt(t *testing.T) {
+	require := require.New(t)
+	withChunkSize(t, 16)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+
+	require.NoError(db.Put([]byte("big"), bytes.Repeat([]byte("x"), 40)))
+	require.NoError(db.Close())
+
+	// Flip a byte of the value of the second chunk.
+	f, err := os.OpenFile(filepath.Join(dir, segmentFilename(0)), os.O_RDWR, 0)
+	require.NoError(err)
+	chunk := int64(EntryHeaderSize + 3 + 16)
+	_, err = f.WriteAt([]byte{'y'}, SegmentHeaderSize+chunk+EntryHeaderSize+3)
+	require.NoError(err)
+	require.NoError(f.Close())
+
+	db, err = Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	_, err = db.Get([]byte("big"))
+	require.ErrorIs(err, ErrChecksumFailed)
+}
+
+func TestDB_CompactChunkedValue(t *testing.T) {
+	require := require.New(t)
+	withChunkSize(t, 16)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir, CompactionRatioOption(0.01))
+	require.NoError(err)
+	defer db.Close()
+
+	big := bytes.Repeat([]byte("x"), 100)
+	require.NoError(db.Put([]byte("a"), []byte("1")))
+	require.NoError(db.Put([]byte("big"), big))
+	mustRollover(t, db)
+	require.NoError(db.Put([]byte("a"), []byte("2")))
+
+	// The chunks of a live value can't be moved.
+	plan, err := db.PlanCompaction()
+	require.NoError(err)
+	require.Empty(plan.Segments)
+
+	// Once the value is overwritten, its chunks are dead.
+	require.NoError(db.Put([]byte("big"), big[:50]))
+	plan, err = db.PlanCompaction()
+	require.NoError(err)
+	require.Len(plan.Segments, 1)
+	require.Equal(int64(0), plan.Segments[0].LiveBytes)
+	require.NoError(db.Compact())
+	v, err := db.Get([]byte("big"))
+	require.NoError(err)
+	require.Equal(big[:50], v)
+}
@@ -0,0 +1,24 @@
+package archivedb
+
+import "time"
+
+// Clock supplies the time for timestamps the database records, such as in
+// audit records and freeze markers. Tests can inject a fixed clock, and
+// distributed deployments a hybrid logical clock so timestamps from
+// different nodes are ordered consistently. Now must be safe for
+// concurrent use.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the default Clock, reading the local wall clock.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// now returns the current time of the database clock in UTC.
+func (db *DB) now() time.Time {
+	return db.opts.clock.Now().UTC()
+}
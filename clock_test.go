@@ -0,0 +1,57 @@
+package archivedb
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a Clock that only moves when told to.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestClockOption(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	_, err := Open(dir, ClockOption(nil))
+	require.Error(err)
+
+	clock := newFakeClock()
+	var log bytes.Buffer
+	db, err := Open(dir, ClockOption(clock), AuditLogOption(&log))
+	require.NoError(err)
+	defer db.Close()
+	require.NoError(db.Put([]byte("a"), []byte("1")))
+	var r AuditRecord
+	require.NoError(json.Unmarshal(log.Bytes(), &r))
+	require.Equal(clock.Now(), r.Time)
+
+	clock.Add(time.Hour)
+	rec, err := db.Freeze()
+	require.NoError(err)
+	require.Equal(clock.Now(), rec.Time)
+}
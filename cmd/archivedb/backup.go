@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/millken/archivedb"
+)
+
+// runBackup copies a database to a tar stream or a directory. The database
+// is opened as a follower, so it can be backed up while another process
+// writes to it; the copy holds what was written when it was opened. With
+// -since it writes an incremental backup and prints the watermark of the
+// next one to stderr.
+func runBackup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	out := fs.String("o", "", "write the tar stream to `file` instead of stdout")
+	dir := fs.String("dir", "", "copy the database into `directory` instead of writing a tar stream")
+	since := fs.String("since", "", "write what was written after `watermark`, as printed by the previous backup, or 0:0 for all")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("expected a database directory")
+	} else if *out != "" && *dir != "" {
+		return errors.New("-o and -dir are exclusive")
+	} else if *since != "" && *dir != "" {
+		return errors.New("-since and -dir are exclusive")
+	}
+	backup := func(db *archivedb.DB, w io.Writer) error { return db.Backup(w) }
+	if *since != "" {
+		from, err := archivedb.ParseWatermark(*since)
+		if err != nil {
+			return err
+		}
+		backup = func(db *archivedb.DB, w io.Writer) error {
+			next, err := db.BackupSince(w, from)
+			if err == nil {
+				fmt.Fprintf(os.Stderr, "watermark %s\n", next)
+			}
+			return err
+		}
+	}
+
+	db, err := archivedb.Open(fs.Arg(0), archivedb.FollowerOption(0))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if *dir != "" {
+		return db.BackupTo(*dir)
+	}
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := backup(db, f); err != nil {
+			return err
+		}
+		return f.Close()
+	}
+	return backup(db, os.Stdout)
+}
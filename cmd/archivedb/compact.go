@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/millken/archivedb"
+)
+
+// compactResult is the JSON form of the result of compact.
+type compactResult struct {
+	Segments        int           `json:"segments"`
+	Holes           int           `json:"holes,omitempty"`
+	ReclaimedBytes  int64         `json:"reclaimed_bytes"`
+	RewrittenBytes  int64         `json:"rewritten_bytes"`
+	CorruptEntries  int           `json:"corrupt_entries"`
+	Corrupt         []corruptInfo `json:"corrupt"`
+	DurationSeconds float64       `json:"duration_seconds"`
+	Error           string        `json:"error,omitempty"`
+}
+
+// corruptPolicies maps the values of compact -corrupt to policies.
+var corruptPolicies = map[string]archivedb.CorruptEntryPolicy{
+	"fail":       archivedb.CorruptEntryFail,
+	"drop":       archivedb.CorruptEntryDrop,
+	"quarantine": archivedb.CorruptEntryQuarantine,
+}
+
+// runCompact compacts the sealed segments of a database whose dead ratio
+// passes the threshold, or with -punch punches holes over their dead
+// entries instead. It needs exclusive access to the database. It fails if
+// it finds a corrupt entry, unless -corrupt drops or quarantines them, and
+// then reports them.
+func runCompact(args []string) error {
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	ratio := fs.Float64("ratio", 0, "dead ratio above which a segment is compacted (default the library's)")
+	punch := fs.Bool("punch", false, "punch holes over dead entries instead of rewriting segments")
+	corrupt := fs.String("corrupt", "fail", "what to do with corrupt entries: fail, drop or quarantine")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("expected a database directory")
+	}
+	policy, ok := corruptPolicies[*corrupt]
+	if !ok {
+		return fmt.Errorf("unknown -corrupt policy %q", *corrupt)
+	}
+
+	opts := []archivedb.Option{archivedb.CorruptEntryPolicyOption(policy)}
+	if *ratio != 0 {
+		opts = append(opts, archivedb.CompactionRatioOption(*ratio))
+	}
+	db, err := archivedb.Open(fs.Arg(0), opts...)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if *punch {
+		return punchHoles(db, os.Stdout, *asJSON)
+	}
+	var progress func(done, total int64)
+	if !*asJSON && isTerminal(os.Stderr) {
+		progress = func(done, total int64) { printProgress("compacting", done, total) }
+	}
+	return compact(db, os.Stdout, *asJSON, policy, progress)
+}
+
+// compact compacts db, opened with the corrupt entry policy policy, and
+// prints the result to w. progress, if not nil, draws the progress of the
+// compaction. With asJSON, the result is printed even if the compaction
+// failed, with its error.
+func compact(db *archivedb.DB, w io.Writer, asJSON bool, policy archivedb.CorruptEntryPolicy, progress func(done, total int64)) error {
+	report, err := db.CompactWithProgress(progress)
+	if progress != nil {
+		fmt.Fprintln(os.Stderr)
+	}
+	if err != nil && !asJSON {
+		return err
+	}
+	res := compactResult{
+		Segments:        report.Segments,
+		ReclaimedBytes:  report.ReclaimedBytes,
+		RewrittenBytes:  report.RewrittenBytes,
+		CorruptEntries:  len(report.Corrupt),
+		Corrupt:         []corruptInfo{},
+		DurationSeconds: report.Duration.Seconds(),
+	}
+	for _, c := range report.Corrupt {
+		res.Corrupt = append(res.Corrupt, corruptInfo{Segment: c.Segment, Offset: c.Offset, Error: c.Err.Error()})
+	}
+	if asJSON {
+		if err != nil {
+			res.Error = err.Error()
+		}
+		if jerr := json.NewEncoder(w).Encode(res); jerr != nil {
+			return jerr
+		}
+		return err
+	}
+	action := "dropped"
+	if policy == archivedb.CorruptEntryQuarantine {
+		action = "quarantined"
+	}
+	for _, c := range res.Corrupt {
+		fmt.Fprintf(w, "%s corrupt entry at segment %04x offset %d: %s\n", action, c.Segment, c.Offset, c.Error)
+	}
+	fmt.Fprintf(w, "compacted %d segments, reclaimed %d bytes and rewrote %d in %v\n",
+		res.Segments, res.ReclaimedBytes, res.RewrittenBytes, report.Duration.Round(time.Millisecond))
+	return nil
+}
+
+// punchHoles punches holes over the dead entries of db and prints the
+// result to w.
+func punchHoles(db *archivedb.DB, w io.Writer, asJSON bool) error {
+	start := time.Now()
+	holes, reclaimed, err := db.PunchHoles()
+	if err != nil {
+		return err
+	}
+	elapsed := time.Since(start)
+	if asJSON {
+		return json.NewEncoder(w).Encode(compactResult{
+			Holes:           holes,
+			ReclaimedBytes:  reclaimed,
+			Corrupt:         []corruptInfo{},
+			DurationSeconds: elapsed.Seconds(),
+		})
+	}
+	fmt.Fprintf(w, "punched %d holes, reclaimed %d bytes in %v\n", holes, reclaimed, elapsed.Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/millken/archivedb"
+	"github.com/millken/archivedb/format"
+	"github.com/stretchr/testify/require"
+)
+
+// corruptValue flips the first byte of the value of the first entry of the
+// first segment of the closed database in dir, whose key is key.
+func corruptValue(t *testing.T, dir string, key string) {
+	f, err := os.OpenFile(filepath.Join(dir, "0000"), os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer f.Close()
+	off := int64(format.SegmentHeaderSize + format.EntryHeaderSize + len(key))
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, off)
+	require.NoError(t, err)
+	b[0] ^= 0xff
+	_, err = f.WriteAt(b, off)
+	require.NoError(t, err)
+}
+
+func TestCompact(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "archivedb-compact")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	db, err := archivedb.Open(dir, archivedb.CompactionRatioOption(0.1))
+	require.NoError(err)
+	defer db.Close()
+
+	value := bytes.Repeat([]byte("v"), 100)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		require.NoError(db.Put([]byte(key), value))
+	}
+	require.NoError(db.Put([]byte("a"), value))
+	_, err = db.SealActiveSegment()
+	require.NoError(err)
+	plan, err := db.PlanCompaction()
+	require.NoError(err)
+	require.Len(plan.Segments, 1)
+
+	var progress [][2]int64
+	var buf bytes.Buffer
+	require.NoError(compact(db, &buf, true, archivedb.CorruptEntryFail, func(done, total int64) {
+		progress = append(progress, [2]int64{done, total})
+	}))
+	var res compactResult
+	require.NoError(json.Unmarshal(buf.Bytes(), &res))
+	// The live entries were moved, and the overwritten one freed.
+	entrySize := int64(format.EntryHeaderSize + 1 + len(value))
+	require.Equal(1, res.Segments)
+	require.Equal(4*entrySize, res.RewrittenBytes)
+	require.Equal(entrySize, res.ReclaimedBytes)
+	require.Zero(res.CorruptEntries)
+	require.Empty(res.Corrupt)
+	require.Equal([][2]int64{{plan.ReadBytes, plan.ReadBytes}}, progress)
+
+	// Nothing is left to compact.
+	buf.Reset()
+	require.NoError(compact(db, &buf, false, archivedb.CorruptEntryFail, nil))
+	require.True(strings.HasPrefix(buf.String(), "compacted 0 segments, reclaimed 0 bytes and rewrote 0 in "), buf.String())
+}
+
+func TestCompact_Corrupt(t *testing.T) {
+	require := require.New(t)
+	for _, policy := range []archivedb.CorruptEntryPolicy{
+		archivedb.CorruptEntryFail, archivedb.CorruptEntryDrop, archivedb.CorruptEntryQuarantine,
+	} {
+		dir, err := ioutil.TempDir("", "archivedb-compact")
+		require.NoError(err)
+		defer os.RemoveAll(dir)
+		db, err := archivedb.Open(dir)
+		require.NoError(err)
+		require.NoError(db.Put([]byte("a"), []byte("1")))
+		require.NoError(db.Put([]byte("b"), []byte("2")))
+		require.NoError(db.Delete([]byte("b")))
+		require.NoError(db.Close())
+		corruptValue(t, dir, "a")
+
+		db, err = archivedb.Open(dir, archivedb.CompactionRatioOption(0.1), archivedb.CorruptEntryPolicyOption(policy))
+		require.NoError(err)
+		_, err = db.SealActiveSegment()
+		require.NoError(err)
+		var buf bytes.Buffer
+		asJSON := policy != archivedb.CorruptEntryQuarantine
+		err = compact(db, &buf, asJSON, policy, nil)
+		require.NoError(db.Close())
+
+		switch policy {
+		case archivedb.CorruptEntryFail:
+			// The result is still printed, with the error.
+			require.ErrorIs(err, archivedb.ErrChecksumFailed)
+			var res compactResult
+			require.NoError(json.Unmarshal(buf.Bytes(), &res))
+			require.Equal(err.Error(), res.Error)
+		case archivedb.CorruptEntryDrop:
+			require.NoError(err)
+			var res compactResult
+			require.NoError(json.Unmarshal(buf.Bytes(), &res))
+			require.Empty(res.Error)
+			require.Equal(1, res.CorruptEntries)
+			require.Equal([]corruptInfo{{Segment: 0, Offset: format.SegmentHeaderSize, Error: res.Corrupt[0].Error}}, res.Corrupt)
+			require.Contains(res.Corrupt[0].Error, archivedb.ErrChecksumFailed.Error())
+		case archivedb.CorruptEntryQuarantine:
+			require.NoError(err)
+			require.True(strings.HasPrefix(buf.String(), "quarantined corrupt entry at segment 0000 offset "), buf.String())
+		}
+	}
+}
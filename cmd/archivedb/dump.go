@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/millken/archivedb"
+)
+
+// dumpEntry is the JSON form of an entry printed by dump.
+type dumpEntry struct {
+	Offset     uint32 `json:"offset"`
+	Flag       string `json:"flag"`
+	Key        string `json:"key"` // hex
+	KeySize    uint8  `json:"key_size"`
+	ValueSize  uint32 `json:"value_size"`
+	Checksum   uint32 `json:"checksum"`
+	ChecksumOK bool   `json:"checksum_ok"`
+	Tag        uint32 `json:"tag,omitempty"`
+	Truncated  bool   `json:"truncated,omitempty"`
+	Codec      string `json:"codec,omitempty"`
+	Encrypted  bool   `json:"encrypted,omitempty"`
+	Chunked    bool   `json:"chunked,omitempty"`
+	Expires    string `json:"expires,omitempty"` // RFC 3339
+}
+
+// runDump prints every entry of a segment file, including corrupt ones.
+func runDump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print one JSON object per entry")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("expected a segment file")
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	enc := json.NewEncoder(w)
+	err := archivedb.DumpSegment(fs.Arg(0), func(info archivedb.SegmentEntryInfo) error {
+		if *asJSON {
+			return enc.Encode(dumpEntry{
+				Offset:     info.Offset,
+				Flag:       flagName(info.Flag),
+				Key:        hex.EncodeToString(info.Key),
+				KeySize:    info.KeySize,
+				ValueSize:  info.ValueSize,
+				Checksum:   info.Checksum,
+				ChecksumOK: info.ChecksumOK,
+				Tag:        info.Tag,
+				Truncated:  info.Truncated,
+				Codec:      codecName(info.Codec),
+				Encrypted:  info.Encrypted,
+				Chunked:    info.Chunked,
+				Expires:    formatExpiry(info.Expires),
+			})
+		}
+		status := "ok"
+		if info.Truncated {
+			status = "truncated"
+		} else if !info.ChecksumOK {
+			status = "bad-checksum"
+		}
+		_, err := fmt.Fprintf(w, "%d\t%s\t%s\tkey=%d\tvalue=%d\tcrc=%08x\ttag=%d\tattrs=%s\t%s\n",
+			info.Offset, flagName(info.Flag), printableKey(info.Key),
+			info.KeySize, info.ValueSize, info.Checksum, info.Tag, attrsString(info.EntryAttrs), status)
+		return err
+	})
+	if e := w.Flush(); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+func flagName(flag uint8) string {
+	switch flag {
+	case archivedb.EntryInsertFlag:
+		return "put"
+	case archivedb.EntryDeleteFlag:
+		return "delete"
+	case archivedb.EntryChunkFlag:
+		return "chunk"
+	case archivedb.EntryHoleFlag:
+		return "hole"
+	default:
+		return strconv.Itoa(int(flag))
+	}
+}
+
+// codecName returns the name of the codec with the given id, or "" for
+// none.
+func codecName(id uint8) string {
+	switch id {
+	case 0:
+		return ""
+	case archivedb.DeflateCodec.ID():
+		return "deflate"
+	default:
+		return "codec" + strconv.Itoa(int(id))
+	}
+}
+
+// formatExpiry returns t in RFC 3339, or "" if it is zero.
+func formatExpiry(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// attrsString lists the attributes of an entry, separated by commas, or
+// returns "-" if it has none.
+func attrsString(a archivedb.EntryAttrs) string {
+	var attrs []string
+	if a.Codec != 0 {
+		attrs = append(attrs, codecName(a.Codec))
+	}
+	if a.Encrypted {
+		attrs = append(attrs, "encrypted")
+	}
+	if a.Chunked {
+		attrs = append(attrs, "chunked")
+	}
+	if !a.Expires.IsZero() {
+		attrs = append(attrs, "expires="+formatExpiry(a.Expires))
+	}
+	if len(attrs) == 0 {
+		return "-"
+	}
+	return strings.Join(attrs, ",")
+}
+
+// printableKey quotes keys made of printable characters and hex encodes
+// any other key.
+func printableKey(key []byte) string {
+	for _, r := range string(key) {
+		if r == unicode.ReplacementChar || !unicode.IsPrint(r) {
+			return "0x" + hex.EncodeToString(key)
+		}
+	}
+	return strconv.Quote(string(key))
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"time"
+
+	"github.com/millken/archivedb"
+)
+
+// runExport writes the live keys of a database to a file or stdout. The
+// database is opened read-only, so it may be exported while in use. With
+// -at, the keys are those live at a watermark or time, to recover from bad
+// writes made after it.
+func runExport(args []string) (err error) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", string(archivedb.ExportJSON), "output format: jsonl, csv, sql (a script for sqlite3), sqlite or parquet")
+	out := fs.String("o", "", "output file (default stdout)")
+	at := fs.String("at", "", "export the database as of a `watermark` (segment:offset) or RFC 3339 time")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("expected a database directory")
+	}
+
+	db, err := openAt(fs.Arg(0), *at)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if e := f.Close(); e != nil && err == nil {
+				err = e
+			}
+		}()
+		w = f
+	}
+	return db.Export(w, archivedb.ExportFormat(*format))
+}
+
+// openAt opens the database at path read-only, as of at if it isn't empty.
+func openAt(path, at string) (*archivedb.DB, error) {
+	if at == "" {
+		return archivedb.Open(path, archivedb.FollowerOption(0))
+	} else if w, err := archivedb.ParseWatermark(at); err == nil {
+		return archivedb.OpenAt(path, w)
+	}
+	t, err := time.Parse(time.RFC3339, at)
+	if err != nil {
+		return nil, errors.New("-at must be a watermark or an RFC 3339 time")
+	}
+	return archivedb.OpenAtTime(path, t)
+}
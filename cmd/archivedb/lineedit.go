@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// lineReader reads the commands typed into the shell. readLine returns
+// io.EOF once input ends.
+type lineReader interface {
+	readLine(prompt string) (string, error)
+}
+
+// newLineReader returns a line editor with history and completion if in is
+// a terminal, and a plain reader of lines otherwise.
+func newLineReader(in *os.File, out io.Writer, history func() []string, complete func(line string) (string, []string)) lineReader {
+	if restore, err := rawMode(in); err == nil {
+		restore()
+		return &termReader{
+			in:       in,
+			r:        bufio.NewReader(in),
+			out:      out,
+			history:  history,
+			complete: complete,
+		}
+	}
+	return &plainReader{s: bufio.NewScanner(in)}
+}
+
+// plainReader reads lines from a pipe or file, without prompting.
+type plainReader struct {
+	s *bufio.Scanner
+}
+
+func (r *plainReader) readLine(prompt string) (string, error) {
+	if !r.s.Scan() {
+		if err := r.s.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	return r.s.Text(), nil
+}
+
+// termReader edits lines on a terminal in raw mode. It supports backspace,
+// Ctrl-U to clear the line, the arrow keys to walk the history, Tab to
+// complete and Ctrl-C and Ctrl-D to cancel the line and to quit.
+type termReader struct {
+	in       *os.File
+	r        *bufio.Reader
+	out      io.Writer
+	history  func() []string
+	complete func(line string) (string, []string)
+}
+
+const (
+	keyCtrlC     = 3
+	keyCtrlD     = 4
+	keyBackspace = 8
+	keyTab       = '\t'
+	keyCtrlU     = 21
+	keyEscape    = 27
+	keyDelete    = 127
+)
+
+func (t *termReader) readLine(prompt string) (line string, err error) {
+	restore, err := rawMode(t.in)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if e := restore(); e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	var buf []rune
+	history := t.history()
+	pos := len(history)
+	redraw := func() {
+		fmt.Fprintf(t.out, "\r\x1b[K%s%s", prompt, string(buf))
+	}
+	fmt.Fprint(t.out, prompt)
+	for {
+		c, _, err := t.r.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch c {
+		case '\r', '\n':
+			fmt.Fprint(t.out, "\n")
+			return string(buf), nil
+		case keyCtrlC:
+			fmt.Fprint(t.out, "^C\n")
+			buf, pos = buf[:0], len(history)
+			fmt.Fprint(t.out, prompt)
+		case keyCtrlD:
+			if len(buf) == 0 {
+				fmt.Fprint(t.out, "\n")
+				return "", io.EOF
+			}
+		case keyBackspace, keyDelete:
+			if len(buf) > 0 {
+				buf = buf[:len(buf)-1]
+				fmt.Fprint(t.out, "\b \b")
+			}
+		case keyCtrlU:
+			buf = buf[:0]
+			redraw()
+		case keyTab:
+			completed, options := t.complete(string(buf))
+			if completed != string(buf) {
+				buf = []rune(completed)
+			} else if len(options) > 1 {
+				fmt.Fprintf(t.out, "\n%s\n", strings.Join(options, "  "))
+			}
+			redraw()
+		case keyEscape:
+			// Only the up and down arrows, ESC [ A and ESC [ B, are handled.
+			if b, err := t.r.ReadByte(); err != nil || b != '[' {
+				continue
+			}
+			b, err := t.r.ReadByte()
+			if err != nil {
+				continue
+			}
+			switch {
+			case b == 'A' && pos > 0:
+				pos--
+			case b == 'B' && pos < len(history):
+				pos++
+			default:
+				continue
+			}
+			buf = buf[:0]
+			if pos < len(history) {
+				buf = append(buf, []rune(history[pos])...)
+			}
+			redraw()
+		default:
+			if unicode.IsPrint(c) {
+				buf = append(buf, c)
+				fmt.Fprint(t.out, string(c))
+			}
+		}
+	}
+}
@@ -0,0 +1,51 @@
+// Command archivedb inspects, exports and edits archivedb databases.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"backup":  {"backup [-o file | -dir directory] [-since watermark] <dir>", runBackup},
+	"compact": {"compact [-json] [-ratio r] [-punch] [-corrupt fail|drop|quarantine] <dir>", runCompact},
+	"dump":    {"dump [-json] <segmentfile>", runDump},
+	"export":  {"export [-format jsonl|csv|sql|sqlite|parquet] [-o file] [-at watermark|time] <dir>", runExport},
+	"restore": {"restore [-i file] [-force] <dir>", runRestore},
+	"shell":   {"shell [-readonly] [-format text|hex|json] <dir>", runShell},
+	"tail":    {"tail [-prefix p] [-interval d] [-all] <dir>", runTail},
+	"verify":  {"verify [-json] <dir>", runVerify},
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "archivedb: unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "archivedb %s: %v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: archivedb <command> [arguments]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	for _, name := range []string{"backup", "compact", "dump", "export", "restore", "shell", "tail", "verify"} {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"os"
+
+	"github.com/millken/archivedb"
+)
+
+// runRestore creates a database from a backup tar stream, or applies an
+// incremental one to the database restored from the backups before it.
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	in := fs.String("i", "", "read the tar stream from `file` instead of stdin")
+	force := fs.Bool("force", false, "replace the database or files in the directory")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("expected a database directory")
+	}
+
+	var r io.Reader = os.Stdin
+	if *in != "" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	return archivedb.RestoreWithOptions(fs.Arg(0), r, archivedb.RestoreOptions{Force: *force})
+}
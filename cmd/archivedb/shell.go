@@ -0,0 +1,508 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/millken/archivedb"
+)
+
+// shellScanLimit is the number of keys scan prints by default.
+const shellScanLimit = 100
+
+// shellCompleteLimit is the number of keys Tab looks at. If more keys
+// match, only the plain words among them are listed and the key typed
+// isn't extended, as the common prefix of every match isn't known.
+const shellCompleteLimit = 64
+
+// errStopScan ends a Scan early.
+var errStopScan = errors.New("stop scan")
+
+// errUsage is returned by a command given the wrong arguments.
+var errUsage = errors.New("usage")
+
+// shellCommands describes the commands of the shell, by name. help and
+// exit are run by the shell itself.
+var shellCommands = map[string]struct {
+	usage string
+	run   func(s *shell, args [][]byte) error
+	keyed bool // the first argument is a key or prefix
+}{
+	"get":     {"get <key>", (*shell).get, true},
+	"meta":    {"meta <key>", (*shell).meta, true},
+	"put":     {"put <key> <value>", (*shell).put, true},
+	"delete":  {"delete <key>", (*shell).delete, true},
+	"scan":    {"scan [prefix [limit]]", (*shell).scan, true},
+	"stats":   {"stats [prefix]", (*shell).stats, true},
+	"history": {"history", (*shell).showHistory, false},
+	"format":  {"format [text|hex|json]", (*shell).setFormat, false},
+	"help":    {"help", nil, false},
+	"exit":    {"exit", nil, false},
+}
+
+// shell is an interactive session on a database.
+type shell struct {
+	db      *archivedb.DB
+	out     io.Writer
+	format  string // text, hex or json
+	history []string
+}
+
+// runShell reads commands from stdin and runs them against a database,
+// completing keys with Tab when stdin is a terminal.
+func runShell(args []string) error {
+	fs := flag.NewFlagSet("shell", flag.ExitOnError)
+	readOnly := fs.Bool("readonly", false, "open the database read-only, so it may be inspected while in use")
+	format := fs.String("format", "text", "output format: text, hex or json")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("expected a database directory")
+	}
+	s := &shell{out: os.Stdout}
+	if err := s.setFormat([][]byte{[]byte(*format)}); err != nil {
+		return err
+	}
+
+	var opts []archivedb.Option
+	if *readOnly {
+		opts = append(opts, archivedb.FollowerOption(0))
+	}
+	db, err := archivedb.Open(fs.Arg(0), opts...)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	s.db = db
+
+	in := newLineReader(os.Stdin, os.Stdout, func() []string { return s.history }, s.complete)
+	for {
+		line, err := in.readLine("archivedb> ")
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		if n := len(s.history); n == 0 || s.history[n-1] != line {
+			s.history = append(s.history, line)
+		}
+		if done, err := s.exec(line); err != nil {
+			fmt.Fprintf(s.out, "error: %v\n", err)
+		} else if done {
+			return nil
+		}
+	}
+}
+
+// exec runs a command line. done is set once the shell should exit.
+func (s *shell) exec(line string) (done bool, err error) {
+	name, rest := splitCommand(line)
+	if name == "quit" {
+		name = "exit"
+	}
+	cmd, ok := shellCommands[name]
+	switch {
+	case !ok:
+		return false, fmt.Errorf("unknown command %q, try help", name)
+	case name == "exit":
+		return true, nil
+	case name == "help":
+		s.help()
+		return false, nil
+	}
+	args, err := parseArgs(rest)
+	if err != nil {
+		return false, err
+	}
+	if err := cmd.run(s, args); err == errUsage {
+		return false, errors.New("usage: " + cmd.usage)
+	} else if err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+func (s *shell) get(args [][]byte) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	value, err := s.db.Get(args[0])
+	if err != nil {
+		return err
+	}
+	return s.printEntry(args[0], value, false)
+}
+
+// shellMeta is the JSON form of the meta command.
+type shellMeta struct {
+	Segment    uint32 `json:"segment"`
+	Offset     uint32 `json:"offset"`
+	Tag        uint32 `json:"tag,omitempty"`
+	StoredSize uint32 `json:"stored_size"`
+	Checksum   uint32 `json:"checksum"`
+	Codec      string `json:"codec,omitempty"`
+	Encrypted  bool   `json:"encrypted,omitempty"`
+	Chunked    bool   `json:"chunked,omitempty"`
+	Expires    string `json:"expires,omitempty"`
+}
+
+// meta prints where and how the value of a key is stored.
+func (s *shell) meta(args [][]byte) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	m, err := s.db.GetMeta(args[0])
+	if err != nil {
+		return err
+	}
+	if s.format == "json" {
+		return json.NewEncoder(s.out).Encode(shellMeta{
+			Segment:    m.Segment,
+			Offset:     m.Offset,
+			Tag:        m.Tag,
+			StoredSize: m.StoredSize,
+			Checksum:   m.Checksum,
+			Codec:      codecName(m.Codec),
+			Encrypted:  m.Encrypted,
+			Chunked:    m.Chunked,
+			Expires:    formatExpiry(m.Expires),
+		})
+	}
+	fmt.Fprintf(s.out, "segment\t%d\n", m.Segment)
+	fmt.Fprintf(s.out, "offset\t%d\n", m.Offset)
+	fmt.Fprintf(s.out, "tag\t%d\n", m.Tag)
+	fmt.Fprintf(s.out, "stored size\t%d\n", m.StoredSize)
+	fmt.Fprintf(s.out, "checksum\t%08x\n", m.Checksum)
+	_, err = fmt.Fprintf(s.out, "attrs\t%s\n", attrsString(m.EntryAttrs))
+	return err
+}
+
+func (s *shell) put(args [][]byte) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	return s.db.Put(args[0], args[1])
+}
+
+func (s *shell) delete(args [][]byte) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	return s.db.Delete(args[0])
+}
+
+// scan prints the keys starting with a prefix and their values, up to a
+// limit.
+func (s *shell) scan(args [][]byte) error {
+	if len(args) > 2 {
+		return errUsage
+	}
+	var prefix []byte
+	if len(args) > 0 {
+		prefix = args[0]
+	}
+	limit := shellScanLimit
+	if len(args) == 2 {
+		n, err := strconv.Atoi(string(args[1]))
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid limit %q", args[1])
+		}
+		limit = n
+	}
+	n := 0
+	err := s.db.Scan(prefix, func(key, value []byte) error {
+		if n == limit {
+			return errStopScan
+		}
+		n++
+		return s.printEntry(key, value, true)
+	})
+	if err == errStopScan {
+		if s.format != "json" {
+			fmt.Fprintf(s.out, "(stopped after %d keys)\n", limit)
+		}
+		return nil
+	}
+	return err
+}
+
+// shellStats is the JSON form of the stats command.
+type shellStats struct {
+	Seq                uint64  `json:"seq"`
+	Keys               int64   `json:"keys"`
+	KeysEver           int64   `json:"keys_ever"`
+	LiveBytes          int64   `json:"live_bytes"`
+	LogicalBytes       int64   `json:"logical_bytes"`
+	PhysicalBytes      int64   `json:"physical_bytes"`
+	WriteAmplification float64 `json:"write_amplification"`
+	IndexMemory        int64   `json:"index_memory"`
+	Segments           int     `json:"segments"`
+	DiskBytes          int64   `json:"disk_bytes"`
+	DeadBytes          int64   `json:"dead_bytes"`
+	TombstoneBytes     int64   `json:"tombstone_bytes"`
+	Reads              int64   `json:"reads"`
+	Writes             int64   `json:"writes"`
+	Syncs              int64   `json:"syncs"`
+	LastCompaction     string  `json:"last_compaction,omitempty"`
+	ReadOnly           bool    `json:"read_only"`
+	Degraded           string  `json:"degraded,omitempty"`
+}
+
+// stats prints the size and health of the database, counting only the
+// keys starting with a prefix if one is given.
+func (s *shell) stats(args [][]byte) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	var prefix []byte
+	if len(args) == 1 {
+		prefix = args[0]
+	}
+	ps, err := s.db.StatsPrefix(prefix)
+	if err != nil {
+		return err
+	}
+	st, health := s.db.Stats(), s.db.Health()
+	out := shellStats{
+		Seq:                s.db.Seq(),
+		Keys:               ps.Keys,
+		KeysEver:           s.db.ApproxTotalKeysEver(),
+		LiveBytes:          ps.LiveBytes,
+		LogicalBytes:       st.LogicalBytes,
+		PhysicalBytes:      st.PhysicalBytes,
+		WriteAmplification: st.WriteAmplification(),
+		IndexMemory:        st.IndexMemory,
+		Segments:           st.Segments,
+		DiskBytes:          st.DiskBytes,
+		DeadBytes:          st.DeadBytes,
+		TombstoneBytes:     st.TombstoneBytes,
+		Reads:              st.Reads,
+		Writes:             st.Writes,
+		Syncs:              st.Syncs,
+		ReadOnly:           health.ReadOnly,
+	}
+	if !st.LastCompaction.IsZero() {
+		out.LastCompaction = st.LastCompaction.UTC().Format(time.RFC3339)
+	}
+	if health.Degraded != nil {
+		out.Degraded = health.Degraded.Error()
+	}
+	if s.format == "json" {
+		return json.NewEncoder(s.out).Encode(out)
+	}
+	fmt.Fprintf(s.out, "seq\t%d\n", out.Seq)
+	fmt.Fprintf(s.out, "keys\t%d\n", out.Keys)
+	fmt.Fprintf(s.out, "keys ever (approx.)\t%d\n", out.KeysEver)
+	fmt.Fprintf(s.out, "live bytes\t%d\n", out.LiveBytes)
+	fmt.Fprintf(s.out, "logical bytes\t%d\n", out.LogicalBytes)
+	fmt.Fprintf(s.out, "physical bytes\t%d\n", out.PhysicalBytes)
+	fmt.Fprintf(s.out, "write amplification\t%.2f\n", out.WriteAmplification)
+	fmt.Fprintf(s.out, "index memory\t%d\n", out.IndexMemory)
+	fmt.Fprintf(s.out, "segments\t%d\n", out.Segments)
+	fmt.Fprintf(s.out, "disk bytes\t%d\n", out.DiskBytes)
+	fmt.Fprintf(s.out, "dead bytes\t%d\n", out.DeadBytes)
+	fmt.Fprintf(s.out, "tombstone bytes\t%d\n", out.TombstoneBytes)
+	fmt.Fprintf(s.out, "reads\t%d\n", out.Reads)
+	fmt.Fprintf(s.out, "writes\t%d\n", out.Writes)
+	fmt.Fprintf(s.out, "syncs\t%d\n", out.Syncs)
+	if out.LastCompaction != "" {
+		fmt.Fprintf(s.out, "last compaction\t%s\n", out.LastCompaction)
+	}
+	fmt.Fprintf(s.out, "read-only\t%t\n", out.ReadOnly)
+	if out.Degraded != "" {
+		fmt.Fprintf(s.out, "degraded\t%s\n", out.Degraded)
+	}
+	return nil
+}
+
+// showHistory prints the commands entered in this session.
+func (s *shell) showHistory(args [][]byte) error {
+	for i, line := range s.history {
+		fmt.Fprintf(s.out, "%4d  %s\n", i+1, line)
+	}
+	return nil
+}
+
+// setFormat sets the format values are printed in, or prints it.
+func (s *shell) setFormat(args [][]byte) error {
+	switch {
+	case len(args) == 0:
+		fmt.Fprintln(s.out, s.format)
+		return nil
+	case len(args) > 1:
+		return errUsage
+	}
+	switch f := string(args[0]); f {
+	case "text", "hex", "json":
+		s.format = f
+		return nil
+	default:
+		return fmt.Errorf("unknown format %q", f)
+	}
+}
+
+func (s *shell) help() {
+	names := make([]string, 0, len(shellCommands))
+	for name := range shellCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(s.out, "  %s\n", shellCommands[name].usage)
+	}
+	fmt.Fprintln(s.out, "\nKeys and values are plain words, Go quoted strings or 0x-prefixed hex.")
+}
+
+// printEntry prints a value, with its key if withKey is set, in the
+// current format. The JSON form, which always has the key, matches that of
+// export.
+func (s *shell) printEntry(key, value []byte, withKey bool) error {
+	switch s.format {
+	case "json":
+		return json.NewEncoder(s.out).Encode(struct {
+			Key   []byte `json:"key"`
+			Value []byte `json:"value"`
+		}{key, value})
+	case "hex":
+		if withKey {
+			fmt.Fprintf(s.out, "%s\t", hex.EncodeToString(key))
+		}
+		_, err := fmt.Fprintln(s.out, hex.EncodeToString(value))
+		return err
+	default:
+		if withKey {
+			fmt.Fprintf(s.out, "%s\t", printableKey(key))
+		}
+		_, err := fmt.Fprintln(s.out, printableKey(value))
+		return err
+	}
+}
+
+// complete completes the command name or the key being typed at the end
+// of line. It returns the completed line and, if more than one key or
+// command matches, the matches.
+func (s *shell) complete(line string) (string, []string) {
+	name, rest := splitCommand(line)
+	if len(name) == len(line) {
+		var names []string
+		for n := range shellCommands {
+			if strings.HasPrefix(n, name) {
+				names = append(names, n)
+			}
+		}
+		sort.Strings(names)
+		return completion(line[:len(line)-len(name)], names)
+	}
+	// Only the first argument of a keyed command is completed, and only
+	// with keys that are plain words.
+	if !shellCommands[name].keyed || strings.ContainsAny(rest, " \t") || strings.HasPrefix(rest, `"`) {
+		return line, nil
+	}
+	var keys []string
+	visited := 0
+	err := s.db.Scan([]byte(rest), func(key, _ []byte) error {
+		if visited == shellCompleteLimit {
+			return errStopScan
+		}
+		visited++
+		if isWord(key) {
+			keys = append(keys, string(key))
+		}
+		return nil
+	})
+	if err == errStopScan {
+		return line, keys
+	} else if err != nil {
+		return line, nil
+	}
+	return completion(line[:len(line)-len(rest)], keys)
+}
+
+// completion returns head followed by the longest common prefix of the
+// candidates, and a space if there is one candidate.
+func completion(head string, candidates []string) (string, []string) {
+	if len(candidates) == 0 {
+		return head, nil
+	} else if len(candidates) == 1 {
+		return head + candidates[0] + " ", nil
+	}
+	common := candidates[0]
+	for _, c := range candidates[1:] {
+		for !strings.HasPrefix(c, common) {
+			_, size := utf8.DecodeLastRuneInString(common)
+			common = common[:len(common)-size]
+		}
+	}
+	return head + common, candidates
+}
+
+// splitCommand splits a line into the command name and the rest of the
+// line, which has its leading spaces removed.
+func splitCommand(line string) (name, rest string) {
+	line = strings.TrimLeft(line, " \t")
+	i := strings.IndexAny(line, " \t")
+	if i < 0 {
+		return line, ""
+	}
+	return line[:i], strings.TrimLeft(line[i:], " \t")
+}
+
+// parseArgs splits the arguments of a command on spaces. An argument is a
+// Go quoted string, 0x followed by hex digits, or a plain word.
+func parseArgs(s string) ([][]byte, error) {
+	var args [][]byte
+	for s = strings.TrimLeft(s, " \t"); s != ""; s = strings.TrimLeft(s, " \t") {
+		if s[0] == '"' || s[0] == '`' {
+			q, err := strconv.QuotedPrefix(s)
+			if err != nil {
+				return nil, fmt.Errorf("bad quoted string: %s", s)
+			}
+			arg, _ := strconv.Unquote(q)
+			args = append(args, []byte(arg))
+			s = s[len(q):]
+			continue
+		}
+		word := s
+		if i := strings.IndexAny(s, " \t"); i >= 0 {
+			word = s[:i]
+		}
+		s = s[len(word):]
+		if strings.HasPrefix(word, "0x") {
+			b, err := hex.DecodeString(word[2:])
+			if err != nil {
+				return nil, fmt.Errorf("bad hex %q", word)
+			}
+			args = append(args, b)
+			continue
+		}
+		args = append(args, []byte(word))
+	}
+	return args, nil
+}
+
+// isWord reports whether key is read back unchanged by parseArgs as a
+// plain word.
+func isWord(key []byte) bool {
+	if len(key) == 0 || key[0] == '"' || key[0] == '`' || strings.HasPrefix(string(key), "0x") {
+		return false
+	}
+	for _, r := range string(key) {
+		if r == unicode.ReplacementChar || !unicode.IsPrint(r) || unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/millken/archivedb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitCommand(t *testing.T) {
+	for _, tt := range []struct{ line, name, rest string }{
+		{"", "", ""},
+		{"get", "get", ""},
+		{"  get  foo bar", "get", "foo bar"},
+		{"scan\tpre ", "scan", "pre "},
+	} {
+		name, rest := splitCommand(tt.line)
+		require.Equal(t, tt.name, name, tt.line)
+		require.Equal(t, tt.rest, rest, tt.line)
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	require := require.New(t)
+	args, err := parseArgs(` foo "a b\n" 0x00ff ` + "`raw`" + `	bar`)
+	require.NoError(err)
+	require.Equal([][]byte{[]byte("foo"), []byte("a b\n"), {0, 0xff}, []byte("raw"), []byte("bar")}, args)
+
+	args, err = parseArgs("  ")
+	require.NoError(err)
+	require.Empty(args)
+	_, err = parseArgs(`"unterminated`)
+	require.Error(err)
+	_, err = parseArgs("0xzz")
+	require.Error(err)
+}
+
+func TestCompletion(t *testing.T) {
+	require := require.New(t)
+	line, matches := completion("get ", nil)
+	require.Equal("get ", line)
+	require.Nil(matches)
+	line, matches = completion("get ", []string{"foo"})
+	require.Equal("get foo ", line)
+	require.Nil(matches)
+	line, matches = completion("get ", []string{"user/1", "user/2", "users"})
+	require.Equal("get user", line)
+	require.Equal([]string{"user/1", "user/2", "users"}, matches)
+	line, _ = completion("", []string{"héllo", "hèllo"})
+	require.Equal("h", line)
+}
+
+func TestShellComplete(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "archivedb-shell")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	db, err := archivedb.Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	s := &shell{db: db, out: ioutil.Discard}
+
+	line, matches := s.complete("ge")
+	require.Equal("get ", line)
+	require.Nil(matches)
+
+	require.NoError(db.Put([]byte("user/1"), []byte("a")))
+	require.NoError(db.Put([]byte("user/2"), []byte("b")))
+	require.NoError(db.Put([]byte("user 3"), []byte("c")))
+	line, matches = s.complete("get us")
+	require.Equal("get user/", line)
+	require.Equal([]string{"user/1", "user/2"}, matches)
+	line, _ = s.complete("history us")
+	require.Equal("history us", line)
+
+	// Past the limit, the key typed isn't extended to a prefix that only
+	// the keys looked at share.
+	for i := 0; i < shellCompleteLimit; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("many/a%03d", i)), nil))
+	}
+	require.NoError(db.Put([]byte("many/b"), nil))
+	line, matches = s.complete("get many/")
+	require.Equal("get many/", line)
+	require.Len(matches, shellCompleteLimit)
+
+	// Keys that aren't words count towards the limit too.
+	for i := 0; i <= shellCompleteLimit; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("bin/\x00%03d", i)), nil))
+	}
+	line, matches = s.complete("get bin/")
+	require.Equal("get bin/", line)
+	require.Empty(matches)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/millken/archivedb"
+)
+
+// tailRecord is the JSON line printed by tail for every write.
+type tailRecord struct {
+	Seq     uint64     `json:"seq"`
+	Op      string     `json:"op"`
+	Key     []byte     `json:"key"`
+	Value   []byte     `json:"value,omitempty"`
+	Tag     uint32     `json:"tag,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// runTail follows a database read-only and prints every write made after
+// it started, as one JSON object per line, until interrupted. Writes are
+// picked up by polling, so they are printed up to one interval late.
+func runTail(args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	prefix := fs.String("prefix", "", "only print writes to keys starting with `p`")
+	interval := fs.Duration("interval", time.Second, "how often to poll for new writes")
+	all := fs.Bool("all", false, "print the writes already made before following")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("expected a database directory")
+	} else if *interval <= 0 {
+		return errors.New("interval must be positive")
+	}
+
+	db, err := archivedb.Open(fs.Arg(0), archivedb.FollowerOption(0))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	next := db.Seq() + 1
+	if *all {
+		next = 1
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	return tail(db, os.Stdout, []byte(*prefix), next, *interval, interrupt)
+}
+
+// tail prints the writes to keys starting with prefix, from sequence
+// number next on, refreshing the follower db every interval, until stop
+// receives.
+func tail(db *archivedb.DB, out io.Writer, prefix []byte, next uint64, interval time.Duration, stop <-chan os.Signal) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	w := bufio.NewWriter(out)
+	enc := json.NewEncoder(w)
+	for {
+		err := db.ForEachRaw(archivedb.EntryFilter{MinSeq: next}, func(e archivedb.RawEntry) error {
+			next = e.Seq + 1
+			if !bytes.HasPrefix(e.Key, prefix) {
+				return nil
+			}
+			r := tailRecord{Seq: e.Seq, Op: flagName(e.Header.Flag), Key: e.Key, Tag: e.Header.Tag}
+			if e.Header.Flag != archivedb.EntryDeleteFlag {
+				r.Value = e.Value
+			}
+			if !e.Expires.IsZero() {
+				r.Expires = &e.Expires
+			}
+			return enc.Encode(r)
+		})
+		if e := w.Flush(); e != nil && err == nil {
+			err = e
+		}
+		if err != nil {
+			return err
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+		if err := db.Refresh(); err != nil {
+			return err
+		}
+	}
+}
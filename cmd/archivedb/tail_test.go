@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/millken/archivedb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTail(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "archivedb-tail")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	db, err := archivedb.Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	require.NoError(db.Put([]byte("old"), []byte("0")))
+
+	follower, err := archivedb.Open(dir, archivedb.FollowerOption(0))
+	require.NoError(err)
+	defer follower.Close()
+	r, w := io.Pipe()
+	stop := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() {
+		err := tail(follower, w, []byte("k"), follower.Seq()+1, time.Millisecond, stop)
+		w.CloseWithError(err)
+		done <- err
+	}()
+
+	// Records are read as they are printed, so writes land before,
+	// during and after Refreshes.
+	records := make(chan tailRecord)
+	go func() {
+		dec := json.NewDecoder(r)
+		for {
+			var rec tailRecord
+			if dec.Decode(&rec) != nil {
+				close(records)
+				return
+			}
+			records <- rec
+		}
+	}()
+	next := func() tailRecord {
+		select {
+		case rec, ok := <-records:
+			require.True(ok, "tail stopped")
+			return rec
+		case <-time.After(5 * time.Second):
+			t.Fatal("no record printed")
+			return tailRecord{}
+		}
+	}
+
+	require.NoError(db.Put([]byte("k1"), []byte("a")))
+	require.NoError(db.Put([]byte("other"), []byte("b")))
+	rec := next()
+	require.Equal("put", rec.Op)
+	require.Equal("k1", string(rec.Key))
+	require.Equal("a", string(rec.Value))
+	last := rec.Seq
+
+	_, err = db.SealActiveSegment()
+	require.NoError(err)
+	require.NoError(db.Put([]byte("k2"), []byte("c")))
+	require.NoError(db.Delete([]byte("k1")))
+	want := []struct{ op, key string }{{"put", "k2"}, {"delete", "k1"}}
+	for _, w := range want {
+		rec := next()
+		require.Greater(rec.Seq, last)
+		require.Equal(w.op, rec.Op)
+		require.Equal(w.key, string(rec.Key))
+		last = rec.Seq
+	}
+
+	// Nothing is printed twice.
+	select {
+	case rec := <-records:
+		t.Fatalf("unexpected record %+v", rec)
+	case <-time.After(50 * time.Millisecond):
+	}
+	stop <- os.Interrupt
+	require.NoError(<-done)
+}
@@ -0,0 +1,15 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// rawMode is not supported on this platform, so the shell reads whole lines
+// without completion.
+func rawMode(f *os.File) (restore func() error, err error) {
+	return nil, errors.New("raw terminal mode not supported")
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/millken/archivedb"
+)
+
+// verifyResult is the JSON form of the result of verify.
+type verifyResult struct {
+	Segments        int           `json:"segments"`
+	Entries         int64         `json:"entries"`
+	Bytes           int64         `json:"bytes"`
+	CorruptEntries  int           `json:"corrupt_entries"`
+	Corrupt         []corruptInfo `json:"corrupt"`
+	DurationSeconds float64       `json:"duration_seconds"`
+}
+
+type corruptInfo struct {
+	Segment uint32 `json:"segment"`
+	Offset  uint32 `json:"offset"`
+	Error   string `json:"error"`
+}
+
+// runVerify checks every entry of a database against its checksum. It
+// fails if any is corrupt, so it can alert from cron. The database is
+// opened read-only, so it may be verified while in use.
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("expected a database directory")
+	}
+
+	db, err := archivedb.Open(fs.Arg(0), archivedb.FollowerOption(0))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var progress func(done, total int64)
+	if !*asJSON && isTerminal(os.Stderr) {
+		progress = func(done, total int64) { printProgress("verifying", done, total) }
+	}
+	return verify(db, os.Stdout, *asJSON, progress)
+}
+
+// verify verifies db and prints the result to w. progress, if not nil,
+// draws the progress of the verification.
+func verify(db *archivedb.DB, w io.Writer, asJSON bool, progress func(done, total int64)) error {
+	report, err := db.Verify(progress)
+	if progress != nil {
+		fmt.Fprintln(os.Stderr)
+	}
+	if err != nil {
+		return err
+	}
+
+	res := verifyResult{
+		Segments:        report.Segments,
+		Entries:         report.Entries,
+		Bytes:           report.Bytes,
+		CorruptEntries:  len(report.Corrupt),
+		Corrupt:         []corruptInfo{},
+		DurationSeconds: report.Duration.Seconds(),
+	}
+	for _, c := range report.Corrupt {
+		res.Corrupt = append(res.Corrupt, corruptInfo{Segment: c.Segment, Offset: c.Offset, Error: c.Err.Error()})
+	}
+	if asJSON {
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			return err
+		}
+	} else {
+		for _, c := range res.Corrupt {
+			fmt.Fprintf(w, "segment %04x offset %d: %s\n", c.Segment, c.Offset, c.Error)
+		}
+		fmt.Fprintf(w, "checked %d entries in %d segments (%d bytes) in %v\n",
+			res.Entries, res.Segments, res.Bytes, report.Duration.Round(time.Millisecond))
+	}
+	if n := len(res.Corrupt); n > 0 {
+		return fmt.Errorf("found %d corrupt entries", n)
+	}
+	return nil
+}
+
+// isTerminal reports whether f is a terminal rather than a pipe or file.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// printProgress redraws a progress bar on stderr.
+func printProgress(label string, done, total int64) {
+	const width = 30
+	frac := 1.0
+	if total > 0 {
+		frac = float64(done) / float64(total)
+	}
+	n := int(frac * width)
+	fmt.Fprintf(os.Stderr, "\r%s [%s%s] %3.0f%%", label, strings.Repeat("#", n), strings.Repeat(" ", width-n), frac*100)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/millken/archivedb"
+	"github.com/millken/archivedb/format"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "archivedb-verify")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	db, err := archivedb.Open(dir)
+	require.NoError(err)
+	require.NoError(db.Put([]byte("a"), []byte("1")))
+	require.NoError(db.Put([]byte("b"), []byte("2")))
+	require.NoError(db.Close())
+
+	db, err = archivedb.Open(dir, archivedb.FollowerOption(0))
+	require.NoError(err)
+	var progress []int64
+	var buf bytes.Buffer
+	require.NoError(verify(db, &buf, true, func(done, total int64) {
+		require.Equal(done, total)
+		progress = append(progress, done)
+	}))
+	require.NoError(db.Close())
+	var res verifyResult
+	require.NoError(json.Unmarshal(buf.Bytes(), &res))
+	entrySize := int64(format.EntryHeaderSize + 2)
+	require.Equal(verifyResult{
+		Segments:        1,
+		Entries:         2,
+		Bytes:           format.SegmentHeaderSize + 2*entrySize,
+		Corrupt:         []corruptInfo{},
+		DurationSeconds: res.DurationSeconds,
+	}, res)
+	require.Equal([]int64{res.Bytes}, progress)
+
+	// A corrupt entry is listed, and fails the command.
+	corruptValue(t, dir, "a")
+	db, err = archivedb.Open(dir, archivedb.FollowerOption(0))
+	require.NoError(err)
+	defer db.Close()
+	buf.Reset()
+	require.EqualError(verify(db, &buf, true, nil), "found 1 corrupt entries")
+	res = verifyResult{}
+	require.NoError(json.Unmarshal(buf.Bytes(), &res))
+	require.Equal(2, int(res.Entries))
+	require.Equal(1, res.CorruptEntries)
+	require.Equal([]corruptInfo{{Segment: 0, Offset: format.SegmentHeaderSize, Error: archivedb.ErrChecksumFailed.Error()}}, res.Corrupt)
+
+	buf.Reset()
+	require.Error(verify(db, &buf, false, nil))
+	require.True(strings.HasPrefix(buf.String(), "segment 0000 offset 6: checksum failed\nchecked 2 entries in 1 segments"), buf.String())
+}
@@ -0,0 +1,60 @@
+package archivedb
+
+import "sync"
+
+// flightGroup coalesces concurrent reads of the same key: the first reader
+// does the read and the others wait for and share its result.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is a read in progress.
+type flight struct {
+	done    chan struct{}
+	value   []byte
+	err     error
+	waiters int
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{flights: make(map[string]*flight)}
+}
+
+// do calls fn and returns its result, unless a call for key is already in
+// progress, in which case it waits for that call and returns its result.
+// shared is true if the result came from another call. Each caller gets
+// its own copy of a shared value, so one can't change another's.
+func (g *flightGroup) do(key string, fn func() ([]byte, error)) (value []byte, shared bool, err error) {
+	g.mu.Lock()
+	if f, ok := g.flights[key]; ok {
+		f.waiters++
+		g.mu.Unlock()
+		<-f.done
+		return cloneBytes(f.value), true, f.err
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.flights, key)
+		waiters := f.waiters
+		g.mu.Unlock()
+		close(f.done)
+		if waiters > 0 {
+			value = cloneBytes(value)
+		}
+	}()
+	f.value, f.err = fn()
+	return f.value, false, f.err
+}
+
+// cloneBytes returns a copy of b, or nil if b is nil.
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte(nil), b...)
+}
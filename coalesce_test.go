@@ -0,0 +1,159 @@
+package archivedb
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlightGroup(t *testing.T) {
+	require := require.New(t)
+	g := newFlightGroup()
+
+	var calls, shared int32
+	started, release := make(chan struct{}), make(chan struct{})
+	read := func() ([]byte, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+		}
+		<-release
+		return []byte("bar"), nil
+	}
+	var wg sync.WaitGroup
+	get := func() {
+		defer wg.Done()
+		v, s, err := g.do("foo", read)
+		require.NoError(err)
+		require.Equal([]byte("bar"), v)
+		if s {
+			atomic.AddInt32(&shared, 1)
+		}
+	}
+	wg.Add(1)
+	go get()
+	<-started
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go get()
+	}
+	// Give the other reads time to join the first.
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	require.Equal(int32(1), calls)
+	require.Equal(int32(4), shared)
+
+	// Once done, the next read of the key is a new call.
+	_, s, err := g.do("foo", read)
+	require.NoError(err)
+	require.False(s)
+	require.Equal(int32(2), calls)
+	require.Empty(g.flights)
+}
+
+func TestCoalesceReadsOption(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	db, err := Open(dir, CoalesceReadsOption(true))
+	require.NoError(err)
+	defer db.Close()
+	require.NotNil(db.flights)
+	require.NoError(db.Put([]byte("foo"), []byte("bar")))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := db.Get([]byte("foo"))
+			require.NoError(err)
+			require.Equal([]byte("bar"), v)
+			_, err = db.Get([]byte("missing"))
+			require.ErrorIs(err, ErrKeyNotFound)
+		}()
+	}
+	wg.Wait()
+	require.ErrorIs(db.SetOption(CoalesceReadsOption(false)), ErrImmutableOption)
+}
+
+// TestFlightGroup_Copies checks callers sharing a result can't see each
+// other's changes to it.
+func TestFlightGroup_Copies(t *testing.T) {
+	require := require.New(t)
+	g := newFlightGroup()
+
+	started, release := make(chan struct{}), make(chan struct{})
+	read := func() ([]byte, error) {
+		close(started)
+		<-release
+		return []byte("value"), nil
+	}
+	values := make([][]byte, 2)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		values[0], _, _ = g.do("foo", read)
+	}()
+	<-started
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		values[1], _, _ = g.do("foo", read)
+	}()
+	// Give the second read time to join the first.
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	values[0][0] = 'X'
+	require.Equal([]byte("Xalue"), values[0])
+	require.Equal([]byte("value"), values[1])
+}
+
+// TestCoalesceReadsOption_Verify checks a verified read and an unverified
+// read of another key never share a flight, whatever the keys are.
+func TestCoalesceReadsOption_Verify(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	loading := make(chan string, 2)
+	release := make(chan struct{})
+	db, err := Open(dir, CoalesceReadsOption(true), LoaderOption(func(key []byte) ([]byte, error) {
+		loading <- string(key)
+		<-release
+		return append([]byte("loaded:"), key...), nil
+	}))
+	require.NoError(err)
+	defer db.Close()
+
+	keys := []string{"a", "a\x00verify"}
+	values := make([][]byte, len(keys))
+	var wg sync.WaitGroup
+	for i, key := range keys {
+		wg.Add(1)
+		go func(i int, key string) {
+			defer wg.Done()
+			v, err := db.GetWithOptions([]byte(key), ReadOptions{VerifyChecksum: i == 0})
+			require.NoError(err)
+			values[i] = v
+		}(i, key)
+		select {
+		case k := <-loading:
+			require.Equal(key, k)
+		case <-time.After(5 * time.Second):
+			close(release)
+			t.Fatalf("%q didn't load", key)
+		}
+	}
+	close(release)
+	wg.Wait()
+	require.Equal([]byte("loaded:a"), values[0])
+	require.Equal([]byte("loaded:a\x00verify"), values[1])
+}
@@ -0,0 +1,644 @@
+package archivedb
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/millken/archivedb/format"
+	"github.com/pkg/errors"
+)
+
+// DefaultCompactionRatio is the dead-data ratio above which a segment is
+// considered worth compacting.
+const DefaultCompactionRatio = 0.5
+
+// SegmentUsage describes how much of a segment is still referenced.
+type SegmentUsage struct {
+	ID        uint32
+	Size      int64 // bytes of entries in the segment, less punched holes
+	LiveBytes int64 // bytes of entries still referenced by live keys
+
+	// chunks is set if the segment holds chunks of live values, which
+	// compaction can't move.
+	chunks bool
+	// tombstoneBytes is the bytes of the current tombstones of keys.
+	tombstoneBytes int64
+}
+
+// DeadRatio returns the fraction of the segment's entries that are no
+// longer referenced.
+func (u SegmentUsage) DeadRatio() float64 {
+	if u.Size == 0 {
+		return 0
+	}
+	return float64(u.Size-u.LiveBytes) / float64(u.Size)
+}
+
+// CompactionPlan describes the work a compaction would do.
+type CompactionPlan struct {
+	// Segments are the sealed segments whose dead ratio passed the threshold.
+	Segments []SegmentUsage
+	// ReclaimableBytes is the dead data that compacting Segments would free.
+	ReclaimableBytes int64
+	// ReadBytes is the data read to scan Segments.
+	ReadBytes int64
+	// WriteBytes is the data rewritten for the live entries in Segments,
+	// including their index records.
+	WriteBytes int64
+}
+
+// PlanCompaction returns the segments a compaction would rewrite and its
+// expected cost, without modifying the database. The active segment,
+// segments held by a SegmentRef and segments holding chunks of live values
+// are never selected.
+func (db *DB) PlanCompaction() (CompactionPlan, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return CompactionPlan{}, ErrDatabaseClosed
+	}
+	return db.planCompaction()
+}
+
+// planCompaction is PlanCompaction for a caller holding db.mu.
+func (db *DB) planCompaction() (CompactionPlan, error) {
+	usage, liveKeys, err := db.segmentUsage()
+	if err != nil {
+		return CompactionPlan{}, err
+	}
+	var plan CompactionPlan
+	now := db.now()
+	for _, u := range usage[:len(usage)-1] {
+		if db.retainsTombstones(u.ID, now) {
+			u.LiveBytes += u.tombstoneBytes
+		}
+		if u.Size == 0 || u.DeadRatio() < db.opts.compactionRatio || u.chunks || db.segmentRefs[u.ID] > 0 {
+			continue
+		}
+		plan.Segments = append(plan.Segments, u)
+		plan.ReclaimableBytes += u.Size - u.LiveBytes
+		plan.ReadBytes += u.Size
+		plan.WriteBytes += u.LiveBytes + liveKeys[u.ID]*indexItemSize
+	}
+	return plan, nil
+}
+
+// retainsTombstones returns true if Compact keeps the tombstones of segment
+// id at now, as set by TombstoneRetentionOption. The caller must hold
+// db.mu.
+func (db *DB) retainsTombstones(id uint32, now time.Time) bool {
+	if db.opts.tombstoneRetention == 0 {
+		return false
+	}
+	sc, ok := db.manifest.sealed(id)
+	return ok && sc.Sealed.After(now.Add(-db.opts.tombstoneRetention))
+}
+
+// segmentUsage returns the usage of every segment, in order, and the number
+// of live keys in each. The caller must hold db.mu.
+func (db *DB) segmentUsage() ([]SegmentUsage, map[uint32]int64, error) {
+	usage := make([]SegmentUsage, len(db.segments))
+	index := make(map[uint32]int, len(db.segments))
+	for i, s := range db.segments {
+		usage[i] = SegmentUsage{ID: s.ID()}
+		if !s.offline() {
+			usage[i].Size = int64(s.Size()) - SegmentHeaderSize
+		}
+		index[s.ID()] = i
+	}
+	// Holes punched by PunchHoles take no space.
+	for _, sc := range db.manifest.Segments {
+		if i, ok := index[sc.ID]; ok && !sc.Detached {
+			usage[i].Size -= sc.Punched
+		}
+	}
+	liveKeys := make(map[uint32]int64, len(db.segments))
+	err := db.index.ForEach(func(_ uint64, it item) error {
+		i, ok := index[it.ID()]
+		if !ok {
+			return ErrSegmentNotFound
+		} else if db.segments[i].missing {
+			return nil
+		}
+		hdr, err := db.segments[i].ReadEntryHeader(it.Offset())
+		if err != nil {
+			return err
+		} else if hdr.Flag == EntryDeleteFlag {
+			usage[i].tombstoneBytes += int64(hdr.EntrySize())
+			return nil
+		}
+		usage[i].LiveBytes += int64(hdr.EntrySize())
+		liveKeys[it.ID()]++
+		if hdr.Attrs&format.AttrChunked == 0 {
+			return nil
+		}
+		return db.chunkUsage(db.segments[i], it.Offset(), func(ref format.ChunkRef, size int64) error {
+			j, ok := index[ref.Segment]
+			if !ok {
+				return ErrSegmentNotFound
+			}
+			usage[j].LiveBytes += size
+			usage[j].chunks = true
+			return nil
+		})
+	})
+	return usage, liveKeys, err
+}
+
+// chunkUsage calls fn with the reference and entry size of every chunk
+// listed by the entry at off in s. The caller must hold db.mu.
+func (db *DB) chunkUsage(s *segment, off uint32, fn func(ref format.ChunkRef, size int64) error) error {
+	e, err := s.ReadEntry(off)
+	if err != nil {
+		return err
+	} else if err := db.decrypt(&e); err != nil {
+		return err
+	} else if err := db.decompress(&e); err != nil {
+		return err
+	}
+	l, err := chunkList(&e)
+	if err != nil {
+		return err
+	}
+	for _, ref := range l.Chunks {
+		c := db.segment(ref.Segment)
+		if c == nil && db.segmentMissing(ref.Segment) {
+			continue
+		} else if c == nil {
+			return ErrSegmentNotFound
+		} else if c.detached {
+			continue
+		}
+		hdr, err := c.ReadEntryHeader(ref.Offset)
+		if err != nil {
+			return err
+		} else if err := fn(ref, int64(hdr.EntrySize())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compact reclaims the space held by overwritten entries, tombstones and
+// expired values in the sealed segments PlanCompaction selects. The live
+// entries of each segment are appended to the end of the log, as new
+// entries without audit records, and the segment file is then replaced by
+// an empty one; the segment keeps its id, and the manifest records how
+// many entries it held so sequence numbers don't change. Expired keys are
+// removed as by PurgeExpired, and tombstones are dropped, so deleted keys
+// read as ErrKeyNotFound, unless a segment is detached, which could bring
+// back the deleted values when attached, or TombstoneRetentionOption keeps
+// them for longer. Tombstones and expired values are also moved rather
+// than dropped while an older entry of their key survives in a segment not
+// being compacted, so that OpenAt doesn't bring it back. Finally the index
+// file is checkpointed, as by CheckpointIndex.
+//
+// Every entry moved is verified against its checksum first, and every
+// entry the index refers to against its key; CorruptEntryPolicyOption
+// sets what happens to a corrupt one, which by default fails the
+// compaction and leaves its segment as it was. The database is locked for
+// writes while Compact runs. Values returned by Get are copied out of the
+// segments, so they stay valid, but snapshots taken before it return
+// ErrWrittenAfterSnapshot for the keys it moved. Compact fails with the
+// Merkle log enabled, as it would break the inclusion proofs of the moved
+// entries.
+func (db *DB) Compact() error {
+	_, err := db.CompactWithProgress(nil)
+	return err
+}
+
+// CompactReport is the result of CompactWithProgress.
+type CompactReport struct {
+	// Segments is the number of segments emptied.
+	Segments int
+	// ReclaimedBytes is the space freed: the bytes the emptied segments
+	// held, less punched holes, and less RewrittenBytes.
+	ReclaimedBytes int64
+	// RewrittenBytes is the bytes of the entries moved to the end of the
+	// log.
+	RewrittenBytes int64
+	// Corrupt lists the entries left out as corrupt under CorruptEntryDrop
+	// or CorruptEntryQuarantine, segment by segment.
+	Corrupt []CorruptEntry
+	// Duration is how long the compaction took.
+	Duration time.Duration
+}
+
+// CompactWithProgress is Compact, also returning what it did. progress, if
+// not nil, is called after each segment with the bytes of the segments
+// compacted so far and in total, as PlanCompaction counts them in
+// ReadBytes. It is called with the database locked, so it must not use
+// the database. The report is returned on failure too, covering the
+// segments compacted before it.
+func (db *DB) CompactWithProgress(progress func(done, total int64)) (CompactReport, error) {
+	start := time.Now()
+	var c compaction
+	onExpire, err := db.compact(&c, progress)
+	if onExpire != nil {
+		for _, key := range c.expired {
+			onExpire(key)
+		}
+	}
+	c.report.Duration = time.Since(start)
+	return c.report, err
+}
+
+// compact does the work of Compact in c, returning the callback to notify
+// of the expired keys it removed.
+func (db *DB) compact(c *compaction, progress func(done, total int64)) (onExpire func(key []byte), err error) {
+	db.lockFor(lockWrite)
+	defer db.mu.Unlock()
+	if err := db.checkWritable(); err != nil {
+		return nil, err
+	} else if db.merkle != nil {
+		return nil, errors.New("segments can't be compacted with the merkle log enabled")
+	}
+	onExpire = db.opts.onExpire
+	plan, err := db.planCompaction()
+	if err != nil || len(plan.Segments) == 0 {
+		return onExpire, err
+	}
+	// Writes whose index records are appended but not yet published are
+	// only seen in the index file.
+	items, err := db.index.Persisted()
+	if err != nil {
+		return onExpire, err
+	}
+	masks, err := db.compactionMasks(plan, items)
+	if err != nil {
+		return onExpire, err
+	}
+	c.items, c.masks, c.records = items, masks, make(map[uint32]map[uint32]uint64)
+	c.now, c.keepTombstones = db.now(), db.manifest.detachedEntries() > 0
+	for _, u := range plan.Segments {
+		c.records[u.ID] = make(map[uint32]uint64)
+	}
+	for k, it := range items {
+		if r, ok := c.records[it.ID()]; ok {
+			r[it.Offset()] = k
+		}
+	}
+	var done int64
+	for _, u := range plan.Segments {
+		rewritten := c.report.RewrittenBytes
+		err := db.compactSegment(db.segment(u.ID), c)
+		if err != nil {
+			return onExpire, errors.Wrapf(err, "compact segment %s", segmentFilename(u.ID))
+		}
+		c.report.Segments++
+		c.report.ReclaimedBytes += u.Size - (c.report.RewrittenBytes - rewritten)
+		if done += u.Size; progress != nil {
+			progress(done, plan.ReadBytes)
+		}
+	}
+	return onExpire, db.degrade(db.index.Rewrite(c.items))
+}
+
+// compaction is the state of a Compact.
+type compaction struct {
+	items          map[uint64]item              // as returned by index.Persisted, kept up to date
+	masks          map[uint64]item              // as returned by compactionMasks
+	records        map[uint32]map[uint32]uint64 // keys of the items not yet found, by segment and offset
+	now            time.Time
+	keepTombstones bool
+	expired        [][]byte // decoded keys of the expired entries removed
+	report         CompactReport
+}
+
+// compactSegment moves the live entries of the sealed segment s to the end
+// of the log and empties s. The caller must hold db.mu.
+func (db *DB) compactSegment(s *segment, c *compaction) error {
+	var written []*segment
+	keepTombstones := c.keepTombstones || db.retainsTombstones(s.ID(), c.now)
+	for off := uint32(SegmentHeaderSize); off < s.Size(); {
+		e, err := s.ReadEntry(off)
+		if err != nil {
+			return err
+		}
+		k, it := db.opts.hashFunc(e.key), item{s.ID(), off}
+		off += e.Size()
+		mask := c.masks[k] == it
+		if e.hdr.Flag == EntryHoleFlag || (c.items[k] != it && !mask) {
+			continue
+		}
+		indexed := c.items[k] == it
+		if indexed {
+			delete(c.records[s.ID()], it.Offset())
+		}
+		if indexed && ((e.hdr.Flag == EntryDeleteFlag && !keepTombstones && !mask) || (e.expired(c.now) && !db.manifest.pinned(k))) {
+			if err := db.removeKey(k); err != nil {
+				return db.degrade(err)
+			}
+			delete(c.items, k)
+			if e.hdr.Flag == EntryInsertFlag {
+				c.expired = append(c.expired, append([]byte(nil), db.decodeKey(e.key)...))
+			}
+			if !mask {
+				continue
+			}
+			indexed = false
+		}
+		if e.hdr.Checksum != crc32.Checksum(e.value, CastagnoliCrcTable) {
+			atomic.AddInt64(&db.stats.checksums, 1)
+			err := errors.Wrapf(ErrChecksumFailed, "entry at offset %d", it.Offset())
+			if err := db.corruptEntry(s, it.Offset(), k, indexed, c, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if e, err = db.standalone(e); err != nil {
+			return err
+		}
+		moved, err := db.copyEntry(e)
+		if err != nil {
+			return err
+		}
+		c.report.RewrittenBytes += int64(e.Size())
+		if indexed {
+			if err := db.index.Insert(k, moved.ID(), moved.Offset()); err != nil {
+				return db.degrade(err)
+			}
+			atomic.AddInt64(&db.stats.physicalBytes, indexItemSize)
+			c.items[k] = moved
+		}
+		if n := len(written); n == 0 || written[n-1].ID() != moved.ID() {
+			written = append(written, db.segment(moved.ID()))
+		}
+	}
+	// Index records left refer to entries whose keys were damaged.
+	var lost []uint32
+	for off := range c.records[s.ID()] {
+		lost = append(lost, off)
+	}
+	sort.Slice(lost, func(i, j int) bool { return lost[i] < lost[j] })
+	for _, off := range lost {
+		err := errors.Wrapf(ErrKeyMismatch, "entry at offset %d", off)
+		if err := db.corruptEntry(s, off, c.records[s.ID()][off], true, c, err); err != nil {
+			return err
+		}
+	}
+
+	// The moved entries must be durable before the originals are gone.
+	for _, w := range written {
+		if err := db.flushSegment(w); err != nil {
+			return err
+		}
+	}
+	if len(written) == 0 {
+		if err := db.index.Flush(); err != nil {
+			return db.degrade(err)
+		}
+	}
+
+	// The manifest records the compaction, and Open finishes it if the
+	// segment file wasn't replaced yet.
+	db.manifest.Reclaimed = db.watermark()
+	for i := range db.manifest.Segments {
+		if sc := &db.manifest.Segments[i]; sc.ID == s.ID() {
+			sc.Compacted += s.stats.Entries
+			sc.Entries, sc.Tombstones = 0, 0
+			sc.Size, sc.Checksum = emptySegmentChecksum()
+		}
+	}
+	if err := db.saveManifest(); err != nil {
+		return err
+	}
+	reclaimed := s.Size() - SegmentHeaderSize
+	if err := db.emptySegment(s); err != nil {
+		return err
+	}
+	atomic.AddInt64(&db.stats.compactions, 1)
+	atomic.AddInt64(&db.stats.reclaimed, int64(reclaimed))
+	atomic.StoreInt64(&db.stats.lastCompaction, db.now().UnixNano())
+	db.event(EventCompaction, fmt.Sprintf("compacted segment %d, reclaiming %d bytes", s.ID(), reclaimed), s.path, nil)
+	return nil
+}
+
+// copyEntry appends a copy of e to the log and returns where it was
+// written. The caller must hold db.mu.
+func (db *DB) copyEntry(e entry) (it item, err error) {
+	defer func() { db.degrade(err) }()
+	segment, err := db.appendToLog(e)
+	if err != nil {
+		return item{}, err
+	}
+	atomic.AddInt64(&db.stats.physicalBytes, int64(e.Size()))
+	db.seq++
+	return item{segment.ID(), segment.Size() - e.Size()}, nil
+}
+
+// CorruptEntryPolicy decides what Compact does with a corrupt entry, for
+// CorruptEntryPolicyOption.
+type CorruptEntryPolicy int
+
+const (
+	// CorruptEntryFail fails the compaction, leaving the segment of the
+	// entry as it was.
+	CorruptEntryFail CorruptEntryPolicy = iota
+	// CorruptEntryDrop leaves the entry out of the compacted segment and
+	// raises a Warning. A key whose current entry it was reads as
+	// ErrKeyNotFound.
+	CorruptEntryDrop
+	// CorruptEntryQuarantine is CorruptEntryDrop, but first writes the
+	// bytes of the entry to a file in QuarantineDir named after its
+	// segment and offset, as listed in the quarantine report.
+	CorruptEntryQuarantine
+)
+
+// corruptEntry applies CorruptEntryPolicyOption to the entry at off in s,
+// which failed its check with cause while s was compacted. current is set
+// if the index refers to it for the key hashing to k. The caller must
+// hold db.mu for writing.
+func (db *DB) corruptEntry(s *segment, off uint32, k uint64, current bool, c *compaction, cause error) error {
+	switch db.opts.corruptEntries {
+	case CorruptEntryFail:
+		return cause
+	case CorruptEntryQuarantine:
+		if err := db.quarantineEntry(s, off, cause); err != nil {
+			return errors.Wrap(err, "quarantine corrupt entry")
+		}
+	}
+	if current {
+		if err := db.removeKey(k); err != nil {
+			return db.degrade(err)
+		}
+		delete(c.items, k)
+	}
+	c.report.Corrupt = append(c.report.Corrupt, CorruptEntry{Segment: s.ID(), Offset: off, Err: cause})
+	db.warn(Warning{Op: "drop corrupt entry", Path: s.path, Err: cause})
+	return nil
+}
+
+// quarantineEntry copies the bytes of the entry at off in s, as far as its
+// header tells, to the quarantine directory. The caller must hold db.mu.
+func (db *DB) quarantineEntry(s *segment, off uint32, cause error) error {
+	n := uint32(EntryHeaderSize)
+	if hdr, err := s.ReadEntryHeader(off); err == nil {
+		n = hdr.EntrySize()
+	}
+	if off+n > s.Size() || off+n < off {
+		n = s.Size() - off
+	}
+	data, err := s.mmap.ReadOff(int(off), int(n))
+	if err != nil {
+		return err
+	}
+	return quarantineData(db.path, fmt.Sprintf("%s.%d", segmentFilename(s.ID()), off), data, cause)
+}
+
+// standalone returns e, read from a segment, with its value re-encoded if
+// it refers to another entry of the segment, which doesn't survive the
+// compaction: deltas are stored in full and values compressed with the
+// segment dictionary are compressed without. The caller must hold db.mu.
+func (db *DB) standalone(e entry) (entry, error) {
+	if !segmentLocal(e) {
+		return e, nil
+	} else if err := db.decodeValue(&e); err != nil {
+		return entry{}, err
+	}
+	stored, f, attrs, err := db.encodeValue(e.hdr.Flag, e.key, e.data, nil, nil)
+	if err != nil {
+		return entry{}, err
+	}
+	attrs |= e.hdr.Attrs & (format.AttrExpires | format.AttrPrev | format.AttrPrevWide)
+	f.Expires, f.PrevSegment, f.PrevOffset = e.expires, e.prev.ID(), e.prev.Offset()
+	re := createEntryWithFields(e.hdr.Flag, e.key, stored, attrs, f)
+	re.hdr.Tag = e.hdr.Tag
+	return re, nil
+}
+
+// compactionMasks returns, by key, the tombstones and values with an expiry
+// time in the segments of plan that must be kept although they are
+// current or dead, because an older entry of their key survives in a
+// segment outside plan: OpenAt, which rebuilds the index from the log,
+// would bring that entry back. Only the newest such entry of a key in plan
+// is a mask. Finding the older entries takes a scan of the keys of the
+// segments before the masks, so it is skipped when there are no
+// candidates. The caller must hold db.mu.
+func (db *DB) compactionMasks(plan CompactionPlan, items map[uint64]item) (map[uint64]item, error) {
+	compacted := make(map[uint32]bool, len(plan.Segments))
+	candidates := make(map[uint64]item)
+	for _, u := range plan.Segments {
+		compacted[u.ID] = true
+		s := db.segment(u.ID)
+		if err := s.forEachKey(s.Size(), func(off uint32, hdr EntryHeader, key []byte) error {
+			if hdr.Flag != EntryDeleteFlag && hdr.Attrs&format.AttrExpires == 0 {
+				return nil
+			}
+			k, it := db.opts.hashFunc(key), item{s.ID(), off}
+			// Only the current entry of a key, or any of a removed key,
+			// can hide older ones.
+			if cur, ok := items[k]; ok && cur != it {
+				return nil
+			} else if prev, ok := candidates[k]; !ok || prev.before(it) {
+				candidates[k] = it
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	masks := make(map[uint64]item)
+	if len(candidates) == 0 {
+		return masks, nil
+	}
+	last := plan.Segments[len(plan.Segments)-1].ID
+	for _, s := range db.segments {
+		if s.ID() >= last {
+			break
+		} else if compacted[s.ID()] || s.offline() {
+			continue
+		}
+		if err := s.sequentially(func() error {
+			return s.forEachKey(s.Size(), func(off uint32, _ EntryHeader, key []byte) error {
+				k := db.opts.hashFunc(key)
+				if it, ok := candidates[k]; ok && s.ID() < it.ID() {
+					masks[k] = it
+				}
+				return nil
+			})
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return masks, nil
+}
+
+// emptySegment replaces the file of the compacted segment s with one
+// holding only a segment header. The caller must hold db.mu.
+func (db *DB) emptySegment(s *segment) error {
+	db.opts.env.release(s.MappedSize())
+	// Windows can't rename over a mapped file.
+	if err := s.Close(); err != nil {
+		return err
+	}
+	tmp := s.path + ".initializing"
+	if err := writeEmptySegmentFile(tmp); err != nil {
+		return err
+	} else if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	es, err := db.openSegment(s.ID(), s.path)
+	if err != nil {
+		return err
+	}
+	db.segments[s.ID()] = es
+	return nil
+}
+
+// writeEmptySegmentFile writes a segment file holding only a header at
+// path.
+func writeEmptySegmentFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hdr := newSegmentHeader()
+	if _, err := hdr.WriteTo(f); err != nil {
+		return err
+	} else if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// emptySegmentChecksum returns the size and checksum of a segment holding
+// only a header.
+func emptySegmentChecksum() (uint32, uint32) {
+	var buf bytes.Buffer
+	hdr := newSegmentHeader()
+	hdr.WriteTo(&buf)
+	return uint32(buf.Len()), crc32.Checksum(buf.Bytes(), CastagnoliCrcTable)
+}
+
+// finishCompactions empties the segments whose compaction was recorded in
+// the manifest but interrupted before their file was replaced. The caller
+// must hold db.mu.
+func (db *DB) finishCompactions() error {
+	for _, sc := range db.manifest.Segments {
+		s := db.segment(sc.ID)
+		if sc.Compacted == 0 || sc.Detached || s == nil || s.MappedSize() == int64(sc.Size) {
+			continue
+		}
+		if err := db.emptySegment(s); err != nil {
+			return err
+		}
+		db.event(EventRecovery, "finished interrupted compaction", s.path, nil)
+	}
+	return nil
+}
+
+// autoCompact compacts the database if PlanCompaction selects any segment.
+func (db *DB) autoCompact() error {
+	plan, err := db.PlanCompaction()
+	if err != nil || len(plan.Segments) == 0 {
+		return err
+	}
+	return db.Compact()
+}
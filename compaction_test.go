@@ -0,0 +1,398 @@
+package archivedb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// mustRollover forces db to start a new active segment.
+func mustRollover(t testing.TB, db *DB) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, err := db.createSegment(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDB_PlanCompaction(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+
+	for i := 0; i < 4; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value")))
+	}
+	mustRollover(t, db)
+	for i := 0; i < 3; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value")))
+	}
+	mustRollover(t, db)
+
+	plan, err := db.PlanCompaction()
+	require.NoError(err)
+	entrySize := int64(EntryHeaderSize + 4 + 5)
+	require.Equal([]SegmentUsage{{ID: 0, Size: 4 * entrySize, LiveBytes: entrySize}}, plan.Segments)
+	require.Equal(3*entrySize, plan.ReclaimableBytes)
+	require.Equal(4*entrySize, plan.ReadBytes)
+	require.Equal(entrySize+indexItemSize, plan.WriteBytes)
+	require.Equal(0.75, plan.Segments[0].DeadRatio())
+
+	require.NoError(db.Delete([]byte("key0")))
+	require.NoError(db.Delete([]byte("key1")))
+	plan, err = db.PlanCompaction()
+	require.NoError(err)
+	require.Len(plan.Segments, 2)
+}
+
+func TestDB_CompactKeepsValuesValid(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir, CompactionRatioOption(0.1))
+	require.NoError(err)
+	defer db.Close()
+
+	require.NoError(db.Put([]byte("live"), []byte("value")))
+	require.NoError(db.Put([]byte("dead"), []byte("old")))
+	mustRollover(t, db)
+	require.NoError(db.Put([]byte("dead"), []byte("new")))
+	v, err := db.Get([]byte("live"))
+	require.NoError(err)
+	require.NoError(db.Compact())
+
+	// The segment v was read from is unmapped.
+	require.Equal(int64(SegmentHeaderSize), db.segments[0].MappedSize())
+	require.Equal("value", string(v))
+}
+
+func TestDB_Compact(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	clock := newFakeClock()
+	var expired []string
+	db, err := Open(dir, ClockOption(clock), CompactionRatioOption(0.1), OnExpireOption(func(key []byte) {
+		expired = append(expired, string(key))
+	}))
+	require.NoError(err)
+	defer db.Close()
+
+	require.NoError(db.Put([]byte("live"), []byte("1")))
+	require.NoError(db.PutTagged([]byte("tagged"), []byte("2"), 7))
+	require.NoError(db.Put([]byte("overwritten"), []byte("old")))
+	require.NoError(db.Put([]byte("deleted"), []byte("3")))
+	require.NoError(db.Delete([]byte("deleted")))
+	require.NoError(db.PutWithTTL([]byte("expired"), []byte("4"), time.Second))
+	require.NoError(db.PutWithTTL([]byte("pinned"), []byte("5"), time.Second))
+	require.NoError(db.PutWithTTL([]byte("ttl"), []byte("6"), time.Hour))
+	require.NoError(db.Pin([]byte("pinned")))
+	mustRollover(t, db)
+	require.NoError(db.Put([]byte("overwritten"), []byte("new")))
+	clock.Add(time.Second)
+
+	plan, err := db.PlanCompaction()
+	require.NoError(err)
+	require.Len(plan.Segments, 1)
+	seq := db.Seq()
+	require.NoError(db.Compact())
+	require.Equal([]string{"expired"}, expired)
+	// live, tagged, pinned and ttl are moved.
+	require.Equal(seq+4, db.Seq())
+
+	check := func(db *DB) {
+		for key, want := range map[string]string{"live": "1", "tagged": "2", "overwritten": "new"} {
+			v, err := db.Get([]byte(key))
+			require.NoError(err, key)
+			require.Equal(want, string(v), key)
+		}
+		_, err := db.Get([]byte("deleted"))
+		require.ErrorIs(err, ErrKeyNotFound)
+		_, err = db.Get([]byte("expired"))
+		require.ErrorIs(err, ErrKeyNotFound)
+		_, err = db.Get([]byte("pinned"))
+		require.ErrorIs(err, ErrKeyExpired)
+		var keys []string
+		require.NoError(db.LookupTag(7, func(key, _ []byte) error {
+			keys = append(keys, string(key))
+			return nil
+		}))
+		require.Equal([]string{"tagged"}, keys)
+		fi, err := os.Stat(db.segment(0).path)
+		require.NoError(err)
+		require.Equal(int64(SegmentHeaderSize), fi.Size())
+	}
+	check(db)
+	v, err := db.Get([]byte("ttl"))
+	require.NoError(err)
+	require.Equal([]byte("6"), v)
+	plan, err = db.PlanCompaction()
+	require.NoError(err)
+	require.Empty(plan.Segments)
+	require.NoError(db.VerifyBackups(dir))
+	var raw []uint64
+	require.NoError(db.ForEachRaw(EntryFilter{}, func(e RawEntry) error {
+		raw = append(raw, e.Seq)
+		return nil
+	}))
+	require.Equal([]uint64{seq, seq + 1, seq + 2, seq + 3, seq + 4}, raw)
+	events := db.Events()
+	require.Equal(EventCompaction, events[len(events)-1].Kind)
+
+	require.NoError(db.Close())
+	db, err = Open(dir, ClockOption(clock))
+	require.NoError(err)
+	defer db.Close()
+	check(db)
+	require.Equal(seq+4, db.Seq())
+
+	// The TTL of a moved entry still applies.
+	clock.Add(time.Hour)
+	_, err = db.Get([]byte("ttl"))
+	require.ErrorIs(err, ErrKeyExpired)
+}
+
+// TestDB_Compact_Keep checks compaction keeps tombstones while a segment is
+// detached, and refuses to run with the Merkle log on.
+func TestDB_Compact_Keep(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+
+	require.NoError(db.Put([]byte("foo"), []byte("bar")))
+	mustRollover(t, db)
+	require.NoError(db.Delete([]byte("foo")))
+	require.NoError(db.Put([]byte("baz"), []byte("1")))
+	require.NoError(db.Put([]byte("baz"), []byte("2")))
+	mustRollover(t, db)
+	require.NoError(db.DetachSegment(0))
+	require.NoError(db.Compact())
+	_, err = db.Get([]byte("foo"))
+	require.ErrorIs(err, ErrKeyDeleted)
+	require.NoError(db.AttachSegment(0))
+	_, err = db.Get([]byte("foo"))
+	require.ErrorIs(err, ErrKeyDeleted)
+	require.NoError(db.Close())
+
+	dir2, cleanup2 := MustTempDir()
+	defer cleanup2()
+	db, err = Open(dir2, MerkleLogOption(true))
+	require.NoError(err)
+	defer db.Close()
+	require.Error(db.Compact())
+}
+
+// TestDB_Compact_Interrupted checks Open finishes a compaction recorded in
+// the manifest whose segment file wasn't replaced.
+func TestDB_Compact_Interrupted(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	require.NoError(db.Put([]byte("foo"), []byte("bar")))
+	mustRollover(t, db)
+	require.NoError(db.Put([]byte("foo"), []byte("baz")))
+	seq := db.Seq()
+	db.mu.Lock()
+	sc := &db.manifest.Segments[0]
+	sc.Compacted, sc.Entries = 1, 0
+	sc.Size, sc.Checksum = emptySegmentChecksum()
+	require.NoError(db.saveManifest())
+	db.mu.Unlock()
+	require.NoError(db.Close())
+
+	db, err = Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	require.Equal(seq, db.Seq())
+	require.Equal(int64(1), db.RecoveryReport().Entries)
+	require.Equal(uint32(SegmentHeaderSize), db.segment(0).Size())
+	v, err := db.Get([]byte("foo"))
+	require.NoError(err)
+	require.Equal([]byte("baz"), v)
+	require.NoError(db.VerifyBackups(dir))
+}
+
+func TestDB_Compact_Follower(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	require.NoError(db.Put([]byte("foo"), []byte("bar")))
+	require.NoError(db.Put([]byte("old"), []byte("1")))
+	mustRollover(t, db)
+	require.NoError(db.Put([]byte("old"), []byte("2")))
+
+	follower, err := Open(dir, FollowerOption(0))
+	require.NoError(err)
+	defer follower.Close()
+	require.NoError(db.Compact())
+	require.NoError(db.Put([]byte("new"), []byte("3")))
+	require.NoError(follower.Refresh())
+	for key, want := range map[string]string{"foo": "bar", "old": "2", "new": "3"} {
+		v, err := follower.Get([]byte(key))
+		require.NoError(err, key)
+		require.Equal(want, string(v), key)
+	}
+}
+
+func TestAutoCompactOption(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir, AutoCompactOption(time.Millisecond))
+	require.NoError(err)
+	defer db.Close()
+	require.ErrorIs(db.SetOption(AutoCompactOption(time.Hour)), ErrImmutableOption)
+
+	require.NoError(db.Put([]byte("foo"), []byte("bar")))
+	mustRollover(t, db)
+	require.NoError(db.Put([]byte("foo"), []byte("baz")))
+	require.Eventually(func() bool {
+		plan, err := db.PlanCompaction()
+		return err == nil && len(plan.Segments) == 0
+	}, 5*time.Second, time.Millisecond)
+	v, err := db.Get([]byte("foo"))
+	require.NoError(err)
+	require.Equal([]byte("baz"), v)
+}
+
+func TestTombstoneRetentionOption(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	clock := newFakeClock()
+	db, err := Open(dir, ClockOption(clock), CompactionRatioOption(0.1), TombstoneRetentionOption(time.Hour))
+	require.NoError(err)
+	defer db.Close()
+	seal := func() {
+		_, err := db.SealActiveSegment()
+		require.NoError(err)
+	}
+
+	require.NoError(db.Put([]byte("a"), make([]byte, 100)))
+	require.NoError(db.Delete([]byte("a")))
+	seal()
+	// Kept while its segment is younger than the retention.
+	require.NoError(db.Compact())
+	_, err = db.Get([]byte("a"))
+	require.ErrorIs(err, ErrKeyDeleted)
+
+	// The segment it was moved to isn't worth compacting until it is
+	// older, and then it is dropped.
+	seal()
+	clock.Add(30 * time.Minute)
+	plan, err := db.PlanCompaction()
+	require.NoError(err)
+	require.Empty(plan.Segments)
+	clock.Add(time.Hour)
+	plan, err = db.PlanCompaction()
+	require.NoError(err)
+	require.Len(plan.Segments, 1)
+	require.NoError(db.Compact())
+	_, err = db.Get([]byte("a"))
+	require.ErrorIs(err, ErrKeyNotFound)
+
+	require.Error(db.SetOption(TombstoneRetentionOption(-1)))
+}
+
+func TestCorruptEntryPolicyOption(t *testing.T) {
+	fooSize := EntryHeaderSize + 3 + 3
+	for _, tt := range []struct {
+		policy CorruptEntryPolicy
+		err    error
+	}{
+		{CorruptEntryFail, ErrChecksumFailed},
+		{CorruptEntryDrop, nil},
+		{CorruptEntryQuarantine, nil},
+	} {
+		t.Run(fmt.Sprint(tt.policy), func(t *testing.T) {
+			require := require.New(t)
+			dir, cleanup := MustTempDir()
+			defer cleanup()
+			db, err := Open(dir)
+			require.NoError(err)
+			require.NoError(db.Put([]byte("foo"), []byte("bar")))
+			require.NoError(db.Put([]byte("baz"), []byte("qux")))
+			require.NoError(db.Put([]byte("old"), []byte("v1")))
+			require.NoError(db.Put([]byte("old"), []byte("v2")))
+			require.NoError(db.Close())
+
+			// Damage the value of foo and the key of baz.
+			f, err := os.OpenFile(filepath.Join(dir, segmentFilename(0)), os.O_RDWR, 0)
+			require.NoError(err)
+			_, err = f.WriteAt([]byte("!"), SegmentHeaderSize+EntryHeaderSize+3)
+			require.NoError(err)
+			_, err = f.WriteAt([]byte("!"), int64(SegmentHeaderSize+fooSize+EntryHeaderSize))
+			require.NoError(err)
+			require.NoError(f.Close())
+
+			var warnings []Warning
+			db, err = Open(dir, CompactionRatioOption(0.1), CorruptEntryPolicyOption(tt.policy),
+				WarningHandlerOption(func(w Warning) { warnings = append(warnings, w) }))
+			require.NoError(err)
+			defer db.Close()
+			mustRollover(t, db)
+			var progress [][2]int64
+			report, err := db.CompactWithProgress(func(done, total int64) {
+				progress = append(progress, [2]int64{done, total})
+			})
+			if tt.err != nil {
+				require.ErrorIs(err, tt.err)
+				plan, err := db.PlanCompaction()
+				require.NoError(err)
+				require.Len(plan.Segments, 1)
+				return
+			}
+			require.NoError(err)
+			require.Len(warnings, 2)
+			require.ErrorIs(warnings[0].Err, ErrChecksumFailed)
+			require.ErrorIs(warnings[1].Err, ErrKeyMismatch)
+			require.Equal(1, report.Segments)
+			require.Equal([]CorruptEntry{
+				{Segment: 0, Offset: SegmentHeaderSize, Err: warnings[0].Err},
+				{Segment: 0, Offset: uint32(SegmentHeaderSize + fooSize), Err: warnings[1].Err},
+			}, report.Corrupt)
+			// Only v2 of old was moved.
+			oldSize := int64(EntryHeaderSize + 3 + 2)
+			size := int64(2*fooSize) + 2*oldSize
+			require.Equal(oldSize, report.RewrittenBytes)
+			require.Equal(size-oldSize, report.ReclaimedBytes)
+			require.Equal([][2]int64{{size, size}}, progress)
+			for _, key := range []string{"foo", "baz"} {
+				_, err = db.Get([]byte(key))
+				require.ErrorIs(err, ErrKeyNotFound)
+			}
+			v, err := db.Get([]byte("old"))
+			require.NoError(err)
+			require.Equal([]byte("v2"), v)
+
+			files, err := ioutil.ReadDir(filepath.Join(dir, QuarantineDir))
+			if tt.policy == CorruptEntryDrop {
+				require.True(os.IsNotExist(err))
+				return
+			}
+			require.NoError(err)
+			require.Len(files, 3)
+			foo, err := ioutil.ReadFile(filepath.Join(dir, QuarantineDir, fmt.Sprintf("%s.%d", segmentFilename(0), SegmentHeaderSize)))
+			require.NoError(err)
+			require.Len(foo, fooSize)
+			require.Equal("foo!ar", string(foo[EntryHeaderSize:]))
+		})
+	}
+	require.Error(t, CorruptEntryPolicyOption(CorruptEntryQuarantine+1)(&option{}))
+}
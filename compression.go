@@ -0,0 +1,110 @@
+package archivedb
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+
+	"github.com/millken/archivedb/format"
+	"github.com/pkg/errors"
+)
+
+// MaxCodecID is the largest codec id an entry can record.
+const MaxCodecID = format.AttrCodecMask >> format.AttrCodecShift
+
+// ErrUnknownCodec is returned when reading a value compressed with a codec
+// the database isn't configured with.
+var ErrUnknownCodec = errors.New("unknown compression codec")
+
+// Codec compresses values for CompressionOption. Its id, from 1 to
+// MaxCodecID, is recorded in every entry it compressed, so it must never
+// change; ids below 4 are reserved for codecs of this package.
+type Codec interface {
+	ID() uint8
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+}
+
+// DeflateCodec compresses with DEFLATE at its fastest level. It needs no
+// configuration to be read.
+var DeflateCodec Codec = deflateCodec{}
+
+type deflateCodec struct{}
+
+func (deflateCodec) ID() uint8 { return 1 }
+
+func (deflateCodec) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	} else if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (deflateCodec) Decompress(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// compress returns what to store for value and the id of the codec that
+// compressed it, or value and zero if compression is off, value is under
+// the threshold or compressing it didn't make it smaller. DeflateCodec
+// compresses with dict, the dictionary of a segment, unless it is nil.
+func (db *DB) compress(value, dict []byte) ([]byte, uint8, error) {
+	codec := db.opts.codec
+	if codec == nil || len(value) < db.opts.compressThreshold {
+		return value, 0, nil
+	} else if dict != nil && codec == DeflateCodec {
+		codec = dictionaryCodec{dict}
+	}
+	b, err := codec.Compress(value)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "compress value")
+	} else if len(b) >= len(value) {
+		return value, 0, nil
+	}
+	return b, codec.ID(), nil
+}
+
+// segmentLocal returns true if the value of e, as read from a segment,
+// refers to another entry of the segment: it is a delta or compressed
+// with the segment dictionary.
+func segmentLocal(e entry) bool {
+	id := e.hdr.Codec()
+	return id == deltaCodecID || id == dictionaryCodecID
+}
+
+// decompress replaces the data of e, read from a segment, with the value
+// it was written with.
+func (db *DB) decompress(e *entry) error {
+	id := e.hdr.Codec()
+	if id == 0 {
+		return nil
+	} else if id == deltaCodecID {
+		return db.undelta(e)
+	} else if id == dictionaryCodecID {
+		return db.undictionary(e)
+	}
+	var codec Codec
+	switch {
+	case db.opts.codec != nil && db.opts.codec.ID() == id:
+		codec = db.opts.codec
+	case id == DeflateCodec.ID():
+		codec = DeflateCodec
+	default:
+		return errors.Wrapf(ErrUnknownCodec, "id %d", id)
+	}
+	data, err := codec.Decompress(e.data)
+	if err != nil {
+		return errors.Wrapf(err, "decompress value with codec %d", id)
+	}
+	e.data = data
+	return nil
+}
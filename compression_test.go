@@ -0,0 +1,176 @@
+package archivedb
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// xorCodec is a test codec that flips every byte and drops a trailing
+// zero, so it always shrinks values ending in one.
+type xorCodec struct{}
+
+func (xorCodec) ID() uint8 { return 4 }
+
+func (xorCodec) Compress(src []byte) ([]byte, error) {
+	b := make([]byte, 0, len(src))
+	for _, c := range bytes.TrimSuffix(src, []byte{0}) {
+		b = append(b, ^c)
+	}
+	return b, nil
+}
+
+func (xorCodec) Decompress(src []byte) ([]byte, error) {
+	b := make([]byte, 0, len(src)+1)
+	for _, c := range src {
+		b = append(b, ^c)
+	}
+	return append(b, 0), nil
+}
+
+func TestCompressionOption(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir, CompressionOption(DeflateCodec, 64))
+	require.NoError(err)
+	defer db.Close()
+
+	big := bytes.Repeat([]byte("archive"), 100)
+	require.NoError(db.Put([]byte("big"), big))
+	require.NoError(db.Put([]byte("small"), []byte("tiny")))
+	require.NoError(db.SetOption(CompressionOption(xorCodec{}, 1)))
+	require.NoError(db.Put([]byte("xor"), []byte{1, 2, 0}))
+	require.NoError(db.Put([]byte("plain"), []byte{1, 2, 3}))
+
+	codecs := make(map[string]uint8)
+	require.NoError(db.ForEachRaw(EntryFilter{}, func(e RawEntry) error {
+		codecs[string(e.Key)] = e.Header.Codec()
+		return nil
+	}))
+	require.Equal(map[string]uint8{"big": 1, "small": 0, "xor": 4, "plain": 0}, codecs)
+	stats := db.Stats()
+	require.Less(stats.PhysicalBytes, stats.LogicalBytes)
+
+	check := func() {
+		for key, want := range map[string][]byte{"big": big, "small": []byte("tiny"), "xor": {1, 2, 0}} {
+			v, err := db.Get([]byte(key))
+			require.NoError(err)
+			require.Equal(want, v)
+		}
+		values, err := db.GetPrefix([]byte("big"), 1)
+		require.NoError(err)
+		require.Equal(big, values["big"])
+	}
+	check()
+
+	// Deflated values stay readable with compression off, values of other
+	// codecs don't.
+	require.NoError(db.Close())
+	db, err = Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	v, err := db.Get([]byte("big"))
+	require.NoError(err)
+	require.Equal(big, v)
+	_, err = db.Get([]byte("xor"))
+	require.ErrorIs(err, ErrUnknownCodec)
+	require.NoError(db.SetOption(CompressionOption(xorCodec{}, 1)))
+	check()
+
+	require.Error(db.SetOption(CompressionOption(DeflateCodec, -1)))
+	require.Error(db.SetOption(CompressionOption(badCodec{}, 0)))
+	require.Error(db.SetOption(CompressionOption(dictionaryCodec{}, 0)))
+}
+
+type badCodec struct{ xorCodec }
+
+func (badCodec) ID() uint8 { return MaxCodecID + 1 }
+
+func TestSegmentDictionaryOption(t *testing.T) {
+	for name, extra := range map[string][]Option{
+		"plain":     nil,
+		"encrypted": {EncryptionOption(bytes.Repeat([]byte("k"), 32))},
+	} {
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+			dir, cleanup := MustTempDir()
+			defer cleanup()
+			opts := append(extra, CompressionOption(DeflateCodec, 64), SegmentDictionaryOption(4096), CompactionRatioOption(0.1))
+			db, err := Open(dir, opts...)
+			require.NoError(err)
+			defer func() { db.Close() }()
+
+			event := func(i int) []byte {
+				return []byte(fmt.Sprintf(`{"type":"page_view","user":"user-%d","path":"/products/%d","referrer":"https://example.com/search?q=shoes","agent":"Mozilla/5.0 (X11; Linux x86_64)"}`, i, i%37))
+			}
+			values := make(map[string][]byte)
+			put := func(prefix string, from, to int) {
+				for i := from; i < to; i++ {
+					key := fmt.Sprintf("%s%04d", prefix, i)
+					values[key] = event(i)
+					require.NoError(db.Put([]byte(key), values[key]))
+				}
+			}
+			check := func() {
+				for key, want := range values {
+					v, err := db.Get([]byte(key))
+					require.NoError(err, key)
+					require.Equal(want, v, key)
+				}
+			}
+			put("e", 0, 100)
+			mustRollover(t, db)
+			put("f", 0, 600)
+
+			// The values of the second segment are compressed with a
+			// dictionary trained from those of the first, but for the
+			// first value, which was encoded before the dictionary.
+			sizes, counts := make(map[uint32]int), make(map[uint32]int)
+			require.NoError(db.ForEachRaw(EntryFilter{}, func(e RawEntry) error {
+				sizes[e.Segment] += int(e.Header.ValueSize)
+				counts[e.Segment]++
+				if e.Segment == 1 && string(e.Key) != "f0000" {
+					require.Equal(uint8(dictionaryCodecID), e.Header.Codec(), string(e.Key))
+				} else {
+					require.NotEqual(uint8(dictionaryCodecID), e.Header.Codec(), string(e.Key))
+				}
+				return nil
+			}))
+			require.Less(sizes[1]/counts[1], sizes[0]/counts[0]/2)
+			check()
+
+			// The dictionary is read from the segment without the option.
+			require.NoError(db.Close())
+			db, err = Open(dir, extra...)
+			require.NoError(err)
+			check()
+			require.NoError(db.Close())
+			db, err = Open(dir, opts...)
+			require.NoError(err)
+
+			// PunchHoles keeps the dictionary of live values.
+			put("f", 0, 500)
+			mustRollover(t, db)
+			mustPunchHoles(t, db)
+			require.NoError(db.Close())
+			db, err = Open(dir, opts...)
+			require.NoError(err)
+			check()
+
+			// Compact moves values out of the segment of their dictionary.
+			put("f", 0, 500)
+			mustRollover(t, db)
+			require.NoError(db.Compact())
+			check()
+			require.NoError(db.ForEachRaw(EntryFilter{}, func(e RawEntry) error {
+				if e.Segment == 1 {
+					return fmt.Errorf("segment 1 not compacted")
+				}
+				return nil
+			}))
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package archivedb
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// lockOp identifies the operation acquiring the database lock.
+type lockOp int
+
+const (
+	lockGet   lockOp = iota // Get
+	lockWrite               // Put and Delete appending an entry
+	lockSync                // Put and Delete syncing with fsync on
+	numLockOps
+)
+
+var lockOpNames = [numLockOps]string{"get", "write", "sync"}
+
+// LockWaits describes the sampled waits for the database lock by one kind
+// of operation.
+type LockWaits struct {
+	// Acquisitions is how often the operation took the lock.
+	Acquisitions int64
+	// Samples is how many of those acquisitions were timed.
+	Samples int64
+	// Total is the time the sampled acquisitions spent waiting.
+	Total time.Duration
+	// Max is the longest sampled wait.
+	Max time.Duration
+}
+
+// Mean returns the average sampled wait, or 0 if nothing was sampled.
+func (w LockWaits) Mean() time.Duration {
+	if w.Samples == 0 {
+		return 0
+	}
+	return w.Total / time.Duration(w.Samples)
+}
+
+// ContentionProfile holds the lock waits sampled since the database was
+// opened with ContentionProfileOption, by operation: "get", "write" and
+// "sync". A mean wait that is large next to the operation's own latency
+// means the workload is bound by the database lock.
+type ContentionProfile struct {
+	// SampleRate is the rate set by ContentionProfileOption; zero when
+	// profiling is off.
+	SampleRate int
+	Ops        map[string]LockWaits
+}
+
+// lockWaits holds the counters behind LockWaits, updated atomically. It is
+// allocated separately from DB to keep the counters 64-bit aligned.
+type lockWaits struct {
+	acquisitions int64
+	samples      int64
+	total        int64
+	max          int64
+}
+
+// ContentionProfile returns the lock waits sampled so far.
+func (db *DB) ContentionProfile() ContentionProfile {
+	p := ContentionProfile{
+		SampleRate: db.opts.contentionRate,
+		Ops:        make(map[string]LockWaits),
+	}
+	if db.contention == nil {
+		return p
+	}
+	for op, name := range lockOpNames {
+		w := &db.contention[op]
+		p.Ops[name] = LockWaits{
+			Acquisitions: atomic.LoadInt64(&w.acquisitions),
+			Samples:      atomic.LoadInt64(&w.samples),
+			Total:        time.Duration(atomic.LoadInt64(&w.total)),
+			Max:          time.Duration(atomic.LoadInt64(&w.max)),
+		}
+	}
+	return p
+}
+
+// lockFor acquires db.mu for writing on behalf of op.
+func (db *DB) lockFor(op lockOp) {
+	if db.contention == nil {
+		db.mu.Lock()
+		return
+	}
+	db.sampleWait(op, db.mu.Lock)
+}
+
+// rlockFor acquires db.mu for reading on behalf of op.
+func (db *DB) rlockFor(op lockOp) {
+	if db.contention == nil {
+		db.mu.RLock()
+		return
+	}
+	db.sampleWait(op, db.mu.RLock)
+}
+
+// sampleWait calls acquire, timing one in every contentionRate calls.
+func (db *DB) sampleWait(op lockOp, acquire func()) {
+	w := &db.contention[op]
+	if atomic.AddInt64(&w.acquisitions, 1)%int64(db.opts.contentionRate) != 0 {
+		acquire()
+		return
+	}
+	start := time.Now()
+	acquire()
+	wait := int64(time.Since(start))
+	atomic.AddInt64(&w.samples, 1)
+	atomic.AddInt64(&w.total, wait)
+	for {
+		max := atomic.LoadInt64(&w.max)
+		if wait <= max || atomic.CompareAndSwapInt64(&w.max, max, wait) {
+			return
+		}
+	}
+}
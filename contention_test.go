@@ -0,0 +1,125 @@
+package archivedb
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_ContentionProfile(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	db, err := Open(dir)
+	require.NoError(err)
+	require.NoError(db.Put([]byte("foo"), []byte("bar")))
+	require.Equal(ContentionProfile{Ops: map[string]LockWaits{}}, db.ContentionProfile())
+	require.NoError(db.Close())
+
+	_, err = Open(dir, ContentionProfileOption(-1))
+	require.Error(err)
+
+	db, err = Open(dir, ContentionProfileOption(2), FsyncOption(true))
+	require.NoError(err)
+	defer db.Close()
+	for i := 0; i < 4; i++ {
+		require.NoError(db.Put([]byte("foo"), []byte("bar")))
+		_, err := db.Get([]byte("foo"))
+		require.NoError(err)
+	}
+	p := db.ContentionProfile()
+	require.Equal(2, p.SampleRate)
+	require.Len(p.Ops, 3)
+	for _, name := range []string{"get", "write", "sync"} {
+		w := p.Ops[name]
+		require.Equal(int64(4), w.Acquisitions, name)
+		require.Equal(int64(2), w.Samples, name)
+		require.True(w.Max <= w.Total, name)
+		require.True(w.Mean() <= w.Max, name)
+	}
+	require.ErrorIs(db.SetOption(ContentionProfileOption(1)), ErrImmutableOption)
+}
+
+// reportLockWaits reports the mean sampled wait for the database lock by
+// the named operations, so lock hold time regressions show up in benchmark
+// results.
+func reportLockWaits(b *testing.B, db *DB, ops ...string) {
+	p := db.ContentionProfile()
+	for _, name := range ops {
+		b.ReportMetric(float64(p.Ops[name].Mean().Nanoseconds()), name+"-wait-ns")
+	}
+}
+
+func BenchmarkDB_GetParallel(b *testing.B) {
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir, ContentionProfileOption(16))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	const keyCount = 1024
+	value := make([]byte, 256)
+	for i := 0; i < keyCount; i++ {
+		if err := db.Put([]byte(strconv.Itoa(i)), value); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			if _, err := db.Get([]byte(strconv.Itoa(i % keyCount))); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+	b.StopTimer()
+	reportLockWaits(b, db, "get")
+}
+
+// BenchmarkDB_MixedParallel runs Gets from every goroutine while one in
+// every ten operations is a Put, so readers wait behind the writer.
+func BenchmarkDB_MixedParallel(b *testing.B) {
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir, ContentionProfileOption(16))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	const keyCount = 1024
+	value := make([]byte, 256)
+	for i := 0; i < keyCount; i++ {
+		if err := db.Put([]byte(strconv.Itoa(i)), value); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	var ops int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n := atomic.AddInt64(&ops, 1)
+			key := []byte(strconv.Itoa(int(n % keyCount)))
+			var err error
+			if n%10 == 0 {
+				err = db.Put(key, value)
+			} else {
+				_, err = db.Get(key)
+			}
+			if err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+	b.StopTimer()
+	reportLockWaits(b, db, "get", "write")
+}
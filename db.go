@@ -6,14 +6,18 @@ import (
 	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/millken/archivedb/format"
 	"github.com/pkg/errors"
 )
 
 const (
-	MaxKeySize          = math.MaxUint16
-	MaxValueSize uint32 = SegmentSize - SegmentHeaderSize
+	MaxKeySize          = math.MaxUint8 // key size is stored in one byte of the entry header
+	MaxValueSize uint32 = SegmentSize - SegmentHeaderSize - EntryHeaderSize - MaxKeySize
 )
 
 var (
@@ -29,53 +33,202 @@ var (
 	ErrLengthMismatch     = errors.New("length mismatch")
 	ErrInvalidEntryHeader = errors.New("invalid entry header")
 	ErrInvalidOffset      = errors.New("invalid offset")
+	ErrUnexpectedFile     = errors.New("unexpected file in database directory")
+	ErrDatabaseClosed     = errors.New("database closed")
+	ErrReadOnly           = errors.New("database is read-only")
 )
 
 type DB struct {
 	path     string
 	opts     *option
 	index    *index
+	manifest *Manifest
 	segments []*segment
+	stats    stats
+	seq      uint64   // entries written, including those found at Open
+	tags     tagIndex // guarded by tagsMu
+	tagsMu   sync.Mutex
+	merkle   *os.File
+	lockFile *os.File
+	// contention holds sampled lock waits, or is nil if not profiling.
+	contention *[numLockOps]lockWaits
+	// access counts sampled reads by key, or is nil if not counting.
+	access *accessTable
+	// events holds recent events, or is nil if the event log is off.
+	events  *eventLog
+	workers *workerPool    // runs background work, shared with the Env's databases
+	tasks   sync.WaitGroup // counts the work queued on workers
+	// watches holds the open watches. Guarded by mu. blockingWatches
+	// counts those with WatchBlock, so writers can skip waiting for them.
+	watches         []*Watch
+	blockingWatches int32
+	// flights coalesces concurrent Gets, or is nil if not coalescing.
+	flights  *flightGroup
+	standby  *standbySegment
+	recovery RecoveryReport
+	closed   bool
 	mu       sync.RWMutex
+
+	// activeStart is when the first entry of the active segment was
+	// written, or zero if it is empty.
+	activeStart time.Time
+
+	// lastWrites holds the entries recently written, which may not be
+	// published to the index yet, for linking versions. Guarded by mu.
+	lastWrites map[uint64]item
+
+	// samples holds values sampled for the dictionary of the next segment.
+	// Guarded by mu.
+	samples dictionarySamples
+
+	// segmentRefs counts the SegmentRefs held on each segment. Guarded by
+	// mu.
+	segmentRefs map[uint32]int
+
+	// sketchChanged is set when keys were added to the key sketch since
+	// the manifest was saved. Guarded by mu.
+	sketchChanged bool
+
+	// degraded is the write failure that switched the database to
+	// read-only, or nil.
+	degraded   error // guarded by degradedMu
+	degradedMu sync.Mutex
+
+	following  sync.Once
+	stopFollow chan struct{}
+	followDone chan struct{}
+
+	// scheduled holds the jobs run periodically on the workers. jobs
+	// counts the goroutine queuing them and the jobs queued, stopped by
+	// closing stopJobs.
+	scheduled    []*job
+	jobs         sync.WaitGroup
+	stopJobs     chan struct{}
+	stoppingJobs sync.Once
 }
 
 func Open(path string, options ...Option) (db *DB, err error) {
+	start := time.Now()
 	opts := &option{
-		fsync:    false,
-		hashFunc: DefaultHashFunc,
+		fsync:             false,
+		hashFunc:          DefaultHashFunc,
+		compactionRatio:   DefaultCompactionRatio,
+		clock:             SystemClock,
+		preallocate:       DefaultPreallocateThreshold,
+		readRetries:       DefaultReadRetries,
+		readRetryBackoff:  DefaultReadRetryBackoff,
+		eventLogSize:      DefaultEventLogSize,
+		stallThreshold:    DefaultStallThreshold,
+		backgroundWorkers: DefaultBackgroundWorkers,
+		getPrefixBudget:   DefaultGetPrefixBudget,
 	}
 	db = &DB{
 		path: path,
 		opts: opts,
 	}
-	// Create path if it doesn't exist.
-	if err := os.MkdirAll(filepath.Join(path), 0777); err != nil {
-		return nil, err
-	}
 	for _, opt := range options {
 		if err := opt(opts); err != nil {
 			return nil, errors.Wrap(err, "Invalid option")
 		}
 	}
+	if opts.eventLogSize > 0 {
+		db.events = newEventLog(opts.eventLogSize)
+	}
+	db.workers = opts.env.workerPool(opts.backgroundWorkers)
+	if opts.coalesceReads {
+		db.flights = newFlightGroup()
+	}
+	// Create the database if path doesn't hold one.
+	if !opts.readOnly {
+		if err := os.MkdirAll(filepath.Dir(filepath.Clean(path)), 0777); err != nil {
+			return nil, err
+		} else if err := db.initDatabase(); err != nil {
+			return nil, errors.Wrap(err, "init database")
+		}
+	}
+	if err := opts.env.register(db); err != nil {
+		return nil, err
+	}
+	if opts.contentionRate > 0 {
+		db.contention = new([numLockOps]lockWaits)
+	}
+	if opts.accessRate > 0 {
+		db.access = newAccessTable(opts.accessRate, opts.accessPrefix)
+	}
+	if !opts.readOnly {
+		if err := db.lock(); err != nil {
+			db.Close()
+			return nil, err
+		} else if err := db.removeIncompleteInit(); err != nil {
+			db.Close()
+			return nil, errors.Wrap(err, "init database")
+		}
+	}
 
-	if db.index, err = openIndex(db.IndexPath()); err != nil {
-		return nil, errors.Wrap(err, "open index")
+	if err := db.openManifest(); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "open manifest")
 	}
 	// Open components.
 	if err := func() (err error) {
 		if err = db.openSegments(); err != nil {
 			return err
 		}
-
-		//  if err := db.index.Recover(db.segments); err != nil {
-		// 	return err
-		// }
-
+		db.findOrphans()
+		db.seq = uint64(db.recovery.Entries + db.manifest.detachedEntries() + db.manifest.compactedEntries())
+		db.initActiveStart()
+		if db.opts.merkleLog {
+			if err = db.openMerkleLog(); err != nil {
+				return errors.Wrap(err, "open merkle log")
+			}
+		}
+		if db.opts.at != nil {
+			db.index, err = db.openIndexAt(*db.opts.at)
+		} else if db.opts.readOnly {
+			db.index, err = openIndexReadOnly(db.IndexPath(), db.itemExists)
+		} else {
+			db.recoverStandby()
+			db.index, err = openIndex(db.IndexPath())
+		}
+		if err != nil {
+			return errors.Wrap(err, "open index")
+		}
+		db.recovery.IndexItems = db.index.Length()
+		if err = db.openKeySketch(); err != nil {
+			return err
+		}
+		if !db.opts.readOnly {
+			return db.removeDanglingItems()
+		}
 		return nil
 	}(); err != nil {
 		db.Close()
 		return nil, err
 	}
+	db.recovery.Duration = time.Since(start)
+	if db.opts.follow > 0 {
+		db.startFollowing(db.opts.follow)
+	} else if !db.opts.readOnly {
+		if db.opts.purgeInterval > 0 {
+			db.every(db.opts.purgeInterval, "purge expired", func() error {
+				_, err := db.PurgeExpired()
+				return err
+			})
+		}
+		if db.opts.autoCompact > 0 {
+			db.every(db.opts.autoCompact, "compact", db.autoCompact)
+		}
+		if db.opts.syncInterval > 0 {
+			db.every(db.opts.syncInterval, "sync", db.syncUnsynced)
+		}
+		if db.opts.gcOrphans > 0 {
+			db.every(db.opts.gcOrphans, "gc orphans", func() error {
+				_, _, err := db.GCOrphans()
+				return err
+			})
+		}
+		db.startJobs()
+	}
 	return db, nil
 }
 
@@ -85,25 +238,183 @@ func (db *DB) openSegments() error {
 	if err != nil {
 		return err
 	}
+	partitions := db.manifest.partitionRoots()
+	paths := make(map[uint32]string)
+	// Quarantined segments keep their ids, so later segments stay
+	// addressable and new ones don't reuse them.
+	quarantined := make(map[uint32]bool)
 	for _, fi := range fis {
+		if isReservedFilename(fi.Name()) || (fi.IsDir() && partitions[fi.Name()]) {
+			continue
+		}
 		segmentID, err := parseSegmentFilename(fi.Name())
+		if err == nil && !fi.IsDir() {
+			err = validateSegmentFile(filepath.Join(db.path, fi.Name()))
+		} else if err == nil {
+			err = errors.New("segment is a directory")
+		}
 		if err != nil {
+			if db.opts.readOnly {
+				// Leave it for the owner of the directory to deal with.
+				continue
+			} else if !db.opts.quarantine {
+				return errors.Wrapf(ErrUnexpectedFile, "%s: %v", fi.Name(), err)
+			}
+			if err := quarantineFile(db.path, fi.Name(), err); err != nil {
+				return err
+			} else if id, perr := parseSegmentFilename(fi.Name()); perr == nil {
+				quarantined[id] = true
+			}
+			db.recovery.Quarantined = append(db.recovery.Quarantined, fi.Name())
+			db.event(EventRecovery, "quarantined unexpected file", filepath.Join(db.path, fi.Name()), err)
+			continue
+		}
+		paths[segmentID] = filepath.Join(db.path, fi.Name())
+	}
+
+	// Sealed segments may live in partition directories.
+	detached := make(map[uint32]bool)
+	for _, sc := range db.manifest.Segments {
+		if sc.Dir == "" {
 			continue
 		}
+		target := db.sealedPath(sc)
+		if sc.Detached {
+			detached[sc.ID] = true
+			paths[sc.ID] = target
+		} else if path, ok := paths[sc.ID]; !ok {
+			paths[sc.ID] = target
+		} else if !db.opts.readOnly {
+			// Sealed, but not moved into its partition yet.
+			if err := moveSegmentFile(path, target); err != nil {
+				db.warn(Warning{Op: "move segment to partition", Path: path, Err: err})
+			} else {
+				paths[sc.ID] = target
+			}
+		}
+	}
+	ids := make([]int, 0, len(paths))
+	for id := range paths {
+		ids = append(ids, int(id))
+	}
+	for id := range quarantined {
+		if _, ok := paths[id]; !ok {
+			ids = append(ids, int(id))
+		}
+	}
+	sort.Ints(ids)
 
-		segment := newSegment(segmentID, filepath.Join(db.path, fi.Name()))
-		if err := segment.Open(); err != nil {
+	for _, id := range ids {
+		segmentID, path := uint32(id), paths[uint32(id)]
+		db.addMissingSegments(segmentID)
+		if path == "" {
+			db.segments = append(db.segments, db.missingSegment(segmentID))
+			continue
+		} else if detached[segmentID] {
+			// Kept in place so segments stay addressable by id.
+			segment := newSegment(segmentID, path)
+			segment.detached = true
+			db.segments = append(db.segments, segment)
+			continue
+		}
+		segment, err := db.openSegment(segmentID, path)
+		if err != nil {
 			return err
 		}
+		db.recovery.recordSegment(segment)
+		if segment.stats.TornBytes > 0 {
+			db.event(EventRecovery, fmt.Sprintf("cleared %d bytes of torn entry", segment.stats.TornBytes), path, nil)
+		}
 		db.segments = append(db.segments, segment)
 	}
-	// Create initial segment if none exist.
+	if db.opts.readOnly {
+		if len(db.segments) == 0 {
+			return ErrSegmentNotFound
+		}
+		return nil
+	}
+	// Create initial segment if none exist. A missing active segment is
+	// replaced once the index shows which ids are in use.
 	if len(db.segments) == 0 {
-		segment, err := createSegment(0, filepath.Join(db.path, "0000"))
-		if err != nil {
+		if _, err := db.createSegment(); err != nil {
 			return err
 		}
-		db.segments = append(db.segments, segment)
+	}
+	// Seal segments written before checksums were recorded.
+	for _, s := range db.segments[:len(db.segments)-1] {
+		if _, ok := db.manifest.sealed(s.ID()); ok || s.missing {
+			continue
+		}
+		if err := db.sealSegment(s); err != nil {
+			return err
+		}
+	}
+	if err := db.finishCompactions(); err != nil {
+		return err
+	}
+	return db.finishPunching()
+}
+
+// openSegment opens the existing segment with the given id at path. A
+// sealed segment whose entries are counted in the manifest isn't scanned.
+func (db *DB) openSegment(id uint32, path string) (*segment, error) {
+	segment := newSegment(id, path)
+	segment.readOnly = db.opts.readOnly
+	if sc, ok := db.manifest.sealed(id); ok && sc.counted() {
+		segment.sealedSize = sc.Size
+		segment.stats = segmentScan{Entries: sc.Entries, Tombstones: sc.Tombstones}
+	} else if !db.opts.readOnly {
+		// Backups hold only the data of the active segment; give it back
+		// its room for appends.
+		if err := extendFile(path, int64(SegmentSize)); err != nil {
+			return nil, err
+		}
+	}
+	if err := db.retryTooManyFiles("open segment", segment.path, segment.Open); err != nil {
+		return nil, err
+	}
+	if err := db.opts.env.reserve(segment.MappedSize()); err != nil {
+		segment.Close()
+		return nil, err
+	}
+	return segment, nil
+}
+
+// sealSegment flushes a segment that will no longer be written to and
+// records its checksum in the manifest, which Open trusts without scanning
+// the segment.
+func (db *DB) sealSegment(s *segment) error {
+	if err := s.Flush(); err != nil {
+		db.event(EventFlushError, "flush segment", s.path, err)
+		return db.degrade(err)
+	}
+	sum, err := s.Checksum()
+	if err != nil {
+		return err
+	}
+	sc := SegmentChecksum{
+		ID:         s.ID(),
+		Size:       s.Size(),
+		Checksum:   sum,
+		Sealed:     db.now(),
+		Entries:    s.stats.Entries,
+		Tombstones: s.stats.Tombstones,
+	}
+	if db.opts.partition {
+		sc.Dir = partitionName(sc.Sealed)
+	}
+	db.manifest.Segments = append(db.manifest.Segments, sc)
+	if err := db.saveManifest(); err != nil {
+		return err
+	}
+	if sc.Dir != "" {
+		// Some platforms can't rename a mapped file; Open moves it then.
+		target := db.sealedPath(sc)
+		if err := moveSegmentFile(s.path, target); err != nil {
+			db.warn(Warning{Op: "move segment to partition", Path: s.path, Err: err})
+		} else {
+			s.path = target
+		}
 	}
 	return nil
 }
@@ -116,111 +427,538 @@ func (db *DB) activeSegment() *segment {
 	return db.segments[len(db.segments)-1]
 }
 
+// segment returns the segment with the given id, or nil if it doesn't exist
+// or its file is missing.
+func (db *DB) segment(id uint32) *segment {
+	if int(id) >= len(db.segments) || db.segments[id].missing {
+		return nil
+	}
+	return db.segments[id]
+}
+
+// segmentMissing returns true if the segment with the given id was found
+// missing or quarantined, so the index items in it can't be read but must
+// not be reused. The caller must hold db.mu.
+func (db *DB) segmentMissing(id uint32) bool {
+	return int(id) < len(db.segments) && db.segments[id].missing
+}
+
+// addMissingSegments appends placeholders for the ids before id that have
+// no segment, keeping db.segments indexed by id.
+func (db *DB) addMissingSegments(id uint32) {
+	for next := uint32(len(db.segments)); next < id; next++ {
+		db.segments = append(db.segments, db.missingSegment(next))
+	}
+}
+
+// missingSegment returns the placeholder for the segment with the given id
+// whose file is missing or quarantined.
+func (db *DB) missingSegment(id uint32) *segment {
+	path := filepath.Join(db.path, segmentFilename(id))
+	if sc, ok := db.manifest.sealed(id); ok {
+		path = db.sealedPath(sc)
+	}
+	s := newSegment(id, path)
+	s.missing = true
+	return s
+}
+
 func (db *DB) createSegment() (*segment, error) {
+	if err := db.checkSpace(uint64(SegmentSize)); err != nil {
+		return nil, err
+	}
 
 	// Generate a new sequential segment identifier.
-	var id uint16
+	var id uint32
 	if len(db.segments) > 0 {
-		id = db.segments[len(db.segments)-1].ID() + 1
+		last := db.segments[len(db.segments)-1].ID()
+		if last == math.MaxUint32 {
+			return nil, ErrSegmentIDsExhausted
+		}
+		id = last + 1
+	}
+	// Seal the current active segment before replacing it.
+	active := db.activeSegment()
+	if active != nil && !active.missing {
+		if err := db.sealSegment(active); err != nil {
+			return nil, err
+		}
 	}
-	filename := fmt.Sprintf("%04x", id)
 
-	// Generate new empty segment.
-	segment, err := createSegment(id, filepath.Join(db.path, filename))
-	if err != nil {
+	// Generate new empty segment, or use the standby one.
+	var segment *segment
+	path := filepath.Join(db.path, segmentFilename(id))
+	standby := db.takeStandby(path)
+	if err := db.retryTooManyFiles("create segment", path, func() (err error) {
+		if standby {
+			segment = newSegment(id, path)
+			return segment.Open()
+		}
+		segment, err = createSegment(id, path)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	if err := db.opts.env.reserve(segment.MappedSize()); err != nil {
+		segment.Close()
 		return nil, err
 	}
 	db.segments = append(db.segments, segment)
+	db.activeStart = time.Time{}
+	if active != nil && !active.missing {
+		atomic.AddInt64(&db.stats.rollovers, 1)
+		db.event(EventRollover, fmt.Sprintf("sealed segment %d at %d bytes", active.ID(), active.Size()), segment.path, nil)
+	}
 
 	return segment, nil
 }
 
+// SetOption changes options of an open database. Fsync, size limit and
+// compaction options take effect for the next operation; size limits are
+// recorded in the manifest. Options fixed at Open, such as the hash func,
+// key transform and env, return ErrImmutableOption.
+func (db *DB) SetOption(options ...Option) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrDatabaseClosed
+	}
+	opts := *db.opts
+	opts.keyTransformSet = false
+	for _, opt := range options {
+		if err := opt(&opts); err != nil {
+			return errors.Wrap(err, "Invalid option")
+		}
+	}
+	if err := db.opts.checkImmutable(&opts); err != nil {
+		return err
+	}
+	if db.manifest.applyLimits(&opts) {
+		if err := db.saveManifest(); err != nil {
+			return errors.Wrap(err, "write manifest")
+		}
+	}
+	*db.opts = opts
+	return nil
+}
+
+// IndexMemoryUsage returns an estimate of the heap bytes used by the
+// in-memory index.
+func (db *DB) IndexMemoryUsage() int64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.index.MemoryUsage()
+}
+
 // IndexPath returns the path to the series index.
 func (db *DB) IndexPath() string { return filepath.Join(db.path, "index") }
 
 //Put put the value of the key to the db
 func (db *DB) Put(key, value []byte) error {
-	if err := validateKey(key); err != nil {
+	return db.set(key, value, EntryInsertFlag, WriteOptions{})
+}
+
+// set writes an entry for key. The entry is appended under the write lock,
+// but published to the in-memory index and synced after releasing it, so
+// readers are only blocked for the append itself.
+func (db *DB) set(key, value []byte, flag uint8, opts WriteOptions) error {
+	if flag == EntryDeleteFlag {
+		defer db.stats.deletes.since(time.Now())
+	} else {
+		defer db.stats.puts.since(time.Now())
+	}
+	w, err := db.appendEntry(key, value, flag, opts)
+	return db.publish(w, opts.Tag, err)
+}
+
+// publish makes w, returned by appendEntry with err, visible and syncs it
+// if asked to, then returns err or the sync error. The caller must not
+// hold db.mu.
+func (db *DB) publish(w *pendingWrite, tag uint32, err error) error {
+	if w == nil {
+		return err
+	}
+	defer db.waitWatches()
+	// The entry is stored and recorded in the index file, so make it
+	// visible even if a later step failed.
+	db.index.Publish(w.hashKey, w.segment.ID(), w.offset)
+	if tag != 0 {
+		db.addTag(tag, w.hashKey)
+	}
+	if err != nil {
 		return err
 	}
-	if len(value) > int(MaxValueSize) {
-		return ErrValueTooLarge
+	if w.sync {
+		db.rlockFor(lockSync)
+		defer db.mu.RUnlock()
+		if db.closed {
+			return ErrDatabaseClosed
+		}
+		defer db.checkStall("sync", time.Now())
+		return db.flushSegment(w.segment)
 	}
-	return db.set(key, value, EntryInsertFlag)
+	return nil
 }
 
-//Put put the value of the key to the db
-func (db *DB) set(key, value []byte, flag uint8) error {
-	var err error
-	db.mu.Lock()
+// pendingWrite is an appended entry not yet published to the index.
+type pendingWrite struct {
+	hashKey uint64
+	segment *segment
+	offset  uint32
+	sync    bool
+	// skipped is set for a batched put skipped by SkipUnchangedOption,
+	// which points at the stored entry instead.
+	skipped bool
+}
+
+// appendEntry writes the entry and its index record. It returns a non-nil
+// pendingWrite once both are written, along with any error from steps
+// after that.
+func (db *DB) appendEntry(key, value []byte, flag uint8, opts WriteOptions) (w *pendingWrite, err error) {
+	start := time.Now()
+	db.lockFor(lockWrite)
 	defer db.mu.Unlock()
-	entry := createEntry(flag, key, value)
-	segment := db.activeSegment()
-	if segment == nil || !segment.CanWrite(entry) {
-		if segment, err = db.createSegment(); err != nil {
-			return err
-		}
+	defer db.checkStall("write", start)
+	if err := db.checkWritable(); err != nil {
+		return nil, err
+	} else if opts.ExpectedSeq != 0 && opts.ExpectedSeq != db.seq {
+		return nil, errors.Wrapf(ErrSeqMismatch, "expected %d, at %d", opts.ExpectedSeq, db.seq)
 	}
-	if err = segment.WriteEntry(entry); err != nil {
-		return err
+	var expires int64
+	if opts.TTL != 0 {
+		expires = db.now().Add(opts.TTL).UnixNano()
 	}
-	hashKey := db.opts.hashFunc(key)
-	offset := segment.Size() - entry.Size()
-	if err = db.index.Insert(hashKey, segment.ID(), offset); err != nil {
-		return err
+	if key, err = db.checkEntry(key, value, flag, expires); err != nil {
+		return nil, err
 	}
-	if db.opts.fsync {
-		if err := segment.Flush(); err != nil {
-			return err
-		} else if err := db.index.Flush(); err != nil {
-			return err
+	if flag == EntryInsertFlag && db.opts.skipUnchanged && db.unchanged(key, value, opts.Tag, expires) {
+		// The stored entry may not be synced yet.
+		if opts.Sync || db.opts.fsync {
+			return nil, db.flush()
 		}
+		return nil, nil
 	}
-	return nil
+	w, err = db.writeEntry(key, value, flag, opts.Tag, expires)
+	if w != nil && opts.Sync {
+		w.sync = true
+	}
+	return w, err
 }
 
-//Get gets the value of the key
-func (db *DB) Get(key []byte) ([]byte, error) {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
-	if err := validateKey(key); err != nil {
+// checkEntry returns the encoded key of an entry, or an error if the key
+// or value, with the expiry stored in front of it, can't be stored. The
+// size limits only apply to inserts, so a key put before the limit was
+// lowered can be deleted. The caller must hold db.mu.
+func (db *DB) checkEntry(key, value []byte, flag uint8, expires int64) ([]byte, error) {
+	if flag != EntryDeleteFlag && len(key) > db.opts.maxKeySize {
+		return nil, ErrKeyTooLarge
+	}
+	key, err := db.encodeKey(key)
+	if err != nil {
 		return nil, err
 	}
-	hashKey := db.opts.hashFunc(key)
-	item, ok := db.index.Get(hashKey)
-	if !ok {
-		return nil, ErrKeyNotFound
+	size := len(value)
+	if expires != 0 {
+		size += format.ExpirySize
+	}
+	// Values too large for a segment are chunked, unless the limit was
+	// lowered.
+	if size > int(db.opts.maxValueSize) && db.opts.maxValueSize < MaxValueSize {
+		return nil, ErrValueTooLarge
+	}
+	return key, nil
+}
+
+// writeEntry is appendEntry for a key already encoded and checked by
+// checkEntry, expiring at expires in Unix nanoseconds unless it is zero.
+// The caller must hold db.mu and have checked the database is writable.
+func (db *DB) writeEntry(key, value []byte, flag uint8, tag uint32, expires int64) (*pendingWrite, error) {
+	stored, attrs := value, uint8(0)
+	if flag == EntryInsertFlag {
+		db.sampleValue(value)
+	}
+	if flag == EntryInsertFlag && len(value) > chunkSize {
+		var err error
+		if stored, err = db.writeChunks(key, value); err != nil {
+			return nil, db.degrade(err)
+		}
+		attrs = format.AttrChunked
+	}
+	w, err := db.writeValue(flag, key, stored, attrs, len(value), tag, expires)
+	if w != nil {
+		db.notifyWatches(flag, key, value, len(value), tag, expires)
 	}
-	segment := db.segments[item.ID()]
-	if segment == nil {
-		return nil, ErrSegmentNotFound
+	return w, err
+}
+
+// writeValue is writeEntry for a value already chunked if it had to be,
+// stored with the attributes attrs, size bytes long before chunking.
+func (db *DB) writeValue(flag uint8, key, stored []byte, attrs uint8, size int, tag uint32, expires int64) (w *pendingWrite, err error) {
+	defer func() { db.degrade(err) }()
+	hashKey := db.opts.hashFunc(key)
+	entry, err := db.createWriteEntry(flag, key, stored, attrs, expires, hashKey)
+	if err != nil {
+		return nil, err
 	}
-	entry, err := segment.ReadEntry(item.Offset())
+	entry.hdr.Tag = tag
+	segment, err := db.appendToLog(entry)
 	if err != nil {
 		return nil, err
 	}
-	if entry.hdr.Flag == EntryDeleteFlag {
-		return nil, ErrKeyDeleted
+	w = &pendingWrite{
+		hashKey: hashKey,
+		segment: segment,
+		offset:  segment.Size() - entry.Size(),
+		sync:    db.addUnsynced(int64(entry.Size())) || db.opts.fsync,
 	}
+	if err = db.index.Append(w.hashKey, segment.ID(), w.offset); err != nil {
+		return nil, err
+	}
+	if db.opts.versions {
+		db.rememberWrite(w.hashKey, item{segment.ID(), w.offset})
+	}
+	atomic.AddInt64(&db.stats.logicalBytes, int64(len(key)+size))
+	atomic.AddInt64(&db.stats.physicalBytes, int64(entry.Size())+indexItemSize)
+	atomic.AddInt64(&db.stats.writes, 1)
+	if flag == EntryInsertFlag {
+		db.stats.addValueSize(size)
+	}
+	db.addKeySketch(w.hashKey)
+	db.seq++
+	if err = db.appendMerkleLog(segment.ID(), w.offset, entry); err != nil {
+		return w, err
+	}
+	return w, db.audit(flag, w.hashKey, size, tag)
+}
 
-	if err := entry.verify(key); err != nil {
+// createWriteEntry returns the entry storing value for key until expires,
+// with the attributes attrs, linked to the previous entry of the key with
+// VersionsOption, and stored as a delta against it with
+// DeltaEncodingOption or compressed with the dictionary of the active
+// segment with SegmentDictionaryOption. The caller must hold db.mu for
+// writing.
+func (db *DB) createWriteEntry(flag uint8, key, value []byte, attrs uint8, expires int64, hashKey uint64) (entry, error) {
+	var prev item
+	if db.opts.versions {
+		prev = db.previousEntry(hashKey)
+	}
+	e, err := db.encodeEntry(flag, key, value, attrs, expires, prev, true)
+	// Deltas and dictionaries are of the segment the entry is written to.
+	if err == nil && segmentLocal(e) && !db.appendsToActive(e) {
+		e, err = db.encodeEntry(flag, key, value, attrs, expires, prev, false)
+	}
+	return e, err
+}
+
+// encodeEntry is createWriteEntry for the previous entry prev, or a zero
+// item, only storing value as a delta or with a dictionary if local is
+// set.
+func (db *DB) encodeEntry(flag uint8, key, value []byte, attrs uint8, expires int64, prev item, local bool) (entry, error) {
+	var base, dict []byte
+	if local {
+		base, _ = db.deltaBase(flag, attrs, key, prev)
+		dict = db.activeDictionary()
+	}
+	stored, f, codedAttrs, err := db.encodeValue(flag, key, value, base, dict)
+	if err != nil {
+		return entry{}, err
+	}
+	attrs |= codedAttrs
+	if f.Expires = expires; expires != 0 {
+		attrs |= format.AttrExpires
+	}
+	if prev.off != 0 {
+		attrs |= format.AttrPrevWide
+		f.PrevSegment, f.PrevOffset = prev.id, prev.off
+	}
+	return createEntryWithFields(flag, key, stored, attrs, f), nil
+}
+
+// encodeValue returns what to store for value in an entry of key with the
+// flag flag, compressed, with dict unless it is nil, or as a delta against
+// base unless it is nil, whichever is smaller, and, unless it is a
+// tombstone, encrypted as configured, along with the fields and attributes
+// recording how.
+func (db *DB) encodeValue(flag uint8, key, value, base, dict []byte) ([]byte, format.ValueFields, uint8, error) {
+	var f format.ValueFields
+	stored, codec, err := db.compress(value, dict)
+	if err != nil {
+		return nil, f, 0, err
+	}
+	if base != nil {
+		if d := encodeDelta(base, value); len(d) < len(stored) {
+			stored, codec = d, deltaCodecID
+		}
+	}
+	attrs := codec << format.AttrCodecShift
+	if flag != EntryDeleteFlag && db.opts.cipher != nil {
+		if stored, f.Nonce, err = db.encrypt(key, stored); err != nil {
+			return nil, f, 0, err
+		}
+		attrs |= format.AttrEncrypted
+	}
+	return stored, f, attrs, nil
+}
+
+// appendToLog writes e to the active segment, rolling over to a new one
+// first if it is full or its rollover window ended, and returns the
+// segment written to. The caller must hold db.mu.
+func (db *DB) appendToLog(e entry) (*segment, error) {
+	segment := db.activeSegment()
+	if !db.appendsToActive(e) {
+		var err error
+		if segment, err = db.createSegment(); err != nil {
+			return nil, err
+		}
+	}
+	if segment.Size() == SegmentHeaderSize {
+		if err := db.writeDictionary(segment, e); err != nil {
+			return nil, err
+		}
+	}
+	if err := segment.WriteEntry(e); err != nil {
 		return nil, err
 	}
+	if db.activeStart.IsZero() {
+		db.activeStart = db.now()
+	}
+	db.maybePrepareStandby(segment)
+	return segment, nil
+}
 
-	return entry.value, nil
+// appendsToActive returns true if appendToLog would write e to the active
+// segment rather than roll over. The caller must hold db.mu.
+func (db *DB) appendsToActive(e entry) bool {
+	segment := db.activeSegment()
+	return segment != nil && segment.CanWrite(e) && !db.windowEnded()
 }
 
-func (db *DB) Delete(key []byte) error {
-	if err := validateKey(key); err != nil {
-		return err
+// checkWritable returns an error if the database can't be modified. The
+// caller must hold db.mu.
+func (db *DB) checkWritable() error {
+	switch {
+	case db.closed:
+		return ErrDatabaseClosed
+	case db.manifest.Frozen != nil:
+		return ErrFrozen
+	case db.opts.readOnly:
+		return ErrReadOnly
+	}
+	return db.degradedErr()
+}
+
+// flush commits the active segment and the index to stable storage. The
+// caller must hold db.mu.
+func (db *DB) flush() error {
+	return db.flushSegment(db.activeSegment())
+}
+
+// flushSegment commits s and the index to stable storage. The caller must
+// hold db.mu, for reading at least.
+func (db *DB) flushSegment(s *segment) error {
+	// Writes made while flushing count towards the next sync.
+	atomic.StoreInt64(&db.stats.unsynced, 0)
+	if err := s.Flush(); err != nil {
+		db.event(EventFlushError, "flush segment", s.path, err)
+		return db.degrade(err)
+	} else if err := db.index.Flush(); err != nil {
+		db.event(EventFlushError, "flush index", db.IndexPath(), err)
+		return db.degrade(err)
+	}
+	if db.merkle != nil {
+		if err := db.merkle.Sync(); err != nil {
+			db.event(EventFlushError, "sync merkle log", db.MerkleLogPath(), err)
+			return db.degrade(err)
+		}
+	}
+	atomic.AddInt64(&db.stats.syncs, 1)
+	return nil
+}
+
+//Get gets the value of the key
+func (db *DB) Get(key []byte) ([]byte, error) {
+	return db.GetWithOptions(key, ReadOptions{VerifyChecksum: true, FillCache: true})
+}
+
+// forEachLiveEntry calls fn with the current entry of every key that is
+// not deleted or expired, in no particular order, skipping keys whose
+// segment is missing. Entry keys are decoded with the key transform, and
+// their values decrypted and decompressed if values is set. The caller
+// must hold db.mu.
+func (db *DB) forEachLiveEntry(values bool, fn func(e entry) error) error {
+	if db.closed {
+		return ErrDatabaseClosed
+	}
+	now := db.now()
+	return db.index.ForEach(func(_ uint64, it item) error {
+		e, ok, err := db.liveEntry(it, now, values)
+		if !ok || err != nil {
+			return err
+		}
+		return fn(e)
+	})
+}
+
+// liveEntry reads the entry of the index item it, as forEachLiveEntry
+// passes it on. It returns false if the key is deleted or expired at now,
+// or its segment is missing. The caller must hold db.mu.
+func (db *DB) liveEntry(it item, now time.Time, values bool) (entry, bool, error) {
+	segment := db.segment(it.ID())
+	if segment == nil && db.segmentMissing(it.ID()) {
+		return entry{}, false, nil
+	} else if segment == nil {
+		return entry{}, false, ErrSegmentNotFound
+	}
+	e, err := segment.ReadEntry(it.Offset())
+	if err != nil {
+		return entry{}, false, err
 	}
-	return db.set(key, nil, EntryDeleteFlag)
+	if e.hdr.Flag == EntryDeleteFlag || e.expired(now) {
+		return entry{}, false, nil
+	}
+	if values {
+		if err := db.decodeValue(&e); err != nil {
+			return entry{}, false, err
+		}
+	}
+	e.key = db.decodeKey(e.key)
+	return e, true, nil
 }
 
-// Close closes the DB
+func (db *DB) Delete(key []byte) error {
+	return db.set(key, nil, EntryDeleteFlag, WriteOptions{})
+}
+
+// Close closes the DB. Closing a closed DB does nothing.
 func (db *DB) Close() error {
+	db.stopFollowing()
+	db.stopBackgroundJobs()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+	db.endWatches(ErrDatabaseClosed)
+	db.tasks.Wait()
+	if db.index != nil && !db.opts.readOnly && db.degradedErr() == nil && db.indexStale() {
+		if err := db.checkpointIndex(); err != nil {
+			db.warn(Warning{Op: "checkpoint index", Path: db.IndexPath(), Err: err})
+		}
+	}
+	if db.sketchChanged && db.degradedErr() == nil {
+		if err := db.saveManifest(); err != nil {
+			db.warn(Warning{Op: "save key sketch", Path: db.ManifestPath(), Err: err})
+		}
+	}
 	var err error
 	for _, s := range db.segments {
+		if s.Dirty() {
+			if e := s.Flush(); e != nil && err == nil {
+				err = e
+			}
+		}
+		db.opts.env.release(s.MappedSize())
 		if e := s.Close(); e != nil && err == nil {
 			err = e
 		}
@@ -230,6 +968,15 @@ func (db *DB) Close() error {
 			err = e
 		}
 	}
+	if db.merkle != nil {
+		if e := db.merkle.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	db.opts.env.unregister(db)
+	if e := db.unlock(); e != nil && err == nil {
+		err = e
+	}
 	return err
 }
 
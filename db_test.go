@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
@@ -63,6 +64,125 @@ func TestDB(t *testing.T) {
 	require.NoError(db.Close())
 }
 
+func TestDB_SizeLimits(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	_, err := Open(dir, MaxKeySizeOption(MaxKeySize+1))
+	require.Error(err)
+
+	db, err := Open(dir)
+	require.NoError(err)
+	require.ErrorIs(db.Put(bytes.Repeat([]byte("k"), MaxKeySize+1), nil), ErrKeyTooLarge)
+	require.NoError(db.Close())
+
+	db, err = Open(dir, MaxKeySizeOption(4), MaxValueSizeOption(8))
+	require.NoError(err)
+	require.NoError(db.Put([]byte("1234"), []byte("12345678")))
+	require.ErrorIs(db.Put([]byte("12345"), []byte("v")), ErrKeyTooLarge)
+	require.ErrorIs(db.Put([]byte("k"), []byte("123456789")), ErrValueTooLarge)
+	require.NoError(db.Close())
+
+	// Limits are kept in the manifest.
+	db, err = Open(dir)
+	require.NoError(err)
+	require.ErrorIs(db.Put([]byte("12345"), []byte("v")), ErrKeyTooLarge)
+	require.NoError(db.Close())
+
+	db, err = Open(dir, MaxKeySizeOption(MaxKeySize))
+	require.NoError(err)
+	require.NoError(db.Put([]byte("12345"), []byte("v")))
+	require.ErrorIs(db.Put([]byte("k"), []byte("123456789")), ErrValueTooLarge)
+	require.NoError(db.Close())
+
+	// Keys put before the limit was lowered can still be read and deleted.
+	db, err = Open(dir, MaxKeySizeOption(4))
+	require.NoError(err)
+	v, err := db.Get([]byte("12345"))
+	require.NoError(err)
+	require.Equal("v", string(v))
+	ok, err := db.Has([]byte("12345"))
+	require.NoError(err)
+	require.True(ok)
+	require.NoError(db.Delete([]byte("12345")))
+	_, err = db.Get([]byte("12345"))
+	require.ErrorIs(err, ErrKeyDeleted)
+	require.NoError(db.Close())
+}
+
+func TestDB_SetOption(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	db, err := Open(dir)
+	require.NoError(err)
+	require.NoError(db.SetOption(FsyncOption(true), MaxValueSizeOption(4)))
+	require.True(db.opts.fsync)
+	require.ErrorIs(db.Put([]byte("foo"), []byte("12345")), ErrValueTooLarge)
+	require.NoError(db.Put([]byte("foo"), []byte("1234")))
+
+	require.Error(db.SetOption(MaxValueSizeOption(0)))
+	require.ErrorIs(db.SetOption(HashFuncOption(func(b []byte) uint64 { return 0 })), ErrImmutableOption)
+	require.ErrorIs(db.SetOption(KeyTransformOption(PrefixKeyTransform([]byte("p")))), ErrImmutableOption)
+	require.NoError(db.SetOption(HashFuncOption(DefaultHashFunc)))
+	require.NoError(db.Close())
+
+	db, err = Open(dir)
+	require.NoError(err)
+	require.False(db.opts.fsync)
+	require.ErrorIs(db.Put([]byte("foo"), []byte("12345")), ErrValueTooLarge)
+	require.NoError(db.Close())
+}
+
+func TestOpen_Failures(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	// Index path is a directory.
+	require.NoError(os.Mkdir(filepath.Join(dir, "index"), 0777))
+	db, err := Open(dir)
+	require.Error(err)
+	require.Nil(db)
+	require.NoError(os.Remove(filepath.Join(dir, "index")))
+
+	// Manifest is corrupt.
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, ManifestFileName), []byte("{"), 0644))
+	_, err = Open(dir)
+	require.ErrorIs(err, ErrInvalidManifest)
+	require.NoError(os.Remove(filepath.Join(dir, ManifestFileName)))
+
+	// Database path is a file.
+	file := filepath.Join(dir, "file")
+	require.NoError(ioutil.WriteFile(file, nil, 0644))
+	_, err = Open(file)
+	require.Error(err)
+}
+
+func TestDB_UseAfterClose(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	db, err := Open(dir)
+	require.NoError(err)
+	require.NoError(db.Put([]byte("foo"), []byte("bar")))
+	require.NoError(db.Close())
+	require.NoError(db.Close())
+
+	_, err = db.Get([]byte("foo"))
+	require.ErrorIs(err, ErrDatabaseClosed)
+	require.ErrorIs(db.Put([]byte("foo"), []byte("bar")), ErrDatabaseClosed)
+	require.ErrorIs(db.Delete([]byte("foo")), ErrDatabaseClosed)
+	require.ErrorIs(db.SetOption(FsyncOption(true)), ErrDatabaseClosed)
+	_, err = db.StatsPrefix(nil)
+	require.ErrorIs(err, ErrDatabaseClosed)
+	_, err = db.PlanCompaction()
+	require.ErrorIs(err, ErrDatabaseClosed)
+}
+
 // Tests multiple goroutines simultaneously opening a database.
 func TestOpen_MultipleGoroutines(t *testing.T) {
 	t.Skip("skipping test until we can fix the")
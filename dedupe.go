@@ -0,0 +1,46 @@
+package archivedb
+
+import (
+	"bytes"
+	"runtime/debug"
+
+	"github.com/millken/archivedb/format"
+)
+
+// encodedAttrs are the attributes of an entry whose stored value differs
+// from the value it was written with.
+const encodedAttrs = format.AttrEncrypted | format.AttrChunked | format.AttrCodecMask
+
+// unchanged returns true if the current entry of key, encoded and checked
+// by checkEntry, holds value with the tag tag and the expiry expires, so
+// putting it again would change nothing. A stored value that fails its
+// checksum never counts as unchanged. The caller must hold db.mu.
+func (db *DB) unchanged(key, value []byte, tag uint32, expires int64) (same bool) {
+	// A new expiry is always later than the stored one.
+	if expires != 0 {
+		return false
+	}
+	it, ok := db.index.Get(db.opts.hashFunc(key))
+	if !ok {
+		return false
+	}
+	s := db.segment(it.ID())
+	if s == nil || s.detached {
+		return false
+	}
+	var err error
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer recoverFault(&err, ErrReadFault)
+
+	e, err := readEntryOnce(s, it.Offset(), key, false)
+	if err != nil || e.hdr.Flag != EntryInsertFlag || e.hdr.Tag != tag || e.expires != 0 {
+		return false
+	} else if e.hdr.Attrs&encodedAttrs == 0 && len(e.data) != len(value) {
+		return false
+	} else if err = e.verify(key); err != nil {
+		return false
+	} else if err = db.decodeValue(&e); err != nil {
+		return false
+	}
+	return bytes.Equal(e.data, value)
+}
@@ -0,0 +1,117 @@
+package archivedb
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSkipUnchangedOption(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir, SkipUnchangedOption(true))
+	require.NoError(err)
+	defer db.Close()
+
+	require.NoError(db.Put([]byte("a"), []byte("1")))
+	require.NoError(db.Put([]byte("a"), []byte("1")))
+	require.Equal(uint64(1), db.Seq())
+
+	// A changed value, tag or expiry is written.
+	require.NoError(db.Put([]byte("a"), []byte("2")))
+	require.Equal(uint64(2), db.Seq())
+	require.NoError(db.PutTagged([]byte("a"), []byte("2"), 7))
+	require.Equal(uint64(3), db.Seq())
+	require.NoError(db.PutTagged([]byte("a"), []byte("2"), 7))
+	require.Equal(uint64(3), db.Seq())
+	require.NoError(db.PutWithOptions([]byte("a"), []byte("2"), WriteOptions{Tag: 7, TTL: time.Hour}))
+	require.Equal(uint64(4), db.Seq())
+	require.NoError(db.PutTagged([]byte("a"), []byte("2"), 7))
+	require.Equal(uint64(5), db.Seq())
+
+	// So is a value put again after a delete.
+	require.NoError(db.Delete([]byte("a")))
+	require.NoError(db.PutTagged([]byte("a"), []byte("2"), 7))
+	require.Equal(uint64(7), db.Seq())
+
+	require.NoError(db.SetOption(SkipUnchangedOption(false)))
+	require.NoError(db.PutTagged([]byte("a"), []byte("2"), 7))
+	require.Equal(uint64(8), db.Seq())
+	v, err := db.Get([]byte("a"))
+	require.NoError(err)
+	require.Equal([]byte("2"), v)
+}
+
+func TestSkipUnchangedOption_Encoded(t *testing.T) {
+	require := require.New(t)
+	withChunkSize(t, 64)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir, SkipUnchangedOption(true), EncryptionOption(bytes.Repeat([]byte{7}, 16)),
+		CompressionOption(DeflateCodec, 32))
+	require.NoError(err)
+	defer db.Close()
+
+	big := bytes.Repeat([]byte("chunked "), 40)
+	require.NoError(db.Put([]byte("big"), big))
+	seq := db.Seq()
+	require.NoError(db.Put([]byte("big"), big))
+	require.Equal(seq, db.Seq())
+	big[0] = 'C'
+	require.NoError(db.Put([]byte("big"), big))
+	require.Greater(db.Seq(), seq)
+}
+
+func TestSkipUnchangedOption_Batch(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir, SkipUnchangedOption(true), FsyncOption(true))
+	require.NoError(err)
+	defer db.Close()
+
+	require.NoError(db.PutTagged([]byte("a"), []byte("1"), 7))
+	require.NoError(db.Put([]byte("b"), []byte("2")))
+	require.Equal(uint64(2), db.Seq())
+
+	// Unchanged puts are skipped as by Put, and the batch still commits.
+	b := db.NewWriteBatch()
+	b.PutTagged([]byte("a"), []byte("1"), 7)
+	b.Put([]byte("b"), []byte("3"))
+	b.Put([]byte("c"), []byte("4"))
+	require.NoError(b.Commit())
+	require.Equal(uint64(4), db.Seq())
+	require.NoError(db.LookupTag(7, func(key, value []byte) error {
+		require.Equal([]byte("a"), key)
+		return nil
+	}))
+
+	// A put back to the stored value after an earlier write of the key in
+	// the same batch is written, as the stored value is no longer current.
+	b.Put([]byte("b"), []byte("5"))
+	b.Put([]byte("b"), []byte("3"))
+	b.Delete([]byte("c"))
+	b.Put([]byte("c"), []byte("4"))
+	require.NoError(b.Commit())
+	require.Equal(uint64(8), db.Seq())
+	for key, value := range map[string]string{"a": "1", "b": "3", "c": "4"} {
+		v, err := db.Get([]byte(key))
+		require.NoError(err)
+		require.Equal([]byte(value), v, key)
+	}
+
+	// A changed tag is written; a batch of only unchanged puts writes
+	// nothing.
+	b.Put([]byte("a"), []byte("1"))
+	b.PutTagged([]byte("a"), []byte("1"), 7)
+	require.NoError(b.Commit())
+	require.Equal(uint64(10), db.Seq())
+	b.PutTagged([]byte("a"), []byte("1"), 7)
+	b.Put([]byte("b"), []byte("3"))
+	require.NoError(b.Commit())
+	require.Equal(uint64(10), db.Seq())
+	require.Zero(b.Len())
+}
@@ -0,0 +1,98 @@
+package archivedb
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// ErrWriteFault is returned when writing a mapped segment raised a memory
+// fault, as happens when the filesystem runs out of space to back a page.
+var ErrWriteFault = errors.New("fault writing segment")
+
+// Health describes whether the database is accepting writes.
+type Health struct {
+	// ReadOnly is set while writes are refused, because the database was
+	// opened read-only, is frozen or has degraded.
+	ReadOnly bool
+	// Degraded is the write failure that switched the database to
+	// read-only, or nil. Reads keep working; call Resume once the cause,
+	// such as a full disk, has been dealt with.
+	Degraded error
+}
+
+// Health reports whether the database is accepting writes.
+func (db *DB) Health() Health {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	db.degradedMu.Lock()
+	defer db.degradedMu.Unlock()
+	return Health{
+		ReadOnly: db.degraded != nil || db.opts.readOnly || db.manifest.Frozen != nil,
+		Degraded: db.degraded,
+	}
+}
+
+// Resume accepts writes again after the database degraded to read-only. It
+// first checks the configured disk headroom is free and flushes the active
+// segment and the index, and stays degraded if either fails. Resuming a
+// database that isn't degraded does nothing.
+func (db *DB) Resume() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrDatabaseClosed
+	}
+	db.degradedMu.Lock()
+	degraded := db.degraded != nil
+	db.degradedMu.Unlock()
+	if !degraded {
+		return nil
+	}
+	if err := db.checkSpace(0); err != nil {
+		return err
+	}
+	if s := db.activeSegment(); s != nil {
+		if err := db.flushSegment(s); err != nil {
+			return err
+		}
+	}
+	db.degradedMu.Lock()
+	db.degraded = nil
+	db.degradedMu.Unlock()
+	db.event(EventResume, "accepting writes", db.path, nil)
+	return nil
+}
+
+// degrade switches the database to read-only if err shows the disk can't
+// take more writes, raising a Warning. It returns err.
+func (db *DB) degrade(err error) error {
+	if err == nil || !isWriteFailure(err) {
+		return err
+	}
+	db.degradedMu.Lock()
+	defer db.degradedMu.Unlock()
+	if db.degraded == nil {
+		db.degraded = err
+		db.warn(Warning{Op: "degrade", Path: db.path, Err: err})
+	}
+	return err
+}
+
+// degradedErr returns the error writes fail with while the database is
+// degraded, or nil.
+func (db *DB) degradedErr() error {
+	db.degradedMu.Lock()
+	defer db.degradedMu.Unlock()
+	if db.degraded == nil {
+		return nil
+	}
+	return errors.Wrapf(ErrReadOnly, "degraded after write failure: %v", db.degraded)
+}
+
+// isWriteFailure returns true if err means writes will keep failing until
+// something outside the database changes.
+func isWriteFailure(err error) bool {
+	return isDiskFull(err) || errors.Is(err, ErrWriteFault) ||
+		errors.Is(err, syscall.EIO) || errors.Is(err, syscall.EROFS)
+}
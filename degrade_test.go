@@ -0,0 +1,64 @@
+package archivedb
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_Degrade(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	var warnings []Warning
+	db, err := Open(dir, WarningHandlerOption(func(w Warning) {
+		warnings = append(warnings, w)
+	}))
+	require.NoError(err)
+	defer db.Close()
+	require.NoError(db.Put([]byte("foo"), []byte("bar")))
+	require.Equal(Health{}, db.Health())
+
+	// Errors that don't point at the disk are left alone.
+	require.Error(db.degrade(errors.New("boom")))
+	require.Equal(Health{}, db.Health())
+
+	cause := ErrWriteFault
+	require.Equal(cause, db.degrade(cause))
+	require.Equal(Health{ReadOnly: true, Degraded: cause}, db.Health())
+	require.Len(warnings, 1)
+	require.Equal("degrade", warnings[0].Op)
+
+	require.ErrorIs(db.Put([]byte("foo"), []byte("baz")), ErrReadOnly)
+	require.ErrorIs(db.Delete([]byte("foo")), ErrReadOnly)
+	v, err := db.Get([]byte("foo"))
+	require.NoError(err)
+	require.Equal([]byte("bar"), v)
+
+	require.NoError(db.Resume())
+	require.Equal(Health{}, db.Health())
+	require.NoError(db.Put([]byte("foo"), []byte("baz")))
+	v, err = db.Get([]byte("foo"))
+	require.NoError(err)
+	require.Equal([]byte("baz"), v)
+
+	// Resuming a healthy database does nothing.
+	require.NoError(db.Resume())
+}
+
+func TestDB_HealthReadOnly(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	db, err := Open(dir)
+	require.NoError(err)
+	require.NoError(db.Close())
+
+	db, err = Open(dir, FollowerOption(0))
+	require.NoError(err)
+	defer db.Close()
+	require.Equal(Health{ReadOnly: true}, db.Health())
+}
@@ -0,0 +1,112 @@
+package archivedb
+
+import (
+	"encoding/binary"
+
+	"github.com/millken/archivedb/format"
+	"github.com/pkg/errors"
+)
+
+// deltaCodecID is the codec id, among those Codec reserves, of values
+// stored by DeltaEncodingOption as a delta against the previous entry of
+// their key.
+const deltaCodecID = 2
+
+// maxDeltaChain is the most deltas read to rebuild a value; the next
+// version of the key is stored in full.
+const maxDeltaChain = 8
+
+// encodeDelta returns value as a delta against base: the lengths of the
+// prefix and suffix they share, as uvarints, and the bytes in between.
+func encodeDelta(base, value []byte) []byte {
+	n := len(base)
+	if len(value) < n {
+		n = len(value)
+	}
+	prefix := 0
+	for prefix < n && base[prefix] == value[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < n-prefix && base[len(base)-1-suffix] == value[len(value)-1-suffix] {
+		suffix++
+	}
+	b := make([]byte, 2*binary.MaxVarintLen32+len(value)-prefix-suffix)
+	n = binary.PutUvarint(b, uint64(prefix))
+	n += binary.PutUvarint(b[n:], uint64(suffix))
+	return append(b[:n], value[prefix:len(value)-suffix]...)
+}
+
+// applyDelta returns the value encodeDelta encoded as d against base.
+func applyDelta(base, d []byte) ([]byte, error) {
+	prefix, n := binary.Uvarint(d)
+	if n <= 0 {
+		return nil, errors.New("invalid delta prefix")
+	}
+	d = d[n:]
+	suffix, n := binary.Uvarint(d)
+	if n <= 0 || prefix > uint64(len(base)) || suffix > uint64(len(base))-prefix {
+		return nil, errors.New("invalid delta suffix")
+	}
+	d = d[n:]
+	value := make([]byte, 0, int(prefix)+len(d)+int(suffix))
+	value = append(value, base[:prefix]...)
+	value = append(value, d...)
+	return append(value, base[uint64(len(base))-suffix:]...), nil
+}
+
+// deltaBase returns the value of prev, the previous entry of the encoded
+// key, if DeltaEncodingOption is on and an entry with the flag flag and
+// the attributes attrs can be stored as a delta against it: it must be a
+// value in the active segment, not chunked, rebuilt from fewer than
+// maxDeltaChain deltas. The caller must hold db.mu for writing.
+func (db *DB) deltaBase(flag, attrs uint8, key []byte, prev item) ([]byte, bool) {
+	s := db.activeSegment()
+	if !db.opts.deltaEncoding || flag != EntryInsertFlag || attrs&format.AttrChunked != 0 ||
+		prev.off == 0 || s == nil || s.ID() != prev.ID() || db.windowEnded() {
+		return nil, false
+	}
+	for it, n := prev, 0; ; n++ {
+		hdr, err := s.ReadEntryHeader(it.Offset())
+		if err != nil || hdr.Flag != EntryInsertFlag || hdr.Attrs&format.AttrChunked != 0 {
+			return nil, false
+		} else if hdr.Codec() != deltaCodecID {
+			break
+		} else if n+1 == maxDeltaChain {
+			return nil, false
+		}
+		if it, _, err = db.readLink(it, key); err != nil || it.ID() != s.ID() {
+			return nil, false
+		}
+	}
+	// A base that can't be read only costs the saving.
+	e, err := db.readEntry(s, prev.Offset(), key, true)
+	if err != nil {
+		return nil, false
+	}
+	return e.data, true
+}
+
+// undelta replaces the data of e, a delta decrypted as read from a
+// segment, with the value it was written with. The caller must hold
+// db.mu.
+func (db *DB) undelta(e *entry) error {
+	s := db.segment(e.prev.ID())
+	if e.prev.off == 0 || s == nil {
+		return errors.Wrap(ErrInvalidEntryHeader, "delta without a base")
+	} else if s.detached {
+		return ErrSegmentDetached
+	}
+	base, err := db.readEntry(s, e.prev.Offset(), e.key, true)
+	if err != nil {
+		return errors.Wrap(err, "read delta base")
+	} else if base.hdr.Flag != EntryInsertFlag {
+		return errors.Wrap(ErrInvalidEntryHeader, "delta base is not a value")
+	}
+	data, err := applyDelta(base.data, e.data)
+	if err != nil {
+		return errors.Wrap(ErrInvalidEntryHeader, err.Error())
+	}
+	e.data = data
+	return nil
+}
@@ -0,0 +1,146 @@
+package archivedb
+
+import "github.com/pkg/errors"
+
+var (
+	ErrSegmentDetached    = errors.New("segment is detached")
+	ErrSegmentNotDetached = errors.New("segment is not detached")
+)
+
+// DetachSegment takes a sealed segment offline: its keys are removed from
+// the index and it is unmapped, so rarely read data uses no memory until
+// AttachSegment. The segment is recorded as detached in the manifest and
+// stays offline across reopening. Values returned by Get from the segment
+// must not be used after DetachSegment returns.
+func (db *DB) DetachSegment(id uint32) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	if s := db.segment(id); s == nil {
+		return ErrSegmentNotFound
+	} else if s.detached {
+		return ErrSegmentDetached
+	}
+	return db.detachSegments([]uint32{id})
+}
+
+// AttachSegment brings a detached segment back online, restoring its keys
+// unless they were overwritten or deleted since. Keys whose newer entries
+// are in segments that are still detached get the older value until those
+// are attached too.
+func (db *DB) AttachSegment(id uint32) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	if s := db.segment(id); s == nil {
+		return ErrSegmentNotFound
+	} else if !s.detached {
+		return ErrSegmentNotDetached
+	}
+	return db.attachSegments([]uint32{id})
+}
+
+// DetachedSegments returns the ids of the detached segments.
+func (db *DB) DetachedSegments() ([]uint32, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrDatabaseClosed
+	}
+	var ids []uint32
+	for _, s := range db.segments {
+		if s.detached {
+			ids = append(ids, s.ID())
+		}
+	}
+	return ids, nil
+}
+
+// detachSegments takes sealed segments offline. The caller must hold db.mu.
+func (db *DB) detachSegments(ids []uint32) error {
+	if db.merkle != nil {
+		return errors.New("segments can't be detached with the merkle log enabled")
+	}
+	detach := make(map[uint32]bool, len(ids))
+	for _, id := range ids {
+		if db.segment(id) == nil {
+			return errors.Wrapf(ErrSegmentNotFound, "segment %s", segmentFilename(id))
+		} else if _, ok := db.manifest.sealed(id); !ok {
+			return errors.Errorf("segment %s is not sealed", segmentFilename(id))
+		} else if db.segmentRefs[id] > 0 {
+			return errors.Wrapf(ErrSegmentReferenced, "segment %s", segmentFilename(id))
+		}
+		detach[id] = true
+	}
+	var keys []uint64
+	if err := db.index.ForEach(func(k uint64, it item) error {
+		if detach[it.ID()] {
+			keys = append(keys, k)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := db.removeKey(k); err != nil {
+			return err
+		}
+	}
+	for i := range db.manifest.Segments {
+		sc := &db.manifest.Segments[i]
+		if !detach[sc.ID] {
+			continue
+		}
+		s := db.segment(sc.ID)
+		sc.Detached, sc.Entries, sc.Tombstones = true, s.stats.Entries, s.stats.Tombstones
+		db.opts.env.release(s.MappedSize())
+		if err := s.Close(); err != nil {
+			return err
+		}
+		s.detached = true
+	}
+	return db.saveManifest()
+}
+
+// attachSegments brings detached segments back online. The caller must
+// hold db.mu.
+func (db *DB) attachSegments(ids []uint32) error {
+	for _, id := range ids {
+		sc, _ := db.manifest.sealed(id)
+		path := db.sealedPath(sc)
+		if err := verifySegmentFile(path, sc); err != nil {
+			return errors.Wrapf(err, "attach segment %s", segmentFilename(id))
+		}
+		s, err := db.openSegment(id, path)
+		if err != nil {
+			return err
+		}
+		db.segments[id] = s
+
+		// Restore keys whose latest entry is in this segment.
+		for off := uint32(SegmentHeaderSize); off < s.Size(); {
+			e, err := s.ReadEntry(off)
+			if err != nil {
+				return err
+			}
+			// Chunks are reached through their chunk list, not the index.
+			k := db.opts.hashFunc(e.key)
+			if it, ok := db.index.Get(k); e.hdr.Flag != EntryChunkFlag && e.hdr.Flag != EntryHoleFlag && (!ok || it.before(item{id, off})) {
+				if err := db.index.Insert(k, id, off); err != nil {
+					return err
+				}
+			}
+			off += e.Size()
+		}
+		for i := range db.manifest.Segments {
+			if db.manifest.Segments[i].ID == id {
+				db.manifest.Segments[i].Detached = false
+			}
+		}
+	}
+	return db.saveManifest()
+}
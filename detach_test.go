@@ -0,0 +1,49 @@
+package archivedb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_DetachSegment(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+
+	require.NoError(db.Put([]byte("old"), []byte("1")))
+	require.NoError(db.Put([]byte("gone"), []byte("1")))
+	mustRollover(t, db)
+	require.NoError(db.Delete([]byte("gone")))
+
+	require.ErrorIs(db.DetachSegment(7), ErrSegmentNotFound)
+	require.Error(db.DetachSegment(1), "active segment isn't sealed")
+	require.ErrorIs(db.AttachSegment(0), ErrSegmentNotDetached)
+	before := db.IndexMemoryUsage()
+	require.NoError(db.DetachSegment(0))
+	require.ErrorIs(db.DetachSegment(0), ErrSegmentDetached)
+	require.Less(db.IndexMemoryUsage(), before)
+	ids, err := db.DetachedSegments()
+	require.NoError(err)
+	require.Equal([]uint32{0}, ids)
+	_, err = db.Get([]byte("old"))
+	require.ErrorIs(err, ErrKeyNotFound)
+
+	// Reads and compaction planning skip the detached segment.
+	_, err = db.PlanCompaction()
+	require.NoError(err)
+	require.NoError(db.Put([]byte("new"), []byte("2")))
+
+	require.NoError(db.AttachSegment(0))
+	v, err := db.Get([]byte("old"))
+	require.NoError(err)
+	require.Equal("1", string(v))
+	_, err = db.Get([]byte("gone"))
+	require.ErrorIs(err, ErrKeyDeleted)
+	ids, err = db.DetachedSegments()
+	require.NoError(err)
+	require.Empty(ids)
+}
@@ -0,0 +1,204 @@
+package archivedb
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// dictionaryCodecID is the codec id, among those Codec reserves, of values
+// compressed by SegmentDictionaryOption with the dictionary of their
+// segment.
+const dictionaryCodecID = 3
+
+// MaxDictionarySize is the largest dictionary SegmentDictionaryOption
+// trains, the size of the DEFLATE window.
+const MaxDictionarySize = 32 << 10
+
+const (
+	// maxDictionarySamples is the most values sampled for a dictionary.
+	maxDictionarySamples = 64
+	// minDictionarySamples is the fewest values a dictionary is trained
+	// from.
+	minDictionarySamples = 8
+)
+
+// dictionaryCodec compresses with DEFLATE at its fastest level, using dict
+// as a preset dictionary.
+type dictionaryCodec struct {
+	dict []byte
+}
+
+func (dictionaryCodec) ID() uint8 { return dictionaryCodecID }
+
+func (c dictionaryCodec) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriterDict(&buf, flate.BestSpeed, c.dict)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	} else if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c dictionaryCodec) Decompress(src []byte) ([]byte, error) {
+	r := flate.NewReaderDict(bytes.NewReader(src), c.dict)
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// dictionarySamples holds values sampled evenly from those written: every
+// stride-th one, the stride doubling whenever the samples are full.
+type dictionarySamples struct {
+	values [][]byte
+	stride int
+	skip   int
+}
+
+// add samples value, keeping at most its first max bytes.
+func (s *dictionarySamples) add(value []byte, max int) {
+	if s.skip > 0 {
+		s.skip--
+		return
+	}
+	if len(s.values) == maxDictionarySamples {
+		// Keep every other sample.
+		for i := 0; i < len(s.values)/2; i++ {
+			s.values[i] = s.values[2*i+1]
+		}
+		s.values = s.values[:len(s.values)/2]
+		s.stride *= 2
+	}
+	if s.stride == 0 {
+		s.stride = 1
+	}
+	if len(value) > max {
+		value = value[:max]
+	}
+	s.values = append(s.values, append([]byte(nil), value...))
+	s.skip = s.stride - 1
+}
+
+// train returns a dictionary of at most size bytes, the samples
+// concatenated with the latest last, where DEFLATE finds them soonest, or
+// nil if there are too few samples.
+func (s *dictionarySamples) train(size int) []byte {
+	if len(s.values) < minDictionarySamples {
+		return nil
+	}
+	var dict []byte
+	for _, v := range s.values {
+		dict = append(dict, v...)
+	}
+	if len(dict) > size {
+		dict = dict[len(dict)-size:]
+	}
+	return dict
+}
+
+// sampleValue samples value, about to be written, for the dictionary of
+// the next segment. The caller must hold db.mu for writing.
+func (db *DB) sampleValue(value []byte) {
+	if size := db.opts.dictionarySize; size > 0 && db.opts.codec == DeflateCodec && len(value) >= db.opts.compressThreshold {
+		db.samples.add(value, size/minDictionarySamples)
+	}
+}
+
+// writeDictionary writes a dictionary trained from the values sampled since
+// the last one as the first entry of the empty segment s, unless next, the
+// entry to be written after it, would no longer fit. The dictionary is a
+// chunk with an empty key, which no value refers to, stored encrypted as
+// configured. The caller must hold db.mu for writing.
+func (db *DB) writeDictionary(s *segment, next entry) error {
+	if db.opts.dictionarySize == 0 || db.opts.codec != DeflateCodec {
+		return nil
+	}
+	dict := db.samples.train(db.opts.dictionarySize)
+	db.samples = dictionarySamples{}
+	if dict == nil {
+		return nil
+	}
+	stored, f, attrs, err := db.encodeValue(EntryChunkFlag, nil, dict, nil, nil)
+	if err != nil {
+		return err
+	}
+	e := createEntryWithFields(EntryChunkFlag, nil, stored, attrs, f)
+	if s.Size()+e.Size()+next.Size() > SegmentSize {
+		return nil
+	} else if err := s.WriteEntry(e); err != nil {
+		return err
+	}
+	s.dict.Store(dict)
+	atomic.AddInt64(&db.stats.physicalBytes, int64(e.Size()))
+	db.addUnsynced(int64(e.Size()))
+	db.seq++
+	return nil
+}
+
+// activeDictionary returns the dictionary of the active segment to
+// compress values written to it with, or nil. The caller must hold db.mu
+// for writing.
+func (db *DB) activeDictionary() []byte {
+	s := db.activeSegment()
+	if s == nil || db.opts.dictionarySize == 0 || db.opts.codec != DeflateCodec {
+		return nil
+	}
+	dict, err := db.segmentDictionary(s)
+	if err != nil {
+		return nil
+	}
+	return dict
+}
+
+// segmentDictionary returns the dictionary written first in s, or nil if
+// it has none. The caller must hold db.mu.
+func (db *DB) segmentDictionary(s *segment) ([]byte, error) {
+	if dict, ok := s.dict.Load().([]byte); ok {
+		return dict, nil
+	} else if s.Size() <= SegmentHeaderSize {
+		return nil, nil
+	}
+	e, err := s.ReadEntry(SegmentHeaderSize)
+	if err != nil {
+		return nil, err
+	} else if e.hdr.Flag != EntryChunkFlag || len(e.key) != 0 {
+		s.dict.Store([]byte(nil))
+		return nil, nil
+	} else if err := e.verify(nil); err != nil {
+		return nil, errors.Wrap(err, "read segment dictionary")
+	} else if err := db.decodeValue(&e); err != nil {
+		return nil, errors.Wrap(err, "read segment dictionary")
+	}
+	dict := append([]byte(nil), e.data...)
+	s.dict.Store(dict)
+	return dict, nil
+}
+
+// undictionary replaces the data of e, decrypted as read from a segment,
+// with the value it was written with, decompressing it with the
+// dictionary of its segment. The caller must hold db.mu.
+func (db *DB) undictionary(e *entry) error {
+	s := db.segment(e.seg)
+	if s == nil {
+		return ErrSegmentNotFound
+	}
+	dict, err := db.segmentDictionary(s)
+	if err != nil {
+		return err
+	} else if dict == nil {
+		return errors.Wrap(ErrInvalidEntryHeader, "segment has no dictionary")
+	}
+	data, err := dictionaryCodec{dict}.Decompress(e.data)
+	if err != nil {
+		return errors.Wrap(err, "decompress value with the segment dictionary")
+	}
+	e.data = data
+	return nil
+}
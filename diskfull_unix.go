@@ -0,0 +1,16 @@
+//go:build darwin || dragonfly || freebsd || linux || nacl || netbsd || openbsd
+// +build darwin dragonfly freebsd linux nacl netbsd openbsd
+
+package archivedb
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// isDiskFull returns true if err was caused by the filesystem or the user's
+// quota running out of space.
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
@@ -0,0 +1,18 @@
+package archivedb
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	errorHandleDiskFull syscall.Errno = 39  // ERROR_HANDLE_DISK_FULL
+	errorDiskFull       syscall.Errno = 112 // ERROR_DISK_FULL
+)
+
+// isDiskFull returns true if err was caused by the volume running out of
+// space.
+func isDiskFull(err error) bool {
+	return errors.Is(err, errorDiskFull) || errors.Is(err, errorHandleDiskFull)
+}
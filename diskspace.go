@@ -0,0 +1,23 @@
+package archivedb
+
+import "github.com/pkg/errors"
+
+// ErrInsufficientSpace is returned when the filesystem doesn't have room
+// for a new segment plus the configured headroom.
+var ErrInsufficientSpace = errors.New("insufficient disk space")
+
+// checkSpace returns ErrInsufficientSpace unless the filesystem holding the
+// database has need bytes free on top of the configured headroom. The check
+// is skipped on platforms where free space can't be determined.
+func (db *DB) checkSpace(need uint64) error {
+	free, ok, err := diskFree(db.path)
+	if err != nil {
+		return errors.Wrap(err, "check disk space")
+	} else if !ok {
+		return nil
+	}
+	if want := need + db.opts.headroom; free < want {
+		return errors.Wrapf(ErrInsufficientSpace, "%d bytes free, %d needed", free, want)
+	}
+	return nil
+}
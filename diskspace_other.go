@@ -0,0 +1,10 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!windows
+
+package archivedb
+
+// diskFree reports that free space can't be determined on this platform,
+// so the space checks are skipped.
+func diskFree(path string) (uint64, bool, error) {
+	return 0, false, nil
+}
@@ -0,0 +1,40 @@
+package archivedb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_DiskHeadroom(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	// No filesystem has an exabyte to spare.
+	const huge = 1 << 60
+	if _, ok, err := diskFree(dir); err != nil || !ok {
+		t.Skip("free space unknown on this platform")
+	}
+	_, err := Open(dir, DiskHeadroomOption(huge))
+	require.ErrorIs(err, ErrInsufficientSpace)
+
+	db, err := Open(dir)
+	require.NoError(err)
+	require.NoError(db.Put([]byte("foo"), []byte("bar")))
+	require.NoError(db.SetOption(DiskHeadroomOption(huge)))
+
+	// The active segment keeps taking writes; only a rollover fails.
+	require.NoError(db.Put([]byte("foo"), []byte("baz")))
+	db.mu.Lock()
+	_, err = db.createSegment()
+	db.mu.Unlock()
+	require.ErrorIs(err, ErrInsufficientSpace)
+	require.Len(db.segments, 1)
+	require.Equal(Health{}, db.Health())
+
+	v, err := db.Get([]byte("foo"))
+	require.NoError(err)
+	require.Equal([]byte("baz"), v)
+	require.NoError(db.Close())
+}
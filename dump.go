@@ -0,0 +1,93 @@
+package archivedb
+
+import (
+	"hash/crc32"
+
+	"github.com/millken/archivedb/format"
+	"github.com/millken/archivedb/internal/mmap"
+	"github.com/pkg/errors"
+)
+
+// SegmentEntryInfo describes an entry found by DumpSegment.
+type SegmentEntryInfo struct {
+	Offset     uint32
+	Flag       uint8
+	Key        []byte
+	KeySize    uint8
+	ValueSize  uint32
+	Checksum   uint32
+	ChecksumOK bool
+	Tag        uint32
+	Truncated  bool // entry runs past the end of the file; Key is nil
+	// EntryAttrs are decoded from the header, but Expires is left zero
+	// for a truncated entry.
+	EntryAttrs
+}
+
+// DumpSegment calls fn for every entry in the segment file at path, in file
+// order. Unlike Open it doesn't stop at, or repair, a bad entry: entries
+// failing their checksum are reported with ChecksumOK false, and a
+// truncated entry at the end of the file is reported before returning. The
+// walk stops at the first header with an invalid flag, which is normally
+// the unused tail of the segment. Key is only valid during the call.
+func DumpSegment(path string, fn func(info SegmentEntryInfo) error) error {
+	m, err := mmap.OpenFile(path, mmap.Read)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	buf, err := m.ReadOff(0, SegmentHeaderSize)
+	if err != nil {
+		return errors.Wrap(ErrInvalidSegment, "truncated segment header")
+	}
+	if hdr, err := decodeSegmentHeader(buf); err != nil {
+		return err
+	} else if hdr.Version != SegmentVersion {
+		return ErrInvalidSegmentVersion
+	}
+
+	end := uint64(m.Len())
+	for off := uint64(SegmentHeaderSize); off+EntryHeaderSize <= end; {
+		buf, err := m.ReadOff(int(off), EntryHeaderSize)
+		if err != nil {
+			return err
+		}
+		hdr, err := readEntryHeader(buf)
+		if err != nil {
+			return err
+		} else if !isValidEntryFlag(hdr.Flag) {
+			return nil
+		}
+		info := SegmentEntryInfo{
+			Offset:     uint32(off),
+			Flag:       hdr.Flag,
+			KeySize:    hdr.KeySize,
+			ValueSize:  hdr.ValueSize,
+			Checksum:   hdr.Checksum,
+			Tag:        hdr.Tag,
+			EntryAttrs: newEntryAttrs(hdr, 0),
+		}
+		if off+uint64(hdr.EntrySize()) > end {
+			info.Truncated = true
+			return fn(info)
+		}
+		start := int(off) + EntryHeaderSize
+		if info.Key, err = m.ReadOff(start, int(hdr.KeySize)); err != nil {
+			return err
+		}
+		value, err := m.ReadOff(start+int(hdr.KeySize), int(hdr.ValueSize))
+		if err != nil {
+			return err
+		}
+		info.ChecksumOK = crc32.Checksum(value, CastagnoliCrcTable) == hdr.Checksum
+		if f, _, err := format.SplitValue(hdr, value); err == nil {
+			info.EntryAttrs = newEntryAttrs(hdr, f.Expires)
+		}
+		if err := fn(info); err != nil {
+			return err
+		}
+		off += uint64(hdr.EntrySize())
+	}
+	return nil
+}
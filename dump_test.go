@@ -0,0 +1,68 @@
+package archivedb
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpSegment(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	require.NoError(db.Put([]byte("a"), []byte("1")))
+	require.NoError(db.Put([]byte("b"), []byte("2")))
+	require.NoError(db.Delete([]byte("a")))
+	require.NoError(db.Close())
+
+	// Corrupt the value of "b".
+	path := filepath.Join(dir, segmentFilename(0))
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	require.NoError(err)
+	_, err = f.WriteAt([]byte("!"), SegmentHeaderSize+2*EntryHeaderSize+3)
+	require.NoError(err)
+	require.NoError(f.Close())
+
+	var infos []SegmentEntryInfo
+	require.NoError(DumpSegment(path, func(info SegmentEntryInfo) error {
+		info.Key = append([]byte(nil), info.Key...)
+		infos = append(infos, info)
+		return nil
+	}))
+	require.Len(infos, 3)
+	require.Equal(uint32(SegmentHeaderSize), infos[0].Offset)
+	require.Equal("a", string(infos[0].Key))
+	require.True(infos[0].ChecksumOK)
+	require.Equal("b", string(infos[1].Key))
+	require.False(infos[1].ChecksumOK)
+	require.Equal(EntryDeleteFlag, infos[2].Flag)
+	require.Equal(uint32(0), infos[2].ValueSize)
+	require.True(infos[2].ChecksumOK)
+}
+
+func TestDumpSegment_Attrs(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir, EncryptionOption(bytes.Repeat([]byte{7}, 16)))
+	require.NoError(err)
+	expires := time.Now().Add(time.Hour)
+	require.NoError(db.PutWithOptions([]byte("a"), []byte("1"), WriteOptions{TTL: time.Hour}))
+	require.NoError(db.Close())
+
+	var infos []SegmentEntryInfo
+	require.NoError(DumpSegment(filepath.Join(dir, segmentFilename(0)), func(info SegmentEntryInfo) error {
+		infos = append(infos, info)
+		return nil
+	}))
+	require.Len(infos, 1)
+	require.True(infos[0].Encrypted)
+	require.Zero(infos[0].Codec)
+	require.WithinDuration(expires, infos[0].Expires, time.Minute)
+}
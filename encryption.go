@@ -0,0 +1,142 @@
+package archivedb
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+
+	"github.com/millken/archivedb/format"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrDecryptionFailed is returned when an encrypted value can't be
+	// decrypted, because the encryption key is wrong or the value was
+	// tampered with.
+	ErrDecryptionFailed = errors.New("decryption failed")
+	// ErrNoEncryptionKey is returned when reading an encrypted value from a
+	// database opened without EncryptionOption.
+	ErrNoEncryptionKey = errors.New("value is encrypted but no encryption key is set")
+)
+
+// encrypt seals plaintext, the value to store for key, with a random nonce,
+// and returns the ciphertext and the nonce. The stored key is authenticated
+// with the value, so an encrypted value can't be moved to another key.
+func (db *DB) encrypt(key, plaintext []byte) ([]byte, [format.NonceSize]byte, error) {
+	var nonce [format.NonceSize]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, nonce, errors.Wrap(err, "generate nonce")
+	}
+	return db.opts.cipher.Seal(nil, nonce[:], plaintext, key), nonce, nil
+}
+
+// decrypt replaces the data of e, read from a segment, with its plaintext.
+// It must be called before the key of e is decoded.
+func (db *DB) decrypt(e *entry) error {
+	if e.hdr.Attrs&format.AttrEncrypted == 0 {
+		return nil
+	} else if db.opts.cipher == nil {
+		return ErrNoEncryptionKey
+	}
+	data, err := db.opts.cipher.Open(nil, e.nonce[:], e.data, e.key)
+	if err != nil {
+		return ErrDecryptionFailed
+	}
+	e.data = data
+	return nil
+}
+
+// decodeValue replaces the data of e, read from a segment, with the value
+// it was written with, decrypting and decompressing it and reading its
+// chunks if it was chunked. The caller must hold db.mu.
+func (db *DB) decodeValue(e *entry) error {
+	if err := db.decrypt(e); err != nil {
+		return err
+	} else if err := db.decompress(e); err != nil {
+		return err
+	} else if e.hdr.Attrs&format.AttrChunked != 0 {
+		return db.readChunks(e)
+	}
+	return nil
+}
+
+type encryptedKeyTransform struct {
+	aead cipher.AEAD
+	mac  []byte
+	name string
+}
+
+// EncryptedKeyTransform returns a KeyTransform that encrypts keys with
+// AES-GCM under a key derived from secret, which must be 16, 24 or 32
+// bytes long. Encryption is deterministic, the nonce being derived from
+// the key, so equal keys still hash alike; this reveals which entries
+// share a key, but not the key. Encrypted keys are 28 bytes longer than
+// the keys they encrypt. The encryption key, the nonce key and the
+// key-check value naming the transform are derived separately from secret
+// with HKDF, so the name reveals nothing about secret itself.
+func EncryptedKeyTransform(secret []byte) (KeyTransform, error) {
+	switch len(secret) {
+	case 16, 24, 32:
+	default:
+		return nil, errors.Wrap(aes.KeySizeError(len(secret)), "key encryption secret")
+	}
+	block, err := aes.NewCipher(hkdfSHA256(secret, "archivedb key encryption", len(secret)))
+	if err != nil {
+		return nil, errors.Wrap(err, "key encryption secret")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "key encryption secret")
+	}
+	check := hmac.New(sha256.New, hkdfSHA256(secret, "archivedb key check", sha256.Size))
+	check.Write([]byte("archivedb key check value"))
+	return &encryptedKeyTransform{
+		aead: aead,
+		mac:  hkdfSHA256(secret, "archivedb key nonce", sha256.Size),
+		name: "aes-gcm:" + hex.EncodeToString(check.Sum(nil)[:8]),
+	}, nil
+}
+
+// hkdfSHA256 derives a key of n bytes, at most sha256.Size, from secret for
+// the purpose named by label, with HKDF (RFC 5869) over SHA-256 and no
+// salt.
+func hkdfSHA256(secret []byte, label string, n int) []byte {
+	extract := hmac.New(sha256.New, make([]byte, sha256.Size))
+	extract.Write(secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(label))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)[:n]
+}
+
+func (t *encryptedKeyTransform) Name() string {
+	return t.name
+}
+
+func (t *encryptedKeyTransform) Encode(key []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, t.mac)
+	mac.Write(key)
+	nonce := mac.Sum(nil)[:t.aead.NonceSize()]
+	b := make([]byte, 0, len(nonce)+len(key)+t.aead.Overhead())
+	b = append(b, nonce...)
+	return t.aead.Seal(b, nonce, key, nil), nil
+}
+
+// Decode returns key as it is if it can't be decrypted, which only
+// happens to keys corrupted on disk since the secret is bound to the
+// database by the name of the transform.
+func (t *encryptedKeyTransform) Decode(key []byte) []byte {
+	n := t.aead.NonceSize()
+	if len(key) < n {
+		return key
+	}
+	b, err := t.aead.Open(nil, key[:n], key[n:], nil)
+	if err != nil {
+		return key
+	}
+	return b
+}
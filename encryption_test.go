@@ -0,0 +1,151 @@
+package archivedb
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptionOption(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	secret := bytes.Repeat([]byte{7}, 32)
+	db, err := Open(dir, EncryptionOption(secret), CompressionOption(DeflateCodec, 64))
+	require.NoError(err)
+	defer db.Close()
+
+	big := bytes.Repeat([]byte("plaintext"), 100)
+	require.NoError(db.Put([]byte("small"), []byte("plaintext secret")))
+	require.NoError(db.Put([]byte("big"), big))
+	require.NoError(db.Put([]byte("small"), []byte("plaintext again")))
+	require.NoError(db.Delete([]byte("big")))
+	require.NoError(db.Put([]byte("big"), big))
+
+	check := func(db *DB) {
+		v, err := db.Get([]byte("small"))
+		require.NoError(err)
+		require.Equal([]byte("plaintext again"), v)
+		v, err = db.Get([]byte("big"))
+		require.NoError(err)
+		require.Equal(big, v)
+		values, err := db.GetPrefix([]byte("sm"), 1)
+		require.NoError(err)
+		require.Equal([]byte("plaintext again"), values["small"])
+	}
+	check(db)
+	require.ErrorIs(db.SetOption(EncryptionOption(secret)), ErrImmutableOption)
+
+	requireNotOnDisk(t, dir, "plaintext")
+
+	require.NoError(db.Close())
+	db, err = Open(dir, EncryptionOption(secret))
+	require.NoError(err)
+	defer db.Close()
+	check(db)
+
+	require.NoError(db.Close())
+	db, err = Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	_, err = db.Get([]byte("small"))
+	require.ErrorIs(err, ErrNoEncryptionKey)
+
+	require.NoError(db.Close())
+	db, err = Open(dir, EncryptionOption(bytes.Repeat([]byte{8}, 32)))
+	require.NoError(err)
+	defer db.Close()
+	_, err = db.Get([]byte("small"))
+	require.ErrorIs(err, ErrDecryptionFailed)
+
+	_, err = Open(dir, EncryptionOption([]byte("short")))
+	require.Error(err)
+}
+
+func TestEncryptedKeyTransform(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	secret := bytes.Repeat([]byte{7}, 16)
+	transform, err := EncryptedKeyTransform(secret)
+	require.NoError(err)
+	db, err := Open(dir, KeyTransformOption(transform), EncryptionOption(secret))
+	require.NoError(err)
+	defer db.Close()
+
+	require.NoError(db.Put([]byte("hidden-key"), []byte("v1")))
+	require.NoError(db.Put([]byte("hidden-key"), []byte("v2")))
+	v, err := db.Get([]byte("hidden-key"))
+	require.NoError(err)
+	require.Equal([]byte("v2"), v)
+
+	it := db.NewIterator()
+	require.True(it.First())
+	require.Equal([]byte("hidden-key"), it.Key())
+	require.False(it.Next())
+
+	requireNotOnDisk(t, dir, "hidden")
+
+	other, err := EncryptedKeyTransform(bytes.Repeat([]byte{8}, 16))
+	require.NoError(err)
+	require.NotEqual(transform.Name(), other.Name())
+	// The name is a key-check value, not a hash of the secret.
+	digest := sha256.Sum256(secret)
+	require.NotContains(transform.Name(), hex.EncodeToString(digest[:8]))
+	// The secret isn't used as the AES key itself.
+	aead := transform.(*encryptedKeyTransform).aead
+	block, err := aes.NewCipher(secret)
+	require.NoError(err)
+	raw, err := cipher.NewGCM(block)
+	require.NoError(err)
+	encoded, err := transform.Encode([]byte("k"))
+	require.NoError(err)
+	n := aead.NonceSize()
+	_, err = raw.Open(nil, encoded[:n], encoded[n:], nil)
+	require.Error(err)
+	_, err = EncryptedKeyTransform([]byte("short"))
+	require.Error(err)
+}
+
+func TestHKDFSHA256(t *testing.T) {
+	// RFC 5869, test case 3.
+	okm := hkdfSHA256(bytes.Repeat([]byte{0x0b}, 22), "", sha256.Size)
+	require.Equal(t, "8da4e775a563c18f715f802a063c5a31b8a11f5c5ee1879ec3454e5f3c738d2d", hex.EncodeToString(okm))
+}
+
+// requireNotOnDisk fails t if any file of the database at dir contains s.
+// Files are read a block at a time, as segments are 1GB long.
+func requireNotOnDisk(t *testing.T, dir, s string) {
+	fis, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	for _, fi := range fis {
+		if fi.IsDir() {
+			continue
+		}
+		f, err := os.Open(filepath.Join(dir, fi.Name()))
+		require.NoError(t, err)
+		// Each block starts with the end of the one before, so s is found
+		// across block boundaries too.
+		buf := make([]byte, len(s)-1+1<<20)
+		var kept int
+		for {
+			n, err := io.ReadFull(f, buf[kept:])
+			require.False(t, bytes.Contains(buf[:kept+n], []byte(s)), fi.Name())
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			require.NoError(t, err)
+			kept = copy(buf, buf[kept+n-(len(s)-1):kept+n])
+		}
+		f.Close()
+	}
+}
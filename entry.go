@@ -5,75 +5,55 @@ import (
 	"fmt"
 	"hash/crc32"
 	"math"
+	"time"
 
+	"github.com/millken/archivedb/format"
 	"github.com/pkg/errors"
 )
 
 const (
-	EntryMaxVersion       = math.MaxUint8
-	EntryHeaderSize       = 16
-	EntryFlagSize         = 1
-	EntryInsertFlag uint8 = 1
-	EntryDeleteFlag uint8 = 2
+	EntryMaxVersion = math.MaxUint8
+	EntryHeaderSize = format.EntryHeaderSize
+	EntryFlagSize   = 1
+	EntryInsertFlag = format.FlagInsert
+	EntryDeleteFlag = format.FlagDelete
+	EntryChunkFlag  = format.FlagChunk
+	EntryHoleFlag   = format.FlagHole
 )
 
-var CastagnoliCrcTable = crc32.MakeTable(crc32.Castagnoli)
-
-/*
-*
-+----------+---------------+---------------+---------------+
-| Flag(1B) |  keySize (1B) | ValueSize (4B)|  Checksum (4B)|
-+----------+---------------+---------------+---------------+
-*
-*/
-type EntryHeader struct {
-	ValueSize uint32
-	Checksum  uint32
-	KeySize   uint8
-	Flag      uint8
-	_         [6]byte // padding
-}
+var CastagnoliCrcTable = format.CastagnoliTable
+
+// EntryHeader is the header in front of every entry; see package format
+// for its layout.
+type EntryHeader = format.EntryHeader
 
 type entry struct {
 	key   []byte
-	value []byte
+	value []byte // as stored, with the fields flagged by hdr.Attrs
 	hdr   EntryHeader
-}
-
-func (hdr EntryHeader) EntrySize() uint32 {
-	return EntryHeaderSize + uint32(hdr.KeySize) + hdr.ValueSize
-}
-
-func (e *EntryHeader) Encode() []byte {
-	var b [EntryHeaderSize]byte
-	intconv.PutUint32(b[0:4], e.ValueSize)
-	intconv.PutUint32(b[4:8], e.Checksum)
-	b[9] = byte(e.KeySize)
-	b[10] = byte(e.Flag)
-
-	return b[:]
-}
-
-func (e *EntryHeader) String() string {
-	return fmt.Sprintf("Flag: %d, KeySize: %d, ValueSize: %d, Checksum: %d",
-		e.Flag, e.KeySize, e.ValueSize, e.Checksum)
+	// data is the value the entry was written with, and expires its expiry
+	// time in Unix nanoseconds, or zero if it doesn't expire. prev locates
+	// the previous entry of the key, or is zero. nonce is the nonce data
+	// was encrypted with, with format.AttrEncrypted. seg is the id of the
+	// segment e was read from.
+	data    []byte
+	expires int64
+	prev    item
+	nonce   [format.NonceSize]byte
+	seg     uint32
 }
 
 func (e *entry) Size() uint32 {
-	return EntryHeaderSize + uint32(e.hdr.KeySize) + e.hdr.ValueSize
+	return e.hdr.EntrySize()
 }
 
 //go:noinline
 func readEntryHeader(b []byte) (EntryHeader, error) {
-	if len(b) < EntryHeaderSize {
-		return EntryHeader{}, errors.Wrapf(ErrInvalidEntryHeader, "read entry header length %d", len(b))
+	hdr, err := format.ParseEntryHeader(b)
+	if err != nil {
+		return hdr, errors.Wrapf(ErrInvalidEntryHeader, "read entry header length %d", len(b))
 	}
-	return EntryHeader{
-		ValueSize: intconv.Uint32(b[0:4]),
-		Checksum:  intconv.Uint32(b[4:8]),
-		KeySize:   uint8(b[9]),
-		Flag:      uint8(b[10]),
-	}, nil
+	return hdr, nil
 }
 
 func createEntry(flag uint8, key, value []byte) entry {
@@ -86,19 +66,62 @@ func createEntry(flag uint8, key, value []byte) entry {
 			KeySize:   uint8(len(key)),
 			Flag:      flag,
 		},
+		data: value,
 	}
 }
 
+// createEntryWithFields returns an entry holding value behind the fields f
+// of the attributes attrs. With no attributes storing fields, it is
+// createEntry.
+func createEntryWithFields(flag uint8, key, value []byte, attrs uint8, f format.ValueFields) entry {
+	e := createEntry(flag, key, format.JoinValue(attrs, f, value))
+	e.hdr.Attrs = attrs
+	e.data, e.expires, e.prev, e.nonce = value, f.Expires, item{f.PrevSegment, f.PrevOffset}, f.Nonce
+	return e
+}
+
+// split decodes the fields stored in front of the value of an entry read
+// from a segment.
+func (e *entry) split() error {
+	f, data, err := format.SplitValue(e.hdr, e.value)
+	if err != nil {
+		return errors.Wrapf(ErrInvalidEntryHeader, "attributes %#x: %v", e.hdr.Attrs, err)
+	}
+	e.data, e.expires, e.prev, e.nonce = data, f.Expires, item{f.PrevSegment, f.PrevOffset}, f.Nonce
+	return nil
+}
+
+// mapped returns true if the data of e, read from a segment and decoded by
+// decodeValue, still points into the segment's mapping rather than memory
+// of its own.
+func (e *entry) mapped() bool {
+	return e.hdr.Codec() == 0 && e.hdr.Attrs&(format.AttrEncrypted|format.AttrChunked) == 0
+}
+
+// expired returns true if e has expired at now.
+func (e *entry) expired(now time.Time) bool {
+	return e.expires != 0 && now.UnixNano() >= e.expires
+}
+
 func (e *entry) verify(key []byte) error {
+	if err := e.matches(key); err != nil {
+		return err
+	}
+	if e.hdr.Checksum != crc32.Checksum(e.value, CastagnoliCrcTable) {
+		return ErrChecksumFailed
+	}
+	return nil
+}
+
+// matches checks the lengths in the header and the key of e, but not its
+// checksum.
+func (e *entry) matches(key []byte) error {
 	if e.hdr.KeySize != uint8(len(e.key)) || e.hdr.ValueSize != uint32(len(e.value)) {
 		return ErrLengthMismatch
 	}
 	if !bytes.Equal(e.key, key) {
 		return errors.Wrap(ErrKeyMismatch, "verify entry key")
 	}
-	if e.hdr.Checksum != crc32.Checksum(e.value, CastagnoliCrcTable) {
-		return ErrChecksumFailed
-	}
 	return nil
 }
 
@@ -110,7 +133,7 @@ func (e *entry) String() string {
 // isValidEntryFlag returns true if flag is valid.
 func isValidEntryFlag(flag uint8) bool {
 	switch flag {
-	case EntryInsertFlag, EntryDeleteFlag:
+	case EntryInsertFlag, EntryDeleteFlag, EntryChunkFlag, EntryHoleFlag:
 		return true
 	default:
 		return false
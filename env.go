@@ -0,0 +1,239 @@
+package archivedb
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrMmapBudgetExceeded = errors.New("mmap budget exceeded")
+	ErrEnvClosed          = errors.New("env closed")
+)
+
+// EnvOption sets parameters for Env construction
+type EnvOption func(*Env) error
+
+// Env holds resources shared by every DB opened with SharedEnvOption, so
+// a process embedding many databases can bound their combined footprint:
+// an mmap budget, a value cache, background workers and an import rate
+// limit.
+type Env struct {
+	mu        sync.Mutex
+	maxMapped int64
+	mapped    int64
+	dbs       map[*DB]uint64 // registered databases and their cache ids
+	lastID    uint64
+	closed    bool
+
+	cache   *valueCache  // or nil
+	workers *workerPool  // or nil for a pool per database
+	imports *rateLimiter // or nil
+}
+
+// NewEnv returns a new shared environment.
+func NewEnv(options ...EnvOption) (*Env, error) {
+	env := &Env{
+		dbs: make(map[*DB]uint64),
+	}
+	for _, opt := range options {
+		if err := opt(env); err != nil {
+			return nil, errors.Wrap(err, "Invalid env option")
+		}
+	}
+	return env, nil
+}
+
+// EnvMmapBudget limits the total segment bytes mapped by all databases in
+// the env.
+// Zero means unlimited.
+func EnvMmapBudget(bytes int64) EnvOption {
+	return func(env *Env) error {
+		if bytes < 0 {
+			return errors.New("mmap budget must not be negative")
+		}
+		env.maxMapped = bytes
+		return nil
+	}
+}
+
+// EnvValueCache keeps up to bytes of the keys and values read by Get in a
+// cache shared by all databases in the env, so hot values are served
+// without reading and verifying their entries again. Only values read
+// with ReadOptions.FillCache and VerifyChecksum are added. Zero, the
+// default, disables the cache.
+func EnvValueCache(bytes int64) EnvOption {
+	return func(env *Env) error {
+		if bytes < 0 {
+			return errors.New("value cache size must not be negative")
+		}
+		env.cache = nil
+		if bytes > 0 {
+			env.cache = newValueCache(bytes)
+		}
+		return nil
+	}
+}
+
+// EnvBackgroundWorkers runs the background work of all databases in the
+// env on one pool of n goroutines, in place of the pool each database
+// sizes with BackgroundWorkersOption.
+func EnvBackgroundWorkers(n int) EnvOption {
+	return func(env *Env) error {
+		if n < 1 {
+			return errors.New("background workers must be at least 1")
+		}
+		env.workers = newWorkerPool(n)
+		return nil
+	}
+}
+
+// EnvImportRateLimit limits the keys and values Import writes to all
+// databases in the env together to bytesPerSecond, on top of the pacing
+// each database sets with ImportPacingOption. Zero, the default, doesn't
+// limit them.
+func EnvImportRateLimit(bytesPerSecond int64) EnvOption {
+	return func(env *Env) error {
+		if bytesPerSecond < 0 {
+			return errors.New("import rate limit must not be negative")
+		}
+		env.imports = nil
+		if bytesPerSecond > 0 {
+			env.imports = &rateLimiter{rate: bytesPerSecond}
+		}
+		return nil
+	}
+}
+
+// MappedBytes returns the number of bytes currently mapped by databases
+// registered with the env.
+func (env *Env) MappedBytes() int64 {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	return env.mapped
+}
+
+// CachedBytes returns the bytes of keys and values in the value cache.
+func (env *Env) CachedBytes() int64 {
+	if env.cache == nil {
+		return 0
+	}
+	return env.cache.bytes()
+}
+
+// Len returns the number of databases registered with the env.
+func (env *Env) Len() int {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	return len(env.dbs)
+}
+
+// Close marks the env closed. Databases still registered keep working, but
+// no new database can join.
+func (env *Env) Close() error {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	env.closed = true
+	return nil
+}
+
+func (env *Env) register(db *DB) error {
+	if env == nil {
+		return nil
+	}
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	if env.closed {
+		return ErrEnvClosed
+	}
+	env.lastID++
+	env.dbs[db] = env.lastID
+	return nil
+}
+
+func (env *Env) unregister(db *DB) {
+	if env == nil {
+		return
+	}
+	env.mu.Lock()
+	id, ok := env.dbs[db]
+	delete(env.dbs, db)
+	env.mu.Unlock()
+	if ok && env.cache != nil {
+		env.cache.removeDB(id)
+	}
+}
+
+// workerPool returns the pool running the background work of a database
+// asking for n workers: the env's, if it has one.
+func (env *Env) workerPool(n int) *workerPool {
+	if env == nil || env.workers == nil {
+		return newWorkerPool(n)
+	}
+	return env.workers
+}
+
+// valueCache returns the value cache and the cache id of db, or a nil
+// cache if the env has none.
+func (env *Env) valueCache(db *DB) (*valueCache, uint64) {
+	if env == nil || env.cache == nil {
+		return nil, 0
+	}
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	return env.cache, env.dbs[db]
+}
+
+// throttleImport waits until Import may write n more bytes under the env's
+// import rate limit.
+func (env *Env) throttleImport(n int) {
+	if env == nil || env.imports == nil {
+		return
+	}
+	env.imports.wait(n)
+}
+
+// reserve accounts n mapped bytes against the budget.
+func (env *Env) reserve(n int64) error {
+	if env == nil {
+		return nil
+	}
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	if env.maxMapped > 0 && env.mapped+n > env.maxMapped {
+		return errors.Wrapf(ErrMmapBudgetExceeded, "%d of %d bytes mapped", env.mapped, env.maxMapped)
+	}
+	env.mapped += n
+	return nil
+}
+
+// release returns n mapped bytes to the budget.
+func (env *Env) release(n int64) {
+	if env == nil {
+		return
+	}
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	env.mapped -= n
+}
+
+// rateLimiter spaces out work so that it proceeds at rate bytes per second
+// on average, whichever goroutines do it.
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate int64
+	next time.Time // when the work taken so far is paid for
+}
+
+// wait waits until the work taken before is paid for, then takes n bytes.
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	start := l.next
+	if now := time.Now(); start.Before(now) {
+		start = now
+	}
+	l.next = start.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	l.mu.Unlock()
+	time.Sleep(time.Until(start))
+}
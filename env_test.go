@@ -0,0 +1,174 @@
+package archivedb
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnv(t *testing.T) {
+	require := require.New(t)
+	env, err := NewEnv(EnvMmapBudget(int64(SegmentSize) * 2))
+	require.NoError(err)
+
+	dir1, cleanup1 := MustTempDir()
+	defer cleanup1()
+	dir2, cleanup2 := MustTempDir()
+	defer cleanup2()
+	dir3, cleanup3 := MustTempDir()
+	defer cleanup3()
+
+	db1, err := Open(dir1, SharedEnvOption(env))
+	require.NoError(err)
+	db2, err := Open(dir2, SharedEnvOption(env))
+	require.NoError(err)
+	require.Equal(2, env.Len())
+	require.Equal(int64(SegmentSize)*2, env.MappedBytes())
+
+	_, err = Open(dir3, SharedEnvOption(env))
+	require.ErrorIs(err, ErrMmapBudgetExceeded)
+	require.Equal(2, env.Len())
+
+	require.NoError(db1.Close())
+	require.Equal(1, env.Len())
+	require.Equal(int64(SegmentSize), env.MappedBytes())
+
+	db3, err := Open(dir3, SharedEnvOption(env))
+	require.NoError(err)
+	require.NoError(db3.Close())
+	require.NoError(db2.Close())
+	require.Equal(0, env.Len())
+	require.Equal(int64(0), env.MappedBytes())
+
+	require.NoError(env.Close())
+	_, err = Open(dir1, SharedEnvOption(env))
+	require.ErrorIs(err, ErrEnvClosed)
+}
+
+func TestEnvValueCache(t *testing.T) {
+	require := require.New(t)
+	_, err := NewEnv(EnvValueCache(-1))
+	require.Error(err)
+	env, err := NewEnv(EnvValueCache(64))
+	require.NoError(err)
+	defer env.Close()
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	clock := newFakeClock()
+	db, err := Open(dir, SharedEnvOption(env), ClockOption(clock))
+	require.NoError(err)
+
+	require.NoError(db.Put([]byte("a"), []byte("1")))
+	require.NoError(db.PutWithTTL([]byte("b"), []byte("2"), time.Minute))
+	_, err = db.GetWithOptions([]byte("a"), ReadOptions{VerifyChecksum: true})
+	require.NoError(err)
+	require.Equal(int64(0), env.CachedBytes())
+	value, err := db.Get([]byte("a"))
+	require.NoError(err)
+	require.Equal([]byte("1"), value)
+	require.Equal(int64(2), env.CachedBytes())
+
+	// Hits return copies of the cached value.
+	value[0] = 'x'
+	value, err = db.Get([]byte("a"))
+	require.NoError(err)
+	require.Equal([]byte("1"), value)
+
+	// Overwritten values are read again, and cached values expire.
+	require.NoError(db.Put([]byte("a"), []byte("3")))
+	value, err = db.Get([]byte("a"))
+	require.NoError(err)
+	require.Equal([]byte("3"), value)
+	_, err = db.Get([]byte("b"))
+	require.NoError(err)
+	clock.Add(time.Minute)
+	_, err = db.Get([]byte("b"))
+	require.ErrorIs(err, ErrKeyExpired)
+
+	// Compaction moves values, leaving the cached ones behind.
+	require.NoError(db.Put([]byte("c"), make([]byte, 40)))
+	mustRollover(t, db)
+	require.NoError(db.Compact())
+	value, err = db.Get([]byte("a"))
+	require.NoError(err)
+	require.Equal([]byte("3"), value)
+
+	// Values larger than the cache are not cached, and the least recently
+	// used ones make room for new ones.
+	require.NoError(db.Put([]byte("big"), make([]byte, 64)))
+	_, err = db.Get([]byte("big"))
+	require.NoError(err)
+	require.LessOrEqual(env.CachedBytes(), int64(64))
+
+	require.NoError(db.Close())
+	require.Equal(int64(0), env.CachedBytes())
+}
+
+func TestEnvBackgroundWorkers(t *testing.T) {
+	require := require.New(t)
+	_, err := NewEnv(EnvBackgroundWorkers(0))
+	require.Error(err)
+	env, err := NewEnv(EnvBackgroundWorkers(1))
+	require.NoError(err)
+	defer env.Close()
+	dir1, cleanup1 := MustTempDir()
+	defer cleanup1()
+	dir2, cleanup2 := MustTempDir()
+	defer cleanup2()
+
+	db1, err := Open(dir1, SharedEnvOption(env), PreallocateOption(1e-9))
+	require.NoError(err)
+	db2, err := Open(dir2, SharedEnvOption(env), PreallocateOption(1e-9), BackgroundWorkersOption(4))
+	require.NoError(err)
+	require.Same(env.workers, db1.workers)
+	require.Same(env.workers, db2.workers)
+
+	// Work of one database waits for the other's on the only worker.
+	release := make(chan struct{})
+	var ran int32
+	db1.background(func() { <-release })
+	db2.background(func() { atomic.StoreInt32(&ran, 1) })
+	time.Sleep(20 * time.Millisecond)
+	require.Equal(int32(0), atomic.LoadInt32(&ran))
+	close(release)
+
+	for _, db := range []*DB{db1, db2} {
+		require.NoError(db.Put([]byte("a"), []byte("1")))
+		mustRollover(t, db)
+	}
+	require.NoError(db1.Close())
+	require.Equal(int32(1), atomic.LoadInt32(&ran))
+	require.NoError(db2.Close())
+}
+
+func TestEnvImportRateLimit(t *testing.T) {
+	require := require.New(t)
+	_, err := NewEnv(EnvImportRateLimit(-1))
+	require.Error(err)
+	env, err := NewEnv(EnvImportRateLimit(100 << 10))
+	require.NoError(err)
+	defer env.Close()
+	dir1, cleanup1 := MustTempDir()
+	defer cleanup1()
+	dir2, cleanup2 := MustTempDir()
+	defer cleanup2()
+	db1, err := Open(dir1, SharedEnvOption(env))
+	require.NoError(err)
+	defer db1.Close()
+	db2, err := Open(dir2, SharedEnvOption(env))
+	require.NoError(err)
+	defer db2.Close()
+
+	// Two imports of 20 KiB each share 100 KiB/s, taking 400ms together.
+	value := make([]byte, 1019)
+	start := time.Now()
+	errs := make(chan error, 2)
+	for _, db := range []*DB{db1, db2} {
+		go func(db *DB) { errs <- db.Import(&sliceImportSource{n: 20, value: value}, nil, nil) }(db)
+	}
+	require.NoError(<-errs)
+	require.NoError(<-errs)
+	require.GreaterOrEqual(int64(time.Since(start)), int64(350*time.Millisecond))
+}
@@ -0,0 +1,110 @@
+package archivedb
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultEventLogSize is how many events the database keeps.
+	DefaultEventLogSize = 256
+
+	// DefaultStallThreshold is how long appending or syncing an entry may
+	// take before it is recorded as a stall.
+	DefaultStallThreshold = 100 * time.Millisecond
+)
+
+// EventKind classifies an Event.
+type EventKind string
+
+const (
+	EventWarning    EventKind = "warning"     // a Warning was raised
+	EventRollover   EventKind = "rollover"    // the active segment was sealed and a new one created
+	EventFlushError EventKind = "flush error" // syncing a segment, the index or the Merkle log failed
+	EventStall      EventKind = "stall"       // a write took longer than the stall threshold
+	EventRecovery   EventKind = "recovery"    // Open repaired something
+	EventResume     EventKind = "resume"      // a degraded database accepted writes again
+	EventCompaction EventKind = "compaction"  // Compact, GCOrphans or PunchHoles reclaimed space
+)
+
+// Event is a notable thing that happened to the database.
+type Event struct {
+	Time    time.Time
+	Kind    EventKind
+	Message string
+	Path    string // file involved, if any
+	Err     error
+}
+
+func (e Event) String() string {
+	s := fmt.Sprintf("%s %s: %s", e.Time.Format(time.RFC3339Nano), e.Kind, e.Message)
+	if e.Path != "" {
+		s += " " + e.Path
+	}
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+// eventLog is a ring buffer of the most recent events.
+type eventLog struct {
+	mu     sync.Mutex
+	events []Event
+	next   int  // position the next event is written to
+	full   bool // set once the buffer wrapped
+}
+
+func newEventLog(size int) *eventLog {
+	return &eventLog{events: make([]Event, size)}
+}
+
+func (l *eventLog) add(e Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events[l.next] = e
+	if l.next++; l.next == len(l.events) {
+		l.next, l.full = 0, true
+	}
+}
+
+// list returns the events oldest first.
+func (l *eventLog) list() []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.full {
+		return append([]Event(nil), l.events[:l.next]...)
+	}
+	return append(append([]Event(nil), l.events[l.next:]...), l.events[:l.next]...)
+}
+
+// Events returns the most recent events, oldest first: segment rollovers,
+// flush errors, write stalls, recovery actions taken by Open and every
+// Warning raised. It keeps working after Close, for postmortems. The number
+// of events kept and the stall threshold are set with EventLogOption.
+func (db *DB) Events() []Event {
+	if db.events == nil {
+		return nil
+	}
+	return db.events.list()
+}
+
+// event records an event, if the event log is on.
+func (db *DB) event(kind EventKind, message, path string, err error) {
+	if db.events == nil {
+		return
+	}
+	db.events.add(Event{Time: db.now(), Kind: kind, Message: message, Path: path, Err: err})
+}
+
+// checkStall records a stall if op, which started at start, took longer
+// than the stall threshold.
+func (db *DB) checkStall(op string, start time.Time) {
+	if db.opts.stallThreshold == 0 {
+		return
+	}
+	if d := time.Since(start); d > db.opts.stallThreshold {
+		db.event(EventStall, fmt.Sprintf("%s took %v", op, d), "", nil)
+	}
+}
@@ -0,0 +1,93 @@
+package archivedb
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_Events(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	var fault *faultFile
+	injectFaults(t, func(_ string, f *faultFile) { fault = f })
+	clock := newFakeClock()
+	db, err := Open(dir, FsyncOption(true), ClockOption(clock), EventLogOption(3, 0))
+	require.NoError(err)
+	defer db.Close()
+	require.Empty(db.Events())
+
+	require.NoError(db.Put([]byte("foo"), []byte("bar")))
+	mustRollover(t, db)
+	events := db.Events()
+	require.Len(events, 1)
+	require.Equal(EventRollover, events[0].Kind)
+	require.Equal(clock.Now(), events[0].Time)
+	require.Equal(filepath.Join(dir, segmentFilename(1)), events[0].Path)
+
+	fault.syncErr = syscall.EIO
+	require.Error(db.Put([]byte("foo"), []byte("baz")))
+	fault.syncErr = nil
+	require.NoError(db.Resume())
+	events = db.Events()
+	require.Len(events, 3)
+	require.Equal(EventFlushError, events[0].Kind)
+	require.ErrorIs(events[0].Err, syscall.EIO)
+	require.Equal(Event{Time: clock.Now(), Kind: EventWarning, Message: "degrade", Path: dir, Err: syscall.EIO}, events[1])
+	require.Equal(EventResume, events[2].Kind)
+
+	// Every write stalls past a threshold of a nanosecond.
+	require.NoError(db.SetOption(EventLogOption(3, time.Nanosecond)))
+	require.NoError(db.Put([]byte("foo"), []byte("qux")))
+	events = db.Events()
+	require.Len(events, 3)
+	require.Equal(EventResume, events[0].Kind)
+	require.Equal(EventStall, events[1].Kind)
+	require.Regexp("^write took ", events[1].Message)
+	require.Regexp("^sync took ", events[2].Message)
+
+	require.ErrorIs(db.SetOption(EventLogOption(4, 0)), ErrImmutableOption)
+	require.NoError(db.Close())
+	require.Len(db.Events(), 3)
+}
+
+func TestDB_EventsRecovery(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	db, err := Open(dir)
+	require.NoError(err)
+	require.NoError(db.Put([]byte("foo"), []byte("bar")))
+	require.NoError(db.Close())
+
+	// Damage the value of the entry, as if the write was torn.
+	f, err := os.OpenFile(filepath.Join(dir, segmentFilename(0)), os.O_RDWR, 0)
+	require.NoError(err)
+	_, err = f.WriteAt([]byte("!"), SegmentHeaderSize+EntryHeaderSize+5)
+	require.NoError(err)
+	require.NoError(f.Close())
+
+	db, err = Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	events := db.Events()
+	require.Len(events, 2)
+	require.Equal(EventRecovery, events[0].Kind)
+	require.Equal("cleared 22 bytes of torn entry", events[0].Message)
+	require.Equal(filepath.Join(dir, segmentFilename(0)), events[0].Path)
+	require.Equal("removed 1 dangling index items", events[1].Message)
+
+	dir2, cleanup2 := MustTempDir()
+	defer cleanup2()
+	db2, err := Open(dir2, EventLogOption(0, 0))
+	require.NoError(err)
+	defer db2.Close()
+	require.Nil(db2.Events())
+}
@@ -0,0 +1,76 @@
+package archivedb
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrInvalidTTL is returned for a negative TTL.
+var ErrInvalidTTL = errors.New("invalid ttl")
+
+// PutWithTTL puts the value of the key as Put does, but the value expires
+// once ttl has passed on the database's clock: reads then return
+// ErrKeyExpired and iteration skips the key. A zero ttl never expires.
+//
+// The expiry is stored in the entry, so it survives reopening. An expired
+// entry takes space until PurgeExpired or a compaction drops it.
+func (db *DB) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	return db.PutWithOptions(key, value, WriteOptions{TTL: ttl})
+}
+
+// PurgeExpired removes the expired keys from the index, so reads of them
+// return ErrKeyNotFound rather than ErrKeyExpired, and returns how many it
+// removed. Pinned keys are kept. Their entries stay in the segments until
+// compacted. The OnExpireOption callback is called with every removed key
+// once the database is unlocked.
+func (db *DB) PurgeExpired() (int, error) {
+	keys, onExpire, err := db.purgeExpired()
+	if onExpire != nil {
+		for _, key := range keys {
+			onExpire(key)
+		}
+	}
+	return len(keys), err
+}
+
+// purgeExpired removes the expired keys from the index and returns them,
+// decoded, with the callback to notify of them.
+func (db *DB) purgeExpired() (keys [][]byte, onExpire func(key []byte), err error) {
+	db.lockFor(lockWrite)
+	defer db.mu.Unlock()
+	if err := db.checkWritable(); err != nil {
+		return nil, nil, err
+	}
+	type expiredKey struct {
+		hash uint64
+		key  []byte
+	}
+	now := db.now()
+	var expired []expiredKey
+	if err := db.index.ForEach(func(k uint64, it item) error {
+		segment := db.segment(it.ID())
+		if segment == nil && db.segmentMissing(it.ID()) {
+			return nil
+		} else if segment == nil {
+			return ErrSegmentNotFound
+		}
+		e, err := segment.ReadEntry(it.Offset())
+		if err != nil {
+			return err
+		} else if e.expired(now) && !db.manifest.pinned(k) {
+			expired = append(expired, expiredKey{k, append([]byte(nil), db.decodeKey(e.key)...)})
+		}
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+	keys = make([][]byte, 0, len(expired))
+	for _, x := range expired {
+		if err := db.removeKey(x.hash); err != nil {
+			return keys, db.opts.onExpire, err
+		}
+		keys = append(keys, x.key)
+	}
+	return keys, db.opts.onExpire, nil
+}
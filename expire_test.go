@@ -0,0 +1,162 @@
+package archivedb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_PutWithTTL(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	clock := newFakeClock()
+	db, err := Open(dir, ClockOption(clock))
+	require.NoError(err)
+	defer db.Close()
+
+	require.NoError(db.PutWithTTL([]byte("foo"), []byte("bar"), time.Minute))
+	require.NoError(db.PutWithOptions([]byte("baz"), []byte("qux"), WriteOptions{TTL: time.Hour, Tag: 7}))
+	require.NoError(db.Put([]byte("keep"), []byte("1")))
+	require.ErrorIs(db.PutWithTTL([]byte("a"), nil, -time.Second), ErrInvalidTTL)
+	v, err := db.Get([]byte("foo"))
+	require.NoError(err)
+	require.Equal([]byte("bar"), v)
+
+	clock.Add(time.Minute)
+	_, err = db.Get([]byte("foo"))
+	require.ErrorIs(err, ErrKeyExpired)
+	require.Equal([]string{"baz", "keep"}, iterKeys(t, db))
+
+	// The expiry survives reopening.
+	require.NoError(db.Close())
+	db, err = Open(dir, ClockOption(clock))
+	require.NoError(err)
+	defer db.Close()
+	_, err = db.Get([]byte("foo"))
+	require.ErrorIs(err, ErrKeyExpired)
+	v, err = db.Get([]byte("baz"))
+	require.NoError(err)
+	require.Equal([]byte("qux"), v)
+
+	clock.Add(time.Hour)
+	require.Equal([]string{"keep"}, iterKeys(t, db))
+	require.NoError(db.Scan(nil, func(key, _ []byte) error {
+		require.Equal("keep", string(key))
+		return nil
+	}))
+	require.NoError(db.LookupTag(7, func(key, _ []byte) error {
+		t.Errorf("expired key %q looked up", key)
+		return nil
+	}))
+
+	// Rewriting an expired key makes it live again.
+	require.NoError(db.Put([]byte("baz"), []byte("new")))
+	v, err = db.Get([]byte("baz"))
+	require.NoError(err)
+	require.Equal([]byte("new"), v)
+
+	n, err := db.PurgeExpired()
+	require.NoError(err)
+	require.Equal(1, n)
+	_, err = db.Get([]byte("foo"))
+	require.ErrorIs(err, ErrKeyNotFound)
+	require.Equal([]string{"baz", "keep"}, iterKeys(t, db))
+}
+
+func TestDB_PutWithTTL_Loader(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	clock := newFakeClock()
+	db, err := Open(dir, ClockOption(clock), LoaderOption(func(key []byte) ([]byte, error) {
+		return []byte("loaded"), nil
+	}))
+	require.NoError(err)
+	defer db.Close()
+
+	require.NoError(db.PutWithTTL([]byte("foo"), []byte("bar"), time.Second))
+	clock.Add(time.Second)
+	v, err := db.Get([]byte("foo"))
+	require.NoError(err)
+	require.Equal([]byte("loaded"), v)
+}
+
+// iterKeys returns the keys an iterator over db yields.
+func iterKeys(t *testing.T, db *DB) []string {
+	it := db.NewIterator()
+	defer it.Close()
+	var keys []string
+	for it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	require.NoError(t, it.Err())
+	return keys
+}
+
+func TestOnExpireOption(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	clock := newFakeClock()
+	expired := make(chan string, 4)
+	var db *DB
+	db, err := Open(dir, ClockOption(clock), PurgeIntervalOption(time.Millisecond), OnExpireOption(func(key []byte) {
+		// The callback may call into the database.
+		if _, err := db.Get(key); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Get of purged key: %v", err)
+		}
+		expired <- string(key)
+	}))
+	require.NoError(err)
+	defer db.Close()
+
+	require.NoError(db.PutWithTTL([]byte("foo"), []byte("bar"), time.Minute))
+	require.NoError(db.Put([]byte("keep"), []byte("1")))
+	clock.Add(time.Minute)
+	select {
+	case key := <-expired:
+		require.Equal("foo", key)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expired key not purged")
+	}
+	require.Equal([]string{"keep"}, iterKeys(t, db))
+	require.ErrorIs(db.SetOption(PurgeIntervalOption(time.Hour)), ErrImmutableOption)
+}
+
+func TestDB_PurgeExpired_OnExpire(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	clock := newFakeClock()
+	var expired []string
+	db, err := Open(dir, ClockOption(clock), OnExpireOption(func(key []byte) {
+		expired = append(expired, string(key))
+	}))
+	require.NoError(err)
+	defer db.Close()
+
+	require.NoError(db.PutWithTTL([]byte("a"), []byte("1"), time.Second))
+	require.NoError(db.PutWithTTL([]byte("b"), []byte("2"), time.Second))
+	require.NoError(db.PutWithTTL([]byte("c"), []byte("3"), time.Hour))
+	require.NoError(db.PutWithTTL([]byte("pinned"), []byte("4"), time.Second))
+	require.NoError(db.Pin([]byte("pinned")))
+	clock.Add(time.Second)
+	n, err := db.PurgeExpired()
+	require.NoError(err)
+	require.Equal(2, n)
+	require.ElementsMatch([]string{"a", "b"}, expired)
+
+	require.NoError(db.SetOption(OnExpireOption(nil)))
+	clock.Add(time.Hour)
+	n, err = db.PurgeExpired()
+	require.NoError(err)
+	require.Equal(1, n)
+	require.Len(expired, 2)
+}
@@ -0,0 +1,226 @@
+package archivedb
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ExportFormat names an output format for Export.
+type ExportFormat string
+
+const (
+	// ExportJSON writes one JSON object per line with base64 key and value.
+	ExportJSON ExportFormat = "jsonl"
+	// ExportCSV writes a header and one row per key, with hex encoded key
+	// and value.
+	ExportCSV ExportFormat = "csv"
+	// ExportSQL writes a SQL script that creates and fills an "archive"
+	// table, suitable for piping into sqlite3.
+	ExportSQL ExportFormat = "sql"
+	// ExportSQLite writes a SQLite database file with an "archive" table.
+	ExportSQLite ExportFormat = "sqlite"
+	// ExportParquet writes a Parquet file, uncompressed and plain encoded.
+	ExportParquet ExportFormat = "parquet"
+)
+
+// ErrUnsupportedFormat is returned by Export for formats it can't write.
+var ErrUnsupportedFormat = errors.New("unsupported export format")
+
+// Export writes every live key and its value to w in key order, as they
+// were when the export started. The live keys are collected first, holding
+// only the keys in memory, and their segments are kept from being
+// compacted; the values are then read one at a time, and written to w
+// without holding any lock, so the database stays readable and writable
+// while the export runs.
+//
+// Every format has key, value, timestamp and flag columns. Entries don't
+// record when they were written, so the timestamp is when the segment
+// holding the entry was sealed, the latest it can have been written, and
+// is empty (null) for entries in the active segment. The flag is the
+// entry's flag, EntryInsertFlag for every live key. The SQL and SQLite
+// formats store the timestamp in Unix nanoseconds, the JSON and CSV ones
+// as RFC 3339 text. ExportSQLite builds the database's pages in a
+// temporary file before writing them to w, as its first page can only be
+// written last.
+func (db *DB) Export(w io.Writer, format ExportFormat) error {
+	var ew exportWriter
+	switch format {
+	case ExportJSON:
+		ew = &jsonExportWriter{enc: json.NewEncoder(w)}
+	case ExportCSV:
+		ew = &csvExportWriter{w: csv.NewWriter(w)}
+	case ExportSQL:
+		ew = &sqlExportWriter{w: bufio.NewWriter(w)}
+	case ExportSQLite:
+		ew = &sqliteExportWriter{w: w}
+	case ExportParquet:
+		ew = &parquetExportWriter{w: &offsetWriter{w: bufio.NewWriter(w)}}
+	default:
+		return errors.Wrapf(ErrUnsupportedFormat, "%q", format)
+	}
+	if c, ok := ew.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	matches, err := db.holdLiveKeys()
+	if err != nil {
+		return err
+	}
+	defer db.releaseMatches(matches)
+	if err := ew.Begin(); err != nil {
+		return err
+	}
+	for _, m := range matches {
+		row, err := db.readHeldMatch(m)
+		if err != nil {
+			return err
+		} else if err := ew.Write(row); err != nil {
+			return err
+		}
+	}
+	return ew.End()
+}
+
+// exportRow is a key written by Export.
+type exportRow struct {
+	key, value []byte
+	// written is when the segment holding the entry was sealed, or zero.
+	written time.Time
+	flag    uint8
+}
+
+// holdLiveKeys returns the live keys in key order, as scanKeys does, and
+// holds the segments of their entries until releaseMatches.
+func (db *DB) holdLiveKeys() ([]scanMatch, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil, ErrDatabaseClosed
+	}
+	matches, err := db.scanKeys(nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range matches {
+		db.holdSegment(m.it.ID())
+	}
+	return matches, nil
+}
+
+// releaseMatches releases the segments held by holdLiveKeys.
+func (db *DB) releaseMatches(matches []scanMatch) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, m := range matches {
+		db.releaseSegment(m.it.ID())
+	}
+}
+
+// readHeldMatch reads the entry of a key returned by holdLiveKeys, its
+// value copied out of its segment.
+func (db *DB) readHeldMatch(m scanMatch) (exportRow, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return exportRow{}, ErrDatabaseClosed
+	}
+	e, err := db.readMatch(m)
+	if err != nil {
+		return exportRow{}, err
+	}
+	row := exportRow{key: m.key, value: e.data, flag: e.hdr.Flag}
+	if e.mapped() {
+		row.value = make([]byte, len(e.data))
+		copy(row.value, e.data)
+	}
+	if sc, ok := db.manifest.sealed(m.it.ID()); ok {
+		row.written = sc.Sealed
+	}
+	return row, nil
+}
+
+type exportWriter interface {
+	Begin() error
+	Write(row exportRow) error
+	End() error
+}
+
+// exportTime formats t for the text formats, or returns "" if it is zero.
+func exportTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+type jsonExportWriter struct {
+	enc *json.Encoder
+}
+
+func (w *jsonExportWriter) Begin() error { return nil }
+func (w *jsonExportWriter) End() error   { return nil }
+
+func (w *jsonExportWriter) Write(row exportRow) error {
+	return w.enc.Encode(struct {
+		Key       []byte `json:"key"`
+		Value     []byte `json:"value"`
+		Timestamp string `json:"timestamp,omitempty"`
+		Flag      uint8  `json:"flag"`
+	}{row.key, row.value, exportTime(row.written), row.flag})
+}
+
+type csvExportWriter struct {
+	w *csv.Writer
+}
+
+func (w *csvExportWriter) Begin() error {
+	return w.w.Write([]string{"key", "value", "timestamp", "flag"})
+}
+
+func (w *csvExportWriter) Write(row exportRow) error {
+	return w.w.Write([]string{
+		hex.EncodeToString(row.key),
+		hex.EncodeToString(row.value),
+		exportTime(row.written),
+		strconv.Itoa(int(row.flag)),
+	})
+}
+
+func (w *csvExportWriter) End() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+type sqlExportWriter struct {
+	w *bufio.Writer
+}
+
+func (w *sqlExportWriter) Begin() error {
+	_, err := io.WriteString(w.w, "BEGIN TRANSACTION;\n"+
+		"CREATE TABLE IF NOT EXISTS archive (key BLOB PRIMARY KEY, value BLOB NOT NULL, timestamp INTEGER, flag INTEGER NOT NULL);\n")
+	return err
+}
+
+func (w *sqlExportWriter) Write(row exportRow) error {
+	timestamp := "NULL"
+	if !row.written.IsZero() {
+		timestamp = strconv.FormatInt(row.written.UnixNano(), 10)
+	}
+	_, err := fmt.Fprintf(w.w, "INSERT OR REPLACE INTO archive VALUES (X'%x', X'%x', %s, %d);\n", row.key, row.value, timestamp, row.flag)
+	return err
+}
+
+func (w *sqlExportWriter) End() error {
+	if _, err := io.WriteString(w.w, "COMMIT;\n"); err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
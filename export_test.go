@@ -0,0 +1,92 @@
+package archivedb
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_Export(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	clock := newFakeClock()
+	db, err := Open(dir, ClockOption(clock), RolloverOption(time.Hour))
+	require.NoError(err)
+	defer db.Close()
+
+	require.NoError(db.Put([]byte("b"), []byte("2")))
+	require.NoError(db.Put([]byte("a"), []byte("1")))
+	require.NoError(db.Put([]byte("c"), []byte("3")))
+	require.NoError(db.Delete([]byte("c")))
+	// Sealing the segment at 02:00 dates the keys in it.
+	clock.Add(2 * time.Hour)
+	require.NoError(db.Put([]byte("d"), []byte("4")))
+
+	tests := []struct {
+		format ExportFormat
+		want   string
+	}{
+		{ExportJSON, "{\"key\":\"YQ==\",\"value\":\"MQ==\",\"timestamp\":\"2020-01-01T02:00:00Z\",\"flag\":1}\n" +
+			"{\"key\":\"Yg==\",\"value\":\"Mg==\",\"timestamp\":\"2020-01-01T02:00:00Z\",\"flag\":1}\n" +
+			"{\"key\":\"ZA==\",\"value\":\"NA==\",\"flag\":1}\n"},
+		{ExportCSV, "key,value,timestamp,flag\n" +
+			"61,31,2020-01-01T02:00:00Z,1\n" +
+			"62,32,2020-01-01T02:00:00Z,1\n" +
+			"64,34,,1\n"},
+		{ExportSQL, "BEGIN TRANSACTION;\n" +
+			"CREATE TABLE IF NOT EXISTS archive (key BLOB PRIMARY KEY, value BLOB NOT NULL, timestamp INTEGER, flag INTEGER NOT NULL);\n" +
+			"INSERT OR REPLACE INTO archive VALUES (X'61', X'31', 1577844000000000000, 1);\n" +
+			"INSERT OR REPLACE INTO archive VALUES (X'62', X'32', 1577844000000000000, 1);\n" +
+			"INSERT OR REPLACE INTO archive VALUES (X'64', X'34', NULL, 1);\n" +
+			"COMMIT;\n"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		require.NoError(db.Export(&buf, tt.format))
+		require.Equal(tt.want, buf.String(), tt.format)
+	}
+	require.ErrorIs(db.Export(&bytes.Buffer{}, "xml"), ErrUnsupportedFormat)
+}
+
+// blockingWriter signals on written, unless a signal is pending, and then
+// waits for release on every write.
+type blockingWriter struct {
+	written chan struct{}
+	release chan struct{}
+	buf     bytes.Buffer
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	select {
+	case w.written <- struct{}{}:
+	default:
+	}
+	<-w.release
+	return w.buf.Write(p)
+}
+
+func TestDB_ExportWhileWriting(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+
+	require.NoError(db.Put([]byte("a"), []byte("1")))
+	require.NoError(db.Put([]byte("b"), []byte("2")))
+	w := &blockingWriter{written: make(chan struct{}, 1), release: make(chan struct{})}
+	done := make(chan error, 1)
+	go func() { done <- db.Export(w, ExportJSON) }()
+
+	// Writes go ahead while the output blocks, and don't show up in it.
+	<-w.written
+	require.NoError(db.Put([]byte("a"), []byte("3")))
+	require.NoError(db.Put([]byte("c"), []byte("4")))
+	close(w.release)
+	require.NoError(<-done)
+	require.Equal("{\"key\":\"YQ==\",\"value\":\"MQ==\",\"flag\":1}\n{\"key\":\"Yg==\",\"value\":\"Mg==\",\"flag\":1}\n", w.buf.String())
+}
@@ -0,0 +1,173 @@
+package archivedb
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/millken/archivedb/internal/mmap"
+	"github.com/stretchr/testify/require"
+)
+
+// faultFile is a regionFile that injects faults into the file it wraps.
+type faultFile struct {
+	regionFile
+
+	// writeLimit is how many more bytes Write accepts before failing with
+	// writeErr, or negative for no limit.
+	writeLimit int
+	writeErr   error
+	// syncErr is returned by Sync instead of syncing.
+	syncErr error
+	// syncs counts the successful syncs.
+	syncs int
+	// corruptOff is the offset of a byte inverted in the next corruptReads
+	// reads that cover it.
+	corruptOff   int
+	corruptReads int
+	// readErr fails the next readErrs reads.
+	readErr  error
+	readErrs int
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	if f.writeLimit < 0 || len(p) <= f.writeLimit {
+		f.writeLimit -= len(p)
+		return f.regionFile.Write(p)
+	}
+	n, err := f.regionFile.Write(p[:f.writeLimit])
+	f.writeLimit = 0
+	if err != nil {
+		return n, err
+	}
+	return n, f.writeErr
+}
+
+func (f *faultFile) Sync() error {
+	if f.syncErr != nil {
+		return f.syncErr
+	}
+	if err := f.regionFile.Sync(); err != nil {
+		return err
+	}
+	f.syncs++
+	return nil
+}
+
+func (f *faultFile) ReadOff(off, length int) ([]byte, error) {
+	if f.readErrs > 0 {
+		f.readErrs--
+		return nil, f.readErr
+	}
+	buf, err := f.regionFile.ReadOff(off, length)
+	if err != nil || f.corruptReads == 0 || f.corruptOff < off || f.corruptOff >= off+len(buf) {
+		return buf, err
+	}
+	f.corruptReads--
+	buf = append([]byte(nil), buf...)
+	buf[f.corruptOff-off] ^= 0xff
+	return buf, nil
+}
+
+// injectFaults wraps the file of every segment opened until the test ends
+// in a faultFile, after passing it to setup.
+func injectFaults(t *testing.T, setup func(path string, f *faultFile)) {
+	open := openRegionFile
+	t.Cleanup(func() { openRegionFile = open })
+	openRegionFile = func(path string, flag mmap.Flag) (regionFile, error) {
+		rf, err := open(path, flag)
+		if err != nil {
+			return rf, err
+		}
+		f := &faultFile{regionFile: rf, writeLimit: -1}
+		setup(path, f)
+		return f, nil
+	}
+}
+
+func TestSegment_ShortWrite(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	var fault *faultFile
+	injectFaults(t, func(_ string, f *faultFile) { fault = f })
+	segment, err := createSegment(0, filepath.Join(dir, segmentFilename(0)))
+	require.NoError(err)
+	defer segment.Close()
+
+	fault.writeLimit, fault.writeErr = EntryHeaderSize+1, io.ErrShortWrite
+	require.ErrorIs(segment.WriteEntry(createEntry(EntryInsertFlag, []byte("foo"), []byte("bar"))), io.ErrShortWrite)
+	require.Equal(uint32(SegmentHeaderSize), segment.Size())
+
+	// The next entry takes the place of the torn one.
+	fault.writeLimit = -1
+	require.NoError(segment.WriteEntry(createEntry(EntryInsertFlag, []byte("baz"), []byte("qux"))))
+	e, err := segment.ReadEntry(SegmentHeaderSize)
+	require.NoError(err)
+	require.NoError(e.verify([]byte("baz")))
+	require.Equal([]byte("qux"), e.value)
+	require.Equal(int64(1), segment.stats.Entries)
+}
+
+func TestDB_SyncFailure(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	var fault *faultFile
+	injectFaults(t, func(_ string, f *faultFile) { fault = f })
+	db, err := Open(dir, FsyncOption(true))
+	require.NoError(err)
+	defer db.Close()
+
+	cause := &os.PathError{Op: "msync", Path: segmentFilename(0), Err: syscall.EIO}
+	fault.syncErr = cause
+	require.ErrorIs(db.Put([]byte("foo"), []byte("bar")), syscall.EIO)
+	require.Equal(Health{ReadOnly: true, Degraded: cause}, db.Health())
+	require.ErrorIs(db.Put([]byte("foo"), []byte("baz")), ErrReadOnly)
+	require.Error(db.Resume())
+
+	fault.syncErr = nil
+	require.NoError(db.Resume())
+	require.NoError(db.Put([]byte("foo"), []byte("baz")))
+	v, err := db.Get([]byte("foo"))
+	require.NoError(err)
+	require.Equal([]byte("baz"), v)
+}
+
+func TestDB_TransientReadError(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	var fault *faultFile
+	injectFaults(t, func(_ string, f *faultFile) { fault = f })
+	var warnings []Warning
+	db, err := Open(dir, ReadRetryOption(1, 0), WarningHandlerOption(func(w Warning) {
+		warnings = append(warnings, w)
+	}))
+	require.NoError(err)
+	defer db.Close()
+	require.NoError(db.Put([]byte("foo"), []byte("bar")))
+
+	fault.readErr, fault.readErrs = syscall.EIO, 1
+	v, err := db.Get([]byte("foo"))
+	require.NoError(err)
+	require.Equal([]byte("bar"), v)
+	require.Len(warnings, 1)
+
+	fault.readErrs = 2
+	_, err = db.Get([]byte("foo"))
+	require.ErrorIs(err, syscall.EIO)
+	require.Len(warnings, 2)
+
+	// Corruption isn't retried, even if it would read differently.
+	fault.corruptOff = SegmentHeaderSize + EntryHeaderSize + 3
+	fault.corruptReads = 1
+	_, err = db.Get([]byte("foo"))
+	require.ErrorIs(err, ErrChecksumFailed)
+	require.Len(warnings, 2)
+}
@@ -0,0 +1,176 @@
+package archivedb
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Refresh catches a follower up with the writer: entries appended to the
+// active segment, new segments and new index records become visible, and
+// segments the writer detached, attached or moved into a partition are
+// followed as the manifest records them. It does nothing on a database
+// that isn't a follower, including one opened with OpenAt.
+func (db *DB) Refresh() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrDatabaseClosed
+	} else if !db.opts.readOnly || db.opts.at != nil {
+		return nil
+	}
+
+	if m, err := readManifest(db.ManifestPath()); err != nil {
+		return err
+	} else if m != nil {
+		m.applyLimits(db.opts)
+		db.manifest = m
+	}
+	// The writer may have appended to the active segment before rolling
+	// over, so finish it before looking for new ones.
+	if active := db.activeSegment(); active != nil && !active.offline() {
+		if err := active.Refresh(); err != nil {
+			return err
+		}
+	}
+	if err := db.refreshSegments(); err != nil {
+		return err
+	}
+	return db.index.Refresh()
+}
+
+// refreshSegments brings the segments of a follower in line with the
+// manifest and the segment files of the writer. Like openSegments, it
+// keeps db.segments indexed by id, with placeholders for detached
+// segments and for ids with no segment file, such as those the writer
+// quarantined. The caller must hold db.mu.
+func (db *DB) refreshSegments() error {
+	fis, err := ioutil.ReadDir(db.path)
+	if err != nil {
+		return err
+	}
+	paths := make(map[uint32]string)
+	for _, fi := range fis {
+		if id, err := parseSegmentFilename(fi.Name()); err == nil && !fi.IsDir() {
+			paths[id] = filepath.Join(db.path, fi.Name())
+		}
+	}
+	// Sealed segments may live in partition directories.
+	for _, sc := range db.manifest.Segments {
+		if sc.Dir != "" || sc.Detached {
+			paths[sc.ID] = db.sealedPath(sc)
+		}
+	}
+
+	for id, s := range db.segments {
+		sc, sealed := db.manifest.sealed(uint32(id))
+		switch {
+		case s.missing:
+			// The file may have been moved into its partition while
+			// it was looked for.
+			segment, err := db.followSegment(uint32(id), paths[uint32(id)])
+			if err != nil {
+				return err
+			} else if segment != nil {
+				db.segments[id] = segment
+			}
+		case !sealed:
+		case sc.Detached && !s.detached:
+			if db.segmentRefs[s.ID()] > 0 {
+				continue
+			}
+			db.opts.env.release(s.MappedSize())
+			if err := s.Close(); err != nil {
+				return err
+			}
+			s.detached = true
+		case !sc.Detached && s.detached:
+			segment, err := db.followSegment(uint32(id), db.sealedPath(sc))
+			if err != nil {
+				return err
+			} else if segment != nil {
+				db.segments[id] = segment
+			}
+		default:
+			s.path = db.sealedPath(sc)
+		}
+	}
+
+	ids := make([]int, 0, len(paths))
+	for id := range paths {
+		if int(id) >= len(db.segments) {
+			ids = append(ids, int(id))
+		}
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		segment, err := db.followSegment(uint32(id), paths[uint32(id)])
+		if err != nil {
+			return err
+		} else if segment == nil {
+			// Not yet initialized by the writer.
+			break
+		}
+		db.addMissingSegments(uint32(id))
+		db.segments = append(db.segments, segment)
+	}
+	return nil
+}
+
+// followSegment opens the segment with the given id at path for a
+// follower, or returns a placeholder if the manifest records it as
+// detached. It returns nil if there is no valid segment file at path yet.
+func (db *DB) followSegment(id uint32, path string) (*segment, error) {
+	if sc, ok := db.manifest.sealed(id); ok && sc.Detached {
+		segment := newSegment(id, path)
+		segment.detached = true
+		return segment, nil
+	} else if path == "" || validateSegmentFile(path) != nil {
+		return nil, nil
+	}
+	return db.openSegment(id, path)
+}
+
+// itemExists returns true if the entry addressed by it has been loaded. A
+// follower uses it to hold back index records written ahead of the entries
+// it can see. Records in detached and missing segments are loaded, as the
+// writer keeps them.
+func (db *DB) itemExists(_ uint64, it item) bool {
+	if int(it.ID()) >= len(db.segments) {
+		return false
+	}
+	s := db.segments[it.ID()]
+	return s.offline() || it.Offset() < s.Size()
+}
+
+// startFollowing polls for new writes every interval until Close.
+func (db *DB) startFollowing(interval time.Duration) {
+	db.stopFollow = make(chan struct{})
+	db.followDone = make(chan struct{})
+	go func() {
+		defer close(db.followDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-db.stopFollow:
+				return
+			case <-ticker.C:
+				if err := db.Refresh(); err != nil {
+					db.warn(Warning{Op: "refresh", Path: db.path, Err: err})
+				}
+			}
+		}
+	}()
+}
+
+// stopFollowing stops the polling goroutine, if any, and waits for it.
+func (db *DB) stopFollowing() {
+	db.following.Do(func() {
+		if db.stopFollow != nil {
+			close(db.stopFollow)
+			<-db.followDone
+		}
+	})
+}
@@ -0,0 +1,158 @@
+package archivedb
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_Follower(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	_, err := Open(dir+"/missing", FollowerOption(0))
+	require.Error(err)
+
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	require.NoError(db.Put([]byte("foo"), []byte("bar")))
+
+	follower, err := Open(dir, FollowerOption(0))
+	require.NoError(err)
+	defer follower.Close()
+	v, err := follower.Get([]byte("foo"))
+	require.NoError(err)
+	require.Equal([]byte("bar"), v)
+	require.ErrorIs(follower.Put([]byte("foo"), []byte("baz")), ErrReadOnly)
+	require.ErrorIs(follower.Delete([]byte("foo")), ErrReadOnly)
+
+	require.NoError(db.Put([]byte("foo"), []byte("baz")))
+	mustRollover(t, db)
+	require.NoError(db.Put([]byte("new"), []byte("value")))
+
+	v, err = follower.Get([]byte("foo"))
+	require.NoError(err)
+	require.Equal([]byte("bar"), v)
+	_, err = follower.Get([]byte("new"))
+	require.ErrorIs(err, ErrKeyNotFound)
+
+	require.NoError(follower.Refresh())
+	v, err = follower.Get([]byte("foo"))
+	require.NoError(err)
+	require.Equal([]byte("baz"), v)
+	v, err = follower.Get([]byte("new"))
+	require.NoError(err)
+	require.Equal([]byte("value"), v)
+	require.Len(follower.segments, 2)
+}
+
+func TestDB_FollowerPolling(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	follower, err := Open(dir, FollowerOption(time.Millisecond))
+	require.NoError(err)
+
+	require.NoError(db.Put([]byte("foo"), []byte("bar")))
+	require.Eventually(func() bool {
+		v, err := follower.Get([]byte("foo"))
+		return err == nil && string(v) == "bar"
+	}, time.Second, time.Millisecond)
+	require.NoError(follower.Close())
+	require.NoError(follower.Close())
+}
+
+func TestDB_FollowerManifest(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	db, err := Open(dir, PartitionOption(true))
+	require.NoError(err)
+	defer db.Close()
+	require.NoError(db.Put([]byte("k0"), []byte("v0")))
+	follower, err := Open(dir, FollowerOption(0))
+	require.NoError(err)
+	defer follower.Close()
+
+	// Segment 1 is sealed into its partition before the follower sees it,
+	// and segment 0 is detached.
+	for _, key := range []string{"k1", "k2"} {
+		_, err := db.SealActiveSegment()
+		require.NoError(err)
+		require.NoError(db.Put([]byte(key), []byte("v"+key[1:])))
+	}
+	require.NotEmpty(db.manifest.Segments[1].Dir)
+	require.NoError(db.DetachSegment(0))
+
+	require.NoError(follower.Refresh())
+	require.Len(follower.segments, 3)
+	for id, s := range follower.segments {
+		require.Equal(uint32(id), s.ID())
+	}
+	detached, err := follower.DetachedSegments()
+	require.NoError(err)
+	require.Equal([]uint32{0}, detached)
+	_, err = follower.Get([]byte("k0"))
+	require.ErrorIs(err, ErrKeyNotFound)
+	for _, key := range []string{"k1", "k2"} {
+		v, err := follower.Get([]byte(key))
+		require.NoError(err)
+		require.Equal([]byte("v"+key[1:]), v)
+	}
+
+	// Attached again, it is followed again.
+	require.NoError(db.AttachSegment(0))
+	require.NoError(follower.Refresh())
+	v, err := follower.Get([]byte("k0"))
+	require.NoError(err)
+	require.Equal([]byte("v0"), v)
+}
+
+func TestDB_FollowerQuarantinedSegment(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	db, err := Open(dir)
+	require.NoError(err)
+	for i, key := range []string{"k0", "k1", "k2"} {
+		if i > 0 {
+			_, err := db.SealActiveSegment()
+			require.NoError(err)
+		}
+		require.NoError(db.Put([]byte(key), []byte("v"+key)))
+	}
+	require.NoError(db.Close())
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, segmentFilename(1)), []byte("NotASegment"), 0644))
+	db, err = Open(dir, QuarantineOption(true))
+	require.NoError(err)
+	defer db.Close()
+
+	follower, err := Open(dir, FollowerOption(0))
+	require.NoError(err)
+	defer follower.Close()
+	_, err = db.SealActiveSegment()
+	require.NoError(err)
+	require.NoError(db.Put([]byte("k3"), []byte("vk3")))
+
+	require.NoError(follower.Refresh())
+	require.Len(follower.segments, 4)
+	require.True(follower.segmentMissing(1))
+	for _, key := range []string{"k0", "k2", "k3"} {
+		v, err := follower.Get([]byte(key))
+		require.NoError(err)
+		require.Equal([]byte("v"+key), v)
+	}
+	_, err = follower.Get([]byte("k1"))
+	require.Error(err)
+}
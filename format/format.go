@@ -0,0 +1,470 @@
+// Package format describes the on-disk layout of archivedb files and
+// decodes them without opening a database, for tools that inspect or
+// recover database directories.
+//
+// A segment file starts with a SegmentHeaderSize byte header, the magic
+// followed by the format version, and holds entries back to back. Each
+// entry is an EntryHeaderSize byte header, then the key, then the value:
+//
+//	+---------------+---------------+---------+---------+---------+---------+----------+
+//	| ValueSize(4B) | Checksum(4B)  | Attrs   | KeySize | Flag    | (1B)    | Tag(4B)  |
+//	+---------------+---------------+---------+---------+---------+---------+----------+
+//
+// Attrs flags what is stored at the start of the value, in front of the
+// caller's value, in this order: with AttrExpires, the expiry time in Unix
+// nanoseconds (ExpirySize bytes); with AttrPrevWide, the segment (4B) and
+// offset (4B) of the previous entry of the key (PrevWideSize bytes), or
+// with AttrPrev, written before segment ids were widened, the segment (2B)
+// and offset (4B) (PrevSize bytes); with AttrEncrypted, the AES-GCM nonce
+// (NonceSize bytes) the caller's value was sealed with. ValueSize and
+// Checksum cover these fields. Entries written before attributes existed
+// have Attrs zeroed. The AttrCodecMask bits of Attrs hold the id of the
+// codec that compressed the caller's value, before any encryption, or
+// zero.
+//
+// Values too large for a segment are split into FlagChunk entries, which
+// have the key of the value but aren't indexed, followed by an entry with
+// AttrChunked whose value is the chunk list: the size (8B) and checksum
+// (4B) of the whole value, then for each chunk, in order, its segment
+// (4B), offset (4B) and entry checksum (4B). Chunk values are compressed
+// and encrypted on their own, as is the chunk list.
+//
+// A FlagHole entry replaces a run of entries no key refers to anymore,
+// whose space was given back to the filesystem by punching a hole in the
+// file. It has no key, its value is zeroed and its Tag holds the number of
+// entries it replaced.
+//
+// The index file starts with an IndexHeaderSize byte header and holds
+// IndexRecordSize byte records mapping a key hash to the segment and offset
+// of the key's latest entry:
+//
+//	+-------------+-------------+-------------+
+//	| Hash(8B)    | segment(4B) | Offset(4B)  |
+//	+-------------+-------------+-------------+
+//
+// Index files of version 1 hold IndexRecordSizeV1 byte records, with a 2
+// byte segment.
+//
+// Integers are little-endian, except in the MERKLE log whose records are
+// big-endian. The unused tail of segment and index files is zeroed.
+package format
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+)
+
+const (
+	// SegmentMagic starts every segment file.
+	SegmentMagic = "ArSeG"
+	// SegmentVersion is the segment format version.
+	SegmentVersion = 1
+	// SegmentHeaderSize is the size of the segment file header: the magic
+	// and the version.
+	SegmentHeaderSize = 6
+
+	// EntryHeaderSize is the size of an entry header.
+	EntryHeaderSize = 16
+	// FlagInsert marks an entry holding a value.
+	FlagInsert uint8 = 1
+	// FlagDelete marks a tombstone; its value is empty.
+	FlagDelete uint8 = 2
+	// FlagChunk marks a chunk of a value written with AttrChunked.
+	FlagChunk uint8 = 3
+	// FlagHole marks a zeroed run of dead entries; Tag counts them.
+	FlagHole uint8 = 4
+
+	// AttrExpires marks an entry whose value starts with its expiry time.
+	AttrExpires uint8 = 1 << 0
+	// ExpirySize is the size of the expiry time stored with AttrExpires.
+	ExpirySize = 8
+	// AttrPrev marks an entry whose value holds the location of the
+	// previous entry of its key, with a 2 byte segment. It is no longer
+	// written, AttrPrevWide replacing it.
+	AttrPrev uint8 = 1 << 1
+	// PrevSize is the size of the location stored with AttrPrev.
+	PrevSize = 6
+	// AttrCodecMask selects the bits of Attrs holding the codec id.
+	AttrCodecMask uint8 = 7 << AttrCodecShift
+	// AttrCodecShift is the position of the codec id in Attrs.
+	AttrCodecShift = 2
+	// AttrEncrypted marks an entry whose value is encrypted, preceded by
+	// its nonce.
+	AttrEncrypted uint8 = 1 << 5
+	// NonceSize is the size of the nonce stored with AttrEncrypted.
+	NonceSize = 12
+	// AttrPrevWide marks an entry whose value holds the location of the
+	// previous entry of its key.
+	AttrPrevWide uint8 = 1 << 6
+	// PrevWideSize is the size of the location stored with AttrPrevWide.
+	PrevWideSize = 8
+	// AttrChunked marks an entry whose value is a chunk list.
+	AttrChunked uint8 = 1 << 7
+	// ChunkListHeaderSize is the size of the chunk list header: the size
+	// and checksum of the whole value.
+	ChunkListHeaderSize = 12
+	// ChunkRefSize is the size of a chunk reference in a chunk list.
+	ChunkRefSize = 12
+
+	// IndexMagic starts the index file.
+	IndexMagic = "ArIdX"
+	// IndexVersion is the index format version.
+	IndexVersion = 2
+	// IndexHeaderSize is the size of the index file header: the magic and
+	// the version.
+	IndexHeaderSize = 6
+	// IndexRecordSize is the size of an index record.
+	IndexRecordSize = 16
+	// IndexRecordSizeV1 is the size of an index record in version 1 index
+	// files.
+	IndexRecordSizeV1 = 14
+
+	// MerkleRecordSize is the size of a MERKLE log record: segment id,
+	// entry offset and the SHA-256 leaf hash of the entry.
+	MerkleRecordSize = 4 + 4 + 32
+)
+
+var (
+	// ErrShortBuffer is returned when a buffer is too short for what is
+	// being decoded.
+	ErrShortBuffer = errors.New("short buffer")
+	// ErrBadMagic is returned when a file header doesn't start with the
+	// expected magic.
+	ErrBadMagic = errors.New("bad magic")
+	// ErrUnknownAttrs is returned for an entry with attributes this
+	// version doesn't know how to decode.
+	ErrUnknownAttrs = errors.New("unknown entry attributes")
+)
+
+var byteOrder = binary.LittleEndian
+
+// CastagnoliTable is the CRC-32C table entry checksums are computed with.
+var CastagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Checksum returns the checksum stored in the header of an entry holding
+// value.
+func Checksum(value []byte) uint32 {
+	return crc32.Checksum(value, CastagnoliTable)
+}
+
+// FileHeader is the header of a segment or index file.
+type FileHeader struct {
+	Version uint8
+}
+
+// ParseSegmentHeader decodes the segment file header at the start of b.
+func ParseSegmentHeader(b []byte) (FileHeader, error) {
+	return parseFileHeader(b, SegmentMagic)
+}
+
+// ParseIndexHeader decodes the index file header at the start of b.
+func ParseIndexHeader(b []byte) (FileHeader, error) {
+	return parseFileHeader(b, IndexMagic)
+}
+
+func parseFileHeader(b []byte, magic string) (FileHeader, error) {
+	if len(b) < len(magic)+1 {
+		return FileHeader{}, ErrShortBuffer
+	} else if !bytes.Equal(b[:len(magic)], []byte(magic)) {
+		return FileHeader{}, ErrBadMagic
+	}
+	return FileHeader{Version: b[len(magic)]}, nil
+}
+
+// EntryHeader is the header in front of every entry in a segment.
+type EntryHeader struct {
+	ValueSize uint32
+	Checksum  uint32
+	Attrs     uint8 // AttrExpires and so on
+	KeySize   uint8
+	Flag      uint8
+	Tag       uint32  // caller-supplied tag, zero if untagged
+	_         [1]byte // padding
+}
+
+// ParseEntryHeader decodes the entry header at the start of b.
+func ParseEntryHeader(b []byte) (EntryHeader, error) {
+	if len(b) < EntryHeaderSize {
+		return EntryHeader{}, ErrShortBuffer
+	}
+	return EntryHeader{
+		ValueSize: byteOrder.Uint32(b[0:4]),
+		Checksum:  byteOrder.Uint32(b[4:8]),
+		Attrs:     b[8],
+		KeySize:   b[9],
+		Flag:      b[10],
+		Tag:       byteOrder.Uint32(b[12:16]),
+	}, nil
+}
+
+// Encode returns the encoded header.
+func (hdr *EntryHeader) Encode() []byte {
+	var b [EntryHeaderSize]byte
+	byteOrder.PutUint32(b[0:4], hdr.ValueSize)
+	byteOrder.PutUint32(b[4:8], hdr.Checksum)
+	b[8] = hdr.Attrs
+	b[9] = hdr.KeySize
+	b[10] = hdr.Flag
+	byteOrder.PutUint32(b[12:16], hdr.Tag)
+	return b[:]
+}
+
+// EntrySize returns the size of the entry, header included. A size past
+// math.MaxUint32, which only a corrupt header gives, is math.MaxUint32, so
+// the entry runs past the end of any segment rather than wrapping around.
+func (hdr EntryHeader) EntrySize() uint32 {
+	n := uint64(EntryHeaderSize) + uint64(hdr.KeySize) + uint64(hdr.ValueSize)
+	if n > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(n)
+}
+
+// Codec returns the id of the codec that compressed the value, or zero
+// if it isn't compressed.
+func (hdr EntryHeader) Codec() uint8 {
+	return (hdr.Attrs & AttrCodecMask) >> AttrCodecShift
+}
+
+// Valid returns true if the header has a known flag. The unused, zeroed
+// tail of a segment has none.
+func (hdr EntryHeader) Valid() bool {
+	return hdr.Flag == FlagInsert || hdr.Flag == FlagDelete || hdr.Flag == FlagChunk ||
+		hdr.Flag == FlagHole
+}
+
+// Entries returns the number of entries written that the entry stands for:
+// the count of a hole, or one.
+func (hdr EntryHeader) Entries() int64 {
+	if hdr.Flag == FlagHole {
+		return int64(hdr.Tag)
+	}
+	return 1
+}
+
+func (hdr *EntryHeader) String() string {
+	return fmt.Sprintf("Flag: %d, KeySize: %d, ValueSize: %d, Checksum: %d, Tag: %d, Attrs: %d",
+		hdr.Flag, hdr.KeySize, hdr.ValueSize, hdr.Checksum, hdr.Tag, hdr.Attrs)
+}
+
+// ValueFields are the attribute fields stored at the start of the value
+// of an entry.
+type ValueFields struct {
+	// Expires is the expiry time in Unix nanoseconds, with AttrExpires.
+	Expires int64
+	// PrevSegment and PrevOffset locate the previous entry of the key,
+	// with AttrPrev.
+	PrevSegment uint32
+	PrevOffset  uint32
+	// Nonce is the nonce the value was encrypted with, with AttrEncrypted.
+	Nonce [NonceSize]byte
+}
+
+// valueAttrs are the attributes that store fields in the value.
+const valueAttrs = AttrExpires | AttrPrev | AttrEncrypted | AttrPrevWide
+
+// SplitValue separates the attribute fields stored at the start of the
+// value of an entry with header hdr from the caller's value, which is
+// still compressed if hdr.Codec is set and encrypted with AttrEncrypted.
+// Fields whose attribute isn't set are zero.
+func SplitValue(hdr EntryHeader, value []byte) (f ValueFields, data []byte, err error) {
+	if hdr.Attrs&^(valueAttrs|AttrCodecMask|AttrChunked) != 0 {
+		return f, nil, ErrUnknownAttrs
+	}
+	if hdr.Attrs&AttrExpires != 0 {
+		if len(value) < ExpirySize {
+			return f, nil, ErrShortBuffer
+		}
+		f.Expires = int64(byteOrder.Uint64(value))
+		value = value[ExpirySize:]
+	}
+	switch {
+	case hdr.Attrs&AttrPrev != 0 && hdr.Attrs&AttrPrevWide != 0:
+		return f, nil, ErrUnknownAttrs
+	case hdr.Attrs&AttrPrev != 0:
+		if len(value) < PrevSize {
+			return f, nil, ErrShortBuffer
+		}
+		f.PrevSegment = uint32(byteOrder.Uint16(value[0:2]))
+		f.PrevOffset = byteOrder.Uint32(value[2:6])
+		value = value[PrevSize:]
+	case hdr.Attrs&AttrPrevWide != 0:
+		if len(value) < PrevWideSize {
+			return f, nil, ErrShortBuffer
+		}
+		f.PrevSegment = byteOrder.Uint32(value[0:4])
+		f.PrevOffset = byteOrder.Uint32(value[4:8])
+		value = value[PrevWideSize:]
+	}
+	if hdr.Attrs&AttrEncrypted != 0 {
+		if len(value) < NonceSize {
+			return f, nil, ErrShortBuffer
+		}
+		copy(f.Nonce[:], value)
+		value = value[NonceSize:]
+	}
+	return f, value, nil
+}
+
+// JoinValue returns the value stored for data in an entry with the
+// attributes attrs and their fields f.
+func JoinValue(attrs uint8, f ValueFields, data []byte) []byte {
+	if attrs&valueAttrs == 0 {
+		return data
+	}
+	n := 0
+	if attrs&AttrExpires != 0 {
+		n += ExpirySize
+	}
+	if attrs&AttrPrev != 0 {
+		n += PrevSize
+	}
+	if attrs&AttrPrevWide != 0 {
+		n += PrevWideSize
+	}
+	if attrs&AttrEncrypted != 0 {
+		n += NonceSize
+	}
+	b := make([]byte, n+len(data))
+	p := b
+	if attrs&AttrExpires != 0 {
+		byteOrder.PutUint64(p, uint64(f.Expires))
+		p = p[ExpirySize:]
+	}
+	if attrs&AttrPrev != 0 {
+		byteOrder.PutUint16(p[0:2], uint16(f.PrevSegment))
+		byteOrder.PutUint32(p[2:6], f.PrevOffset)
+		p = p[PrevSize:]
+	}
+	if attrs&AttrPrevWide != 0 {
+		byteOrder.PutUint32(p[0:4], f.PrevSegment)
+		byteOrder.PutUint32(p[4:8], f.PrevOffset)
+		p = p[PrevWideSize:]
+	}
+	if attrs&AttrEncrypted != 0 {
+		copy(p, f.Nonce[:])
+	}
+	copy(b[n:], data)
+	return b
+}
+
+// ChunkRef locates a chunk of a value in a chunk list.
+type ChunkRef struct {
+	Segment  uint32
+	Offset   uint32
+	Checksum uint32 // checksum in the header of the chunk entry
+}
+
+// ChunkList is the value of an entry with AttrChunked.
+type ChunkList struct {
+	Size     uint64 // size of the whole value
+	Checksum uint32 // checksum of the whole value
+	Chunks   []ChunkRef
+}
+
+// ParseChunkList decodes the chunk list b.
+func ParseChunkList(b []byte) (ChunkList, error) {
+	if len(b) < ChunkListHeaderSize || (len(b)-ChunkListHeaderSize)%ChunkRefSize != 0 {
+		return ChunkList{}, ErrShortBuffer
+	}
+	l := ChunkList{
+		Size:     byteOrder.Uint64(b[0:8]),
+		Checksum: byteOrder.Uint32(b[8:12]),
+		Chunks:   make([]ChunkRef, (len(b)-ChunkListHeaderSize)/ChunkRefSize),
+	}
+	for i := range l.Chunks {
+		p := b[ChunkListHeaderSize+i*ChunkRefSize:]
+		l.Chunks[i] = ChunkRef{
+			Segment:  byteOrder.Uint32(p[0:4]),
+			Offset:   byteOrder.Uint32(p[4:8]),
+			Checksum: byteOrder.Uint32(p[8:12]),
+		}
+	}
+	return l, nil
+}
+
+// Encode returns the encoded chunk list.
+func (l ChunkList) Encode() []byte {
+	b := make([]byte, ChunkListHeaderSize+len(l.Chunks)*ChunkRefSize)
+	byteOrder.PutUint64(b[0:8], l.Size)
+	byteOrder.PutUint32(b[8:12], l.Checksum)
+	for i, c := range l.Chunks {
+		p := b[ChunkListHeaderSize+i*ChunkRefSize:]
+		byteOrder.PutUint32(p[0:4], c.Segment)
+		byteOrder.PutUint32(p[4:8], c.Offset)
+		byteOrder.PutUint32(p[8:12], c.Checksum)
+	}
+	return b
+}
+
+// IndexRecord maps a key hash to the segment and offset of the key's
+// latest entry. A record with a zero offset removes the key.
+type IndexRecord struct {
+	Hash    uint64
+	Segment uint32
+	Offset  uint32
+}
+
+// ParseIndexRecord decodes the index record at the start of b.
+func ParseIndexRecord(b []byte) (IndexRecord, error) {
+	if len(b) < IndexRecordSize {
+		return IndexRecord{}, ErrShortBuffer
+	}
+	return IndexRecord{
+		Hash:    byteOrder.Uint64(b[0:8]),
+		Segment: byteOrder.Uint32(b[8:12]),
+		Offset:  byteOrder.Uint32(b[12:16]),
+	}, nil
+}
+
+// ParseIndexRecordV1 decodes the version 1 index record at the start of b.
+func ParseIndexRecordV1(b []byte) (IndexRecord, error) {
+	if len(b) < IndexRecordSizeV1 {
+		return IndexRecord{}, ErrShortBuffer
+	}
+	return IndexRecord{
+		Hash:    byteOrder.Uint64(b[0:8]),
+		Segment: uint32(byteOrder.Uint16(b[8:10])),
+		Offset:  byteOrder.Uint32(b[10:14]),
+	}, nil
+}
+
+// Encode returns the encoded record.
+func (r IndexRecord) Encode() []byte {
+	b := make([]byte, IndexRecordSize)
+	byteOrder.PutUint64(b[0:8], r.Hash)
+	byteOrder.PutUint32(b[8:12], r.Segment)
+	byteOrder.PutUint32(b[12:16], r.Offset)
+	return b
+}
+
+// Removed returns true if the record removes its key.
+func (r IndexRecord) Removed() bool { return r.Offset == 0 }
+
+// Zero returns true for the zeroed records in the unused tail of the
+// index file.
+func (r IndexRecord) Zero() bool { return r == IndexRecord{} }
+
+// MerkleRecord is a record of the MERKLE log, one per entry written.
+type MerkleRecord struct {
+	Segment uint32
+	Offset  uint32
+	Leaf    [32]byte
+}
+
+// ParseMerkleRecord decodes the Merkle log record at the start of b.
+func ParseMerkleRecord(b []byte) (MerkleRecord, error) {
+	if len(b) < MerkleRecordSize {
+		return MerkleRecord{}, ErrShortBuffer
+	}
+	r := MerkleRecord{
+		Segment: binary.BigEndian.Uint32(b[0:4]),
+		Offset:  binary.BigEndian.Uint32(b[4:8]),
+	}
+	copy(r.Leaf[:], b[8:MerkleRecordSize])
+	return r, nil
+}
@@ -0,0 +1,184 @@
+package format_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/millken/archivedb"
+	"github.com/millken/archivedb/format"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "archivedb-format-")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	db, err := archivedb.Open(dir)
+	require.NoError(err)
+	require.NoError(db.PutTagged([]byte("foo"), []byte("bar"), 7))
+	require.NoError(db.Delete([]byte("foo")))
+	require.NoError(db.Close())
+
+	// Segment files are 1GB and sparse; the entries fit in the first page.
+	f, err := os.Open(filepath.Join(dir, "0000"))
+	require.NoError(err)
+	seg := make([]byte, 4096)
+	_, err = f.ReadAt(seg, 0)
+	require.NoError(err)
+	require.NoError(f.Close())
+	hdr, err := format.ParseSegmentHeader(seg)
+	require.NoError(err)
+	require.Equal(format.FileHeader{Version: format.SegmentVersion}, hdr)
+
+	var entries []format.EntryHeader
+	var offsets []uint32
+	for off := uint32(format.SegmentHeaderSize); ; {
+		e, err := format.ParseEntryHeader(seg[off:])
+		require.NoError(err)
+		if !e.Valid() {
+			break
+		}
+		entries = append(entries, e)
+		offsets = append(offsets, off)
+		off += e.EntrySize()
+	}
+	require.Len(entries, 2)
+	require.Equal(format.FlagInsert, entries[0].Flag)
+	require.Equal(uint8(3), entries[0].KeySize)
+	require.Equal(uint32(7), entries[0].Tag)
+	require.Equal(format.Checksum([]byte("bar")), entries[0].Checksum)
+	require.Equal(format.FlagDelete, entries[1].Flag)
+	require.Zero(entries[1].ValueSize)
+	require.Equal(entries[0].Encode(), seg[offsets[0]:offsets[0]+format.EntryHeaderSize])
+
+	idx, err := ioutil.ReadFile(filepath.Join(dir, "index"))
+	require.NoError(err)
+	_, err = format.ParseIndexHeader(idx)
+	require.NoError(err)
+	var records []format.IndexRecord
+	for off := format.IndexHeaderSize; off+format.IndexRecordSize <= len(idx); off += format.IndexRecordSize {
+		r, err := format.ParseIndexRecord(idx[off:])
+		require.NoError(err)
+		if r.Zero() {
+			break
+		}
+		records = append(records, r)
+	}
+	require.Len(records, 2)
+	require.Equal(records[0].Hash, records[1].Hash)
+	require.Equal(offsets, []uint32{records[0].Offset, records[1].Offset})
+	require.False(records[1].Removed())
+	require.Equal(records[0].Encode(), idx[format.IndexHeaderSize:format.IndexHeaderSize+format.IndexRecordSize])
+}
+
+func TestParse_Errors(t *testing.T) {
+	require := require.New(t)
+	_, err := format.ParseSegmentHeader([]byte("ArSe"))
+	require.Equal(format.ErrShortBuffer, err)
+	_, err = format.ParseSegmentHeader([]byte("ArIdX\x01"))
+	require.Equal(format.ErrBadMagic, err)
+	_, err = format.ParseEntryHeader(make([]byte, format.EntryHeaderSize-1))
+	require.Equal(format.ErrShortBuffer, err)
+	_, err = format.ParseIndexRecord(make([]byte, format.IndexRecordSize-1))
+	require.Equal(format.ErrShortBuffer, err)
+	_, err = format.ParseIndexRecordV1(make([]byte, format.IndexRecordSizeV1-1))
+	require.Equal(format.ErrShortBuffer, err)
+	_, err = format.ParseMerkleRecord(make([]byte, format.MerkleRecordSize-1))
+	require.Equal(format.ErrShortBuffer, err)
+}
+
+func TestSplitValue(t *testing.T) {
+	require := require.New(t)
+	b := format.JoinValue(format.AttrExpires, format.ValueFields{Expires: 42}, []byte("bar"))
+	require.Len(b, format.ExpirySize+3)
+	f, data, err := format.SplitValue(format.EntryHeader{Attrs: format.AttrExpires}, b)
+	require.NoError(err)
+	require.Equal(format.ValueFields{Expires: 42}, f)
+	require.Equal([]byte("bar"), data)
+
+	both := format.AttrExpires | format.AttrPrev
+	want := format.ValueFields{Expires: 42, PrevSegment: 3, PrevOffset: 1000}
+	b = format.JoinValue(both, want, []byte("bar"))
+	require.Len(b, format.ExpirySize+format.PrevSize+3)
+	f, data, err = format.SplitValue(format.EntryHeader{Attrs: both}, b)
+	require.NoError(err)
+	require.Equal(want, f)
+	require.Equal([]byte("bar"), data)
+
+	require.Equal([]byte("bar"), format.JoinValue(0, want, []byte("bar")))
+	f, data, err = format.SplitValue(format.EntryHeader{}, []byte("bar"))
+	require.NoError(err)
+	require.Zero(f)
+	require.Equal([]byte("bar"), data)
+
+	_, _, err = format.SplitValue(format.EntryHeader{Attrs: format.AttrExpires}, []byte("bar"))
+	require.Equal(format.ErrShortBuffer, err)
+	_, _, err = format.SplitValue(format.EntryHeader{Attrs: format.AttrPrev}, []byte("bar"))
+	require.Equal(format.ErrShortBuffer, err)
+	_, _, err = format.SplitValue(format.EntryHeader{Attrs: format.AttrPrev | format.AttrPrevWide}, b)
+	require.Equal(format.ErrUnknownAttrs, err)
+	// AttrChunked stores no field.
+	_, data, err = format.SplitValue(format.EntryHeader{Attrs: format.AttrChunked}, []byte("bar"))
+	require.NoError(err)
+	require.Equal([]byte("bar"), data)
+
+	// The codec id doesn't change the fields.
+	hdr := format.EntryHeader{Attrs: both | 5<<format.AttrCodecShift}
+	require.Equal(uint8(5), hdr.Codec())
+	f, data, err = format.SplitValue(hdr, b)
+	require.NoError(err)
+	require.Equal(want, f)
+	require.Equal([]byte("bar"), data)
+
+	all := both | format.AttrEncrypted
+	want.Nonce = [format.NonceSize]byte{1, 2, 3}
+	b = format.JoinValue(all, want, []byte("bar"))
+	require.Len(b, format.ExpirySize+format.PrevSize+format.NonceSize+3)
+	f, data, err = format.SplitValue(format.EntryHeader{Attrs: all}, b)
+	require.NoError(err)
+	require.Equal(want, f)
+	require.Equal([]byte("bar"), data)
+	_, _, err = format.SplitValue(format.EntryHeader{Attrs: format.AttrEncrypted}, []byte("bar"))
+	require.Equal(format.ErrShortBuffer, err)
+
+	// AttrPrevWide holds segments beyond 16 bits; AttrPrev entries stay
+	// readable.
+	wide := format.ValueFields{PrevSegment: 1 << 20, PrevOffset: 1000}
+	b = format.JoinValue(format.AttrPrevWide, wide, []byte("bar"))
+	require.Len(b, format.PrevWideSize+3)
+	f, data, err = format.SplitValue(format.EntryHeader{Attrs: format.AttrPrevWide}, b)
+	require.NoError(err)
+	require.Equal(wide, f)
+	require.Equal([]byte("bar"), data)
+	_, _, err = format.SplitValue(format.EntryHeader{Attrs: format.AttrPrev | format.AttrPrevWide}, b)
+	require.Equal(format.ErrUnknownAttrs, err)
+}
+
+func TestParseIndexRecordV1(t *testing.T) {
+	require := require.New(t)
+	b := []byte{1, 0, 0, 0, 0, 0, 0, 0, 2, 1, 3, 0, 0, 0}
+	r, err := format.ParseIndexRecordV1(b)
+	require.NoError(err)
+	require.Equal(format.IndexRecord{Hash: 1, Segment: 0x102, Offset: 3}, r)
+
+	r = format.IndexRecord{Hash: 1, Segment: 1 << 20, Offset: 3}
+	parsed, err := format.ParseIndexRecord(r.Encode())
+	require.NoError(err)
+	require.Equal(r, parsed)
+}
+
+func TestChunkList(t *testing.T) {
+	require := require.New(t)
+	l := format.ChunkList{Size: 1 << 40, Checksum: 7, Chunks: []format.ChunkRef{{1, 6, 9}, {1 << 20, 100, 10}}}
+	b := l.Encode()
+	require.Len(b, format.ChunkListHeaderSize+2*format.ChunkRefSize)
+	parsed, err := format.ParseChunkList(b)
+	require.NoError(err)
+	require.Equal(l, parsed)
+	_, err = format.ParseChunkList(b[:len(b)-1])
+	require.Equal(format.ErrShortBuffer, err)
+}
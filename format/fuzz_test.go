@@ -0,0 +1,96 @@
+//go:build go1.18
+// +build go1.18
+
+package format_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/millken/archivedb/format"
+)
+
+// The fuzz targets check that the decoders never panic on bytes read from
+// disk and that what they decode encodes back to the same bytes. Run one
+// with, for instance:
+//
+//	go test -fuzz=FuzzParseEntryHeader github.com/millken/archivedb/format
+
+func FuzzParseFileHeader(f *testing.F) {
+	f.Add([]byte(format.SegmentMagic + "\x01"))
+	f.Add([]byte(format.IndexMagic + "\x02"))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		for _, parse := range []func([]byte) (format.FileHeader, error){format.ParseSegmentHeader, format.ParseIndexHeader} {
+			if hdr, err := parse(b); err == nil && hdr.Version != b[format.SegmentHeaderSize-1] {
+				t.Fatalf("version %d, want %d", hdr.Version, b[format.SegmentHeaderSize-1])
+			}
+		}
+	})
+}
+
+func FuzzParseEntryHeader(f *testing.F) {
+	hdr := format.EntryHeader{ValueSize: 5, Checksum: 7, Attrs: format.AttrExpires, KeySize: 3, Flag: format.FlagInsert, Tag: 9}
+	f.Add(hdr.Encode())
+	f.Add(bytes.Repeat([]byte{0xff}, format.EntryHeaderSize))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		hdr, err := format.ParseEntryHeader(b)
+		if err != nil {
+			return
+		}
+		again, err := format.ParseEntryHeader(hdr.Encode())
+		if err != nil || again != hdr {
+			t.Fatalf("%v does not round trip: %v, %v", hdr, again, err)
+		}
+		if size := uint64(format.EntryHeaderSize) + uint64(hdr.KeySize) + uint64(hdr.ValueSize); size <= 1<<32-1 && uint64(hdr.EntrySize()) != size {
+			t.Fatalf("entry size %d, want %d", hdr.EntrySize(), size)
+		} else if uint64(hdr.EntrySize()) < uint64(format.EntryHeaderSize) {
+			t.Fatalf("entry size %d wrapped around", hdr.EntrySize())
+		}
+	})
+}
+
+func FuzzSplitValue(f *testing.F) {
+	f.Add(format.AttrExpires|format.AttrEncrypted, bytes.Repeat([]byte{1}, 24))
+	f.Add(format.AttrPrevWide|format.AttrChunked, []byte("12345678value"))
+	f.Fuzz(func(t *testing.T, attrs uint8, value []byte) {
+		fields, data, err := format.SplitValue(format.EntryHeader{Attrs: attrs}, value)
+		if err != nil {
+			return
+		} else if !bytes.HasSuffix(value, data) {
+			t.Fatalf("data %x is not the end of value %x", data, value)
+		}
+		if attrs&format.AttrPrev == 0 || attrs&format.AttrPrevWide == 0 {
+			if joined := format.JoinValue(attrs, fields, data); !bytes.Equal(joined, value) {
+				t.Fatalf("joined %x, want %x", joined, value)
+			}
+		}
+	})
+}
+
+func FuzzParseChunkList(f *testing.F) {
+	l := format.ChunkList{Size: 10, Checksum: 1, Chunks: []format.ChunkRef{{Segment: 1, Offset: 2, Checksum: 3}}}
+	f.Add(l.Encode())
+	f.Fuzz(func(t *testing.T, b []byte) {
+		l, err := format.ParseChunkList(b)
+		if err != nil {
+			return
+		} else if !bytes.Equal(l.Encode(), b) {
+			t.Fatalf("%x does not round trip", b)
+		}
+	})
+}
+
+func FuzzParseIndexRecord(f *testing.F) {
+	f.Add(format.IndexRecord{Hash: 1, Segment: 2, Offset: 3}.Encode())
+	f.Fuzz(func(t *testing.T, b []byte) {
+		r, err := format.ParseIndexRecord(b)
+		if err != nil {
+			return
+		} else if !bytes.Equal(r.Encode(), b[:format.IndexRecordSize]) {
+			t.Fatalf("%x does not round trip", b)
+		}
+		if _, err := format.ParseIndexRecordV1(b); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
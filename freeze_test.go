@@ -0,0 +1,55 @@
+package archivedb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_Freeze(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	require.NoError(db.Put([]byte("a"), []byte("1")))
+	mustRollover(t, db)
+	require.NoError(db.Put([]byte("b"), []byte("2")))
+
+	_, err = db.VerifyFreeze()
+	require.ErrorIs(err, ErrFrozen)
+	rec, err := db.Freeze()
+	require.NoError(err)
+	require.Len(db.manifest.Segments, 2)
+	require.ErrorIs(db.Put([]byte("c"), []byte("3")), ErrFrozen)
+	require.ErrorIs(db.Pin([]byte("a")), ErrFrozen)
+	_, err = db.Freeze()
+	require.ErrorIs(err, ErrFrozen)
+	require.NoError(db.Close())
+
+	// The freeze is persistent and verifiable.
+	db, err = Open(dir)
+	require.NoError(err)
+	require.ErrorIs(db.Delete([]byte("a")), ErrFrozen)
+	v, err := db.Get([]byte("b"))
+	require.NoError(err)
+	require.Equal("2", string(v))
+	got, err := db.VerifyFreeze()
+	require.NoError(err)
+	require.Equal(rec.Chain, got.Chain)
+	require.NoError(db.Close())
+
+	// Changing a segment is detected.
+	f, err := os.OpenFile(filepath.Join(dir, segmentFilename(0)), os.O_WRONLY, 0)
+	require.NoError(err)
+	_, err = f.WriteAt([]byte("!"), SegmentHeaderSize+EntryHeaderSize+1)
+	require.NoError(err)
+	require.NoError(f.Close())
+	db, err = Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	_, err = db.VerifyFreeze()
+	require.ErrorIs(err, ErrTampered)
+}
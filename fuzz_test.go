@@ -0,0 +1,97 @@
+//go:build go1.18
+// +build go1.18
+
+package archivedb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/millken/archivedb/format"
+)
+
+// The fuzz targets feed files and streams read from outside the process
+// to the code parsing them, which must fail cleanly, never panic or loop.
+// Run one with, for instance:
+//
+//	go test -fuzz=FuzzSegmentFile github.com/millken/archivedb
+
+// fuzzSegment returns a valid segment file holding a put and a delete.
+func fuzzSegment(f *testing.F) []byte {
+	dir := f.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		f.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.PutWithOptions([]byte("key"), []byte("value"), WriteOptions{Tag: 1}); err != nil {
+		f.Fatal(err)
+	} else if err := db.Delete([]byte("key")); err != nil {
+		f.Fatal(err)
+	}
+	s := db.activeSegment()
+	b, err := s.mmap.ReadOff(0, int(s.Size()))
+	if err != nil {
+		f.Fatal(err)
+	}
+	return append([]byte(nil), b...)
+}
+
+func FuzzSegmentFile(f *testing.F) {
+	f.Add(fuzzSegment(f))
+	f.Add([]byte(format.SegmentMagic + "\x01"))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		path := filepath.Join(t.TempDir(), segmentFilename(0))
+		if err := ioutil.WriteFile(path, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		DumpSegment(path, func(SegmentEntryInfo) error { return nil })
+
+		s := newSegment(0, path)
+		if err := s.Open(); err != nil {
+			return
+		}
+		defer s.Close()
+		if s.Size() > uint32(len(b)) {
+			t.Fatalf("segment size %d past the end of a %d byte file", s.Size(), len(b))
+		}
+		s.ForEachEntry(func(entry) error { return nil })
+	})
+}
+
+func FuzzIndexFile(f *testing.F) {
+	var rec bytes.Buffer
+	rec.WriteString(format.IndexMagic)
+	rec.WriteByte(format.IndexVersion)
+	rec.Write(format.IndexRecord{Hash: 1, Segment: 2, Offset: 3}.Encode())
+	rec.Write(format.IndexRecord{Hash: 1}.Encode())
+	f.Add(rec.Bytes())
+	f.Add([]byte(format.IndexMagic + "\x01" + "01234567890123"))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		path := filepath.Join(t.TempDir(), "index")
+		if err := ioutil.WriteFile(path, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		idx, err := openIndexReadOnly(path, nil)
+		if err != nil {
+			return
+		}
+		defer idx.Close()
+		idx.ForEach(func(uint64, item) error { return nil })
+	})
+}
+
+func FuzzImport(f *testing.F) {
+	f.Add([]byte(`{"key":"a2V5","value":"dmFsdWU="}` + "\n" + `{"key":"b3RoZXI=","value":null}`))
+	f.Add([]byte(`{"key":"","value":""}`))
+	db, err := Open(f.TempDir())
+	if err != nil {
+		f.Fatal(err)
+	}
+	defer db.Close()
+	f.Fuzz(func(t *testing.T, b []byte) {
+		db.Import(NewJSONImportSource(bytes.NewReader(b)), nil, nil)
+	})
+}
@@ -0,0 +1,66 @@
+package archivedb
+
+import (
+	"bytes"
+	"runtime/debug"
+
+	"github.com/millken/archivedb/format"
+)
+
+// Has returns true if key has a value, without reading or verifying the
+// value: only the entry header and key are read, and the expiry time of
+// entries that have one. The index records where entries are but not
+// whether they are tombstones, so these are read from the segment. It
+// returns false with ErrKeyDeleted or ErrKeyExpired for a key that was
+// deleted or expired but not purged yet, and false with no error for a key
+// that was never written or purged, or whose hash is taken by another key.
+func (db *DB) Has(key []byte) (ok bool, err error) {
+	db.rlockFor(lockGet)
+	defer db.mu.RUnlock()
+	if db.closed {
+		return false, ErrDatabaseClosed
+	}
+	key, err = db.encodeKey(key)
+	if err != nil {
+		return false, err
+	}
+	it, found := db.index.Get(db.opts.hashFunc(key))
+	if !found {
+		return false, nil
+	}
+	s := db.segment(it.ID())
+	if s == nil {
+		return false, ErrSegmentNotFound
+	}
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer recoverFault(&err, ErrReadFault)
+
+	hdr, err := s.ReadEntryHeader(it.Offset())
+	if err != nil {
+		return false, err
+	}
+	off := int(it.Offset()) + EntryHeaderSize
+	if stored, err := s.mmap.ReadOff(off, int(hdr.KeySize)); err != nil {
+		return false, err
+	} else if !bytes.Equal(stored, key) {
+		// Another key with the same hash, so key has none.
+		return false, nil
+	}
+	if hdr.Flag == EntryDeleteFlag {
+		return false, ErrKeyDeleted
+	} else if hdr.Attrs&format.AttrExpires == 0 {
+		return true, nil
+	}
+	b, err := s.mmap.ReadOff(off+int(hdr.KeySize), format.ExpirySize)
+	if err != nil {
+		return false, err
+	}
+	f, _, err := format.SplitValue(format.EntryHeader{Attrs: format.AttrExpires}, b)
+	if err != nil {
+		return false, err
+	}
+	if e := (entry{expires: f.Expires}); e.expired(db.now()) {
+		return false, ErrKeyExpired
+	}
+	return true, nil
+}
@@ -0,0 +1,62 @@
+package archivedb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_Has(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	clock := newFakeClock()
+	db, err := Open(dir, ClockOption(clock))
+	require.NoError(err)
+	defer db.Close()
+
+	require.NoError(db.Put([]byte("a"), []byte("1")))
+	require.NoError(db.PutWithOptions([]byte("ttl"), []byte("2"), WriteOptions{TTL: time.Minute}))
+	require.NoError(db.Put([]byte("gone"), []byte("3")))
+	require.NoError(db.Delete([]byte("gone")))
+
+	ok, err := db.Has([]byte("a"))
+	require.NoError(err)
+	require.True(ok)
+	ok, err = db.Has([]byte("ttl"))
+	require.NoError(err)
+	require.True(ok)
+	ok, err = db.Has([]byte("missing"))
+	require.NoError(err)
+	require.False(ok)
+	ok, err = db.Has([]byte("gone"))
+	require.ErrorIs(err, ErrKeyDeleted)
+	require.False(ok)
+
+	clock.Add(time.Hour)
+	ok, err = db.Has([]byte("ttl"))
+	require.ErrorIs(err, ErrKeyExpired)
+	require.False(ok)
+
+	require.NoError(db.Close())
+	_, err = db.Has([]byte("a"))
+	require.ErrorIs(err, ErrDatabaseClosed)
+}
+
+func TestDB_Has_HashCollision(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir, HashFuncOption(func([]byte) uint64 { return 1 }))
+	require.NoError(err)
+	defer db.Close()
+
+	require.NoError(db.Put([]byte("a"), []byte("1")))
+	ok, err := db.Has([]byte("b"))
+	require.NoError(err)
+	require.False(ok)
+	ok, err = db.Has([]byte("a"))
+	require.NoError(err)
+	require.True(ok)
+}
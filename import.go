@@ -0,0 +1,367 @@
+package archivedb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// ImportBatchSize is the number of pairs Import writes between flushes.
+const ImportBatchSize = 4096
+
+// importPacingWindow is the interval over which Import's rate is checked
+// against ImportPacingOption, and how quickly a change to it or to the
+// foreground load takes effect.
+const importPacingWindow = 100 * time.Millisecond
+
+// ImportSource is a stream of key/value pairs in ascending key order, such
+// as a cursor over a Bolt bucket or a Badger or goleveldb iterator, which
+// NewBoltImportSource, NewBadgerImportSource and NewLevelDBImportSource
+// adapt. Key and Value need only stay valid until the next call to Next.
+type ImportSource interface {
+	// Seek positions the source so that the next call to Next moves to
+	// the first key greater than or equal to key.
+	Seek(key []byte)
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Err() error
+}
+
+// Import copies every pair of src into db. If resume is not nil, pairs up
+// to and including the key resume are skipped, so an interrupted import
+// can be restarted from the last key passed to checkpoint.
+//
+// Every ImportBatchSize pairs, and once at the end, Import flushes the
+// database and calls checkpoint, if not nil, with the last key written.
+// Those keys are durable when checkpoint is called.
+//
+// With ImportPacingOption, Import waits between pairs to keep to its rate,
+// and with an Env that has EnvImportRateLimit, to the rate of the env.
+func (db *DB) Import(src ImportSource, resume []byte, checkpoint func(key []byte) error) error {
+	if resume != nil {
+		src.Seek(resume)
+	}
+	var last []byte
+	var n int
+	p := newImportPacer(db)
+	commit := func() error {
+		if last == nil {
+			return nil
+		}
+		db.mu.Lock()
+		err := db.flush()
+		db.mu.Unlock()
+		if err != nil {
+			return err
+		} else if checkpoint != nil {
+			return checkpoint(last)
+		}
+		return nil
+	}
+	for src.Next() {
+		key := src.Key()
+		if resume != nil && bytes.Compare(key, resume) <= 0 {
+			continue
+		}
+		value := src.Value()
+		if err := db.Put(key, value); err != nil {
+			return err
+		}
+		p.pace(len(key) + len(value))
+		db.opts.env.throttleImport(len(key) + len(value))
+		last = append(last[:0], key...)
+		if n++; n%ImportBatchSize == 0 {
+			if err := commit(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := src.Err(); err != nil {
+		return err
+	}
+	return commit()
+}
+
+// importPacer holds Import to the rate set by ImportPacingOption. It tells
+// foreground operations from its own by the Put, Get and Delete counts and
+// the logical bytes of the database stats, less what Import added to them.
+type importPacer struct {
+	db            *DB
+	rate          int64
+	reserve       float64
+	start         time.Time
+	ops, bytes    int64 // the database counters at start
+	ownOps, owned int64 // the operations and bytes of Import since start
+	written       int64 // the bytes of Import not yet paid for
+	busy          bool  // whether foreground operations ran in the last window
+}
+
+func newImportPacer(db *DB) *importPacer {
+	p := &importPacer{db: db}
+	p.next()
+	return p
+}
+
+// next starts a pacing window, picking up changes made with SetOption.
+func (p *importPacer) next() {
+	ops, bytes := p.counts()
+	p.busy = !p.start.IsZero() && ops-p.ops-p.ownOps > 0
+	p.db.mu.RLock()
+	p.rate, p.reserve = p.db.opts.importRate, p.db.opts.importReserve
+	p.db.mu.RUnlock()
+	if p.rate == 0 {
+		p.written = 0
+	}
+	p.start = time.Now()
+	p.ops, p.bytes = ops, bytes
+	p.ownOps, p.owned = 0, 0
+}
+
+// counts returns the Puts, Gets and Deletes of the database and the key
+// and value bytes written.
+func (p *importPacer) counts() (ops, bytes int64) {
+	s := &p.db.stats
+	ops = atomic.LoadInt64(&s.puts.count) + atomic.LoadInt64(&s.gets.count) + atomic.LoadInt64(&s.deletes.count)
+	return ops, atomic.LoadInt64(&s.logicalBytes)
+}
+
+// budget returns the bytes Import may write in the current window: all of
+// the window's share of the rate while nothing else runs, and otherwise
+// what is left once foreground operations have their reserved share or
+// the bytes they wrote, whichever is more. Foreground operations in the
+// last window count as running, so the reserve holds from the start of a
+// window rather than from their first operation in it.
+func (p *importPacer) budget() int64 {
+	budget := p.rate * int64(importPacingWindow) / int64(time.Second)
+	ops, bytes := p.counts()
+	if !p.busy && ops-p.ops-p.ownOps <= 0 {
+		return budget
+	}
+	foreground := int64(float64(budget) * p.reserve)
+	if b := bytes - p.bytes - p.owned; b > foreground {
+		foreground = b
+	}
+	if budget -= foreground; budget < 0 {
+		return 0
+	}
+	return budget
+}
+
+// pace records that Import wrote a pair of n bytes and, once that passes
+// the budget of the current window, waits for as many windows as it
+// takes to pay for it. Budget left unused at the end of a window is lost.
+func (p *importPacer) pace(n int) {
+	p.ownOps++
+	p.owned += int64(n)
+	p.written += int64(n)
+	for p.rate > 0 && p.written >= p.budget() {
+		if d := importPacingWindow - time.Since(p.start); d > 0 {
+			time.Sleep(d)
+		}
+		if p.written -= p.budget(); p.written < 0 {
+			p.written = 0
+		}
+		p.next()
+	}
+	if time.Since(p.start) >= importPacingWindow {
+		p.written = 0
+		p.next()
+	}
+}
+
+// jsonImportSource reads the output of Export in the ExportJSON format.
+type jsonImportSource struct {
+	dec  *json.Decoder
+	seek []byte
+	pair struct {
+		Key   []byte `json:"key"`
+		Value []byte `json:"value"`
+	}
+	err error
+}
+
+// NewJSONImportSource returns a source reading the JSON lines written by
+// Export, so that an export can be loaded into another database.
+func NewJSONImportSource(r io.Reader) ImportSource {
+	return &jsonImportSource{dec: json.NewDecoder(bufio.NewReader(r))}
+}
+
+// Seek skips forward only, as the input is a stream.
+func (s *jsonImportSource) Seek(key []byte) { s.seek = append([]byte(nil), key...) }
+
+func (s *jsonImportSource) Next() bool {
+	for s.err == nil {
+		s.pair.Key, s.pair.Value = nil, nil
+		if err := s.dec.Decode(&s.pair); err == io.EOF {
+			return false
+		} else if err != nil {
+			s.err = err
+			return false
+		}
+		if bytes.Compare(s.pair.Key, s.seek) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *jsonImportSource) Key() []byte   { return s.pair.Key }
+func (s *jsonImportSource) Value() []byte { return s.pair.Value }
+func (s *jsonImportSource) Err() error    { return s.err }
+
+// BoltCursor is the part of a cursor over a BoltDB or bbolt bucket that
+// NewBoltImportSource uses; *bolt.Cursor and *bbolt.Cursor implement it.
+type BoltCursor interface {
+	First() (key, value []byte)
+	Next() (key, value []byte)
+	Seek(seek []byte) (key, value []byte)
+}
+
+// boltImportSource reads the pairs of a Bolt bucket through a cursor.
+type boltImportSource struct {
+	c          BoltCursor
+	started    bool
+	seeked     bool
+	key, value []byte
+}
+
+// NewBoltImportSource returns a source reading the pairs of the bucket c
+// is a cursor over, in the read transaction c belongs to. Nested buckets,
+// which the cursor returns with a nil value, are skipped.
+func NewBoltImportSource(c BoltCursor) ImportSource {
+	return &boltImportSource{c: c}
+}
+
+func (s *boltImportSource) Seek(key []byte) {
+	s.key, s.value = s.c.Seek(key)
+	s.started, s.seeked = true, true
+}
+
+func (s *boltImportSource) Next() bool {
+	for {
+		switch {
+		case s.seeked:
+			s.seeked = false
+		case !s.started:
+			s.key, s.value = s.c.First()
+			s.started = true
+		default:
+			s.key, s.value = s.c.Next()
+		}
+		if s.key == nil || s.value != nil {
+			return s.key != nil
+		}
+	}
+}
+
+func (s *boltImportSource) Key() []byte   { return s.key }
+func (s *boltImportSource) Value() []byte { return s.value }
+func (s *boltImportSource) Err() error    { return nil }
+
+// LevelDBIterator is the part of a goleveldb iterator that
+// NewLevelDBImportSource uses; iterator.Iterator implements it.
+type LevelDBIterator interface {
+	Seek(key []byte) bool
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Error() error
+}
+
+// levelDBImportSource reads the pairs of a goleveldb database.
+type levelDBImportSource struct {
+	it     LevelDBIterator
+	seeked bool // it is positioned at the first pair to return
+	valid  bool
+}
+
+// NewLevelDBImportSource returns a source reading the pairs it iterates
+// over, such as those of a snapshot of a goleveldb database. The caller
+// releases it once Import returns.
+func NewLevelDBImportSource(it LevelDBIterator) ImportSource {
+	return &levelDBImportSource{it: it}
+}
+
+func (s *levelDBImportSource) Seek(key []byte) {
+	s.valid = s.it.Seek(key)
+	s.seeked = true
+}
+
+func (s *levelDBImportSource) Next() bool {
+	if s.seeked {
+		s.seeked = false
+		return s.valid
+	}
+	return s.it.Next()
+}
+
+func (s *levelDBImportSource) Key() []byte   { return s.it.Key() }
+func (s *levelDBImportSource) Value() []byte { return s.it.Value() }
+func (s *levelDBImportSource) Err() error    { return s.it.Error() }
+
+// BadgerIterator is the part of a Badger iterator that
+// NewBadgerImportSource uses; *badger.Iterator implements it.
+type BadgerIterator interface {
+	Rewind()
+	Seek(key []byte)
+	Valid() bool
+	Next()
+}
+
+// badgerImportSource reads the pairs of a Badger database.
+type badgerImportSource struct {
+	it         BadgerIterator
+	item       func() (key, value []byte, err error)
+	started    bool
+	seeked     bool // it is positioned at the first pair to return
+	key, value []byte
+	err        error
+}
+
+// NewBadgerImportSource returns a source reading the pairs it iterates
+// over, in the read transaction it belongs to. Badger iterators return
+// items, whose values may have to be read from the value log, so item
+// returns the key and value of the item it is at, for example:
+//
+//	func() ([]byte, []byte, error) {
+//		item := it.Item()
+//		value, err := item.ValueCopy(nil)
+//		return item.Key(), value, err
+//	}
+//
+// The caller closes it once Import returns.
+func NewBadgerImportSource(it BadgerIterator, item func() (key, value []byte, err error)) ImportSource {
+	return &badgerImportSource{it: it, item: item}
+}
+
+func (s *badgerImportSource) Seek(key []byte) {
+	s.it.Seek(key)
+	s.started, s.seeked = true, true
+}
+
+func (s *badgerImportSource) Next() bool {
+	if s.err != nil {
+		return false
+	} else if !s.started {
+		s.it.Rewind()
+		s.started = true
+	} else if s.seeked {
+		s.seeked = false
+	} else {
+		s.it.Next()
+	}
+	if !s.it.Valid() {
+		s.key, s.value = nil, nil
+		return false
+	}
+	s.key, s.value, s.err = s.item()
+	return s.err == nil
+}
+
+func (s *badgerImportSource) Key() []byte   { return s.key }
+func (s *badgerImportSource) Value() []byte { return s.value }
+func (s *badgerImportSource) Err() error    { return s.err }
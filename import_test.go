@@ -0,0 +1,218 @@
+package archivedb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_Import(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	src, err := Open(dir + "/src")
+	require.NoError(err)
+	defer src.Close()
+	for _, k := range []string{"a", "b", "c"} {
+		require.NoError(src.Put([]byte(k), []byte("v"+k)))
+	}
+	var buf bytes.Buffer
+	require.NoError(src.Export(&buf, ExportJSON))
+
+	dst, err := Open(dir + "/dst")
+	require.NoError(err)
+	defer dst.Close()
+
+	// Fail after the first pair, then resume from the checkpoint.
+	var checkpoints []string
+	r := &failingReader{r: strings.NewReader(buf.String()), n: strings.Index(buf.String(), "\n") + 1}
+	err = dst.Import(NewJSONImportSource(r), nil, func(key []byte) error {
+		checkpoints = append(checkpoints, string(key))
+		return nil
+	})
+	require.Error(err)
+	require.Empty(checkpoints)
+	require.NoError(dst.Import(NewJSONImportSource(strings.NewReader(buf.String())), []byte("a"), func(key []byte) error {
+		checkpoints = append(checkpoints, string(key))
+		return nil
+	}))
+	require.Equal([]string{"c"}, checkpoints)
+
+	for _, k := range []string{"a", "b", "c"} {
+		v, err := dst.Get([]byte(k))
+		require.NoError(err)
+		require.Equal("v"+k, string(v))
+	}
+}
+
+// failingReader returns an error once n bytes have been read.
+type failingReader struct {
+	r *strings.Reader
+	n int
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, errors.New("read failed")
+	}
+	if len(p) > r.n {
+		p = p[:r.n]
+	}
+	n, err := r.r.Read(p)
+	r.n -= n
+	return n, err
+}
+
+// sliceImportSource imports n pairs of size bytes.
+type sliceImportSource struct {
+	i, n  int
+	value []byte
+}
+
+func (s *sliceImportSource) Seek(key []byte) {}
+func (s *sliceImportSource) Next() bool      { s.i++; return s.i <= s.n }
+func (s *sliceImportSource) Key() []byte     { return []byte(fmt.Sprintf("k%04d", s.i)) }
+func (s *sliceImportSource) Value() []byte   { return s.value }
+func (s *sliceImportSource) Err() error      { return nil }
+
+func TestDB_ImportPacing(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir, ImportPacingOption(100<<10, 0.75))
+	require.NoError(err)
+	defer db.Close()
+	value := make([]byte, 1019)
+
+	// 30 KiB at 100 KiB/s takes three windows of 10 KiB each.
+	start := time.Now()
+	require.NoError(db.Import(&sliceImportSource{n: 30, value: value}, nil, nil))
+	require.GreaterOrEqual(int64(time.Since(start)), int64(2*importPacingWindow))
+
+	// Gets alongside it leave it a quarter of the rate once seen: 10 KiB
+	// in the first window, then 2.5 KiB in each of the next eight.
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				db.Get([]byte("k0001"))
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+	start = time.Now()
+	err = db.Import(&sliceImportSource{n: 30, value: value}, nil, nil)
+	close(done)
+	require.NoError(err)
+	require.GreaterOrEqual(int64(time.Since(start)), int64(6*importPacingWindow))
+
+	// Without the option it doesn't wait.
+	require.NoError(db.SetOption(ImportPacingOption(0, 0)))
+	start = time.Now()
+	require.NoError(db.Import(&sliceImportSource{n: 100, value: value}, nil, nil))
+	require.Less(int64(time.Since(start)), int64(importPacingWindow))
+
+	require.Error(db.SetOption(ImportPacingOption(-1, 0)))
+	require.Error(db.SetOption(ImportPacingOption(1, 1)))
+}
+
+// sortedPairs mimics the cursors and iterators of Bolt, goleveldb and
+// Badger over sorted pairs. A nil value is a nested Bolt bucket.
+type sortedPairs struct {
+	keys, values []string
+	i            int
+}
+
+func (p *sortedPairs) at() ([]byte, []byte) {
+	if p.i >= len(p.keys) {
+		return nil, nil
+	} else if p.values[p.i] == "" {
+		return []byte(p.keys[p.i]), nil
+	}
+	return []byte(p.keys[p.i]), []byte(p.values[p.i])
+}
+
+func (p *sortedPairs) seek(key []byte) {
+	for p.i = 0; p.i < len(p.keys) && p.keys[p.i] < string(key); p.i++ {
+	}
+}
+
+// Bolt cursor.
+func (p *sortedPairs) First() ([]byte, []byte)          { p.i = 0; return p.at() }
+func (p *sortedPairs) Seek(key []byte) ([]byte, []byte) { p.seek(key); return p.at() }
+func (p *sortedPairs) Next() ([]byte, []byte)           { p.i++; return p.at() }
+
+// goleveldb iterator, positioned before the first pair.
+type levelDBPairs struct{ sortedPairs }
+
+func (p *levelDBPairs) Seek(key []byte) bool { p.seek(key); return p.i < len(p.keys) }
+func (p *levelDBPairs) Next() bool           { p.i++; return p.i < len(p.keys) }
+func (p *levelDBPairs) Key() []byte          { k, _ := p.at(); return k }
+func (p *levelDBPairs) Value() []byte        { _, v := p.at(); return v }
+func (p *levelDBPairs) Error() error         { return nil }
+
+// Badger iterator.
+type badgerPairs struct{ sortedPairs }
+
+func (p *badgerPairs) Rewind()         { p.i = 0 }
+func (p *badgerPairs) Seek(key []byte) { p.seek(key) }
+func (p *badgerPairs) Valid() bool     { return p.i < len(p.keys) }
+func (p *badgerPairs) Next()           { p.i++ }
+func (p *badgerPairs) item() ([]byte, []byte, error) {
+	k, v := p.at()
+	return k, v, nil
+}
+
+func TestDB_ImportStores(t *testing.T) {
+	// Only the Bolt bucket has a nested bucket.
+	keys, values := []string{"a", "b", "c", "d"}, []string{"va", "vb", "vc", "vd"}
+	sources := map[string]func() ImportSource{
+		"bolt": func() ImportSource {
+			return NewBoltImportSource(&sortedPairs{
+				keys:   []string{"a", "b", "bucket", "c", "d"},
+				values: []string{"va", "vb", "", "vc", "vd"},
+			})
+		},
+		"leveldb": func() ImportSource {
+			return NewLevelDBImportSource(&levelDBPairs{sortedPairs{keys: keys, values: values, i: -1}})
+		},
+		"badger": func() ImportSource {
+			p := &badgerPairs{sortedPairs{keys: keys, values: values}}
+			return NewBadgerImportSource(p, p.item)
+		},
+	}
+	for name, source := range sources {
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+			dir, cleanup := MustTempDir()
+			defer cleanup()
+			db, err := Open(dir)
+			require.NoError(err)
+			defer db.Close()
+
+			var checkpoints []string
+			checkpoint := func(key []byte) error {
+				checkpoints = append(checkpoints, string(key))
+				return nil
+			}
+			require.NoError(db.Import(source(), nil, checkpoint))
+			require.NoError(db.Import(source(), []byte("bb"), checkpoint))
+			require.Equal([]string{"d", "d"}, checkpoints)
+			for _, k := range []string{"a", "b", "c", "d"} {
+				v, err := db.Get([]byte(k))
+				require.NoError(err)
+				require.Equal("v"+k, string(v))
+			}
+			_, err = db.Get([]byte("bucket"))
+			require.ErrorIs(err, ErrKeyNotFound)
+		})
+	}
+}
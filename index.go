@@ -1,29 +1,43 @@
 package archivedb
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"io"
+	"math/rand"
 	"os"
 	"sync"
 	"sync/atomic"
+	"unsafe"
 
+	"github.com/millken/archivedb/format"
 	"github.com/millken/archivedb/internal/mmap"
 	"github.com/pkg/errors"
 )
 
 /*
  +-------------+-------------+-------------+
- | Hash(8B)    | segment(2B) | Offset(4B)  |
+ | Hash(8B)    | segment(4B) | Offset(4B)  |
  +-------------+-------------+-------------+
 */
 const (
 	bucketsCount    = 512
-	indexBlock      = 14 << 16
-	indexItemSize   = 14
-	IndexVersion    = 1
-	IndexMagic      = "ArIdX"
-	IndexHeaderSize = 6
+	indexBlock      = 16 << 16
+	indexItemSize   = format.IndexRecordSize
+	IndexVersion    = format.IndexVersion
+	IndexMagic      = format.IndexMagic
+	IndexHeaderSize = format.IndexHeaderSize
+
+	// indexItemMemory approximates the heap bytes used per indexed key: an
+	// 8 byte hash and an 8 byte item in a map slot, plus its control byte,
+	// in tables kept between half and fully loaded as maps grow, which
+	// measures at 25 to 38 bytes. Keys themselves are never held in
+	// memory, so the cost doesn't grow with key length.
+	indexItemMemory = 32
+	// bucketShrinkMin is the fewest items a bucket must have held before
+	// deletes make it shrink; smaller maps aren't worth reallocating.
+	bucketShrinkMin = 256
 )
 
 var (
@@ -32,10 +46,8 @@ var (
 	ErrIndexNotWritable    = errors.New("index not writable")
 )
 
-var intconv = binary.LittleEndian
-
 type item struct {
-	id  uint16
+	id  uint32
 	off uint32
 }
 
@@ -43,13 +55,22 @@ func (it item) Offset() uint32 {
 	return it.off
 }
 
-func (it item) ID() uint16 {
+func (it item) ID() uint32 {
 	return it.id
 }
 
+// before returns true if it addresses an entry written before o.
+func (it item) before(o item) bool {
+	return it.id < o.id || (it.id == o.id && it.off < o.off)
+}
+
 type bucket struct {
 	items map[uint64]item
-	mu    sync.RWMutex
+	// peak is the most items held since items was allocated. Maps keep
+	// their slots after deletes, so items is reallocated once it holds a
+	// quarter of that.
+	peak int
+	mu   sync.RWMutex
 }
 
 func (b *bucket) Init() {
@@ -57,22 +78,60 @@ func (b *bucket) Init() {
 	b.Reset()
 }
 
+// Reset empties the bucket, releasing the slots of its map.
 func (b *bucket) Reset() {
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	bm := b.items
-	for k := range bm {
-		delete(b.items, k)
-	}
+	b.items, b.peak = make(map[uint64]item), 0
 }
 
 func (b *bucket) Set(k uint64, it item) error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	b.items[k] = it
+	b.set(k, it)
 	return nil
 }
 
+// set sets k to it, recording the peak size. The caller must hold b.mu.
+func (b *bucket) set(k uint64, it item) {
+	b.items[k] = it
+	if n := len(b.items); n > b.peak {
+		b.peak = n
+	}
+}
+
+// SetIfNewer sets k to it unless k addresses an entry written after it.
+func (b *bucket) SetIfNewer(k uint64, it item) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if old, ok := b.items[k]; ok && !old.before(it) {
+		return
+	}
+	b.set(k, it)
+}
+
+func (b *bucket) Delete(k uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.items, k)
+	b.shrink()
+}
+
+// shrink reallocates the map of b, releasing its unused slots, once
+// deletes have left it holding at most a quarter of its peak. Each
+// reallocation copies a third as many items as were deleted since the
+// last. The caller must hold b.mu.
+func (b *bucket) shrink() {
+	if b.peak < bucketShrinkMin || len(b.items) > b.peak/4 {
+		return
+	}
+	items := make(map[uint64]item, len(b.items))
+	for k, it := range b.items {
+		items[k] = it
+	}
+	b.items, b.peak = items, len(items)
+}
+
 func (b *bucket) Get(k uint64) (item, bool) {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
@@ -82,12 +141,24 @@ func (b *bucket) Get(k uint64) (item, bool) {
 	return item{}, false
 }
 
+// ForEach calls fn for every item in the bucket. fn must not modify the bucket.
+func (b *bucket) ForEach(fn func(k uint64, it item) error) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for k, it := range b.items {
+		if err := fn(k, it); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type indexHeader struct {
 	Version uint8
 }
 
 func newIndexHeader() indexHeader {
-	return indexHeader{Version: SegmentVersion}
+	return indexHeader{Version: IndexVersion}
 }
 
 // WriteTo writes the header to w.
@@ -99,24 +170,28 @@ func (hdr *indexHeader) WriteTo(w io.Writer) (n int64, err error) {
 }
 
 type index struct {
-	path    string
-	mmap    *mmap.File
-	buckets [bucketsCount]bucket
-	total   int64
-	c       int
+	path string
+	// version is the format version of the file; version 1 files are
+	// read, but rewritten before records are appended.
+	version  uint8
+	mmap     *mmap.File
+	buckets  [bucketsCount]bucket
+	total    int64
+	c        int
+	readOnly bool
+	valid    func(k uint64, it item) bool
 }
 
 func openIndex(filePath string) (*index, error) {
-	var size int64
 	f, err := os.OpenFile(filePath, os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to open index file")
 	}
+	defer f.Close()
 	fi, err := f.Stat()
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to stat index file")
 	}
-	size = fi.Size()
 	if fi.Size() == 0 {
 		// Write header to file and close.
 		hdr := newIndexHeader()
@@ -128,73 +203,232 @@ func openIndex(filePath string) (*index, error) {
 		} else if err := f.Close(); err != nil {
 			return nil, err
 		}
-		size = int64(n + indexBlock)
 	}
+	idx, err := openIndexFile(filePath, mmap.Read|mmap.Write, nil)
+	if err != nil {
+		return nil, err
+	}
+	if idx.version != IndexVersion {
+		items, err := idx.Persisted()
+		if err != nil {
+			idx.Close()
+			return nil, err
+		} else if err := idx.Rewrite(items); err != nil {
+			idx.Close()
+			return nil, errors.Wrap(err, "upgrade index")
+		}
+	}
+	return idx, nil
+}
 
-	mmap, err := mmap.OpenFile(filePath, mmap.Read|mmap.Write)
+// openIndexReadOnly maps an existing index file without write access.
+// Records rejected by valid are left to be loaded by a later Refresh.
+func openIndexReadOnly(filePath string, valid func(k uint64, it item) bool) (*index, error) {
+	return openIndexFile(filePath, mmap.Read, valid)
+}
+
+func openIndexFile(filePath string, flag mmap.Flag, valid func(k uint64, it item) bool) (*index, error) {
+	m, err := mmap.OpenFile(filePath, flag)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to mmap index file")
 	}
 	idx := &index{
-		path: filePath,
-		mmap: mmap,
-		c:    IndexHeaderSize,
+		path:     filePath,
+		mmap:     m,
+		c:        IndexHeaderSize,
+		readOnly: flag&mmap.Write == 0,
+		valid:    valid,
 	}
 	atomic.StoreInt64(&idx.total, 0)
+	if err := idx.readHeader(); err != nil {
+		m.Close()
+		return nil, err
+	}
 
 	for i := range idx.buckets[:] {
 		idx.buckets[i].Init()
 	}
 
-	return idx, idx.load(size)
+	return idx, idx.load()
+}
+
+// readHeader checks the header of the mapped file and sets idx.version.
+func (idx *index) readHeader() error {
+	b, err := idx.mmap.ReadOff(0, IndexHeaderSize)
+	if err != nil {
+		return errors.Wrap(ErrInvalidIndex, err.Error())
+	}
+	hdr, err := format.ParseIndexHeader(b)
+	if err != nil {
+		return errors.Wrap(ErrInvalidIndex, err.Error())
+	} else if hdr.Version != 1 && hdr.Version != IndexVersion {
+		return errors.Wrapf(ErrInvalidIndexVersion, "version %d", hdr.Version)
+	}
+	idx.version = hdr.Version
+	return nil
 }
 
-func (idx *index) load(size int64) error {
-	for idx.c = IndexHeaderSize; idx.c < idx.mmap.Len(); {
-		b, err := idx.mmap.ReadOff(idx.c, indexItemSize)
+// recordSize returns the size of the records of the file.
+func (idx *index) recordSize() int {
+	if idx.version == 1 {
+		return format.IndexRecordSizeV1
+	}
+	return indexItemSize
+}
+
+// parseRecord decodes the record at the start of b.
+func (idx *index) parseRecord(b []byte) (format.IndexRecord, error) {
+	if idx.version == 1 {
+		return format.ParseIndexRecordV1(b)
+	}
+	return format.ParseIndexRecord(b)
+}
+
+// load reads the records following the last one loaded.
+func (idx *index) load() error {
+	size := idx.recordSize()
+	for idx.c+size <= idx.mmap.Len() {
+		b, err := idx.mmap.ReadOff(idx.c, size)
 		if err != nil {
 			return errors.Wrap(err, "failed to read index item")
 		}
-		key := intconv.Uint64(b[0:8])
-		id := intconv.Uint16(b[8:10])
-		offset := intconv.Uint32(b[10:14])
-		if key == 0 && id == 0 && offset == 0 {
+		r, err := idx.parseRecord(b)
+		if err != nil {
+			return errors.Wrap(err, "failed to read index item")
+		} else if r.Zero() {
 			break
 		}
-
-		if err := idx.set(key, id, offset); err != nil {
+		key, id, offset := r.Hash, r.Segment, r.Offset
+		if offset == 0 {
+			idx.del(key)
+		} else if idx.valid != nil && !idx.valid(key, item{id, offset}) {
+			break
+		} else if err := idx.set(key, id, offset); err != nil {
 			return err
 		}
-		idx.c += indexItemSize
+		idx.c += size
 		atomic.AddInt64(&idx.total, 1)
 	}
 	return nil
 }
 
+// Refresh loads records appended to the index file by another process,
+// remapping the file first if it has grown. If the file was replaced by
+// Rewrite, every record is loaded again.
+func (idx *index) Refresh() error {
+	fi, err := os.Stat(idx.path)
+	if err != nil {
+		return err
+	}
+	cur, err := idx.mmap.Stat()
+	if err != nil {
+		return err
+	}
+	replaced := !os.SameFile(fi, cur)
+	if replaced || fi.Size() > int64(idx.mmap.Len()) {
+		flag := mmap.Read
+		if !idx.readOnly {
+			flag |= mmap.Write
+		}
+		if err := idx.mmap.Close(); err != nil {
+			return err
+		} else if idx.mmap, err = mmap.OpenFile(idx.path, flag); err != nil {
+			return err
+		}
+	}
+	if replaced {
+		if err := idx.readHeader(); err != nil {
+			return err
+		}
+		for i := range idx.buckets[:] {
+			idx.buckets[i].Reset()
+		}
+		idx.c = IndexHeaderSize
+		atomic.StoreInt64(&idx.total, 0)
+	}
+	return idx.load()
+}
+
 func (idx *index) Length() int64 {
 	return atomic.LoadInt64(&idx.total)
 }
 
+// Items returns the number of keys in the index.
+func (idx *index) Items() int64 {
+	var n int64
+	for i := range idx.buckets[:] {
+		b := &idx.buckets[i]
+		b.mu.RLock()
+		n += int64(len(b.items))
+		b.mu.RUnlock()
+	}
+	return n
+}
+
+// MemoryUsage returns an estimate of the heap bytes held by the index.
+// Maps keep their slots after deletes, but buckets shrink once they are a
+// quarter full, so this undercounts the heap held by at most about four
+// times.
+func (idx *index) MemoryUsage() int64 {
+	return int64(unsafe.Sizeof(*idx)) + idx.Items()*indexItemMemory
+}
+
 func (idx *index) get(k uint64) (item, bool) {
 	bid := k % bucketsCount
 	return idx.buckets[bid].Get(k)
 }
 
-func (idx *index) set(k uint64, segmentID uint16, off uint32) error {
+func (idx *index) set(k uint64, segmentID uint32, off uint32) error {
 	bid := k % bucketsCount
 	return idx.buckets[bid].Set(k, item{segmentID, off})
 }
 
-func (idx *index) Insert(k uint64, segmentID uint16, off uint32) error {
-	b := make([]byte, indexItemSize)
-	intconv.PutUint64(b[0:8], k)
-	intconv.PutUint16(b[8:10], segmentID)
-	intconv.PutUint32(b[10:14], off)
-	c := indexBlock / indexItemSize
-	if idx.c > c && idx.c%c == 0 {
+func (idx *index) del(k uint64) {
+	bid := k % bucketsCount
+	idx.buckets[bid].Delete(k)
+}
+
+func (idx *index) Insert(k uint64, segmentID uint32, off uint32) error {
+	if err := idx.append(k, segmentID, off); err != nil {
+		return err
+	}
+	return idx.set(k, segmentID, off)
+}
+
+// Append records k in the index file without making it visible; Publish
+// does that. Calls must be serialized by the caller.
+func (idx *index) Append(k uint64, segmentID uint32, off uint32) error {
+	return idx.append(k, segmentID, off)
+}
+
+// Publish makes k address the entry at off in segment segmentID, unless k
+// already addresses a later entry. Writers publishing out of order thus
+// can't roll a key back, and Publish needs no lock beyond the bucket's.
+func (idx *index) Publish(k uint64, segmentID uint32, off uint32) {
+	bid := k % bucketsCount
+	idx.buckets[bid].SetIfNewer(k, item{segmentID, off})
+}
+
+// Remove deletes k from the index. The removal is persisted as a record
+// with a zero offset, which never addresses an entry.
+func (idx *index) Remove(k uint64) error {
+	if err := idx.append(k, 0, 0); err != nil {
+		return err
+	}
+	idx.del(k)
+	return nil
+}
+
+// append writes a record to the end of the index file, growing it if needed.
+func (idx *index) append(k uint64, segmentID uint32, off uint32) error {
+	if idx.readOnly || idx.version != IndexVersion {
+		return ErrIndexNotWritable
+	}
+	b := format.IndexRecord{Hash: k, Segment: segmentID, Offset: off}.Encode()
+	if idx.c+indexItemSize > idx.mmap.Len() {
 		if err := idx.Close(); err != nil {
 			return err
-		} else if os.Truncate(idx.path, int64(idx.c+indexBlock)) != nil {
+		} else if err := os.Truncate(idx.path, int64(idx.c+indexBlock)); err != nil {
 			return err
 		} else if idx.mmap, err = mmap.OpenFile(idx.path, mmap.Read|mmap.Write); err != nil {
 			return err
@@ -203,20 +437,146 @@ func (idx *index) Insert(k uint64, segmentID uint16, off uint32) error {
 	if n, err := idx.mmap.WriteAt(b, int64(idx.c)); err != nil {
 		return err
 	} else if n != indexItemSize {
-		return err
-	} else if err := idx.set(k, segmentID, off); err != nil {
-		return err
+		return io.ErrShortWrite
 	}
 	idx.c += indexItemSize
 	atomic.AddInt64(&idx.total, 1)
 	return nil
 }
 
+// Persisted returns the item each key addresses according to the index
+// file. It differs from the items in memory for keys whose records were
+// appended but not yet published. Calls must be serialized with appends.
+func (idx *index) Persisted() (map[uint64]item, error) {
+	items := make(map[uint64]item, idx.Length())
+	size := idx.recordSize()
+	for off := IndexHeaderSize; off < idx.c; off += size {
+		b, err := idx.mmap.ReadOff(off, size)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read index item")
+		}
+		r, err := idx.parseRecord(b)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read index item")
+		} else if r.Offset == 0 {
+			delete(items, r.Hash)
+		} else {
+			items[r.Hash] = item{r.Segment, r.Offset}
+		}
+	}
+	return items, nil
+}
+
+// Rewrite replaces the index file with one holding a record for each of
+// items, dropping the records of overwritten and removed keys. The items
+// in memory are left alone, so items must be what Persisted returned,
+// updated with the records appended since. Calls must be serialized with
+// appends.
+func (idx *index) Rewrite(items map[uint64]item) error {
+	if idx.readOnly {
+		return ErrIndexNotWritable
+	}
+	tmp := idx.path + ".initializing"
+	if err := writeIndexFile(tmp, items); err != nil {
+		return err
+	}
+	// Windows can't rename over a mapped file.
+	if err := idx.mmap.Close(); err != nil {
+		return err
+	} else if err := os.Rename(tmp, idx.path); err != nil {
+		return err
+	}
+	m, err := mmap.OpenFile(idx.path, mmap.Read|mmap.Write)
+	if err != nil {
+		return err
+	}
+	idx.mmap = m
+	idx.version = IndexVersion
+	idx.c = IndexHeaderSize + len(items)*indexItemSize
+	atomic.StoreInt64(&idx.total, int64(len(items)))
+	return nil
+}
+
+// writeIndexFile writes an index file holding a record for each of items
+// at path, with room for a block of records after them.
+func writeIndexFile(path string, items map[uint64]item) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := writeIndex(f, items)
+	if err != nil {
+		return err
+	} else if err := f.Truncate(n + indexBlock); err != nil {
+		return err
+	} else if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeIndex writes the header and a record for each of items to w, and
+// returns the number of bytes written.
+func writeIndex(w io.Writer, items map[uint64]item) (int64, error) {
+	bw := bufio.NewWriter(w)
+	hdr := newIndexHeader()
+	n, err := hdr.WriteTo(bw)
+	if err != nil {
+		return n, err
+	}
+	for k, it := range items {
+		r := format.IndexRecord{Hash: k, Segment: it.id, Offset: it.off}
+		if _, err := bw.Write(r.Encode()); err != nil {
+			return n, err
+		}
+		n += indexItemSize
+	}
+	return n, bw.Flush()
+}
+
 func (idx *index) Get(k uint64) (item, bool) {
 	return idx.get(k)
 }
 
+// ForEach calls fn for every item in the index, in no particular order.
+func (idx *index) ForEach(fn func(k uint64, it item) error) error {
+	for i := range idx.buckets[:] {
+		if err := idx.buckets[i].ForEach(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sample calls fn for the items of whole buckets, starting from a random
+// one, until at least n items are seen or every bucket is visited, and
+// returns the fraction of the buckets visited. Keys are spread over the
+// buckets by their hash, so the items seen are a sample of that fraction
+// of the index.
+func (idx *index) Sample(n int, fn func(k uint64, it item) error) (float64, error) {
+	start := rand.Intn(bucketsCount)
+	seen := 0
+	for i := 0; i < bucketsCount; i++ {
+		if seen >= n {
+			return float64(i) / bucketsCount, nil
+		}
+		b := &idx.buckets[(start+i)%bucketsCount]
+		err := b.ForEach(func(k uint64, it item) error {
+			seen++
+			return fn(k, it)
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return 1, nil
+}
+
 func (idx *index) Flush() error {
+	if idx.readOnly {
+		return nil
+	}
 	if err := idx.mmap.Sync(); err != nil {
 		return err
 	}
@@ -1,10 +1,17 @@
 package archivedb
 
 import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
 	"math"
 	"os"
+	"path/filepath"
+	"runtime"
 	"testing"
+	"unsafe"
 
+	"github.com/millken/archivedb/format"
 	"github.com/stretchr/testify/require"
 )
 
@@ -20,22 +27,24 @@ func TestIndex(t *testing.T) {
 
 	require.Equal(idx.Length(), int64(0))
 	for i := uint64(1); i <= 5; i++ {
-		require.NoError(idx.Insert(i, uint16(i), uint32(i)))
+		require.NoError(idx.Insert(i, uint32(i), uint32(i)))
 	}
 
 	for i := uint64(1); i <= 5; i++ {
 		it, ok := idx.Get(i)
 		require.True(ok)
-		require.Equal(it.ID(), uint16(i))
+		require.Equal(it.ID(), uint32(i))
 		require.Equal(it.Offset(), uint32(i))
 	}
 	require.Equal(idx.Length(), int64(5))
+	empty := int64(unsafe.Sizeof(*idx))
+	require.Equal(empty+5*indexItemMemory, idx.MemoryUsage())
 	require.NoError(idx.Close())
 	idx, err = openIndex(testFile)
 	require.NoError(err)
 	tests := []struct {
 		k uint64
-		s uint16
+		s uint32
 		o uint32
 	}{
 		{65538, 15, 65538},
@@ -54,6 +63,104 @@ func TestIndex(t *testing.T) {
 	require.NoError(idx.Close())
 }
 
+func TestIndex_Publish(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	idx, err := openIndex(dir + "/index")
+	require.NoError(err)
+	defer idx.Close()
+
+	// Publishing out of order keeps the latest entry.
+	require.NoError(idx.Append(1, 0, 100))
+	require.NoError(idx.Append(1, 1, 10))
+	_, ok := idx.Get(1)
+	require.False(ok)
+	idx.Publish(1, 1, 10)
+	idx.Publish(1, 0, 100)
+	it, ok := idx.Get(1)
+	require.True(ok)
+	require.Equal(item{1, 10}, it)
+	idx.Publish(1, 1, 20)
+	it, _ = idx.Get(1)
+	require.Equal(item{1, 20}, it)
+}
+
+func TestIndex_MemoryUsage(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	idx, err := openIndex(dir + "/index")
+	require.NoError(err)
+	defer idx.Close()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	empty := idx.MemoryUsage()
+	last := empty
+	const n = 300000
+	for i := uint64(0); i < n; i++ {
+		require.NoError(idx.Insert(i*0x9e3779b97f4a7c15, 1, uint32(i)))
+		if i%10000 == 0 {
+			require.Greater(idx.MemoryUsage(), last)
+			last = idx.MemoryUsage()
+		}
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+
+	// The estimate is within a factor of two of the heap the maps grew by.
+	grown := int64(after.HeapAlloc) - int64(before.HeapAlloc)
+	estimate := idx.MemoryUsage() - empty
+	require.InDelta(1, float64(estimate)/float64(grown), 0.5, "estimated %d, grew %d", estimate, grown)
+
+	// Deleting most keys shrinks the buckets, giving the heap back.
+	for i := uint64(0); i < n; i++ {
+		if i%10 != 0 {
+			require.NoError(idx.Remove(i * 0x9e3779b97f4a7c15))
+		}
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	require.Equal(int64(n/10), idx.Items())
+	held := int64(after.HeapAlloc) - int64(before.HeapAlloc)
+	require.Less(held, grown/3, "held %d of %d", held, grown)
+	runtime.KeepAlive(idx)
+}
+
+func TestBucket_Shrink(t *testing.T) {
+	require := require.New(t)
+	var b bucket
+	b.Init()
+	for k := uint64(0); k < 2*bucketShrinkMin; k++ {
+		require.NoError(b.Set(k, item{1, uint32(k)}))
+	}
+	require.Equal(2*bucketShrinkMin, b.peak)
+	items := b.items
+	for k := uint64(0); k < 3*bucketShrinkMin/2-1; k++ {
+		b.Delete(k)
+	}
+	require.Equal(fmt.Sprintf("%p", items), fmt.Sprintf("%p", b.items), "shrunk early")
+	b.Delete(3*bucketShrinkMin/2 - 1)
+	require.NotEqual(fmt.Sprintf("%p", items), fmt.Sprintf("%p", b.items))
+	require.Equal(bucketShrinkMin/2, b.peak)
+	for k := uint64(3 * bucketShrinkMin / 2); k < 2*bucketShrinkMin; k++ {
+		it, ok := b.Get(k)
+		require.True(ok)
+		require.Equal(item{1, uint32(k)}, it)
+	}
+
+	// Small buckets aren't reallocated.
+	items = b.items
+	for k := uint64(3 * bucketShrinkMin / 2); k < 2*bucketShrinkMin; k++ {
+		b.Delete(k)
+	}
+	require.Equal(fmt.Sprintf("%p", items), fmt.Sprintf("%p", b.items))
+	b.Reset()
+	require.Zero(b.peak)
+}
+
 func BenchmarkIndexSet(b *testing.B) {
 	b.ReportAllocs()
 	require := require.New(b)
@@ -63,7 +170,7 @@ func BenchmarkIndexSet(b *testing.B) {
 	idx, err := openIndex(testFile)
 	require.NoError(err)
 	for i := 0; i < b.N; i++ {
-		if err = idx.Insert(uint64(i), uint16(i), uint32(i)); err != nil {
+		if err = idx.Insert(uint64(i), uint32(i), uint32(i)); err != nil {
 			b.Fatal(err)
 		}
 	}
@@ -79,7 +186,7 @@ func BenchmarkIndexSetSync(b *testing.B) {
 	idx, err := openIndex(testFile)
 	require.NoError(err)
 	for i := 0; i < b.N; i++ {
-		if err := idx.Insert(uint64(i), uint16(i), uint32(i)); err != nil {
+		if err := idx.Insert(uint64(i), uint32(i), uint32(i)); err != nil {
 			b.Fatal(err)
 		}
 		if err := idx.Flush(); err != nil {
@@ -96,7 +203,7 @@ func TestIndexWrite(t *testing.T) {
 	require.NoError(err)
 	n := 1000000
 	for i := 1; i <= n; i++ {
-		require.NoError(idx.Insert(uint64(i), uint16(i%math.MaxUint16), uint32(i)))
+		require.NoError(idx.Insert(uint64(i), uint32(i%math.MaxUint16), uint32(i)))
 	}
 
 	require.Equal(idx.Length(), int64(n))
@@ -113,7 +220,7 @@ func BenchmarkIndexGet(b *testing.B) {
 	require.NoError(err)
 	n := 1000000
 	for i := 1; i <= n; i++ {
-		if err := idx.Insert(uint64(i), uint16(i%math.MaxUint16), uint32(i)); err != nil {
+		if err := idx.Insert(uint64(i), uint32(i%math.MaxUint16), uint32(i)); err != nil {
 			b.Fatal(err)
 		}
 	}
@@ -132,3 +239,48 @@ func BenchmarkIndexGet(b *testing.B) {
 	}
 	require.NoError(idx.Close())
 }
+
+func TestIndex_UpgradeV1(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	path := filepath.Join(dir, "index")
+
+	// A version 1 index with a 2 byte segment in its records.
+	b := append([]byte(IndexMagic), 1)
+	for _, r := range []format.IndexRecord{{Hash: 1, Segment: 2, Offset: 10}, {Hash: 2, Segment: 3, Offset: 20}, {Hash: 1, Offset: 0}} {
+		rec := make([]byte, format.IndexRecordSizeV1)
+		binary.LittleEndian.PutUint64(rec, r.Hash)
+		binary.LittleEndian.PutUint16(rec[8:], uint16(r.Segment))
+		binary.LittleEndian.PutUint32(rec[10:], r.Offset)
+		b = append(b, rec...)
+	}
+	require.NoError(ioutil.WriteFile(path, append(b, make([]byte, 64)...), 0644))
+
+	idx, err := openIndexReadOnly(path, nil)
+	require.NoError(err)
+	it, ok := idx.Get(2)
+	require.True(ok)
+	require.Equal(item{3, 20}, it)
+	require.ErrorIs(idx.Insert(3, 1, 1), ErrIndexNotWritable)
+	require.NoError(idx.Close())
+
+	idx, err = openIndex(path)
+	require.NoError(err)
+	require.Equal(uint8(IndexVersion), idx.version)
+	require.NoError(idx.Insert(3, 1<<20, 30))
+	require.NoError(idx.Close())
+
+	idx, err = openIndex(path)
+	require.NoError(err)
+	defer idx.Close()
+	_, ok = idx.Get(1)
+	require.False(ok)
+	items, err := idx.Persisted()
+	require.NoError(err)
+	require.Equal(map[uint64]item{2: {3, 20}, 3: {1 << 20, 30}}, items)
+
+	require.NoError(ioutil.WriteFile(path, []byte(IndexMagic+"\x09"), 0644))
+	_, err = openIndexReadOnly(path, nil)
+	require.ErrorIs(err, ErrInvalidIndexVersion)
+}
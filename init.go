@@ -0,0 +1,108 @@
+package archivedb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// InitDirName is the suffix of the directories new databases are built in
+// before they are moved into place.
+const InitDirName = ".initializing"
+
+// initDatabase creates a new database, if path doesn't exist, in two
+// phases: its manifest is first written to a temporary directory beside
+// path, which is then renamed into place, so a crash never leaves a
+// database directory without a manifest behind. The first segment is
+// created on open. The temporary directory is locked while the manifest
+// is written, so removeIncompleteInit in another process leaves it be.
+func (db *DB) initDatabase() error {
+	path := filepath.Clean(db.path)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		return err
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(path), initDirPrefix(path))
+	if err != nil {
+		return err
+	}
+	f, err := lockDirectory(tmp)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	err = newManifest(db.opts).Write(filepath.Join(tmp, ManifestFileName))
+	// Windows can't rename a directory holding an open file. Once the
+	// manifest is written, a process removing tmp can only be one that
+	// opened path, so the rename below would fail anyway.
+	unlockFile(f)
+	f.Close()
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.RemoveAll(tmp)
+		if _, serr := os.Stat(path); serr == nil {
+			// Another process created the database first.
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// initDirPrefix returns the name prefix of the directories the database at
+// path is built in.
+func initDirPrefix(path string) string {
+	return "." + filepath.Base(path) + InitDirName
+}
+
+// removeIncompleteInit removes what an interrupted initialization, segment
+// creation or manifest update left beside and in the database directory,
+// raising a Warning for each. The caller must hold the database lock.
+// Temporary directories beside it are only removed if their lock can be
+// taken, as another process may still be initializing them.
+func (db *DB) removeIncompleteInit() error {
+	var remnants []string
+	path := filepath.Clean(db.path)
+	if fis, err := ioutil.ReadDir(filepath.Dir(path)); err == nil {
+		for _, fi := range fis {
+			if !fi.IsDir() || !strings.HasPrefix(fi.Name(), initDirPrefix(path)) {
+				continue
+			}
+			tmp := filepath.Join(filepath.Dir(path), fi.Name())
+			f, err := lockDirectory(tmp)
+			if err != nil {
+				// In use, or already gone.
+				continue
+			}
+			// Windows can't remove the lock file while it is open.
+			unlockFile(f)
+			f.Close()
+			remnants = append(remnants, tmp)
+		}
+	}
+	fis, err := ioutil.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if isInitRemnant(fi.Name()) {
+			remnants = append(remnants, filepath.Join(path, fi.Name()))
+		}
+	}
+	for _, path := range remnants {
+		db.warn(Warning{Op: "remove incomplete init", Path: path})
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isInitRemnant returns true if name is a temporary file left behind when
+// creating a segment or writing the manifest was interrupted.
+func isInitRemnant(name string) bool {
+	return name == ManifestFileName+".tmp" || strings.HasSuffix(name, ".initializing")
+}
@@ -0,0 +1,92 @@
+package archivedb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpen_InitDatabase(t *testing.T) {
+	require := require.New(t)
+	root, cleanup := MustTempDir()
+	defer cleanup()
+	dir := filepath.Join(root, "db")
+	tmp := filepath.Join(root, ".db"+InitDirName)
+
+	// An interrupted init left a partial directory behind.
+	require.NoError(os.MkdirAll(tmp, 0777))
+	require.NoError(ioutil.WriteFile(filepath.Join(tmp, ManifestFileName+".tmp"), []byte("{"), 0644))
+
+	var warnings []Warning
+	db, err := Open(dir, WarningHandlerOption(func(w Warning) {
+		warnings = append(warnings, w)
+	}))
+	require.NoError(err)
+	require.NoError(db.Put([]byte("foo"), []byte("bar")))
+	require.NoError(db.Close())
+	require.Len(warnings, 1)
+	require.Equal(tmp, warnings[0].Path)
+	_, err = os.Stat(tmp)
+	require.True(os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, ManifestFileName))
+	require.NoError(err)
+
+	// Temporary files of an interrupted segment creation or manifest write
+	// are removed rather than reported as unexpected.
+	for _, name := range []string{ManifestFileName + ".tmp", segmentFilename(1) + ".initializing"} {
+		require.NoError(ioutil.WriteFile(filepath.Join(dir, name), []byte("x"), 0644))
+	}
+	warnings = nil
+	db, err = Open(dir, WarningHandlerOption(func(w Warning) {
+		warnings = append(warnings, w)
+	}))
+	require.NoError(err)
+	defer db.Close()
+	require.Len(warnings, 2)
+	v, err := db.Get([]byte("foo"))
+	require.NoError(err)
+	require.Equal([]byte("bar"), v)
+	fis, err := ioutil.ReadDir(dir)
+	require.NoError(err)
+	for _, fi := range fis {
+		require.False(isInitRemnant(fi.Name()), fi.Name())
+	}
+}
+
+func TestOpen_InitInProgress(t *testing.T) {
+	require := require.New(t)
+	root, cleanup := MustTempDir()
+	defer cleanup()
+	dir := filepath.Join(root, "db")
+	db, err := Open(dir)
+	require.NoError(err)
+	require.NoError(db.Close())
+
+	// Another process is still initializing the same path, having lost
+	// the race to create it; its directory is left to it.
+	tmp := filepath.Join(root, ".db"+InitDirName+"123")
+	require.NoError(os.MkdirAll(tmp, 0777))
+	f, err := lockDirectory(tmp)
+	require.NoError(err)
+	var warnings []Warning
+	db, err = Open(dir, WarningHandlerOption(func(w Warning) {
+		warnings = append(warnings, w)
+	}))
+	require.NoError(err)
+	require.NoError(db.Close())
+	require.Empty(warnings)
+	_, err = os.Stat(tmp)
+	require.NoError(err)
+
+	// Once it is abandoned, it is removed.
+	require.NoError(unlockFile(f))
+	require.NoError(f.Close())
+	db, err = Open(dir)
+	require.NoError(err)
+	require.NoError(db.Close())
+	_, err = os.Stat(tmp)
+	require.True(os.IsNotExist(err))
+}
@@ -39,6 +39,17 @@ func (fl Flag) flag() int {
 	return flag
 }
 
+// Advice tells the kernel how a mapping will be read, so it can tune
+// read-ahead.
+type Advice int
+
+const (
+	// Random access, the default of a new mapping: no read-ahead.
+	Random Advice = iota
+	// Sequential access from start to end: aggressive read-ahead.
+	Sequential
+)
+
 type File struct {
 	data []byte
 	c    int
@@ -61,6 +72,9 @@ func OpenFile(filename string, flag Flag) (*File, error) {
 
 // Len returns the length of the underlying memory-mapped file.
 func (f *File) Len() int {
+	if f == nil {
+		return 0
+	}
 	return len(f.data)
 }
 
@@ -185,13 +199,17 @@ func (f *File) Seek(offset int64, whence int) (int64, error) {
 }
 
 func (f *File) ReadOff(off, length int) ([]byte, error) {
+	if f == nil {
+		return nil, os.ErrInvalid
+	}
+
 	if !f.rflag() {
 		return nil, ErrBadFD
 	}
 	if f.data == nil {
 		return nil, ErrClosed
 	}
-	if off < 0 || length < 0 || (off+length) > len(f.data) {
+	if off < 0 || length < 0 || off > len(f.data) || length > len(f.data)-off {
 		return nil, ErrInvalidOffset
 	}
 	return unsafeByteSlice(unsafe.Pointer(f.ref), 0, off, off+length), nil
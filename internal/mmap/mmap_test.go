@@ -53,6 +53,11 @@ func TestMmap(t *testing.T) {
 	if !bytes.Equal(b, []byte("helloworld")) {
 		t.Fatal("invalid data")
 	}
+	for _, a := range []Advice{Sequential, Random} {
+		if err := mmap.Advise(a); err != nil {
+			t.Fatalf("Advise(%d): %v", a, err)
+		}
+	}
 
 	//write large data
 	bigData := make([]byte, 1024)
@@ -101,3 +106,22 @@ func TestOpen(t *testing.T) {
 		t.Fatalf("got %q, want nil", string(got))
 	}
 }
+
+func TestNilFile(t *testing.T) {
+	var f *File
+	if f.Len() != 0 {
+		t.Fatal("expected zero length")
+	}
+	if _, err := f.ReadOff(0, 1); err != os.ErrInvalid {
+		t.Fatalf("ReadOff: %v", err)
+	}
+	if err := f.Sync(); err != os.ErrInvalid {
+		t.Fatalf("Sync: %v", err)
+	}
+	if err := f.Advise(Sequential); err != os.ErrInvalid {
+		t.Fatalf("Advise: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
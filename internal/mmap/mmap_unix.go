@@ -21,6 +21,7 @@ func openFile(filename string, fl Flag) (*File, error) {
 
 	fi, err := f.Stat()
 	if err != nil {
+		f.Close()
 		return nil, fmt.Errorf("mmap: could not stat %q: %w", filename, err)
 	}
 
@@ -29,9 +30,11 @@ func openFile(filename string, fl Flag) (*File, error) {
 		return &File{fd: f, flag: fl, fi: fi}, nil
 	}
 	if size < 0 {
+		f.Close()
 		return nil, fmt.Errorf("mmap: file %q has negative size", filename)
 	}
 	if size != int64(int(size)) {
+		f.Close()
 		return nil, fmt.Errorf("mmap: file %q is too large", filename)
 	}
 
@@ -42,17 +45,25 @@ func openFile(filename string, fl Flag) (*File, error) {
 
 	data, err := unix.Mmap(int(f.Fd()), 0, int(size), prot, syscall.MAP_SHARED)
 	if err != nil {
+		f.Close()
 		return nil, fmt.Errorf("mmap: could not mmap %q: %w", filename, err)
 	}
+	// The mapping stays valid after the descriptor is closed, so don't hold
+	// on to it; a database with many segments would otherwise run out of
+	// file descriptors.
+	if err := f.Close(); err != nil {
+		unix.Munmap(data)
+		return nil, fmt.Errorf("mmap: could not close %q: %w", filename, err)
+	}
 	r := &File{
 		data: data,
 		ref:  (*[maxBytes]byte)(unsafe.Pointer(&data[0])),
-		fd:   f,
 		flag: fl,
 		fi:   fi,
 	}
 	if err := unix.Madvise(data, unix.MADV_RANDOM); err != nil && err != unix.ENOSYS {
 		// Ignore not implemented error in kernel because it still works.
+		r.Close()
 		return nil, fmt.Errorf("madvise: %s", err)
 	}
 	runtime.SetFinalizer(r, (*File).Close)
@@ -61,18 +72,49 @@ func openFile(filename string, fl Flag) (*File, error) {
 
 // Sync commits the current contents of the file to stable storage.
 func (f *File) Sync() error {
+	if f == nil {
+		return os.ErrInvalid
+	}
 	if !f.wflag() {
 		return ErrBadFD
 	}
+	if f.data == nil {
+		return ErrClosed
+	}
 	return unix.Msync(f.data, unix.MS_SYNC)
 }
 
+// Advise tells the kernel how the mapping will be read. Kernels without
+// madvise ignore the advice.
+func (f *File) Advise(a Advice) error {
+	if f == nil {
+		return os.ErrInvalid
+	}
+	if f.data == nil {
+		return nil
+	}
+	advice := unix.MADV_RANDOM
+	if a == Sequential {
+		advice = unix.MADV_SEQUENTIAL
+	}
+	if err := unix.Madvise(f.data, advice); err != nil && err != unix.ENOSYS {
+		return fmt.Errorf("madvise: %w", err)
+	}
+	return nil
+}
+
 // Close closes the memory-mapped file.
 func (f *File) Close() error {
+	if f == nil {
+		return nil
+	}
+	if f.fd != nil {
+		defer f.fd.Close()
+		f.fd = nil
+	}
 	if f.data == nil {
 		return nil
 	}
-	defer f.Close()
 
 	data := f.data
 	f.data = nil
@@ -17,6 +17,7 @@ func openFile(filename string, fl Flag) (*File, error) {
 
 	fi, err := f.Stat()
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
 
@@ -25,9 +26,11 @@ func openFile(filename string, fl Flag) (*File, error) {
 		return &File{fd: f, flag: fl, fi: fi}, nil
 	}
 	if size < 0 {
+		f.Close()
 		return nil, fmt.Errorf("mmap: file %q has negative size", filename)
 	}
 	if size != int64(int(size)) {
+		f.Close()
 		return nil, fmt.Errorf("mmap: file %q is too large", filename)
 	}
 
@@ -41,11 +44,13 @@ func openFile(filename string, fl Flag) (*File, error) {
 	low, high := uint32(size)&0xffffffff, uint32(size>>32)
 	fmap, err := windows.CreateFileMapping(windows.Handle(f.Fd()), nil, prot, high, low, nil)
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
 	defer windows.CloseHandle(fmap)
 	ptr, err := windows.MapViewOfFile(fmap, view, 0, 0, uintptr(size))
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
 	data := (*[maxBytes]byte)(unsafe.Pointer(ptr))[:size]
@@ -64,9 +69,15 @@ func openFile(filename string, fl Flag) (*File, error) {
 
 // Sync commits the current contents of the file to stable storage.
 func (f *File) Sync() error {
+	if f == nil {
+		return os.ErrInvalid
+	}
 	if !f.wflag() {
 		return ErrBadFD
 	}
+	if f.data == nil {
+		return ErrClosed
+	}
 
 	err := windows.FlushViewOfFile(f.addr(), uintptr(len(f.data)))
 	if err != nil {
@@ -81,12 +92,26 @@ func (f *File) Sync() error {
 	return nil
 }
 
+// Advise does nothing: Windows has no read-ahead advice for mapped views.
+func (f *File) Advise(a Advice) error {
+	if f == nil {
+		return os.ErrInvalid
+	}
+	return nil
+}
+
 // Close closes the reader.
 func (f *File) Close() error {
+	if f == nil {
+		return nil
+	}
+	if f.fd != nil {
+		defer f.fd.Close()
+		f.fd = nil
+	}
 	if f.data == nil {
 		return nil
 	}
-	defer f.fd.Close()
 
 	addr := f.addr()
 	f.data = nil
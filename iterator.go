@@ -0,0 +1,93 @@
+package archivedb
+
+import (
+	"bytes"
+	"sort"
+)
+
+// iterator is the Iterator returned by NewIterator. It sorts the keys that
+// were live when it was created and reads each value as it gets to it, so
+// keys deleted or expired in the meantime are skipped and overwritten keys
+// yield their new value.
+type iterator struct {
+	db    *DB
+	keys  [][]byte
+	pos   int // index of the current key in keys
+	key   []byte
+	value []byte
+	err   error
+}
+
+// NewIterator returns an iterator over the keys live in the database, in
+// ascending order. Creating it reads every live entry, to collect the
+// keys; the database isn't locked while it is used.
+func (db *DB) NewIterator() Iterator {
+	it := &iterator{db: db, pos: -1}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	it.err = db.forEachLiveEntry(false, func(e entry) error {
+		it.keys = append(it.keys, append([]byte(nil), e.key...))
+		return nil
+	})
+	sort.Slice(it.keys, func(i, j int) bool {
+		return bytes.Compare(it.keys[i], it.keys[j]) < 0
+	})
+	return it
+}
+
+func (it *iterator) First() bool {
+	it.pos = -1
+	return it.step(1)
+}
+
+func (it *iterator) Last() bool {
+	it.pos = len(it.keys)
+	return it.step(-1)
+}
+
+func (it *iterator) Seek(key []byte) bool {
+	it.pos = sort.Search(len(it.keys), func(i int) bool {
+		return bytes.Compare(it.keys[i], key) >= 0
+	}) - 1
+	return it.step(1)
+}
+
+func (it *iterator) Next() bool { return it.step(1) }
+func (it *iterator) Prev() bool { return it.step(-1) }
+
+// step moves by dir, skipping keys deleted or expired since the iterator
+// was created, until it finds a live key or runs off an end.
+func (it *iterator) step(dir int) bool {
+	it.key, it.value = nil, nil
+	for it.err == nil {
+		it.pos += dir
+		if it.pos < 0 {
+			it.pos = -1
+			return false
+		} else if it.pos >= len(it.keys) {
+			it.pos = len(it.keys)
+			return false
+		}
+		// Keys gone since are skipped, not loaded back.
+		v, err := it.db.get(it.keys[it.pos], ReadOptions{VerifyChecksum: true})
+		if isMissing(err) {
+			continue
+		} else if err != nil {
+			it.err = err
+			return false
+		}
+		it.key, it.value = it.keys[it.pos], v
+		return true
+	}
+	return false
+}
+
+func (it *iterator) Valid() bool   { return it.key != nil }
+func (it *iterator) Key() []byte   { return it.key }
+func (it *iterator) Value() []byte { return it.value }
+func (it *iterator) Err() error    { return it.err }
+
+func (it *iterator) Close() error {
+	it.keys, it.key, it.value = nil, nil, nil
+	return nil
+}
@@ -0,0 +1,116 @@
+package archivedb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_NewIterator(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	var rw ReadWriter = db
+	b := rw.NewBatch()
+	for _, k := range []string{"c", "a", "d", "b"} {
+		b.Put([]byte(k), []byte(k+"1"))
+	}
+	b.Delete([]byte("d"))
+	require.NoError(b.Commit())
+
+	it := rw.NewIterator()
+	defer it.Close()
+	// Changes after the iterator was created show up for keys it holds.
+	require.NoError(db.Put([]byte("b"), []byte("b2")))
+	require.NoError(db.Delete([]byte("c")))
+	require.NoError(db.Put([]byte("e"), []byte("e1")))
+	var got []string
+	for it.Next() {
+		got = append(got, string(it.Key())+"="+string(it.Value()))
+	}
+	require.NoError(it.Err())
+	require.Equal([]string{"a=a1", "b=b2"}, got)
+	require.False(it.Next())
+	require.Nil(it.Key())
+
+	require.NoError(db.Close())
+	it = db.NewIterator()
+	require.False(it.Valid())
+	require.False(it.Next())
+	require.ErrorIs(it.Err(), ErrDatabaseClosed)
+}
+
+func TestDB_IteratorSeek(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	for _, k := range []string{"b", "d", "f", "h"} {
+		require.NoError(db.Put([]byte(k), []byte(k)))
+	}
+	it := db.NewIterator()
+	defer it.Close()
+	require.False(it.Valid())
+	require.False(it.Prev())
+
+	require.True(it.Seek([]byte("c")))
+	require.True(it.Valid())
+	require.Equal([]byte("d"), it.Key())
+	require.True(it.Seek([]byte("f")))
+	require.Equal([]byte("f"), it.Value())
+	require.True(it.Prev())
+	require.Equal([]byte("d"), it.Key())
+	require.True(it.Prev())
+	require.False(it.Prev())
+	require.False(it.Valid())
+	require.Nil(it.Key())
+	require.True(it.Next())
+	require.Equal([]byte("b"), it.Key())
+	require.False(it.Seek([]byte("i")))
+
+	// Iterating backwards skips keys deleted since.
+	require.NoError(db.Delete([]byte("f")))
+	var keys []string
+	for ok := it.Last(); ok; ok = it.Prev() {
+		keys = append(keys, string(it.Key()))
+	}
+	require.Equal([]string{"h", "d", "b"}, keys)
+	require.True(it.First())
+	require.Equal([]byte("b"), it.Key())
+	require.NoError(it.Err())
+}
+
+func TestDB_IteratorLoader(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	db, err := Open(dir, LoaderOption(func(key []byte) ([]byte, error) {
+		t.Errorf("loader called for %s", key)
+		return []byte("loaded"), nil
+	}))
+	require.NoError(err)
+	defer db.Close()
+	for _, k := range []string{"a", "b"} {
+		require.NoError(db.Put([]byte(k), []byte(k)))
+	}
+	it := db.NewIterator()
+	defer it.Close()
+	require.NoError(db.Delete([]byte("a")))
+	var got []string
+	for it.Next() {
+		got = append(got, string(it.Key())+"="+string(it.Value()))
+	}
+	require.NoError(it.Err())
+	require.Equal([]string{"b=b"}, got)
+	has, err := db.Has([]byte("a"))
+	require.ErrorIs(err, ErrKeyDeleted)
+	require.False(has)
+}
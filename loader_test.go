@@ -0,0 +1,103 @@
+package archivedb
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoaderOption(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	var loads []string
+	upstream := map[string]string{"foo": "bar", "baz": "qux"}
+	var warnings []Warning
+	db, err := Open(dir, WarningHandlerOption(func(w Warning) {
+		warnings = append(warnings, w)
+	}), LoaderOption(func(key []byte) ([]byte, error) {
+		loads = append(loads, string(key))
+		if v, ok := upstream[string(key)]; ok {
+			return []byte(v), nil
+		}
+		return nil, ErrKeyNotFound
+	}))
+	require.NoError(err)
+	defer db.Close()
+
+	// The loaded value is stored, so the second Get doesn't load.
+	for i := 0; i < 2; i++ {
+		v, err := db.Get([]byte("foo"))
+		require.NoError(err)
+		require.Equal([]byte("bar"), v)
+	}
+	require.Equal([]string{"foo"}, loads)
+
+	_, err = db.Get([]byte("missing"))
+	require.ErrorIs(err, ErrKeyNotFound)
+
+	// A deleted key is loaded again.
+	upstream["foo"] = "new"
+	require.NoError(db.Delete([]byte("foo")))
+	v, err := db.Get([]byte("foo"))
+	require.NoError(err)
+	require.Equal([]byte("new"), v)
+
+	// Snapshot reads don't load.
+	snap, err := db.Snapshot()
+	require.NoError(err)
+	_, err = db.GetWithOptions([]byte("baz"), ReadOptions{Snapshot: snap})
+	require.ErrorIs(err, ErrKeyNotFound)
+
+	// A value that can't be stored is still returned.
+	_, err = db.Freeze()
+	require.NoError(err)
+	v, err = db.Get([]byte("baz"))
+	require.NoError(err)
+	require.Equal([]byte("qux"), v)
+	require.Len(warnings, 1)
+	require.ErrorIs(warnings[0].Err, ErrFrozen)
+	require.Equal([]string{"foo", "missing", "foo", "baz"}, loads)
+
+	require.NoError(db.SetOption(LoaderOption(nil)))
+	_, err = db.Get([]byte("other"))
+	require.ErrorIs(err, ErrKeyNotFound)
+}
+
+// TestLoaderOption_Error checks every Get sharing a failed load sees its
+// error.
+func TestLoaderOption_Error(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	var mu sync.Mutex
+	loads := 0
+	release := make(chan struct{})
+	fail := errors.New("upstream down")
+	db, err := Open(dir, CoalesceReadsOption(true), LoaderOption(func(key []byte) ([]byte, error) {
+		mu.Lock()
+		loads++
+		mu.Unlock()
+		<-release
+		return nil, fail
+	}))
+	require.NoError(err)
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := db.Get([]byte("foo"))
+			require.ErrorIs(err, fail)
+		}()
+	}
+	close(release)
+	wg.Wait()
+	require.GreaterOrEqual(loads, 1)
+}
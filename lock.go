@@ -0,0 +1,59 @@
+package archivedb
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// LockFileName is the file a writer holds a lock on while the database
+	// is open.
+	LockFileName = "LOCK"
+
+	lockPollInterval = 10 * time.Millisecond
+)
+
+// ErrDatabaseLocked is returned by Open when another process, or another
+// DB in this process, has the database open for writing.
+var ErrDatabaseLocked = errors.New("database is locked by another process")
+
+// LockPath returns the path to the lock file.
+func (db *DB) LockPath() string { return filepath.Join(db.path, LockFileName) }
+
+// lock takes the exclusive lock on the database directory, polling for up
+// to the lock timeout while another writer holds it. Followers don't lock.
+func (db *DB) lock() error {
+	f, err := os.OpenFile(db.LockPath(), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(db.opts.lockTimeout)
+	for {
+		err = lockFile(f)
+		if err == nil {
+			db.lockFile = f
+			return nil
+		} else if err != ErrDatabaseLocked || !time.Now().Before(deadline) {
+			f.Close()
+			return err
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// unlock releases the database lock, if held.
+func (db *DB) unlock() error {
+	if db.lockFile == nil {
+		return nil
+	}
+	f := db.lockFile
+	db.lockFile = nil
+	if err := unlockFile(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
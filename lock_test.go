@@ -0,0 +1,56 @@
+package archivedb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpen_Locked(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	db, err := Open(dir)
+	require.NoError(err)
+	_, err = Open(dir)
+	require.ErrorIs(err, ErrDatabaseLocked)
+	_, err = Open(dir, LockTimeoutOption(20*time.Millisecond))
+	require.ErrorIs(err, ErrDatabaseLocked)
+
+	// Followers don't take the lock.
+	follower, err := Open(dir, FollowerOption(0))
+	require.NoError(err)
+	require.NoError(follower.Close())
+
+	require.NoError(db.Close())
+	db, err = Open(dir)
+	require.NoError(err)
+	require.NoError(db.Close())
+}
+
+func TestLockTimeoutOption(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	_, err := Open(dir, LockTimeoutOption(-time.Second))
+	require.Error(err)
+
+	db, err := Open(dir)
+	require.NoError(err)
+	require.NoError(db.Put([]byte("foo"), []byte("bar")))
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		db.Close()
+	}()
+
+	next, err := Open(dir, LockTimeoutOption(10*time.Second))
+	require.NoError(err)
+	defer next.Close()
+	v, err := next.Get([]byte("foo"))
+	require.NoError(err)
+	require.Equal([]byte("bar"), v)
+	require.ErrorIs(next.SetOption(LockTimeoutOption(time.Second)), ErrImmutableOption)
+}
@@ -0,0 +1,256 @@
+package archivedb
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// ManifestFileName is the name of the manifest file in the database directory.
+	ManifestFileName = "MANIFEST"
+	// ManifestVersion is the current manifest format version.
+	ManifestVersion = 1
+)
+
+var (
+	ErrInvalidManifest  = errors.New("invalid manifest")
+	ErrManifestMismatch = errors.New("options do not match manifest")
+)
+
+// Manifest records database-wide settings that must stay the same for the
+// lifetime of the database.
+type Manifest struct {
+	Version      int       `json:"version"`
+	ID           string    `json:"id,omitempty"`
+	Created      time.Time `json:"created"`
+	KeyTransform string    `json:"keyTransform,omitempty"`
+	MaxKeySize   int       `json:"maxKeySize,omitempty"`
+	MaxValueSize uint32    `json:"maxValueSize,omitempty"`
+	// Segments holds the checksums of sealed segments, in id order.
+	Segments []SegmentChecksum `json:"segments,omitempty"`
+	// Pinned holds the sorted hashes of keys protected by Pin.
+	Pinned []uint64 `json:"pinned,omitempty"`
+	// Frozen is set once the database has been frozen by Freeze.
+	Frozen *FreezeRecord `json:"frozen,omitempty"`
+	// KeysEver holds the HyperLogLog registers behind
+	// ApproxTotalKeysEver.
+	KeysEver []byte `json:"keysEver,omitempty"`
+	// Reclaimed is the end of the log when Compact or PunchHoles last
+	// removed entries, which may have been live before it.
+	Reclaimed *Watermark `json:"reclaimed,omitempty"`
+}
+
+// SegmentChecksum records the size and CRC-32C of a sealed segment's data.
+type SegmentChecksum struct {
+	ID       uint32    `json:"id"`
+	Size     uint32    `json:"size"`
+	Checksum uint32    `json:"checksum"`
+	Sealed   time.Time `json:"sealed"`
+	// Dir is the partition directory holding the segment, relative to
+	// the database directory, or empty for the database directory itself.
+	Dir string `json:"dir,omitempty"`
+	// Detached is set while the segment is offline.
+	Detached bool `json:"detached,omitempty"`
+	// Entries and Tombstones count the entries in the segment, so Open
+	// needn't scan it. Manifests written before they were recorded only
+	// have Entries for detached segments.
+	Entries    int64 `json:"entries,omitempty"`
+	Tombstones int64 `json:"tombstones,omitempty"`
+	// Compacted counts the entries Compact removed from the segment.
+	Compacted int64 `json:"compacted,omitempty"`
+	// Punched is the size of the holes PunchHoles made in the segment.
+	// Punching is set while it runs, as the segment may not match its
+	// checksum until it is done.
+	Punched  int64 `json:"punched,omitempty"`
+	Punching bool  `json:"punching,omitempty"`
+}
+
+// counted returns true if sc records the entries of its segment.
+func (sc SegmentChecksum) counted() bool {
+	return sc.Entries > 0 || sc.Size == SegmentHeaderSize
+}
+
+// sealed returns the checksum recorded for segment id.
+func (m *Manifest) sealed(id uint32) (SegmentChecksum, bool) {
+	for _, sc := range m.Segments {
+		if sc.ID == id {
+			return sc, true
+		}
+	}
+	return SegmentChecksum{}, false
+}
+
+// newManifest returns a manifest describing opts.
+func newManifest(opts *option) *Manifest {
+	m := &Manifest{Version: ManifestVersion, ID: newDatabaseID(), Created: opts.clock.Now().UTC()}
+	if opts.keyTransform != nil {
+		m.KeyTransform = opts.keyTransform.Name()
+	}
+	m.MaxKeySize = opts.maxKeySize
+	m.MaxValueSize = opts.maxValueSize
+	return m
+}
+
+// readManifest reads the manifest at path. It returns nil if the file
+// doesn't exist.
+func readManifest(path string) (*Manifest, error) {
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return decodeManifest(buf)
+}
+
+// decodeManifest decodes a manifest as written by Write.
+func decodeManifest(buf []byte) (*Manifest, error) {
+	var m Manifest
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return nil, errors.Wrap(ErrInvalidManifest, err.Error())
+	} else if m.Version != ManifestVersion {
+		return nil, errors.Wrapf(ErrInvalidManifest, "unsupported version %d", m.Version)
+	}
+	return &m, nil
+}
+
+// encode returns the manifest as written to its file.
+func (m *Manifest) encode() ([]byte, error) {
+	buf, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, '\n'), nil
+}
+
+// Write atomically writes the manifest to path.
+func (m *Manifest) Write(path string) error {
+	buf, err := m.encode()
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(buf); err != nil {
+		return err
+	} else if err := f.Sync(); err != nil {
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// check returns an error if the settings in opts conflict with m.
+func (m *Manifest) check(opts *option) error {
+	want := newManifest(opts)
+	if m.KeyTransform != want.KeyTransform {
+		return errors.Wrapf(ErrManifestMismatch, "key transform %q, want %q", want.KeyTransform, m.KeyTransform)
+	}
+	return nil
+}
+
+// ID returns the identifier generated when the database was created. It is
+// kept in the manifest, so copies of the database directory share it,
+// which lets VerifyBackups tell a backup of another database apart. It is
+// empty for a database created by an older version that has only been
+// opened read-only since.
+func (db *DB) ID() string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.manifest.ID
+}
+
+// newDatabaseID returns a random (version 4) UUID.
+func newDatabaseID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// ManifestPath returns the path to the manifest file.
+func (db *DB) ManifestPath() string { return filepath.Join(db.path, ManifestFileName) }
+
+// openManifest loads the manifest and validates it against the options, or
+// writes a new one for a database without a manifest.
+func (db *DB) openManifest() error {
+	m, err := readManifest(db.ManifestPath())
+	if err != nil {
+		return err
+	}
+	changed := m == nil
+	if m == nil {
+		m = newManifest(db.opts)
+	} else if err := m.check(db.opts); err != nil {
+		return err
+	}
+	if m.applyLimits(db.opts) {
+		changed = true
+	}
+	if m.ID == "" && !db.opts.readOnly {
+		// Databases created before IDs were recorded get one now.
+		m.ID, changed = newDatabaseID(), true
+	}
+	if m.Frozen != nil {
+		// Open frozen databases without touching their files.
+		db.opts.readOnly = true
+	}
+	db.manifest = m
+	if changed {
+		if err := db.saveManifest(); err != nil {
+			return errors.Wrap(err, "write manifest")
+		}
+	}
+	return nil
+}
+
+// saveManifest writes the manifest. A read-only database keeps its changes
+// in memory.
+func (db *DB) saveManifest() error {
+	if db.opts.readOnly {
+		return nil
+	}
+	if err := db.manifest.Write(db.ManifestPath()); err != nil {
+		return err
+	}
+	db.sketchChanged = false
+	return nil
+}
+
+// applyLimits fills in size limits not set in opts from the manifest, and
+// records limits set in opts. It returns true if the manifest changed.
+func (m *Manifest) applyLimits(opts *option) (changed bool) {
+	if opts.maxKeySize == 0 {
+		opts.maxKeySize = m.MaxKeySize
+	} else if opts.maxKeySize != m.MaxKeySize {
+		m.MaxKeySize, changed = opts.maxKeySize, true
+	}
+	if opts.maxValueSize == 0 {
+		opts.maxValueSize = m.MaxValueSize
+	} else if opts.maxValueSize != m.MaxValueSize {
+		m.MaxValueSize, changed = opts.maxValueSize, true
+	}
+	if opts.maxKeySize == 0 {
+		opts.maxKeySize = MaxKeySize
+	}
+	if opts.maxValueSize == 0 {
+		opts.maxValueSize = MaxValueSize
+	}
+	return changed
+}
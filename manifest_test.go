@@ -0,0 +1,66 @@
+package archivedb
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifest(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	path := filepath.Join(dir, ManifestFileName)
+
+	m, err := readManifest(path)
+	require.NoError(err)
+	require.Nil(m)
+
+	want := &Manifest{Version: ManifestVersion, KeyTransform: "prefix:00"}
+	require.NoError(want.Write(path))
+	m, err = readManifest(path)
+	require.NoError(err)
+	require.Equal(want, m)
+
+	require.NoError(ioutil.WriteFile(path, []byte(`{"version":99}`), 0644))
+	_, err = readManifest(path)
+	require.ErrorIs(err, ErrInvalidManifest)
+}
+
+func TestDB_ID(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	db, err := Open(dir)
+	require.NoError(err)
+	id := db.ID()
+	require.Regexp(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, id)
+	require.NoError(db.Close())
+
+	db, err = Open(dir)
+	require.NoError(err)
+	require.Equal(id, db.ID())
+	require.NoError(db.Close())
+
+	// A manifest written before IDs were recorded gets one when opened for
+	// writing, but not by a follower.
+	path := filepath.Join(dir, ManifestFileName)
+	m, err := readManifest(path)
+	require.NoError(err)
+	m.ID = ""
+	require.NoError(m.Write(path))
+
+	db, err = Open(dir, FollowerOption(0))
+	require.NoError(err)
+	require.Empty(db.ID())
+	require.NoError(db.Close())
+
+	db, err = Open(dir)
+	require.NoError(err)
+	require.NotEmpty(db.ID())
+	require.NotEqual(id, db.ID())
+	require.NoError(db.Close())
+}
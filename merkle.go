@@ -0,0 +1,382 @@
+package archivedb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/millken/archivedb/format"
+	"github.com/pkg/errors"
+)
+
+// MerkleLogFileName is the name of the file holding the leaf hashes of the
+// Merkle log.
+const MerkleLogFileName = "MERKLE"
+
+// merkleRecordSize is the size of a Merkle log record: segment id, entry
+// offset and leaf hash.
+const merkleRecordSize = format.MerkleRecordSize
+
+var (
+	ErrMerkleLogDisabled = errors.New("merkle log not enabled")
+	ErrInvalidProof      = errors.New("invalid inclusion proof")
+)
+
+// InclusionProof proves that an entry is part of the Merkle tree over all
+// entries written to the database, following RFC 6962.
+type InclusionProof struct {
+	Index int64    `json:"index"` // position of the entry in the log
+	Size  int64    `json:"size"`  // number of entries in the tree
+	Entry []byte   `json:"entry"` // the entry as stored: header, key and value
+	Path  [][]byte `json:"path"`  // audit path from the leaf to the root
+	Root  []byte   `json:"root"`  // tree head the proof was made for
+}
+
+type merkleRecord struct {
+	id   uint32
+	off  uint32
+	leaf [sha256.Size]byte
+}
+
+// MerkleLogPath returns the path to the Merkle log.
+func (db *DB) MerkleLogPath() string { return filepath.Join(db.path, MerkleLogFileName) }
+
+// openMerkleLog opens the Merkle log, rebuilding it from the segments if it
+// doesn't hold one record per entry, as after enabling the log on an
+// existing database or a crash between writing an entry and its record.
+func (db *DB) openMerkleLog() error {
+	flag := os.O_RDWR | os.O_CREATE | os.O_APPEND
+	if db.opts.readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(db.MerkleLogPath(), flag, 0666)
+	if os.IsNotExist(err) && db.opts.readOnly {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if !db.opts.readOnly && fi.Size() != int64(db.seq)*merkleRecordSize {
+		if err := db.rebuildMerkleLog(f); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	db.merkle = f
+	return nil
+}
+
+// rebuildMerkleLog replaces the contents of f with a record for every entry.
+func (db *DB) rebuildMerkleLog(f *os.File) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := db.forEachRawEntry(func(id uint32, off uint32, raw []byte) error {
+		buf.Write(encodeMerkleRecord(id, off, merkleLeaf(raw)))
+		if buf.Len() >= 1<<20 {
+			_, err := buf.WriteTo(f)
+			return err
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if _, err := buf.WriteTo(f); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// forEachRawEntry calls fn with the bytes of every entry, in write order.
+func (db *DB) forEachRawEntry(fn func(id uint32, off uint32, raw []byte) error) error {
+	for _, s := range db.segments {
+		for off := uint32(SegmentHeaderSize); off < s.Size(); {
+			hdr, err := s.ReadEntryHeader(off)
+			if err != nil {
+				return err
+			} else if hdr.Flag == EntryHoleFlag {
+				return errors.Errorf("segment %d has punched holes", s.ID())
+			}
+			raw, err := s.mmap.ReadOff(int(off), int(hdr.EntrySize()))
+			if err != nil {
+				return err
+			}
+			if err := fn(s.ID(), off, raw); err != nil {
+				return err
+			}
+			off += hdr.EntrySize()
+		}
+	}
+	return nil
+}
+
+// appendMerkleLog records the entry just written at off in segment id. The
+// caller must hold db.mu.
+func (db *DB) appendMerkleLog(id uint32, off uint32, e entry) error {
+	if db.merkle == nil {
+		return nil
+	}
+	leaf := merkleLeaf(e.hdr.Encode(), e.key, e.value)
+	if _, err := db.merkle.Write(encodeMerkleRecord(id, off, leaf)); err != nil {
+		return errors.Wrap(err, "write merkle log")
+	}
+	return nil
+}
+
+// readMerkleLog returns every record in the Merkle log. The caller must
+// hold db.mu.
+func (db *DB) readMerkleLog() ([]merkleRecord, error) {
+	if db.merkle == nil {
+		return nil, ErrMerkleLogDisabled
+	}
+	fi, err := db.merkle.Stat()
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, fi.Size()-fi.Size()%merkleRecordSize)
+	if _, err := db.merkle.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	records := make([]merkleRecord, len(buf)/merkleRecordSize)
+	for i := range records {
+		r, err := format.ParseMerkleRecord(buf[i*merkleRecordSize:])
+		if err != nil {
+			return nil, err
+		}
+		records[i] = merkleRecord{id: r.Segment, off: r.Offset, leaf: r.Leaf}
+	}
+	return records, nil
+}
+
+func encodeMerkleRecord(id uint32, off uint32, leaf [sha256.Size]byte) []byte {
+	var b [merkleRecordSize]byte
+	binary.BigEndian.PutUint32(b[0:4], id)
+	binary.BigEndian.PutUint32(b[4:8], off)
+	copy(b[8:], leaf[:])
+	return b[:]
+}
+
+// MerkleRoot returns the root of the Merkle tree over every entry written
+// to the database and the number of entries it covers. Publishing the root
+// commits to the database contents: later proofs are checked against it.
+func (db *DB) MerkleRoot() (root []byte, size int64, err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, 0, ErrDatabaseClosed
+	}
+	records, err := db.readMerkleLog()
+	if err != nil {
+		return nil, 0, err
+	}
+	leaves := merkleLeaves(records)
+	r := merkleRoot(leaves)
+	return r[:], int64(len(leaves)), nil
+}
+
+// ProveInclusion returns a proof that the current entry of key is part of
+// the Merkle tree with the current root.
+func (db *DB) ProveInclusion(key []byte) (InclusionProof, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return InclusionProof{}, ErrDatabaseClosed
+	}
+	key, err := db.encodeKey(key)
+	if err != nil {
+		return InclusionProof{}, err
+	}
+	it, ok := db.index.Get(db.opts.hashFunc(key))
+	if !ok {
+		return InclusionProof{}, ErrKeyNotFound
+	}
+	records, err := db.readMerkleLog()
+	if err != nil {
+		return InclusionProof{}, err
+	}
+	i := searchMerkleRecords(records, it.ID(), it.Offset())
+	if i < 0 {
+		return InclusionProof{}, errors.Wrap(ErrTampered, "entry missing from merkle log")
+	}
+	segment := db.segment(it.ID())
+	if segment == nil {
+		return InclusionProof{}, ErrSegmentNotFound
+	}
+	hdr, err := segment.ReadEntryHeader(it.Offset())
+	if err != nil {
+		return InclusionProof{}, err
+	}
+	raw, err := segment.mmap.ReadOff(int(it.Offset()), int(hdr.EntrySize()))
+	if err != nil {
+		return InclusionProof{}, err
+	}
+
+	leaves := merkleLeaves(records)
+	root := merkleRoot(leaves)
+	proof := InclusionProof{
+		Index: int64(i),
+		Size:  int64(len(leaves)),
+		Entry: append([]byte(nil), raw...),
+		Root:  root[:],
+	}
+	for _, h := range merklePath(i, leaves) {
+		proof.Path = append(proof.Path, append([]byte(nil), h[:]...))
+	}
+	return proof, nil
+}
+
+// VerifyInclusion checks that proof shows its entry is part of the tree
+// with the given root, which should come from a trusted copy of an earlier
+// MerkleRoot rather than from the proof itself.
+func VerifyInclusion(proof InclusionProof, root []byte) error {
+	if proof.Index < 0 || proof.Index >= proof.Size {
+		return errors.Wrap(ErrInvalidProof, "index out of range")
+	}
+	r := merkleLeaf(proof.Entry)
+	fn, sn := proof.Index, proof.Size-1
+	for _, p := range proof.Path {
+		if sn == 0 || len(p) != sha256.Size {
+			return errors.Wrap(ErrInvalidProof, "path too long")
+		}
+		var sibling [sha256.Size]byte
+		copy(sibling[:], p)
+		if fn&1 == 1 || fn == sn {
+			r = hashChildren(sibling, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = hashChildren(r, sibling)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 {
+		return errors.Wrap(ErrInvalidProof, "path too short")
+	} else if !bytes.Equal(r[:], root) {
+		return errors.Wrap(ErrInvalidProof, "root mismatch")
+	}
+	return nil
+}
+
+// VerifyChain recomputes the leaf hash of every entry and checks it against
+// the Merkle log, returning the root of the verified tree. An error wrapping
+// ErrTampered means an entry was changed, added or removed outside the
+// database.
+func (db *DB) VerifyChain() ([]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrDatabaseClosed
+	}
+	records, err := db.readMerkleLog()
+	if err != nil {
+		return nil, err
+	}
+	var n int
+	if err := db.forEachRawEntry(func(id uint32, off uint32, raw []byte) error {
+		if n >= len(records) {
+			return errors.Wrapf(ErrTampered, "entry %04x:%d not in merkle log", id, off)
+		}
+		rec := records[n]
+		if rec.id != id || rec.off != off || rec.leaf != merkleLeaf(raw) {
+			return errors.Wrapf(ErrTampered, "entry %04x:%d does not match merkle log", id, off)
+		}
+		n++
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if n != len(records) {
+		return nil, errors.Wrapf(ErrTampered, "%d entries, merkle log has %d", n, len(records))
+	}
+	root := merkleRoot(merkleLeaves(records))
+	return root[:], nil
+}
+
+// searchMerkleRecords returns the index of the record for the entry at off
+// in segment id, or -1.
+func searchMerkleRecords(records []merkleRecord, id uint32, off uint32) int {
+	lo, hi := 0, len(records)
+	for lo < hi {
+		m := int(uint(lo+hi) >> 1)
+		if r := records[m]; r.id < id || (r.id == id && r.off < off) {
+			lo = m + 1
+		} else {
+			hi = m
+		}
+	}
+	if lo < len(records) && records[lo].id == id && records[lo].off == off {
+		return lo
+	}
+	return -1
+}
+
+func merkleLeaves(records []merkleRecord) [][sha256.Size]byte {
+	leaves := make([][sha256.Size]byte, len(records))
+	for i := range records {
+		leaves[i] = records[i].leaf
+	}
+	return leaves
+}
+
+// merkleLeaf returns the RFC 6962 leaf hash of the entry made of parts.
+func merkleLeaf(parts ...[]byte) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	for _, p := range parts {
+		h.Write(p)
+	}
+	var leaf [sha256.Size]byte
+	h.Sum(leaf[:0])
+	return leaf
+}
+
+func hashChildren(l, r [sha256.Size]byte) [sha256.Size]byte {
+	var buf [1 + 2*sha256.Size]byte
+	buf[0] = 1
+	copy(buf[1:], l[:])
+	copy(buf[1+sha256.Size:], r[:])
+	return sha256.Sum256(buf[:])
+}
+
+// splitPoint returns the largest power of two smaller than n.
+func splitPoint(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+func merkleRoot(leaves [][sha256.Size]byte) [sha256.Size]byte {
+	switch len(leaves) {
+	case 0:
+		return sha256.Sum256(nil)
+	case 1:
+		return leaves[0]
+	}
+	k := splitPoint(len(leaves))
+	return hashChildren(merkleRoot(leaves[:k]), merkleRoot(leaves[k:]))
+}
+
+// merklePath returns the audit path of leaf m, from the leaf up.
+func merklePath(m int, leaves [][sha256.Size]byte) [][sha256.Size]byte {
+	if len(leaves) <= 1 {
+		return nil
+	}
+	k := splitPoint(len(leaves))
+	if m < k {
+		return append(merklePath(m, leaves[:k]), merkleRoot(leaves[k:]))
+	}
+	return append(merklePath(m-k, leaves[k:]), merkleRoot(leaves[:k]))
+}
@@ -0,0 +1,87 @@
+package archivedb
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_MerkleLog(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	// Entries written before the log is enabled are included.
+	db, err := Open(dir)
+	require.NoError(err)
+	require.NoError(db.Put([]byte("k0"), []byte("v0")))
+	require.NoError(db.Close())
+
+	db, err = Open(dir, MerkleLogOption(true))
+	require.NoError(err)
+	for i := 1; i < 7; i++ {
+		if i == 4 {
+			mustRollover(t, db)
+		}
+		require.NoError(db.Put([]byte(fmt.Sprintf("k%d", i)), []byte(fmt.Sprintf("v%d", i))))
+	}
+	require.NoError(db.Delete([]byte("k2")))
+	root, size, err := db.MerkleRoot()
+	require.NoError(err)
+	require.Equal(int64(8), size)
+	verified, err := db.VerifyChain()
+	require.NoError(err)
+	require.Equal(root, verified)
+
+	for i := 0; i < 7; i++ {
+		proof, err := db.ProveInclusion([]byte(fmt.Sprintf("k%d", i)))
+		require.NoError(err)
+		require.Equal(root, proof.Root)
+		require.NoError(VerifyInclusion(proof, root), i)
+	}
+	proof, err := db.ProveInclusion([]byte("k3"))
+	require.NoError(err)
+	proof.Entry[len(proof.Entry)-1] = '!'
+	require.ErrorIs(VerifyInclusion(proof, root), ErrInvalidProof)
+
+	// Later writes change the root, so old roots don't verify new proofs.
+	require.NoError(db.Put([]byte("k7"), []byte("v7")))
+	proof, err = db.ProveInclusion([]byte("k7"))
+	require.NoError(err)
+	require.ErrorIs(VerifyInclusion(proof, root), ErrInvalidProof)
+	require.NoError(db.Close())
+
+	// A missing record, as after a crash, is rebuilt on open.
+	fi, err := os.Stat(dir + "/" + MerkleLogFileName)
+	require.NoError(err)
+	require.NoError(os.Truncate(dir+"/"+MerkleLogFileName, fi.Size()-merkleRecordSize))
+	db, err = Open(dir, MerkleLogOption(true))
+	require.NoError(err)
+	_, err = db.VerifyChain()
+	require.NoError(err)
+	require.NoError(db.Close())
+
+	// Changing an entry behind the database's back is detected.
+	f, err := os.OpenFile(dir+"/"+segmentFilename(0), os.O_WRONLY, 0)
+	require.NoError(err)
+	_, err = f.WriteAt([]byte("!"), SegmentHeaderSize+EntryHeaderSize)
+	require.NoError(err)
+	require.NoError(f.Close())
+	db, err = Open(dir, MerkleLogOption(true))
+	require.NoError(err)
+	defer db.Close()
+	_, err = db.VerifyChain()
+	require.ErrorIs(err, ErrTampered)
+}
+
+func TestDB_MerkleLogDisabled(t *testing.T) {
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(t, err)
+	defer db.Close()
+	_, _, err = db.MerkleRoot()
+	require.ErrorIs(t, err, ErrMerkleLogDisabled)
+}
@@ -0,0 +1,89 @@
+package archivedb
+
+import (
+	"time"
+
+	"github.com/millken/archivedb/format"
+)
+
+// EntryAttrs describe how the value of an entry is stored.
+type EntryAttrs struct {
+	// Codec is the id of the codec that compressed the value, or zero if
+	// it isn't compressed.
+	Codec     uint8
+	Encrypted bool
+	// Chunked is set if the value is stored in chunk entries, the entry
+	// holding their list.
+	Chunked bool
+	// Expires is when the entry expires, or zero if it doesn't.
+	Expires time.Time
+}
+
+// newEntryAttrs returns the attributes of an entry with header hdr,
+// expiring at expires in Unix nanoseconds unless it is zero.
+func newEntryAttrs(hdr EntryHeader, expires int64) EntryAttrs {
+	a := EntryAttrs{
+		Codec:     hdr.Codec(),
+		Encrypted: hdr.Attrs&format.AttrEncrypted != 0,
+		Chunked:   hdr.Attrs&format.AttrChunked != 0,
+	}
+	if expires != 0 {
+		a.Expires = time.Unix(0, expires)
+	}
+	return a
+}
+
+// EntryMeta describes the current entry of a key, leaving its value out.
+type EntryMeta struct {
+	// Segment and Offset locate the entry.
+	Segment uint32
+	Offset  uint32
+	Tag     uint32
+	// StoredSize is the size of the value as stored, with its attribute
+	// fields, compressed and encrypted: for a chunked value, the size of
+	// its chunk list.
+	StoredSize uint32
+	// Checksum is the CRC-32C of the stored value.
+	Checksum uint32
+	EntryAttrs
+}
+
+// GetMeta returns the metadata of the current entry of key, so how its
+// value was stored can be checked without reading it. It fails as Get
+// does for keys that are missing, deleted or expired. The value is not
+// verified against its checksum.
+func (db *DB) GetMeta(key []byte) (EntryMeta, error) {
+	db.rlockFor(lockGet)
+	defer db.mu.RUnlock()
+	if db.closed {
+		return EntryMeta{}, ErrDatabaseClosed
+	}
+	key, err := db.encodeKey(key)
+	if err != nil {
+		return EntryMeta{}, err
+	}
+	it, ok := db.index.Get(db.opts.hashFunc(key))
+	if !ok {
+		return EntryMeta{}, ErrKeyNotFound
+	}
+	s := db.segment(it.ID())
+	if s == nil {
+		return EntryMeta{}, ErrSegmentNotFound
+	}
+	e, err := readEntryOnce(s, it.Offset(), key, false)
+	if err != nil {
+		return EntryMeta{}, err
+	} else if e.hdr.Flag == EntryDeleteFlag {
+		return EntryMeta{}, ErrKeyDeleted
+	} else if e.expired(db.now()) {
+		return EntryMeta{}, ErrKeyExpired
+	}
+	return EntryMeta{
+		Segment:    it.ID(),
+		Offset:     it.Offset(),
+		Tag:        e.hdr.Tag,
+		StoredSize: e.hdr.ValueSize,
+		Checksum:   e.hdr.Checksum,
+		EntryAttrs: newEntryAttrs(e.hdr, e.expires),
+	}, nil
+}
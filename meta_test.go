@@ -0,0 +1,50 @@
+package archivedb
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_GetMeta(t *testing.T) {
+	require := require.New(t)
+	withChunkSize(t, 1024)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	clock := newFakeClock()
+	db, err := Open(dir, ClockOption(clock), CompressionOption(DeflateCodec, 32))
+	require.NoError(err)
+	defer db.Close()
+
+	require.NoError(db.Put([]byte("plain"), []byte("short")))
+	m, err := db.GetMeta([]byte("plain"))
+	require.NoError(err)
+	require.Equal(EntryAttrs{}, m.EntryAttrs)
+	require.Equal(uint32(SegmentHeaderSize), m.Offset)
+	require.Equal(uint32(5), m.StoredSize)
+
+	compressible := bytes.Repeat([]byte("compressible "), 40)
+	require.NoError(db.PutWithOptions([]byte("ttl"), compressible, WriteOptions{TTL: time.Hour, Tag: 3}))
+	m, err = db.GetMeta([]byte("ttl"))
+	require.NoError(err)
+	require.Equal(DeflateCodec.ID(), m.Codec)
+	require.False(m.Encrypted)
+	require.Equal(clock.Now().Add(time.Hour).UnixNano(), m.Expires.UnixNano())
+	require.Equal(uint32(3), m.Tag)
+
+	require.NoError(db.Put([]byte("big"), bytes.Repeat([]byte("b"), 2000)))
+	m, err = db.GetMeta([]byte("big"))
+	require.NoError(err)
+	require.True(m.Chunked)
+
+	require.NoError(db.Delete([]byte("plain")))
+	_, err = db.GetMeta([]byte("plain"))
+	require.ErrorIs(err, ErrKeyDeleted)
+	_, err = db.GetMeta([]byte("missing"))
+	require.ErrorIs(err, ErrKeyNotFound)
+	clock.Add(2 * time.Hour)
+	_, err = db.GetMeta([]byte("ttl"))
+	require.ErrorIs(err, ErrKeyExpired)
+}
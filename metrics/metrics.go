@@ -0,0 +1,89 @@
+// Package metrics exports the statistics of an archivedb.DB as expvar
+// variables, which are served as JSON on /debug/vars and can be scraped by
+// Prometheus through an expvar exporter.
+package metrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"sync"
+
+	"github.com/millken/archivedb"
+)
+
+// Var is an expvar.Var reporting the QuickStats of a database as a JSON
+// object, read afresh every time it is shown. Counters are reset when the
+// database is reopened.
+type Var struct {
+	mu sync.Mutex
+	db *archivedb.DB
+}
+
+// Publish publishes a Var for db under name. Like expvar.Publish, it
+// panics if name is already in use; call Set on the published Var to
+// report a reopened database instead.
+func Publish(name string, db *archivedb.DB) *Var {
+	v := &Var{db: db}
+	expvar.Publish(name, v)
+	return v
+}
+
+// Set makes v report db, or nothing if db is nil.
+func (v *Var) Set(db *archivedb.DB) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.db = db
+}
+
+// String returns the metrics of the database as a JSON object, which is
+// empty if v reports no database.
+func (v *Var) String() string {
+	v.mu.Lock()
+	db := v.db
+	v.mu.Unlock()
+	if db == nil {
+		return "{}"
+	}
+	b, err := json.Marshal(values(db.QuickStats(), db.Health()))
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
+
+// values flattens s and h into metrics named after Prometheus conventions:
+// counters end in _total and durations are in seconds.
+func values(s archivedb.Stats, h archivedb.Health) map[string]interface{} {
+	m := map[string]interface{}{
+		"logical_bytes_total":     s.LogicalBytes,
+		"physical_bytes_total":    s.PhysicalBytes,
+		"reads_total":             s.Reads,
+		"writes_total":            s.Writes,
+		"syncs_total":             s.Syncs,
+		"rollovers_total":         s.Rollovers,
+		"checksum_failures_total": s.ChecksumFailures,
+		"compactions_total":       s.Compactions,
+		"reclaimed_bytes_total":   s.ReclaimedBytes,
+		"segments":                s.Segments,
+		"disk_bytes":              s.DiskBytes,
+		"index_memory_bytes":      s.IndexMemory,
+		"read_only":               h.ReadOnly,
+		"degraded":                h.Degraded != nil,
+	}
+	if !s.LastCompaction.IsZero() {
+		m["last_compaction_timestamp_seconds"] = s.LastCompaction.Unix()
+	}
+	for op, l := range map[string]archivedb.LatencyStats{
+		"put":    s.PutLatency,
+		"get":    s.GetLatency,
+		"delete": s.DeleteLatency,
+	} {
+		m[op+"_total"] = l.Count
+		m[op+"_seconds_total"] = l.Total.Seconds()
+		m[op+"_seconds_p50"] = l.Quantile(0.5).Seconds()
+		m[op+"_seconds_p99"] = l.Quantile(0.99).Seconds()
+	}
+	return m
+}
+
+var _ expvar.Var = (*Var)(nil)
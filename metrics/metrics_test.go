@@ -0,0 +1,44 @@
+package metrics_test
+
+import (
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/millken/archivedb"
+	"github.com/millken/archivedb/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublish(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "metrics")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	db, err := archivedb.Open(dir)
+	require.NoError(err)
+	defer db.Close()
+
+	v := metrics.Publish("archivedb_test", db)
+	require.Equal(v, expvar.Get("archivedb_test"))
+	require.NoError(db.Put([]byte("foo"), []byte("bar")))
+	require.NoError(db.Delete([]byte("foo")))
+	_, err = db.Get([]byte("foo"))
+	require.ErrorIs(err, archivedb.ErrKeyDeleted)
+
+	var m map[string]interface{}
+	require.NoError(json.Unmarshal([]byte(v.String()), &m))
+	require.Equal(float64(1), m["put_total"])
+	require.Equal(float64(1), m["delete_total"])
+	require.Equal(float64(1), m["get_total"])
+	require.Equal(float64(2), m["writes_total"])
+	require.Equal(float64(1), m["segments"])
+	require.Equal(false, m["degraded"])
+	require.Greater(m["put_seconds_p99"], float64(0))
+	require.NotContains(m, "last_compaction_timestamp_seconds")
+
+	v.Set(nil)
+	require.Equal("{}", v.String())
+}
@@ -0,0 +1,124 @@
+package archivedb
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrWatermarkReclaimed is returned by OpenAt for a watermark before the
+// last Compact or PunchHoles, which may have removed entries live at it.
+var ErrWatermarkReclaimed = errors.New("watermark is before the last compaction")
+
+// Watermark returns the end of the log: where the next entry will be
+// written. Recorded before a risky change, it is where OpenAt can go back
+// to.
+func (db *DB) Watermark() Watermark {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return *db.watermark()
+}
+
+// watermark returns the end of the log. The caller must hold db.mu.
+func (db *DB) watermark() *Watermark {
+	active := db.activeSegment()
+	return &Watermark{Segment: active.ID(), Offset: active.Size()}
+}
+
+// OpenAt opens the database at path read-only as it was when the log
+// ended at the watermark at, to recover from bad writes made after it:
+// the index is rebuilt from the entries written before at rather than
+// loaded from the index file, so Get, Has and iterators see the values
+// keys held then. ForEachRaw and Verify still walk the whole log.
+//
+// Compact and PunchHoles remove entries that are dead when they run, and
+// Compact moves live ones to the end of the log, so OpenAt returns
+// ErrWatermarkReclaimed for a watermark before the last of them. The
+// database can't be backed up while opened this way; copy what is
+// needed out of it instead.
+func OpenAt(path string, at Watermark, options ...Option) (*DB, error) {
+	return Open(path, append(options, func(o *option) error {
+		o.readOnly, o.follow, o.at = true, 0, &at
+		return nil
+	})...)
+}
+
+// OpenAtTime opens the database at path read-only as it was at t, like
+// OpenAt. Entries carry no timestamps, so this goes back to the end of the
+// last segment sealed by t; RolloverOption makes that finer grained.
+func OpenAtTime(path string, t time.Time, options ...Option) (*DB, error) {
+	m, err := readManifest(filepath.Join(path, ManifestFileName))
+	if err != nil {
+		return nil, err
+	}
+	var at Watermark
+	if m != nil {
+		at = m.watermarkAt(t)
+	}
+	return OpenAt(path, at, options...)
+}
+
+// watermarkAt returns the start of the first segment not sealed by t.
+// Segments sealed before seal times were recorded count as sealed by any
+// time.
+func (m *Manifest) watermarkAt(t time.Time) Watermark {
+	var at Watermark
+	found := false
+	for _, sc := range m.Segments {
+		if sc.Sealed.After(t) && (!found || sc.ID < at.Segment) {
+			at.Segment, found = sc.ID, true
+		}
+	}
+	if !found {
+		// Every sealed segment was sealed by t: go back to the start of
+		// the one after the last.
+		for _, sc := range m.Segments {
+			if sc.ID >= at.Segment {
+				at.Segment = sc.ID + 1
+			}
+		}
+	}
+	at.Offset = SegmentHeaderSize
+	return at
+}
+
+// openIndexAt opens the index file without loading any of its records, and
+// sets an item for every entry written before at instead. Detached
+// segments are skipped, as their entries can't be read anyway.
+func (db *DB) openIndexAt(at Watermark) (*index, error) {
+	if end := db.watermark(); end.item().before(at.item()) {
+		return nil, errors.Errorf("watermark %s is past the end of the log at %s", at, end)
+	} else if r := db.manifest.Reclaimed; r != nil && at.item().before(r.item()) {
+		return nil, errors.Wrapf(ErrWatermarkReclaimed, "watermark %s is before %s", at, r)
+	}
+	idx, err := openIndexReadOnly(db.IndexPath(), func(uint64, item) bool { return false })
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range db.segments {
+		if s.ID() > at.Segment {
+			break
+		} else if s.offline() {
+			continue
+		}
+		end := s.Size()
+		if s.ID() == at.Segment && at.Offset < end {
+			end = at.Offset
+		}
+		if err := s.sequentially(func() error {
+			return db.indexSegment(idx, s, end)
+		}); err != nil {
+			idx.Close()
+			return nil, errors.Wrapf(err, "segment %d", s.ID())
+		}
+	}
+	return idx, nil
+}
+
+// indexSegment sets an item in idx for every entry of s before end.
+func (db *DB) indexSegment(idx *index, s *segment, end uint32) error {
+	return s.forEachKey(end, func(off uint32, _ EntryHeader, key []byte) error {
+		return idx.set(db.opts.hashFunc(key), s.ID(), off)
+	})
+}
@@ -0,0 +1,170 @@
+package archivedb
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenAt(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+
+	require.NoError(db.Put([]byte("a"), []byte("1")))
+	require.NoError(db.Put([]byte("b"), []byte("1")))
+	require.NoError(db.Delete([]byte("gone")))
+	mustRollover(t, db)
+	require.NoError(db.Put([]byte("gone"), []byte("1")))
+	at := db.Watermark()
+
+	// Bad writes, after which the index file no longer holds the earlier
+	// items.
+	require.NoError(db.Put([]byte("a"), []byte("2")))
+	require.NoError(db.Delete([]byte("b")))
+	require.NoError(db.Put([]byte("c"), []byte("2")))
+	mustRollover(t, db)
+	require.NoError(db.Delete([]byte("gone")))
+	require.NoError(db.CheckpointIndex())
+
+	check := func(db *DB, want map[string]string) {
+		t.Helper()
+		for _, k := range []string{"a", "b", "c", "gone"} {
+			v, err := db.Get([]byte(k))
+			if w, ok := want[k]; ok {
+				require.NoError(err, k)
+				require.Equal(w, string(v), k)
+			} else {
+				require.Error(err, k)
+			}
+		}
+	}
+	past, err := OpenAt(dir, at)
+	require.NoError(err)
+	defer past.Close()
+	check(past, map[string]string{"a": "1", "b": "1", "gone": "1"})
+	require.ErrorIs(past.Put([]byte("a"), []byte("3")), ErrReadOnly)
+	require.NoError(past.Refresh())
+	check(past, map[string]string{"a": "1", "b": "1", "gone": "1"})
+	require.Error(past.Backup(ioutil.Discard))
+	require.NoError(past.Close())
+
+	// The beginning and end of the log.
+	past, err = OpenAt(dir, Watermark{})
+	require.NoError(err)
+	check(past, nil)
+	require.NoError(past.Close())
+	past, err = OpenAt(dir, db.Watermark())
+	require.NoError(err)
+	check(past, map[string]string{"a": "2", "c": "2"})
+	require.NoError(past.Close())
+
+	end := db.Watermark()
+	end.Offset++
+	_, err = OpenAt(dir, end)
+	require.Error(err)
+}
+
+func TestOpenAtTime(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	clock := newFakeClock()
+	db, err := Open(dir, ClockOption(clock))
+	require.NoError(err)
+	defer db.Close()
+
+	start := clock.Now()
+	require.NoError(db.Put([]byte("a"), []byte("1")))
+	clock.Add(time.Hour)
+	mustRollover(t, db)
+	require.NoError(db.Put([]byte("a"), []byte("2")))
+	clock.Add(time.Hour)
+	mustRollover(t, db)
+	require.NoError(db.Put([]byte("a"), []byte("3")))
+
+	for _, c := range []struct {
+		t    time.Time
+		want string
+	}{
+		{start, ""},
+		{start.Add(time.Hour), "1"},
+		{start.Add(90 * time.Minute), "1"},
+		{start.Add(3 * time.Hour), "2"},
+	} {
+		past, err := OpenAtTime(dir, c.t)
+		require.NoError(err)
+		v, err := past.Get([]byte("a"))
+		if c.want == "" {
+			require.ErrorIs(err, ErrKeyNotFound)
+		} else {
+			require.NoError(err)
+			require.Equal(c.want, string(v), c.t)
+		}
+		require.NoError(past.Close())
+	}
+}
+
+func TestOpenAt_Compacted(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	seal := func() {
+		_, err := db.SealActiveSegment()
+		require.NoError(err)
+	}
+	gone := func(db *DB, key string) {
+		t.Helper()
+		_, err := db.Get([]byte(key))
+		require.True(isMissing(err), "%s: %v", key, err)
+	}
+
+	require.NoError(db.Put([]byte("a"), []byte("old")))
+	seal()
+	require.NoError(db.Delete([]byte("a")))
+	seal()
+	before := db.Watermark()
+	require.NoError(db.Compact())
+	gone(db, "a")
+	past, err := OpenAt(dir, db.Watermark())
+	require.NoError(err)
+	gone(past, "a")
+	require.NoError(past.Close())
+
+	// The tombstone is kept while the old value survives in a segment
+	// that isn't compacted.
+	require.NoError(db.Put([]byte("b"), []byte("old")))
+	require.NoError(db.Put([]byte("keep"), make([]byte, 100)))
+	require.NoError(db.PutWithTTL([]byte("c"), []byte("old"), time.Hour))
+	seal()
+	require.NoError(db.Delete([]byte("b")))
+	require.NoError(db.Put([]byte("c"), []byte("new")))
+	require.NoError(db.Delete([]byte("c")))
+	seal()
+	plan, err := db.PlanCompaction()
+	require.NoError(err)
+	require.Len(plan.Segments, 1)
+	require.NoError(db.Compact())
+	gone(db, "b")
+	gone(db, "c")
+	past, err = OpenAt(dir, db.Watermark())
+	require.NoError(err)
+	gone(past, "b")
+	gone(past, "c")
+	v, err := past.Get([]byte("keep"))
+	require.NoError(err)
+	require.Len(v, 100)
+	require.NoError(past.Close())
+
+	// Compactions moved entries past earlier watermarks.
+	_, err = OpenAt(dir, before)
+	require.ErrorIs(err, ErrWatermarkReclaimed)
+}
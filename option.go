@@ -1,6 +1,15 @@
 package archivedb
 
-import "github.com/cespare/xxhash/v2"
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"io"
+	"reflect"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/pkg/errors"
+)
 
 // Option sets parameters for archiveDB construction parameter
 type Option func(*option) error
@@ -18,6 +27,163 @@ type option struct {
 	hashFunc HashFunc
 	// fsync is used to sync the data to disk
 	fsync bool
+	// syncInterval is how often unsynced writes are synced in the
+	// background, or zero for never
+	syncInterval time.Duration
+	// syncBytes is how many bytes may be written before a write is
+	// synced, or zero for no limit
+	syncBytes int64
+	// quarantine moves unexpected files aside instead of failing Open
+	quarantine bool
+	// env holds resources shared with other databases
+	env *Env
+	// keyTransform rewrites keys before they are stored, and
+	// keyTransformSet records that SetOption was passed one
+	keyTransform    KeyTransform
+	keyTransformSet bool
+	// maxKeySize is the largest key Put accepts
+	maxKeySize int
+	// maxValueSize is the largest value Put accepts
+	maxValueSize uint32
+	// compactionRatio is the dead-data ratio that makes a segment a
+	// compaction candidate
+	compactionRatio float64
+	// warningHandler is called for problems the database recovered from
+	warningHandler func(Warning)
+	// readOnly rejects writes and never modifies the database directory
+	readOnly bool
+	// follow is the interval at which a follower polls for new writes
+	follow time.Duration
+	// auditLog receives a record of every Put and Delete
+	auditLog io.Writer
+	// merkleLog keeps a Merkle tree over every entry written
+	merkleLog bool
+	// clock supplies recorded timestamps
+	clock Clock
+	// preallocate is the active segment fill ratio at which the next
+	// segment is prepared, or zero to create segments on demand
+	preallocate float64
+	// rollover is the time window after which the active segment is sealed
+	rollover time.Duration
+	// partition moves sealed segments into YYYY/MM directories
+	partition bool
+	// readRetries is how many times a failed entry read is retried
+	readRetries int
+	// readRetryBackoff is the wait before the first read retry
+	readRetryBackoff time.Duration
+	// headroom is the free space kept beyond a new segment
+	headroom uint64
+	// lockTimeout is how long Open waits for another writer's lock
+	lockTimeout time.Duration
+	// contentionRate is one over the fraction of lock acquisitions timed
+	contentionRate int
+	// accessRate is one over the fraction of reads counted by key, and
+	// accessPrefix the key bytes they are counted by, or zero for all
+	accessRate, accessPrefix int
+	// eventLogSize is how many events Events keeps, or zero for none
+	eventLogSize int
+	// stallThreshold is how long a write may take before it is an event
+	stallThreshold time.Duration
+	// backgroundWorkers is how many goroutines run background work
+	backgroundWorkers int
+	// coalesceReads shares one read among concurrent Gets of a key
+	coalesceReads bool
+	// loader fetches the values of keys Get doesn't find
+	loader func(key []byte) ([]byte, error)
+	// purgeInterval is how often expired keys are purged, or zero for never
+	purgeInterval time.Duration
+	// onExpire is called with every key purged
+	onExpire func(key []byte)
+	// autoCompact is how often to check for segments worth compacting, or
+	// zero for never
+	autoCompact time.Duration
+	// gcOrphans is how often empty segments are shrunk, or zero for never
+	gcOrphans time.Duration
+	// getPrefixBudget is the most key and value bytes GetPrefix returns
+	getPrefixBudget int
+	// versions links every entry to the previous entry of its key
+	versions bool
+	// deltaEncoding stores values as deltas against the previous entry of
+	// their key when that is smaller
+	deltaEncoding bool
+	// codec compresses values of at least compressThreshold bytes, or is
+	// nil
+	codec             Codec
+	compressThreshold int
+	// dictionarySize is the most bytes of the dictionary trained for each
+	// segment for DeflateCodec, or zero for none
+	dictionarySize int
+	// cipher encrypts values, or is nil
+	cipher cipher.AEAD
+	// skipUnchanged skips Puts of the value a key already holds
+	skipUnchanged bool
+	// importRate is the key and value bytes per second Import writes, or
+	// zero for no limit, of which importReserve is held back while other
+	// operations run
+	importRate    int64
+	importReserve float64
+	// at is the watermark OpenAt opened the database at, or nil
+	at *Watermark
+	// tombstoneRetention is how long after their segment was sealed
+	// Compact keeps tombstones
+	tombstoneRetention time.Duration
+	// corruptEntries is what Compact does with corrupt entries
+	corruptEntries CorruptEntryPolicy
+}
+
+// ErrImmutableOption is returned by SetOption for options that can only be
+// set when the database is opened.
+var ErrImmutableOption = errors.New("option cannot be changed on an open database")
+
+// checkImmutable returns ErrImmutableOption if o changes a setting of opts
+// that is fixed for the lifetime of an open database.
+func (opts *option) checkImmutable(o *option) error {
+	switch {
+	case reflect.ValueOf(opts.hashFunc).Pointer() != reflect.ValueOf(o.hashFunc).Pointer():
+		return errors.Wrap(ErrImmutableOption, "hash func")
+	case o.keyTransformSet && !sameKeyTransform(opts.keyTransform, o.keyTransform):
+		return errors.Wrap(ErrImmutableOption, "key transform")
+	case opts.env != o.env:
+		return errors.Wrap(ErrImmutableOption, "env")
+	case opts.readOnly != o.readOnly || opts.follow != o.follow:
+		return errors.Wrap(ErrImmutableOption, "follower mode")
+	case opts.merkleLog != o.merkleLog:
+		return errors.Wrap(ErrImmutableOption, "merkle log")
+	case opts.lockTimeout != o.lockTimeout:
+		return errors.Wrap(ErrImmutableOption, "lock timeout")
+	case opts.contentionRate != o.contentionRate:
+		return errors.Wrap(ErrImmutableOption, "contention profile")
+	case opts.accessRate != o.accessRate || opts.accessPrefix != o.accessPrefix:
+		return errors.Wrap(ErrImmutableOption, "access stats")
+	case opts.eventLogSize != o.eventLogSize:
+		return errors.Wrap(ErrImmutableOption, "event log size")
+	case opts.backgroundWorkers != o.backgroundWorkers:
+		return errors.Wrap(ErrImmutableOption, "background workers")
+	case opts.coalesceReads != o.coalesceReads:
+		return errors.Wrap(ErrImmutableOption, "coalesce reads")
+	case opts.purgeInterval != o.purgeInterval:
+		return errors.Wrap(ErrImmutableOption, "purge interval")
+	case opts.autoCompact != o.autoCompact:
+		return errors.Wrap(ErrImmutableOption, "auto compaction")
+	case opts.gcOrphans != o.gcOrphans:
+		return errors.Wrap(ErrImmutableOption, "orphan gc interval")
+	case opts.syncInterval != o.syncInterval:
+		return errors.Wrap(ErrImmutableOption, "sync interval")
+	case opts.cipher != o.cipher:
+		return errors.Wrap(ErrImmutableOption, "encryption")
+	}
+	return nil
+}
+
+// sameKeyTransform returns true if a and b are the same transform.
+// Transforms of types that can't be compared are never the same.
+func sameKeyTransform(a, b KeyTransform) (same bool) {
+	defer func() {
+		if recover() != nil {
+			same = false
+		}
+	}()
+	return a == b
 }
 
 // HashFuncOption sets the hash func for the database
@@ -28,9 +194,545 @@ func HashFuncOption(h HashFunc) Option {
 	}
 }
 
+// FsyncOption syncs every write to stable storage before Put returns if
+// fsync is set. FsyncOption(true) is SyncPolicyOption(SyncAlways), but
+// FsyncOption(false) leaves the other sync policies alone.
 func FsyncOption(fsync bool) Option {
 	return func(db *option) error {
 		db.fsync = fsync
 		return nil
 	}
 }
+
+// SyncPolicyOption sets when writes are synced to stable storage. The
+// default is SyncNever. The interval of SyncInterval can only be set when
+// the database is opened.
+func SyncPolicyOption(p SyncPolicy) Option {
+	return func(db *option) error {
+		if p.interval < 0 || p.bytes < 0 {
+			return errors.New("sync policy must not be negative")
+		}
+		db.fsync, db.syncInterval, db.syncBytes = p.always, p.interval, p.bytes
+		return nil
+	}
+}
+
+// QuarantineOption makes Open move unexpected or damaged files found in the
+// database directory into a quarantine subdirectory instead of failing.
+func QuarantineOption(quarantine bool) Option {
+	return func(db *option) error {
+		db.quarantine = quarantine
+		return nil
+	}
+}
+
+// SharedEnvOption registers the database with env, sharing its resource
+// budgets with every other database opened against it.
+func SharedEnvOption(env *Env) Option {
+	return func(db *option) error {
+		db.env = env
+		return nil
+	}
+}
+
+// KeyTransformOption sets a transform applied to every key on Put, Get and
+// Delete. The transform is recorded in the manifest and must be supplied
+// every time the database is opened.
+func KeyTransformOption(t KeyTransform) Option {
+	return func(db *option) error {
+		db.keyTransform, db.keyTransformSet = t, true
+		return nil
+	}
+}
+
+// MaxKeySizeOption lowers the largest key size accepted by Put. The limit is
+// recorded in the manifest and applies to later opens that don't set it.
+// Longer keys stored before it was lowered can still be read and deleted.
+func MaxKeySizeOption(n int) Option {
+	return func(db *option) error {
+		if n <= 0 || n > MaxKeySize {
+			return errors.Errorf("max key size must be between 1 and %d", MaxKeySize)
+		}
+		db.maxKeySize = n
+		return nil
+	}
+}
+
+// MaxValueSizeOption lowers the largest value size accepted by Put. The
+// limit is recorded in the manifest and applies to later opens that don't
+// set it. Without a lower limit, values larger than MaxValueSize are
+// split into chunks across segments.
+func MaxValueSizeOption(n uint32) Option {
+	return func(db *option) error {
+		if n == 0 || n > MaxValueSize {
+			return errors.Errorf("max value size must be between 1 and %d", MaxValueSize)
+		}
+		db.maxValueSize = n
+		return nil
+	}
+}
+
+// CompactionRatioOption sets the fraction of dead data above which a sealed
+// segment is selected for compaction.
+func CompactionRatioOption(ratio float64) Option {
+	return func(db *option) error {
+		if ratio <= 0 || ratio > 1 {
+			return errors.New("compaction ratio must be in (0, 1]")
+		}
+		db.compactionRatio = ratio
+		return nil
+	}
+}
+
+// WarningHandlerOption sets a function called with every Warning raised
+// while the database works around a recoverable problem.
+func WarningHandlerOption(fn func(Warning)) Option {
+	return func(db *option) error {
+		db.warningHandler = fn
+		return nil
+	}
+}
+
+// FollowerOption opens the database read-only as a follower of another
+// process writing to the same directory. Every interval the follower picks
+// up new segments, entries and index records, so reads lag the writer by at
+// most about one interval. A zero interval disables polling; call Refresh
+// to catch up.
+func FollowerOption(interval time.Duration) Option {
+	return func(db *option) error {
+		if interval < 0 {
+			return errors.New("follower interval must not be negative")
+		}
+		db.readOnly = true
+		db.follow = interval
+		return nil
+	}
+}
+
+// AuditLogOption appends an AuditRecord, as one line of JSON, to w for
+// every Put and Delete. Records are written in sequence order while the
+// write lock is held, so w should be fast; a nil w turns the log off.
+func AuditLogOption(w io.Writer) Option {
+	return func(db *option) error {
+		db.auditLog = w
+		return nil
+	}
+}
+
+// MerkleLogOption keeps a log of the hash of every entry written, from which
+// MerkleRoot, ProveInclusion and VerifyChain show that entries weren't
+// altered after the fact. Enabling it on an existing database hashes the
+// entries already written.
+func MerkleLogOption(enabled bool) Option {
+	return func(db *option) error {
+		db.merkleLog = enabled
+		return nil
+	}
+}
+
+// ClockOption sets the clock used for recorded timestamps. The default is
+// SystemClock.
+func ClockOption(c Clock) Option {
+	return func(db *option) error {
+		if c == nil {
+			return errors.New("clock must not be nil")
+		}
+		db.clock = c
+		return nil
+	}
+}
+
+// PreallocateOption sets the fill ratio of the active segment at which the
+// next segment file is prepared in the background. Zero disables
+// preallocation, so the Put that rolls over creates the segment inline.
+// The default is DefaultPreallocateThreshold.
+func PreallocateOption(ratio float64) Option {
+	return func(db *option) error {
+		if ratio < 0 || ratio > 1 {
+			return errors.New("preallocate ratio must be in [0, 1]")
+		}
+		db.preallocate = ratio
+		return nil
+	}
+}
+
+// RolloverOption seals the active segment once the clock passes into a new
+// window of length maxAge, even if the segment isn't full, so each segment
+// only holds entries from one window. Windows are aligned to the zero
+// time, so 24 hours gives one segment per UTC day and time-based retention
+// can drop whole segments. The rollover happens on the first write of the
+// new window. Zero, the default, rolls over by size only.
+func RolloverOption(maxAge time.Duration) Option {
+	return func(db *option) error {
+		if maxAge < 0 {
+			return errors.New("rollover age must not be negative")
+		}
+		db.rollover = maxAge
+		return nil
+	}
+}
+
+// PartitionOption moves each segment, once sealed, into a "YYYY/MM"
+// subdirectory named after its seal time, so whole months of data can be
+// archived or deleted with filesystem tools after DetachPartition.
+// Combine it with RolloverOption to keep segments within one month.
+func PartitionOption(enabled bool) Option {
+	return func(db *option) error {
+		db.partition = enabled
+		return nil
+	}
+}
+
+// ReadRetryOption sets how many times Get retries an entry read that hit a
+// memory fault, a short read or an I/O error, and the wait before the first
+// retry, which doubles on every attempt. Each retry raises a Warning; when
+// all fail, the error is returned as corruption. Checksum failures aren't
+// retried. Zero retries fail on the first error. The defaults are
+// DefaultReadRetries and DefaultReadRetryBackoff.
+func ReadRetryOption(retries int, backoff time.Duration) Option {
+	return func(db *option) error {
+		if retries < 0 || backoff < 0 {
+			return errors.New("read retries and backoff must not be negative")
+		}
+		db.readRetries = retries
+		db.readRetryBackoff = backoff
+		return nil
+	}
+}
+
+// DiskHeadroomOption sets the free space, in bytes, that must remain on the
+// filesystem after a new segment is created. Creating a segment with less
+// space than SegmentSize plus the headroom fails fast with
+// ErrInsufficientSpace rather than leaving a file the filesystem can't
+// back. The default is zero.
+func DiskHeadroomOption(bytes uint64) Option {
+	return func(db *option) error {
+		db.headroom = bytes
+		return nil
+	}
+}
+
+// LockTimeoutOption makes Open wait up to d for another process to release
+// its lock on the database, polling for it, instead of failing with
+// ErrDatabaseLocked straight away. This lets a restarted service open the
+// database while the instance it replaces is still shutting down. Zero,
+// the default, doesn't wait.
+func LockTimeoutOption(d time.Duration) Option {
+	return func(db *option) error {
+		if d < 0 {
+			return errors.New("lock timeout must not be negative")
+		}
+		db.lockTimeout = d
+		return nil
+	}
+}
+
+// ContentionProfileOption times one in every rate acquisitions of the
+// database lock by Get, Put and Delete, for ContentionProfile. Timing costs
+// two clock reads per sample; zero, the default, turns profiling off.
+func ContentionProfileOption(rate int) Option {
+	return func(db *option) error {
+		if rate < 0 {
+			return errors.New("contention sample rate must not be negative")
+		}
+		db.contentionRate = rate
+		return nil
+	}
+}
+
+// AccessStatsOption counts one in every rate Gets by key, or by the first
+// prefixLen bytes of the key if prefixLen is positive, for the HotKeys of
+// Stats: the 256 most read keys or prefixes, from which to tell the data
+// to keep on fast local storage from the data that can move elsewhere.
+// Counting takes a lock shared by all Gets for each sample; zero, the
+// default, turns counting off.
+func AccessStatsOption(rate, prefixLen int) Option {
+	return func(db *option) error {
+		if rate < 0 || prefixLen < 0 {
+			return errors.New("access sample rate and prefix length must not be negative")
+		}
+		db.accessRate = rate
+		db.accessPrefix = prefixLen
+		return nil
+	}
+}
+
+// EventLogOption sets how many of the most recent events Events keeps, and
+// how long appending or syncing an entry may take before it is recorded as
+// a stall. A zero size turns the event log off, and a zero threshold stall
+// detection. The defaults are DefaultEventLogSize and
+// DefaultStallThreshold. Only the threshold can be changed with SetOption.
+func EventLogOption(size int, stallThreshold time.Duration) Option {
+	return func(db *option) error {
+		if size < 0 || stallThreshold < 0 {
+			return errors.New("event log size and stall threshold must not be negative")
+		}
+		db.eventLogSize = size
+		db.stallThreshold = stallThreshold
+		return nil
+	}
+}
+
+// BackgroundWorkersOption caps how many goroutines the database runs
+// background work on, such as preparing the next segment and the periodic
+// jobs of PurgeIntervalOption, AutoCompactOption, SyncInterval and
+// GCOrphansOption, to bound the CPU it takes from the embedding program.
+// Work beyond the cap is queued, and a periodic job skips its ticks while
+// it waits. The default is DefaultBackgroundWorkers. It is ignored for a
+// database opened with an Env that has EnvBackgroundWorkers.
+func BackgroundWorkersOption(n int) Option {
+	return func(db *option) error {
+		if n < 1 {
+			return errors.New("background workers must be at least 1")
+		}
+		db.backgroundWorkers = n
+		return nil
+	}
+}
+
+// CoalesceReadsOption makes concurrent Gets of the same key share one read
+// and checksum verification, so a burst of requests for a cold key, as
+// behind a cache miss, costs a single read. It adds a map lookup under a
+// mutex to every Get, so it is off by default.
+func CoalesceReadsOption(enabled bool) Option {
+	return func(db *option) error {
+		db.coalesceReads = enabled
+		return nil
+	}
+}
+
+// LoaderOption makes Get call load for a key that is missing, deleted or
+// expired, store the value it returns and return it, turning the database
+// into a persistent read-through cache. Errors from load, such as
+// ErrKeyNotFound for keys the upstream source lacks too, are returned by
+// Get. If storing the value fails, as it does in a read-only database, a
+// Warning is raised and the value is still returned. Combined with
+// CoalesceReadsOption, concurrent Gets of a missing key call load once.
+// Nil turns loading off.
+func LoaderOption(load func(key []byte) ([]byte, error)) Option {
+	return func(db *option) error {
+		db.loader = load
+		return nil
+	}
+}
+
+// PurgeIntervalOption runs PurgeExpired every interval in the background,
+// raising a Warning if it fails while the database isn't frozen. Zero, the
+// default, leaves expired keys in the index until PurgeExpired is called. A
+// follower never purges.
+func PurgeIntervalOption(interval time.Duration) Option {
+	return func(db *option) error {
+		if interval < 0 {
+			return errors.New("purge interval must not be negative")
+		}
+		db.purgeInterval = interval
+		return nil
+	}
+}
+
+// OnExpireOption makes PurgeExpired, and the purge job run by
+// PurgeIntervalOption, call fn with every expired key it removes, so an
+// application can clean up resources tied to the key. fn is called
+// without the database locked, so it may call into it. Nil turns the
+// notifications off.
+func OnExpireOption(fn func(key []byte)) Option {
+	return func(db *option) error {
+		db.onExpire = fn
+		return nil
+	}
+}
+
+// AutoCompactOption checks every interval whether PlanCompaction selects
+// any segment, that is, whether the dead data of a sealed segment passed
+// the CompactionRatioOption threshold, and runs Compact if so. A failed
+// compaction raises a Warning. Zero, the default, compacts only when
+// Compact is called. A follower never compacts.
+func AutoCompactOption(interval time.Duration) Option {
+	return func(db *option) error {
+		if interval < 0 {
+			return errors.New("auto compaction interval must not be negative")
+		}
+		db.autoCompact = interval
+		return nil
+	}
+}
+
+// GCOrphansOption runs GCOrphans every interval in the background, raising
+// a Warning if it fails. Zero, the default, leaves empty segments alone
+// until GCOrphans is called. A follower never shrinks segments.
+func GCOrphansOption(interval time.Duration) Option {
+	return func(db *option) error {
+		if interval < 0 {
+			return errors.New("orphan gc interval must not be negative")
+		}
+		db.gcOrphans = interval
+		return nil
+	}
+}
+
+// GetPrefixBudgetOption sets the most key and value bytes GetPrefix
+// returns before failing with ErrPrefixTooLarge. The default is
+// DefaultGetPrefixBudget.
+func GetPrefixBudgetOption(bytes int) Option {
+	return func(db *option) error {
+		if bytes <= 0 {
+			return errors.New("get prefix budget must be positive")
+		}
+		db.getPrefixBudget = bytes
+		return nil
+	}
+}
+
+// VersionsOption links every entry written to the previous entry of its
+// key, at a cost of 8 bytes per entry, so GetVersions and GetAt can read
+// the values a key held before. Entries written without it end the chain
+// of versions. Binaries from before this option can't read linked
+// entries.
+func VersionsOption(enabled bool) Option {
+	return func(db *option) error {
+		db.versions = enabled
+		return nil
+	}
+}
+
+// CompressionOption compresses values of at least threshold bytes with
+// codec before they are written, and decompresses them when read. Values
+// that don't shrink are stored as they are. A nil codec turns compression
+// off; values written compressed stay readable as long as their codec is
+// DeflateCodec or is still set.
+func CompressionOption(codec Codec, threshold int) Option {
+	return func(db *option) error {
+		if codec != nil && (codec.ID() == 0 || codec.ID() > MaxCodecID) {
+			return errors.Errorf("codec id %d out of range 1-%d", codec.ID(), MaxCodecID)
+		} else if codec != nil && codec != DeflateCodec && codec.ID() < 4 {
+			return errors.Errorf("codec id %d is reserved", codec.ID())
+		} else if threshold < 0 {
+			return errors.New("compression threshold must not be negative")
+		}
+		db.codec, db.compressThreshold = codec, threshold
+		return nil
+	}
+}
+
+// EncryptionOption encrypts values with AES-GCM under key, which must be
+// 16, 24 or 32 bytes long, before they are written, and decrypts them when
+// read. Keys are left as they are; encrypt them with EncryptedKeyTransform.
+// A nil key turns encryption off, but values written encrypted can't be
+// read without it.
+func EncryptionOption(key []byte) Option {
+	return func(db *option) error {
+		if key == nil {
+			db.cipher = nil
+			return nil
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return errors.Wrap(err, "encryption key")
+		}
+		if db.cipher, err = cipher.NewGCM(block); err != nil {
+			return errors.Wrap(err, "encryption key")
+		}
+		return nil
+	}
+}
+
+// SkipUnchangedOption makes Put return without writing anything when the
+// key already holds the value, with the same tag and no expiry, as checked
+// by comparing the stored bytes after their length and checksum, so
+// pipelines re-sending unchanged records don't grow the log. It costs a
+// read of the stored entry per Put. Puts with a TTL are always written.
+// WriteBatch.Commit skips such puts too, unless the batch wrote the key
+// before them.
+func SkipUnchangedOption(enabled bool) Option {
+	return func(db *option) error {
+		db.skipUnchanged = enabled
+		return nil
+	}
+}
+
+// ImportPacingOption limits Import to bytesPerSecond of keys and values,
+// and holds back foregroundShare of that rate for as long as Gets, Puts
+// and Deletes run alongside it, so a bulk load doesn't drive up their
+// latency. Bytes those operations write beyond their share come out of
+// Import's rate too. It can be changed with SetOption while an import
+// runs; a zero rate, the default, turns pacing off.
+func ImportPacingOption(bytesPerSecond int64, foregroundShare float64) Option {
+	return func(db *option) error {
+		if bytesPerSecond < 0 {
+			return errors.New("import rate must not be negative")
+		} else if foregroundShare < 0 || foregroundShare >= 1 {
+			return errors.New("foreground share must be at least 0 and less than 1")
+		}
+		db.importRate = bytesPerSecond
+		db.importReserve = foregroundShare
+		return nil
+	}
+}
+
+// TombstoneRetentionOption makes Compact keep the tombstones of segments
+// sealed less than d ago, moving them to the end of the log with the live
+// entries, so replicas and change consumers that lag by less than d still
+// see keys deleted rather than missing. Entries carry no timestamps, so a
+// tombstone may be kept for longer: up to d after the segment it was moved
+// to is sealed. Segments are planned as if their retained tombstones were
+// live. Zero, the default, drops tombstones as soon as their segment is
+// compacted.
+func TombstoneRetentionOption(d time.Duration) Option {
+	return func(db *option) error {
+		if d < 0 {
+			return errors.New("tombstone retention must not be negative")
+		}
+		db.tombstoneRetention = d
+		return nil
+	}
+}
+
+// DeltaEncodingOption stores a value written with VersionsOption as the
+// difference from the previous version of its key, the bytes between the
+// prefix and suffix they share, when that is smaller than the value
+// compressed as configured. Reads rebuild the value from up to 8 deltas,
+// each verified against its checksum; every ninth version in a row is
+// stored in full, as is a value whose previous version is in another
+// segment or chunked. Writes read the previous version to compare with it.
+// Compact stores the deltas it moves in full. It has no effect without
+// VersionsOption. Binaries from before this option can't read the deltas.
+func DeltaEncodingOption(enabled bool) Option {
+	return func(db *option) error {
+		db.deltaEncoding = enabled
+		return nil
+	}
+}
+
+// SegmentDictionaryOption compresses the values CompressionOption
+// compresses with DeflateCodec with a preset dictionary of up to size
+// bytes, trained for each segment from values sampled evenly from those
+// written since the last segment was started, which improves the ratio on
+// many small, similar values such as JSON events. The dictionary is stored
+// as the first entry of its segment, so it is read once per segment and
+// goes with the segment into backups and replicas. Values are only
+// compressed with it if that makes them smaller, and Compact compresses
+// the values it moves without it. Zero, the default, turns it off; size
+// must be at most MaxDictionarySize. Binaries from before this option
+// can't read the values.
+func SegmentDictionaryOption(size int) Option {
+	return func(db *option) error {
+		if size < 0 || size > MaxDictionarySize {
+			return errors.Errorf("dictionary size %d out of range 0-%d", size, MaxDictionarySize)
+		}
+		db.dictionarySize = size
+		return nil
+	}
+}
+
+// CorruptEntryPolicyOption sets what Compact does with an entry it would
+// move that fails its checksum, or that the index refers to under another
+// key. The default is CorruptEntryFail.
+func CorruptEntryPolicyOption(p CorruptEntryPolicy) Option {
+	return func(db *option) error {
+		if p < CorruptEntryFail || p > CorruptEntryQuarantine {
+			return errors.Errorf("unknown corrupt entry policy %d", p)
+		}
+		db.corruptEntries = p
+		return nil
+	}
+}
@@ -0,0 +1,55 @@
+package archivedb
+
+import "fmt"
+
+// GCOrphans shrinks the files of sealed segments that hold no entries to
+// their header, freeing the space preallocated for appends that never
+// came, as when a segment was rolled over before anything was written to
+// it. On filesystems without sparse files each such segment takes
+// SegmentSize bytes. The segments themselves are kept so segment ids stay
+// contiguous. It returns the number of segments shrunk and the bytes their
+// files shrank by; Open counts them in RecoveryReport.EmptySegments.
+func (db *DB) GCOrphans() (segments int, reclaimed int64, err error) {
+	db.lockFor(lockWrite)
+	defer db.mu.Unlock()
+	if err := db.checkWritable(); err != nil {
+		return 0, 0, err
+	}
+	for _, s := range db.orphanSegments() {
+		before := s.MappedSize()
+		if err := db.emptySegment(s); err != nil {
+			return segments, reclaimed, db.degrade(err)
+		}
+		segments++
+		reclaimed += before - db.segments[s.ID()].MappedSize()
+	}
+	if segments > 0 {
+		db.event(EventCompaction, fmt.Sprintf("shrank %d empty segments, reclaiming %d bytes", segments, reclaimed), db.path, nil)
+	}
+	return segments, reclaimed, nil
+}
+
+// orphanSegments returns the attached, sealed segments without entries
+// whose files are larger than their header. The caller must hold db.mu.
+func (db *DB) orphanSegments() []*segment {
+	var orphans []*segment
+	for _, s := range db.segments {
+		if s == db.activeSegment() || s.offline() ||
+			s.Size() > SegmentHeaderSize || s.MappedSize() <= SegmentHeaderSize {
+			continue
+		} else if _, ok := db.manifest.sealed(s.ID()); ok {
+			orphans = append(orphans, s)
+		}
+	}
+	return orphans
+}
+
+// findOrphans counts the segments GCOrphans would shrink in the recovery
+// report.
+func (db *DB) findOrphans() {
+	orphans := db.orphanSegments()
+	db.recovery.EmptySegments = len(orphans)
+	if len(orphans) > 0 {
+		db.event(EventRecovery, fmt.Sprintf("found %d empty segments holding preallocated space", len(orphans)), db.path, nil)
+	}
+}
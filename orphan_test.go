@@ -0,0 +1,70 @@
+package archivedb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_GCOrphans(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+
+	// Rolling over an empty active segment leaves it sealed and empty.
+	mustRollover(t, db)
+	require.NoError(db.Put([]byte("foo"), []byte("bar")))
+	mustRollover(t, db)
+	mustRollover(t, db)
+	require.NoError(db.Close())
+
+	db, err = Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	require.Equal(2, db.RecoveryReport().EmptySegments)
+	n, reclaimed, err := db.GCOrphans()
+	require.NoError(err)
+	require.Equal(2, n)
+	require.Equal(2*int64(SegmentSize-SegmentHeaderSize), reclaimed)
+	for _, id := range []uint32{0, 2} {
+		fi, err := os.Stat(filepath.Join(dir, segmentFilename(id)))
+		require.NoError(err)
+		require.Equal(int64(SegmentHeaderSize), fi.Size())
+	}
+	n, _, err = db.GCOrphans()
+	require.NoError(err)
+	require.Zero(n)
+
+	v, err := db.Get([]byte("foo"))
+	require.NoError(err)
+	require.Equal("bar", string(v))
+	require.NoError(db.Put([]byte("baz"), []byte("qux")))
+	require.NoError(db.Close())
+	db, err = Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	require.Zero(db.RecoveryReport().EmptySegments)
+	require.NoError(db.VerifyBackups(dir))
+}
+
+func TestDB_GCOrphansOption(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir, GCOrphansOption(time.Millisecond))
+	require.NoError(err)
+	defer db.Close()
+
+	mustRollover(t, db)
+	require.Eventually(func() bool {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		return len(db.orphanSegments()) == 0
+	}, time.Second, time.Millisecond)
+}
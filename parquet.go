@@ -0,0 +1,394 @@
+package archivedb
+
+import (
+	"bufio"
+	"encoding/binary"
+)
+
+// The Parquet file written by ExportParquet. See
+// https://github.com/apache/parquet-format for the format, whose metadata
+// is encoded with the Thrift compact protocol.
+const (
+	parquetMagic = "PAR1"
+	// parquetRowGroupSize is the size of the values buffered before they
+	// are written as a row group.
+	parquetRowGroupSize = 64 << 20
+)
+
+// Parquet physical types, encodings and repetitions used.
+const (
+	parquetInt32     = 1
+	parquetInt64     = 2
+	parquetByteArray = 6
+
+	parquetPlain = 0
+	parquetRLE   = 3
+
+	parquetRequired = 0
+	parquetOptional = 1
+)
+
+// parquetColumn is a column of the exported rows.
+type parquetColumn struct {
+	name     string
+	typ      int32
+	optional bool
+}
+
+var parquetColumns = []parquetColumn{
+	{name: "key", typ: parquetByteArray},
+	{name: "value", typ: parquetByteArray},
+	{name: "timestamp", typ: parquetInt64, optional: true},
+	{name: "flag", typ: parquetInt32},
+}
+
+// offsetWriter counts the bytes written through it.
+type offsetWriter struct {
+	w   *bufio.Writer
+	off int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.off += int64(n)
+	return n, err
+}
+
+// parquetExportWriter writes the rows as a Parquet file: a row group, with
+// one uncompressed, plain encoded data page per column, for every
+// parquetRowGroupSize of values, and the file metadata at the end.
+type parquetExportWriter struct {
+	w *offsetWriter
+	// columns holds the plain encoded values of the row group being
+	// filled, in the order of parquetColumns, and defined whether each of
+	// its rows has a timestamp.
+	columns [4][]byte
+	defined []bool
+	groups  []parquetRowGroup
+	rows    int64
+}
+
+// parquetRowGroup records where a row group's column chunks were written.
+type parquetRowGroup struct {
+	rows   int
+	chunks [4]parquetChunk
+}
+
+type parquetChunk struct {
+	offset, size int64
+}
+
+func (w *parquetExportWriter) Begin() error {
+	_, err := w.w.Write([]byte(parquetMagic))
+	return err
+}
+
+func (w *parquetExportWriter) Write(row exportRow) error {
+	w.columns[0] = appendParquetBytes(w.columns[0], row.key)
+	w.columns[1] = appendParquetBytes(w.columns[1], row.value)
+	w.defined = append(w.defined, !row.written.IsZero())
+	if !row.written.IsZero() {
+		w.columns[2] = appendUint64LE(w.columns[2], uint64(row.written.UnixNano()))
+	}
+	w.columns[3] = appendUint32LE(w.columns[3], uint32(row.flag))
+	w.rows++
+
+	size := 0
+	for _, c := range w.columns {
+		size += len(c)
+	}
+	if size >= parquetRowGroupSize {
+		return w.flushRowGroup()
+	}
+	return nil
+}
+
+func (w *parquetExportWriter) End() error {
+	if len(w.defined) > 0 {
+		if err := w.flushRowGroup(); err != nil {
+			return err
+		}
+	}
+	meta := w.fileMetaData()
+	if _, err := w.w.Write(meta); err != nil {
+		return err
+	} else if _, err := w.w.Write(appendUint32LE(nil, uint32(len(meta)))); err != nil {
+		return err
+	} else if _, err := w.w.Write([]byte(parquetMagic)); err != nil {
+		return err
+	}
+	return w.w.w.Flush()
+}
+
+// flushRowGroup writes the buffered values as a row group.
+func (w *parquetExportWriter) flushRowGroup() error {
+	g := parquetRowGroup{rows: len(w.defined)}
+	for i, c := range parquetColumns {
+		data := w.columns[i]
+		if c.optional {
+			// Definition levels, 1 for a value and 0 for a null, come
+			// first, after their length.
+			levels := appendParquetLevels(nil, w.defined)
+			data = append(appendUint32LE(nil, uint32(len(levels))), levels...)
+			data = append(data, w.columns[i]...)
+		}
+		hdr := parquetPageHeader(len(data), g.rows)
+		g.chunks[i] = parquetChunk{offset: w.w.off, size: int64(len(hdr) + len(data))}
+		if _, err := w.w.Write(hdr); err != nil {
+			return err
+		} else if _, err := w.w.Write(data); err != nil {
+			return err
+		}
+		w.columns[i] = w.columns[i][:0]
+	}
+	w.groups = append(w.groups, g)
+	w.defined = w.defined[:0]
+	return nil
+}
+
+// parquetPageHeader returns the header of a data page of size bytes
+// holding rows values.
+func parquetPageHeader(size, rows int) []byte {
+	var t thriftWriter
+	t.i32(1, 0) // data page
+	t.i32(2, int32(size))
+	t.i32(3, int32(size))
+	t.structField(5)
+	t.i32(1, int32(rows))
+	t.i32(2, parquetPlain)
+	t.i32(3, parquetRLE)
+	t.i32(4, parquetRLE)
+	t.end()
+	t.end()
+	return t.b
+}
+
+// fileMetaData returns the file metadata: the schema and where the row
+// groups were written.
+func (w *parquetExportWriter) fileMetaData() []byte {
+	var t thriftWriter
+	t.i32(1, 1) // version
+	t.list(2, thriftStruct, 1+len(parquetColumns))
+	t.begin()
+	t.binary(4, "schema")
+	t.i32(5, int32(len(parquetColumns)))
+	t.end()
+	for _, c := range parquetColumns {
+		t.begin()
+		t.i32(1, c.typ)
+		if c.optional {
+			t.i32(3, parquetOptional)
+		} else {
+			t.i32(3, parquetRequired)
+		}
+		t.binary(4, c.name)
+		switch c.name {
+		case "timestamp":
+			// TIMESTAMP(isAdjustedToUTC=true, unit=NANOS)
+			t.structField(10)
+			t.structField(8)
+			t.boolean(1, true)
+			t.structField(2)
+			t.structField(3)
+			t.end()
+			t.end()
+			t.end()
+			t.end()
+		case "flag":
+			t.i32(6, 11) // UINT_8
+			// INTEGER(bitWidth=8, isSigned=false)
+			t.structField(10)
+			t.structField(10)
+			t.i8(1, 8)
+			t.boolean(2, false)
+			t.end()
+			t.end()
+		}
+		t.end()
+	}
+	t.i64(3, w.rows)
+	t.list(4, thriftStruct, len(w.groups))
+	for _, g := range w.groups {
+		t.begin()
+		t.list(1, thriftStruct, len(parquetColumns))
+		var size int64
+		for i, c := range parquetColumns {
+			chunk := g.chunks[i]
+			size += chunk.size
+			t.begin()
+			t.i64(2, chunk.offset)
+			t.structField(3)
+			t.i32(1, c.typ)
+			if c.optional {
+				t.list(2, thriftI32, 2)
+				t.elemI32(parquetPlain)
+				t.elemI32(parquetRLE)
+			} else {
+				t.list(2, thriftI32, 1)
+				t.elemI32(parquetPlain)
+			}
+			t.list(3, thriftBinary, 1)
+			t.elemBinary(c.name)
+			t.i32(4, 0) // uncompressed
+			t.i64(5, int64(g.rows))
+			t.i64(6, chunk.size)
+			t.i64(7, chunk.size)
+			t.i64(9, chunk.offset)
+			t.end()
+			t.end()
+		}
+		t.i64(2, size)
+		t.i64(3, int64(g.rows))
+		t.end()
+	}
+	t.binary(6, "archivedb")
+	t.end()
+	return t.b
+}
+
+// appendParquetBytes appends b plain encoded: its length, then its bytes.
+func appendParquetBytes(dst, b []byte) []byte {
+	dst = appendUint32LE(dst, uint32(len(b)))
+	return append(dst, b...)
+}
+
+// appendParquetLevels appends levels with the RLE encoding of bit width
+// 1, as a run for every stretch of equal levels.
+func appendParquetLevels(dst []byte, levels []bool) []byte {
+	for i := 0; i < len(levels); {
+		n := 1
+		for i+n < len(levels) && levels[i+n] == levels[i] {
+			n++
+		}
+		dst = appendUvarint(dst, uint64(n)<<1)
+		if levels[i] {
+			dst = append(dst, 1)
+		} else {
+			dst = append(dst, 0)
+		}
+		i += n
+	}
+	return dst
+}
+
+func appendUint32LE(b []byte, v uint32) []byte {
+	var p [4]byte
+	binary.LittleEndian.PutUint32(p[:], v)
+	return append(b, p[:]...)
+}
+
+func appendUint64LE(b []byte, v uint64) []byte {
+	var p [8]byte
+	binary.LittleEndian.PutUint64(p[:], v)
+	return append(b, p[:]...)
+}
+
+// Thrift compact protocol types.
+const (
+	thriftTrue   = 1
+	thriftFalse  = 2
+	thriftByte   = 3
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes a struct with the Thrift compact protocol. Field
+// ids are written as deltas from the last field of the struct they are in.
+type thriftWriter struct {
+	b     []byte
+	last  int16
+	outer []int16
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	if d := id - t.last; d > 0 && d <= 15 {
+		t.b = append(t.b, byte(d)<<4|typ)
+	} else {
+		t.b = append(t.b, typ)
+		t.b = appendZigzag(t.b, int64(id))
+	}
+	t.last = id
+}
+
+func (t *thriftWriter) i8(id int16, v int8) {
+	t.field(id, thriftByte)
+	t.b = append(t.b, byte(v))
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.b = appendZigzag(t.b, int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.b = appendZigzag(t.b, v)
+}
+
+// boolean writes a bool field, whose value is its type.
+func (t *thriftWriter) boolean(id int16, v bool) {
+	if v {
+		t.field(id, thriftTrue)
+	} else {
+		t.field(id, thriftFalse)
+	}
+}
+
+func (t *thriftWriter) binary(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.elemBinary(s)
+}
+
+// structField starts a struct field, whose fields follow until end.
+func (t *thriftWriter) structField(id int16) {
+	t.field(id, thriftStruct)
+	t.begin()
+}
+
+// list starts a list field of n elements of type elem, which follow.
+func (t *thriftWriter) list(id int16, elem byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.b = append(t.b, byte(n)<<4|elem)
+	} else {
+		t.b = append(t.b, 0xf0|elem)
+		t.b = appendUvarint(t.b, uint64(n))
+	}
+}
+
+// begin starts a struct that is a list element; its fields follow until
+// end.
+func (t *thriftWriter) begin() {
+	t.outer = append(t.outer, t.last)
+	t.last = 0
+}
+
+// end ends the struct being written, or the top-level struct if none is.
+func (t *thriftWriter) end() {
+	t.b = append(t.b, 0)
+	if n := len(t.outer); n > 0 {
+		t.last = t.outer[n-1]
+		t.outer = t.outer[:n-1]
+	}
+}
+
+func (t *thriftWriter) elemI32(v int32) {
+	t.b = appendZigzag(t.b, int64(v))
+}
+
+func (t *thriftWriter) elemBinary(s string) {
+	t.b = appendUvarint(t.b, uint64(len(s)))
+	t.b = append(t.b, s...)
+}
+
+func appendZigzag(b []byte, v int64) []byte {
+	return appendUvarint(b, uint64(v<<1^v>>63))
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var p [binary.MaxVarintLen64]byte
+	return append(b, p[:binary.PutUvarint(p[:], v)]...)
+}
@@ -0,0 +1,180 @@
+package archivedb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_ExportParquet(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	clock := newFakeClock()
+	db, err := Open(dir, ClockOption(clock), RolloverOption(time.Hour))
+	require.NoError(err)
+	defer db.Close()
+
+	const n = 100
+	for i := 0; i < n; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("key%03d", i)), bytes.Repeat([]byte{byte(i)}, i)))
+		if i == n/2 {
+			clock.Add(2 * time.Hour)
+		}
+	}
+	sealed := clock.Now().UnixNano()
+
+	var buf bytes.Buffer
+	require.NoError(db.Export(&buf, ExportParquet))
+	file := buf.Bytes()
+	require.Equal(parquetMagic, string(file[:4]))
+	require.Equal(parquetMagic, string(file[len(file)-4:]))
+	size := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	meta := (&thriftReader{b: file[len(file)-8-size : len(file)-8]}).structure()
+
+	require.Equal(int64(n), meta[3])
+	schema := meta[2].([]interface{})
+	require.Len(schema, 5)
+	require.Equal([]byte("schema"), schema[0].(thriftFields)[4])
+	require.Equal(int64(4), schema[0].(thriftFields)[5])
+	for i, c := range parquetColumns {
+		el := schema[i+1].(thriftFields)
+		require.Equal([]byte(c.name), el[4])
+		require.Equal(int64(c.typ), el[1])
+	}
+	timestamp := schema[3].(thriftFields)[10].(thriftFields)[8].(thriftFields)
+	require.Equal(true, timestamp[1])
+	require.Contains(timestamp[2].(thriftFields), int16(3))
+
+	groups := meta[4].([]interface{})
+	require.Len(groups, 1)
+	group := groups[0].(thriftFields)
+	require.Equal(int64(n), group[3])
+	columns := group[1].([]interface{})
+	require.Len(columns, 4)
+	data := make([][]byte, 4)
+	for i, c := range columns {
+		cm := c.(thriftFields)[3].(thriftFields)
+		require.Equal([]interface{}{[]byte(parquetColumns[i].name)}, cm[3])
+		require.Equal(int64(n), cm[5])
+		r := &thriftReader{b: file[cm[9].(int64):]}
+		page := r.structure()
+		require.Equal(int64(0), page[1])
+		require.Equal(int64(n), page[5].(thriftFields)[1])
+		require.Equal(cm[6], int64(len(file[cm[9].(int64):])-len(r.b))+page[2].(int64))
+		data[i] = r.b[:page[2].(int64)]
+	}
+
+	// Timestamps are preceded by their definition levels.
+	levels := data[2][4 : 4+binary.LittleEndian.Uint32(data[2])]
+	data[2] = data[2][4+len(levels):]
+	var defined []bool
+	for len(levels) > 0 {
+		run, k := binary.Uvarint(levels)
+		require.Zero(run&1, "bit-packed run")
+		for j := uint64(0); j < run>>1; j++ {
+			defined = append(defined, levels[k] == 1)
+		}
+		levels = levels[k+1:]
+	}
+	require.Len(defined, n)
+
+	for i := 0; i < n; i++ {
+		key := readParquetBytes(&data[0])
+		value := readParquetBytes(&data[1])
+		require.Equal([]byte(fmt.Sprintf("key%03d", i)), key)
+		require.Equal(bytes.Repeat([]byte{byte(i)}, i), value)
+		require.Equal(i <= n/2, defined[i], i)
+		if defined[i] {
+			require.Equal(sealed, int64(binary.LittleEndian.Uint64(data[2])))
+			data[2] = data[2][8:]
+		}
+		require.Equal(uint32(EntryInsertFlag), binary.LittleEndian.Uint32(data[3]))
+		data[3] = data[3][4:]
+	}
+	require.Empty(data[2])
+}
+
+func readParquetBytes(b *[]byte) []byte {
+	l := binary.LittleEndian.Uint32(*b)
+	v := (*b)[4 : 4+l]
+	*b = (*b)[4+l:]
+	return v
+}
+
+// thriftFields is a struct decoded by thriftReader, by field id.
+type thriftFields map[int16]interface{}
+
+// thriftReader decodes the Thrift compact protocol into thriftFields,
+// []interface{} lists, int64s, bools and []byte binaries.
+type thriftReader struct {
+	b []byte
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b)
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *thriftReader) zigzag() int64 {
+	u := r.uvarint()
+	return int64(u>>1) ^ -int64(u&1)
+}
+
+func (r *thriftReader) structure() thriftFields {
+	s := thriftFields{}
+	var id int16
+	for {
+		h := r.b[0]
+		r.b = r.b[1:]
+		if h == 0 {
+			return s
+		}
+		if d := h >> 4; d != 0 {
+			id += int16(d)
+		} else {
+			id = int16(r.zigzag())
+		}
+		s[id] = r.value(h & 0x0f)
+	}
+}
+
+func (r *thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case thriftTrue:
+		return true
+	case thriftFalse:
+		return false
+	case thriftByte:
+		v := int8(r.b[0])
+		r.b = r.b[1:]
+		return int64(v)
+	case 4, thriftI32, thriftI64:
+		return r.zigzag()
+	case thriftBinary:
+		n := r.uvarint()
+		v := r.b[:n]
+		r.b = r.b[n:]
+		return v
+	case thriftList:
+		h := r.b[0]
+		r.b = r.b[1:]
+		n := int(h >> 4)
+		if n == 15 {
+			n = int(r.uvarint())
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			list[i] = r.value(h & 0x0f)
+		}
+		return list
+	case thriftStruct:
+		return r.structure()
+	}
+	panic(fmt.Sprintf("thrift type %d", typ))
+}
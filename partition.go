@@ -0,0 +1,106 @@
+package archivedb
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrPartitionNotFound = errors.New("partition not found")
+
+// partitionName returns the partition directory, "YYYY/MM", of a segment
+// sealed at t.
+func partitionName(t time.Time) string {
+	return t.UTC().Format("2006/01")
+}
+
+// partitionRoots returns the top-level directories holding partitions.
+func (m *Manifest) partitionRoots() map[string]bool {
+	roots := make(map[string]bool)
+	for _, sc := range m.Segments {
+		if sc.Dir != "" {
+			roots[strings.SplitN(sc.Dir, "/", 2)[0]] = true
+		}
+	}
+	return roots
+}
+
+// detachedEntries returns the number of entries in detached segments.
+func (m *Manifest) detachedEntries() (n int64) {
+	for _, sc := range m.Segments {
+		if sc.Detached {
+			n += sc.Entries
+		}
+	}
+	return n
+}
+
+// compactedEntries returns the number of entries removed by Compact.
+func (m *Manifest) compactedEntries() (n int64) {
+	for _, sc := range m.Segments {
+		n += sc.Compacted
+	}
+	return n
+}
+
+// sealedPath returns the path of a sealed segment file.
+func (db *DB) sealedPath(sc SegmentChecksum) string {
+	return filepath.Join(db.path, filepath.FromSlash(sc.Dir), segmentFilename(sc.ID))
+}
+
+// moveSegmentFile moves a segment file, creating the target directory.
+func moveSegmentFile(from, to string) error {
+	if err := os.MkdirAll(filepath.Dir(to), 0777); err != nil {
+		return err
+	}
+	return os.Rename(from, to)
+}
+
+// DetachPartition takes every segment in the partition name, such as
+// "2021/03", offline: their keys are removed from the index and the
+// segments are unmapped, so they use no memory until AttachPartition. The
+// partition directory can then be archived or deleted with filesystem
+// tools. Values returned by Get from these segments must not be used after
+// DetachPartition returns.
+func (db *DB) DetachPartition(name string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	ids := db.partitionSegments(name, false)
+	if len(ids) == 0 {
+		return errors.Wrap(ErrPartitionNotFound, name)
+	}
+	return db.detachSegments(ids)
+}
+
+// AttachPartition brings the segments of a detached partition back online,
+// restoring their keys unless they were overwritten or deleted since.
+func (db *DB) AttachPartition(name string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	ids := db.partitionSegments(name, true)
+	if len(ids) == 0 {
+		return errors.Wrap(ErrPartitionNotFound, name)
+	}
+	return db.attachSegments(ids)
+}
+
+// partitionSegments returns the ids of the segments in partition name that
+// are detached, or attached. The caller must hold db.mu.
+func (db *DB) partitionSegments(name string, detached bool) []uint32 {
+	var ids []uint32
+	for _, sc := range db.manifest.Segments {
+		if sc.Dir == name && sc.Detached == detached {
+			ids = append(ids, sc.ID)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,70 @@
+package archivedb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_Partitions(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	clock := newFakeClock()
+	opts := []Option{ClockOption(clock), PartitionOption(true), RolloverOption(24 * time.Hour)}
+	db, err := Open(dir, opts...)
+	require.NoError(err)
+	require.NoError(db.Put([]byte("a"), []byte("jan")))
+	require.NoError(db.Put([]byte("b"), []byte("jan")))
+	clock.Add(31 * 24 * time.Hour)
+	require.NoError(db.Put([]byte("b"), []byte("feb")))
+	require.NoError(db.Put([]byte("c"), []byte("feb")))
+	clock.Add(24 * time.Hour)
+	require.NoError(db.Put([]byte("d"), []byte("feb")))
+
+	// Segments are moved into partitions when sealed, or on the next
+	// open where mapped files can't be renamed.
+	require.Equal("2020/02", db.manifest.Segments[0].Dir)
+	require.NoError(db.Close())
+
+	db, err = Open(dir, opts...)
+	require.NoError(err)
+	defer db.Close()
+	_, err = os.Stat(filepath.Join(dir, "2020", "02", segmentFilename(0)))
+	require.NoError(err)
+	_, err = os.Stat(filepath.Join(dir, segmentFilename(0)))
+	require.True(os.IsNotExist(err))
+	get := func(key string) string {
+		v, err := db.Get([]byte(key))
+		if err != nil {
+			return err.Error()
+		}
+		return string(v)
+	}
+	require.Equal("jan", get("a"))
+	require.Equal("feb", get("b"))
+
+	require.ErrorIs(db.DetachPartition("1999/01"), ErrPartitionNotFound)
+	require.NoError(db.DetachPartition("2020/02"))
+	require.Equal(ErrKeyNotFound.Error(), get("a"))
+	require.Equal(ErrKeyNotFound.Error(), get("c"))
+	require.Equal("feb", get("d"))
+
+	// Detached segments stay offline across reopening.
+	require.NoError(db.Close())
+	db, err = Open(dir, opts...)
+	require.NoError(err)
+	require.Equal(ErrKeyNotFound.Error(), get("a"))
+	require.NoError(db.Put([]byte("c"), []byte("mar")))
+
+	// Keys changed since detaching keep their new value.
+	require.NoError(db.AttachPartition("2020/02"))
+	require.Equal("jan", get("a"))
+	require.Equal("feb", get("b"))
+	require.Equal("mar", get("c"))
+	require.ErrorIs(db.AttachPartition("2020/02"), ErrPartitionNotFound)
+}
@@ -0,0 +1,65 @@
+package archivedb
+
+import "sort"
+
+// Pin places key under hold: retention policies and background jobs such
+// as expiry never remove it until Unpin is called. Explicit Put and Delete
+// calls are not affected. Pins are recorded in the manifest; keys need not
+// exist to be pinned.
+func (db *DB) Pin(key []byte) error {
+	return db.updatePins(key, true)
+}
+
+// Unpin releases a hold placed by Pin. Unpinning a key that isn't pinned
+// does nothing.
+func (db *DB) Unpin(key []byte) error {
+	return db.updatePins(key, false)
+}
+
+// IsPinned returns true if key is pinned.
+func (db *DB) IsPinned(key []byte) (bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return false, ErrDatabaseClosed
+	}
+	key, err := db.encodeKey(key)
+	if err != nil {
+		return false, err
+	}
+	return db.manifest.pinned(db.opts.hashFunc(key)), nil
+}
+
+func (db *DB) updatePins(key []byte, pin bool) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	key, err := db.encodeKey(key)
+	if err != nil {
+		return err
+	}
+	hashKey := db.opts.hashFunc(key)
+	pins := db.manifest.Pinned
+	i := sort.Search(len(pins), func(i int) bool { return pins[i] >= hashKey })
+	found := i < len(pins) && pins[i] == hashKey
+	switch {
+	case pin && !found:
+		pins = append(pins, 0)
+		copy(pins[i+1:], pins[i:])
+		pins[i] = hashKey
+	case !pin && found:
+		pins = append(pins[:i], pins[i+1:]...)
+	default:
+		return nil
+	}
+	db.manifest.Pinned = pins
+	return db.saveManifest()
+}
+
+// pinned returns true if the key with the given hash is pinned.
+func (m *Manifest) pinned(hashKey uint64) bool {
+	i := sort.Search(len(m.Pinned), func(i int) bool { return m.Pinned[i] >= hashKey })
+	return i < len(m.Pinned) && m.Pinned[i] == hashKey
+}
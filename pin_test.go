@@ -0,0 +1,35 @@
+package archivedb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_Pin(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+
+	for _, k := range []string{"c", "a", "b", "a"} {
+		require.NoError(db.Pin([]byte(k)))
+	}
+	require.Len(db.manifest.Pinned, 3)
+	require.NoError(db.Unpin([]byte("b")))
+	require.NoError(db.Unpin([]byte("x")))
+	require.NoError(db.Close())
+
+	// Pins are persisted.
+	db, err = Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	for k, want := range map[string]bool{"a": true, "b": false, "c": true, "x": false} {
+		pinned, err := db.IsPinned([]byte(k))
+		require.NoError(err)
+		require.Equal(want, pinned, k)
+	}
+	_, err = db.IsPinned(nil)
+	require.ErrorIs(err, ErrEmptyKey)
+}
@@ -0,0 +1,176 @@
+package archivedb
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultBackgroundWorkers is how many goroutines run background work,
+// such as preparing standby segments, by default.
+const DefaultBackgroundWorkers = 2
+
+// workerPool runs tasks on at most n goroutines. Workers are started as
+// tasks are queued and exit once the queue is empty, so an idle pool holds
+// no goroutines. Queuing never blocks. Jobs queued by every take db.mu, so
+// nothing holding db.mu may wait for a task to finish.
+type workerPool struct {
+	mu      sync.Mutex
+	n       int
+	running int
+	queue   []func()
+	idle    sync.Cond // signalled when the last worker exits
+}
+
+func newWorkerPool(n int) *workerPool {
+	p := &workerPool{n: n}
+	p.idle.L = &p.mu
+	return p
+}
+
+// Go queues task to run on a worker.
+func (p *workerPool) Go(task func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.queue = append(p.queue, task)
+	if p.running < p.n {
+		p.running++
+		go p.work()
+	}
+}
+
+func (p *workerPool) work() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.queue) > 0 {
+		task := p.queue[0]
+		p.queue[0] = nil
+		p.queue = p.queue[1:]
+		p.mu.Unlock()
+		task()
+		p.mu.Lock()
+	}
+	if p.running--; p.running == 0 {
+		p.idle.Broadcast()
+	}
+}
+
+// Wait waits until every queued task has run.
+func (p *workerPool) Wait() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.running > 0 {
+		p.idle.Wait()
+	}
+}
+
+// job is work the database runs periodically on its workers.
+type job struct {
+	interval time.Duration
+	op       string
+	fn       func() error
+	next     time.Time
+	busy     int32 // set while queued or running
+}
+
+// every schedules fn to be called every interval on a worker, once
+// startJobs is called, until Close. A tick is skipped while the previous
+// call is still queued or running. A failure raises a Warning for op,
+// unless the database is frozen, which would fail every call until it is
+// reopened.
+func (db *DB) every(interval time.Duration, op string, fn func() error) {
+	db.scheduled = append(db.scheduled, &job{interval: interval, op: op, fn: fn})
+}
+
+// startJobs starts the goroutine queuing the jobs scheduled by every on
+// the workers when they are due.
+func (db *DB) startJobs() {
+	if len(db.scheduled) == 0 {
+		return
+	}
+	db.stopJobs = make(chan struct{})
+	db.jobs.Add(1)
+	go db.runJobs(db.scheduled)
+}
+
+func (db *DB) runJobs(jobs []*job) {
+	defer db.jobs.Done()
+	now := time.Now()
+	for _, j := range jobs {
+		j.next = now.Add(j.interval)
+	}
+	timer := time.NewTimer(time.Until(nextJob(jobs)))
+	defer timer.Stop()
+	for {
+		select {
+		case <-db.stopJobs:
+			return
+		case <-timer.C:
+		}
+		now := time.Now()
+		for _, j := range jobs {
+			if now.Before(j.next) {
+				continue
+			}
+			for !j.next.After(now) {
+				j.next = j.next.Add(j.interval)
+			}
+			if atomic.CompareAndSwapInt32(&j.busy, 0, 1) {
+				db.jobs.Add(1)
+				db.background(db.runJob(j))
+			}
+		}
+		timer.Reset(time.Until(nextJob(jobs)))
+	}
+}
+
+// runJob returns the task running j once, unless Close began since it was
+// queued.
+func (db *DB) runJob(j *job) func() {
+	return func() {
+		defer db.jobs.Done()
+		defer atomic.StoreInt32(&j.busy, 0)
+		select {
+		case <-db.stopJobs:
+			return
+		default:
+		}
+		if err := j.fn(); err != nil && !errors.Is(err, ErrFrozen) {
+			db.warn(Warning{Op: j.op, Path: db.path, Err: err})
+		}
+	}
+}
+
+// background queues task on the workers, which may be shared with other
+// databases, counting it in db.tasks so Close can wait for it.
+func (db *DB) background(task func()) {
+	db.tasks.Add(1)
+	db.workers.Go(func() {
+		defer db.tasks.Done()
+		task()
+	})
+}
+
+// nextJob returns when the first of jobs is due.
+func nextJob(jobs []*job) time.Time {
+	next := jobs[0].next
+	for _, j := range jobs[1:] {
+		if j.next.Before(next) {
+			next = j.next
+		}
+	}
+	return next
+}
+
+// stopBackgroundJobs stops queuing the jobs scheduled by every and waits
+// for those queued to finish or be skipped.
+func (db *DB) stopBackgroundJobs() {
+	db.stoppingJobs.Do(func() {
+		if db.stopJobs != nil {
+			close(db.stopJobs)
+		}
+	})
+	db.jobs.Wait()
+}
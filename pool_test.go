@@ -0,0 +1,128 @@
+package archivedb
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkerPool(t *testing.T) {
+	require := require.New(t)
+	p := newWorkerPool(2)
+
+	var running, max, done int32
+	release := make(chan struct{})
+	var started sync.WaitGroup
+	started.Add(2)
+	for i := 0; i < 10; i++ {
+		p.Go(func() {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(&max)
+				if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+					break
+				}
+			}
+			if atomic.AddInt32(&done, 1) <= 2 {
+				started.Done()
+			}
+			<-release
+			atomic.AddInt32(&running, -1)
+		})
+	}
+	started.Wait()
+	close(release)
+	p.Wait()
+	require.Equal(int32(10), done)
+	require.Equal(int32(2), max)
+
+	// The pool starts workers again once idle.
+	ran := false
+	p.Go(func() { ran = true })
+	p.Wait()
+	require.True(ran)
+}
+
+func TestBackgroundWorkersOption(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	_, err := Open(dir, BackgroundWorkersOption(0))
+	require.Error(err)
+
+	db, err := Open(dir, BackgroundWorkersOption(1), PreallocateOption(1e-9))
+	require.NoError(err)
+	defer db.Close()
+	require.NoError(db.Put([]byte("a"), []byte("1")))
+	require.NotNil(db.standby)
+	mustRollover(t, db)
+	require.Equal(uint32(1), db.activeSegment().ID())
+	require.ErrorIs(db.SetOption(BackgroundWorkersOption(4)), ErrImmutableOption)
+}
+
+func TestBackgroundWorkersOption_Jobs(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	clock := newFakeClock()
+	expired := make(chan string, 4)
+	db, err := Open(dir, BackgroundWorkersOption(1), ClockOption(clock), PurgeIntervalOption(time.Millisecond),
+		OnExpireOption(func(key []byte) { expired <- string(key) }))
+	require.NoError(err)
+	defer db.Close()
+
+	// The purge job waits for the only worker.
+	release := make(chan struct{})
+	db.workers.Go(func() { <-release })
+	require.NoError(db.PutWithTTL([]byte("foo"), []byte("bar"), time.Minute))
+	clock.Add(time.Minute)
+	select {
+	case key := <-expired:
+		t.Fatalf("%s purged while the worker was busy", key)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case key := <-expired:
+		require.Equal("foo", key)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expired key not purged")
+	}
+}
+
+func TestBackgroundWorkersOption_JobsAndStandby(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	db, err := Open(dir, BackgroundWorkersOption(1), PurgeIntervalOption(time.Millisecond), PreallocateOption(1e-9))
+	require.NoError(err)
+	defer db.Close()
+
+	// Jobs waiting for the write lock must not hold up rollovers waiting
+	// for the standby segment queued behind them.
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 20; i++ {
+			if err := db.Put([]byte("a"), []byte("1")); err != nil {
+				done <- err
+				return
+			} else if _, err := db.SealActiveSegment(); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		require.NoError(err)
+	case <-time.After(30 * time.Second):
+		t.Fatal("rollovers blocked behind background jobs")
+	}
+}
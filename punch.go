@@ -0,0 +1,343 @@
+package archivedb
+
+import (
+	"fmt"
+	"hash/crc32"
+	"os"
+
+	"github.com/millken/archivedb/format"
+	"github.com/pkg/errors"
+)
+
+// ErrHolesUnsupported is returned by PunchHoles when the platform or the
+// filesystem can't punch holes in files.
+var ErrHolesUnsupported = errors.New("punching holes is not supported")
+
+const (
+	// minHoleSize is the smallest run of dead entries PunchHoles replaces
+	// with a hole; smaller runs free too few blocks to be worth a write.
+	minHoleSize = 64 << 10
+	// holePageSize is the granularity holes are punched at.
+	holePageSize = 4096
+)
+
+// PunchHoles frees the space of dead entries in sealed segments without
+// rewriting them, on filesystems that can punch holes in files, such as
+// ext4, XFS and Btrfs on Linux. Every run of at least 64 KiB of entries
+// no key refers to anymore, chunks of live values aside, is replaced by a
+// single hole entry whose zeroed value is given back to the filesystem;
+// the file keeps its size and the live entries keep their offsets, so no
+// index records are written. Tombstones are kept. It returns the number of
+// holes made and the bytes freed.
+//
+// PunchHoles is cheaper than Compact, which it doesn't replace: Compact
+// still drops tombstones and expired values, and empties a segment whose
+// dead entries are scattered among live ones. Holes are not counted as
+// dead space by PlanCompaction. Segments held by a SegmentRef or a
+// backup, detached segments and the active segment are skipped. The
+// database is locked for writes while PunchHoles runs. Values returned by
+// Get from the punched segments must not be used after PunchHoles
+// returns, and backups taken before no longer pass VerifyBackups.
+//
+// The checksum of a segment is recorded again once its holes are made;
+// if PunchHoles is interrupted, Open finishes the segment. It returns
+// ErrHolesUnsupported, after keeping any segment it started on
+// consistent, if holes can't be punched.
+func (db *DB) PunchHoles() (holes int, reclaimed int64, err error) {
+	db.lockFor(lockWrite)
+	defer db.mu.Unlock()
+	if err := db.checkWritable(); err != nil {
+		return 0, 0, err
+	} else if db.merkle != nil {
+		return 0, 0, errors.New("holes can't be punched with the merkle log enabled")
+	} else if !canPunchHoles {
+		return 0, 0, ErrHolesUnsupported
+	}
+	live, err := db.liveOffsets()
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, s := range db.segments[:len(db.segments)-1] {
+		sc, ok := db.manifest.sealed(s.ID())
+		if !ok || s.offline() || !sc.counted() || db.segmentRefs[s.ID()] > 0 {
+			continue
+		}
+		runs, err := deadRuns(s, live[s.ID()])
+		if err != nil {
+			return holes, reclaimed, errors.Wrapf(err, "punch segment %s", segmentFilename(s.ID()))
+		} else if len(runs) == 0 {
+			continue
+		}
+		n, err := db.punchSegment(s, runs)
+		reclaimed += n
+		if err != nil {
+			return holes, reclaimed, errors.Wrapf(err, "punch segment %s", segmentFilename(s.ID()))
+		}
+		holes += len(runs)
+		db.event(EventCompaction, fmt.Sprintf("punched %d holes in segment %d, reclaiming %d bytes", len(runs), s.ID(), n), s.path, nil)
+	}
+	return holes, reclaimed, nil
+}
+
+// liveOffsets returns the offsets, by segment, of the entries the index
+// refers to, of the chunks of live values, of the entries live values are
+// deltas of and of the dictionaries they are compressed with. Keys whose
+// index records are appended but not yet published, or removed but not yet
+// persisted, are counted as they are in the index file as well. The caller
+// must hold db.mu.
+func (db *DB) liveOffsets() (map[uint32]map[uint32]bool, error) {
+	live := make(map[uint32]map[uint32]bool)
+	mark := func(id, off uint32) bool {
+		if live[id] == nil {
+			live[id] = make(map[uint32]bool)
+		} else if live[id][off] {
+			return false
+		}
+		live[id][off] = true
+		return true
+	}
+	visit := func(_ uint64, it item) error {
+		if !mark(it.ID(), it.Offset()) {
+			return nil
+		}
+		s := db.segment(it.ID())
+		if s == nil && db.segmentMissing(it.ID()) {
+			return nil
+		} else if s == nil {
+			return ErrSegmentNotFound
+		} else if s.detached {
+			return nil
+		}
+		hdr, err := s.ReadEntryHeader(it.Offset())
+		if err != nil {
+			return err
+		} else if hdr.Codec() == dictionaryCodecID {
+			// The value needs the dictionary of its segment.
+			mark(s.ID(), SegmentHeaderSize)
+		}
+		if hdr.Attrs&format.AttrChunked != 0 {
+			return db.chunkUsage(s, it.Offset(), func(ref format.ChunkRef, _ int64) error {
+				mark(ref.Segment, ref.Offset)
+				return nil
+			})
+		}
+		// Values stored as deltas need the entries they are deltas of.
+		for off := it.Offset(); hdr.Codec() == deltaCodecID; {
+			e, err := s.ReadEntry(off)
+			if err != nil {
+				return err
+			} else if e.prev.ID() != s.ID() || !mark(s.ID(), e.prev.Offset()) {
+				return nil
+			}
+			off = e.prev.Offset()
+			if hdr, err = s.ReadEntryHeader(off); err != nil {
+				return err
+			} else if hdr.Codec() == dictionaryCodecID {
+				mark(s.ID(), SegmentHeaderSize)
+			}
+		}
+		return nil
+	}
+	items, err := db.index.Persisted()
+	if err != nil {
+		return nil, err
+	}
+	for k, it := range items {
+		if err := visit(k, it); err != nil {
+			return nil, err
+		}
+	}
+	return live, db.index.ForEach(visit)
+}
+
+// hole is a run of dead entries in a segment.
+type hole struct {
+	off, size uint32
+	entries   int64 // entries written in the run
+	parts     int   // entries and holes making up the run
+	punched   bool  // the run is a single hole
+}
+
+// deadRuns returns the runs of at least minHoleSize bytes of entries of s
+// whose offsets aren't in live, tombstones excepted. A run that is already
+// a single hole is left out.
+func deadRuns(s *segment, live map[uint32]bool) ([]hole, error) {
+	var runs []hole
+	var run hole
+	end := func() {
+		if run.size >= minHoleSize && !(run.parts == 1 && run.punched) {
+			runs = append(runs, run)
+		}
+		run = hole{}
+	}
+	for off := uint32(SegmentHeaderSize); off < s.Size(); {
+		hdr, err := s.ReadEntryHeader(off)
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Flag == EntryDeleteFlag || live[off] {
+			end()
+		} else {
+			if run.parts == 0 {
+				run.off = off
+			}
+			run.size += hdr.EntrySize()
+			run.entries += hdr.Entries()
+			run.parts++
+			run.punched = hdr.Flag == EntryHoleFlag
+		}
+		off += hdr.EntrySize()
+	}
+	end()
+	return runs, nil
+}
+
+// punchSegment replaces the runs of dead entries in the sealed segment s
+// with holes and returns the bytes freed. The hole entries are written and
+// synced first, so the segment can be read whatever happens to their
+// values. The caller must hold db.mu.
+func (db *DB) punchSegment(s *segment, runs []hole) (int64, error) {
+	if err := db.recordHoles(s, true); err != nil {
+		return 0, err
+	}
+	for _, r := range runs {
+		n := r.size - EntryHeaderSize
+		hdr := EntryHeader{ValueSize: n, Checksum: zeroChecksum(n), Flag: EntryHoleFlag, Tag: uint32(r.entries)}
+		if _, err := s.mmap.WriteAt(hdr.Encode(), int64(r.off)); err != nil {
+			return 0, db.degrade(err)
+		}
+	}
+	if err := db.flushSegment(s); err != nil {
+		return 0, err
+	}
+	reclaimed, err := clearHoles(s)
+	if err != nil && err != ErrHolesUnsupported {
+		return reclaimed, err
+	} else if rerr := db.recordHoles(s, false); rerr != nil {
+		return reclaimed, rerr
+	}
+	return reclaimed, err
+}
+
+// clearHoles zeroes the values of the hole entries of s, punching the
+// pages they cover out of the file, and returns the bytes punched. Where
+// holes can't be punched the values are zeroed in place, and
+// ErrHolesUnsupported is returned once they all are.
+func clearHoles(s *segment) (reclaimed int64, err error) {
+	f, err := os.OpenFile(s.path, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var unsupported bool
+	for off := uint32(SegmentHeaderSize); off < s.Size(); {
+		hdr, err := s.ReadEntryHeader(off)
+		if err != nil {
+			return reclaimed, err
+		}
+		start, end := off+EntryHeaderSize, off+hdr.EntrySize()
+		off = end
+		if hdr.Flag != EntryHoleFlag {
+			continue
+		}
+		from := (start + holePageSize - 1) / holePageSize * holePageSize
+		to := end / holePageSize * holePageSize
+		if from < to && !unsupported {
+			err := punchHole(f, int64(from), int64(to-from))
+			if err == ErrHolesUnsupported {
+				unsupported = true
+			} else if err != nil {
+				return reclaimed, err
+			} else {
+				reclaimed += int64(to - from)
+			}
+		}
+		if from >= to || unsupported {
+			from, to = end, end
+		}
+		if err := s.zero(start, from); err != nil {
+			return reclaimed, err
+		} else if err := s.zero(to, end); err != nil {
+			return reclaimed, err
+		}
+	}
+	if err := s.Flush(); err != nil {
+		return reclaimed, err
+	} else if unsupported {
+		return reclaimed, ErrHolesUnsupported
+	}
+	return reclaimed, nil
+}
+
+// recordHoles marks the manifest entry of s while its holes are being
+// punched, or records its new checksum and the size of its holes once
+// they are, and saves the manifest. The caller must hold db.mu.
+func (db *DB) recordHoles(s *segment, punching bool) error {
+	var punched int64
+	var sum uint32
+	if !punching {
+		var err error
+		if sum, err = s.Checksum(); err != nil {
+			return err
+		}
+		for off := uint32(SegmentHeaderSize); off < s.Size(); {
+			hdr, err := s.ReadEntryHeader(off)
+			if err != nil {
+				return err
+			} else if hdr.Flag == EntryHoleFlag {
+				punched += int64(hdr.EntrySize())
+			}
+			off += hdr.EntrySize()
+		}
+	}
+	if punching {
+		db.manifest.Reclaimed = db.watermark()
+	}
+	for i := range db.manifest.Segments {
+		if sc := &db.manifest.Segments[i]; sc.ID == s.ID() {
+			sc.Punching = punching
+			if !punching {
+				sc.Checksum, sc.Punched = sum, punched
+			}
+		}
+	}
+	return db.saveManifest()
+}
+
+// finishPunching clears the holes of segments PunchHoles was interrupted
+// on and records their checksums.
+func (db *DB) finishPunching() error {
+	if db.opts.readOnly {
+		return nil
+	}
+	for _, sc := range db.manifest.Segments {
+		s := db.segment(sc.ID)
+		if !sc.Punching || sc.Detached || s == nil {
+			continue
+		}
+		if _, err := clearHoles(s); err != nil && err != ErrHolesUnsupported {
+			return err
+		} else if err := db.recordHoles(s, false); err != nil {
+			return err
+		}
+		db.event(EventRecovery, "finished interrupted hole punching", s.path, nil)
+	}
+	return nil
+}
+
+// zeroChecksum returns the CRC-32C of n zero bytes, the checksum of a
+// hole entry.
+func zeroChecksum(n uint32) uint32 {
+	var zeros [holePageSize]byte
+	var sum uint32
+	for n > 0 {
+		m := n
+		if m > holePageSize {
+			m = holePageSize
+		}
+		sum = crc32.Update(sum, CastagnoliCrcTable, zeros[:m])
+		n -= m
+	}
+	return sum
+}
@@ -0,0 +1,166 @@
+package archivedb
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// mustPunchHoles calls PunchHoles, skipping the test where holes can't be
+// punched.
+func mustPunchHoles(t *testing.T, db *DB) (int, int64) {
+	holes, reclaimed, err := db.PunchHoles()
+	if err == ErrHolesUnsupported {
+		t.Skip(err)
+	}
+	require.NoError(t, err)
+	return holes, reclaimed
+}
+
+func TestDB_PunchHoles(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+
+	value := bytes.Repeat([]byte("x"), 1024)
+	require.NoError(db.Put([]byte("first"), []byte("1")))
+	require.NoError(db.Put([]byte("gone"), value))
+	for i := 0; i < 100; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("a%d", i)), value))
+	}
+	// The tombstone ends the first run of dead entries.
+	require.NoError(db.Delete([]byte("gone")))
+	for i := 0; i < 100; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("b%d", i)), value))
+	}
+	require.NoError(db.Put([]byte("last"), []byte("2")))
+	mustRollover(t, db)
+	for i := 0; i < 100; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("a%d", i)), []byte("new")))
+		require.NoError(db.Put([]byte(fmt.Sprintf("b%d", i)), []byte("new")))
+	}
+
+	seqs := func() map[string]uint64 {
+		m := make(map[string]uint64)
+		require.NoError(db.ForEachRaw(EntryFilter{}, func(e RawEntry) error {
+			m[fmt.Sprintf("%s@%d", e.Key, e.Segment)] = e.Seq
+			return nil
+		}))
+		return m
+	}
+	before := seqs()
+	plan, err := db.PlanCompaction()
+	require.NoError(err)
+	require.Len(plan.Segments, 1)
+	dead := plan.ReclaimableBytes
+
+	holes, reclaimed := mustPunchHoles(t, db)
+	require.Equal(2, holes)
+	require.Greater(reclaimed, int64(180*1024))
+	require.Less(reclaimed, dead)
+	holes, _ = mustPunchHoles(t, db)
+	require.Zero(holes)
+
+	check := func(db *DB) {
+		for key, want := range map[string]string{"first": "1", "last": "2", "a5": "new", "b99": "new"} {
+			v, err := db.Get([]byte(key))
+			require.NoError(err, key)
+			require.Equal(want, string(v), key)
+		}
+		_, err := db.Get([]byte("gone"))
+		require.Error(err)
+		report, err := db.Verify(nil)
+		require.NoError(err)
+		require.Empty(report.Corrupt)
+	}
+	check(db)
+
+	// Punched entries are gone from the log but keep their sequence numbers.
+	after := seqs()
+	require.Len(after, len(before)-200)
+	for _, key := range []string{"first@0", "gone@0", "last@0", "a0@1", "b99@1"} {
+		require.Equal(before[key], after[key], key)
+	}
+	require.Equal(db.Seq(), after["b99@1"])
+
+	// The holes are no longer dead space to compact, leaving only the
+	// tombstone.
+	plan, err = db.PlanCompaction()
+	require.NoError(err)
+	require.Empty(plan.Segments)
+
+	require.NoError(db.Close())
+	db, err = Open(dir, CompactionRatioOption(0.1))
+	require.NoError(err)
+	defer db.Close()
+	check(db)
+	require.NoError(db.VerifyBackups(dir))
+	plan, err = db.PlanCompaction()
+	require.NoError(err)
+	require.Len(plan.Segments, 1)
+	require.Less(plan.ReclaimableBytes, int64(100))
+	require.NoError(db.Compact())
+	check(db)
+}
+
+func TestDB_PunchHoles_Interrupted(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+
+	value := bytes.Repeat([]byte("x"), 1024)
+	for i := 0; i < 100; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("k%d", i)), value))
+	}
+	require.NoError(db.Put([]byte("live"), []byte("1")))
+	mustRollover(t, db)
+	for i := 0; i < 100; i++ {
+		require.NoError(db.Delete([]byte(fmt.Sprintf("k%d", i))))
+	}
+	if !canPunchHoles {
+		t.Skip(ErrHolesUnsupported)
+	}
+
+	// Write the hole entry as PunchHoles does, and stop before its value
+	// is cleared.
+	db.mu.Lock()
+	s := db.segments[0]
+	require.NoError(db.recordHoles(s, true))
+	live, err := db.liveOffsets()
+	require.NoError(err)
+	runs, err := deadRuns(s, live[0])
+	require.NoError(err)
+	require.Len(runs, 1)
+	n := runs[0].size - EntryHeaderSize
+	hdr := EntryHeader{ValueSize: n, Checksum: zeroChecksum(n), Flag: EntryHoleFlag, Tag: uint32(runs[0].entries)}
+	_, err = s.mmap.WriteAt(hdr.Encode(), int64(runs[0].off))
+	require.NoError(err)
+	require.NoError(s.Flush())
+	db.mu.Unlock()
+	report, err := db.Verify(nil)
+	require.NoError(err)
+	require.NotEmpty(report.Corrupt)
+	require.NoError(db.Close())
+
+	db, err = Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	sc, ok := db.manifest.sealed(0)
+	require.True(ok)
+	require.False(sc.Punching)
+	require.Equal(int64(runs[0].size), sc.Punched)
+	report, err = db.Verify(nil)
+	require.NoError(err)
+	require.Empty(report.Corrupt)
+	v, err := db.Get([]byte("live"))
+	require.NoError(err)
+	require.Equal("1", string(v))
+}
@@ -0,0 +1,22 @@
+package archivedb
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// canPunchHoles is true if punchHole is implemented on this platform.
+const canPunchHoles = true
+
+// punchHole deallocates the size bytes at off in f, which then read as
+// zeros, without changing its size. It returns ErrHolesUnsupported if the
+// filesystem can't.
+func punchHole(f *os.File, off, size int64) error {
+	err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, off, size)
+	if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOSYS) {
+		return ErrHolesUnsupported
+	}
+	return err
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package archivedb
+
+import "os"
+
+// canPunchHoles is true if punchHole is implemented on this platform.
+const canPunchHoles = false
+
+// punchHole reports that holes can't be punched on this platform.
+func punchHole(f *os.File, off, size int64) error {
+	return ErrHolesUnsupported
+}
@@ -0,0 +1,79 @@
+package archivedb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// QuarantineDir is the subdirectory unexpected files are moved into.
+	QuarantineDir = "quarantine"
+	// QuarantineReport is the file inside QuarantineDir listing moved files.
+	QuarantineReport = "REPORT"
+)
+
+// isReservedFilename returns true for names owned by the database that are
+// not segments.
+func isReservedFilename(name string) bool {
+	switch name {
+	case "index", ManifestFileName, MerkleLogFileName, StandbySegmentName, QuarantineDir, LockFileName:
+		return true
+	default:
+		return false
+	}
+}
+
+// quarantineFile moves name out of dir into the quarantine subdirectory and
+// appends the reason to the quarantine report.
+func quarantineFile(dir, name string, reason error) error {
+	target, err := quarantineTarget(dir, name)
+	if err != nil {
+		return err
+	} else if err := os.Rename(filepath.Join(dir, name), target); err != nil {
+		return err
+	}
+	return appendQuarantineReport(target, reason)
+}
+
+// quarantineData writes data to a file called name in the quarantine
+// subdirectory of dir and appends the reason to the quarantine report.
+func quarantineData(dir, name string, data []byte, reason error) error {
+	target, err := quarantineTarget(dir, name)
+	if err != nil {
+		return err
+	} else if err := ioutil.WriteFile(target, data, 0644); err != nil {
+		return err
+	}
+	return appendQuarantineReport(target, reason)
+}
+
+// quarantineTarget creates the quarantine subdirectory of dir and returns
+// the path to move name to, suffixed if it is taken.
+func quarantineTarget(dir, name string) (string, error) {
+	qdir := filepath.Join(dir, QuarantineDir)
+	if err := os.MkdirAll(qdir, 0777); err != nil {
+		return "", err
+	}
+	target := filepath.Join(qdir, name)
+	if _, err := os.Lstat(target); err == nil {
+		target = fmt.Sprintf("%s.%d", target, time.Now().UnixNano())
+	}
+	return target, nil
+}
+
+// appendQuarantineReport appends the reason target was quarantined to the
+// quarantine report next to it.
+func appendQuarantineReport(target string, reason error) error {
+	f, err := os.OpenFile(filepath.Join(filepath.Dir(target), QuarantineReport), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%s\t%s\t%s\n", time.Now().UTC().Format(time.RFC3339), filepath.Base(target), reason); err != nil {
+		return err
+	}
+	return f.Close()
+}
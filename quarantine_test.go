@@ -0,0 +1,97 @@
+package archivedb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpen_UnexpectedFile(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("hello"), 0644))
+	db, err := Open(dir)
+	require.ErrorIs(err, ErrUnexpectedFile)
+	require.Nil(db)
+
+	require.NoError(os.Remove(filepath.Join(dir, "notes.txt")))
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "0001"), []byte("ArS"), 0644))
+	_, err = Open(dir)
+	require.ErrorIs(err, ErrUnexpectedFile)
+	require.Contains(err.Error(), "0001")
+}
+
+func TestOpen_Quarantine(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("hello"), 0644))
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "0001"), []byte("NotASegment"), 0644))
+	db, err := Open(dir, QuarantineOption(true))
+	require.NoError(err)
+	require.NoError(db.Put([]byte("foo"), []byte("bar")))
+	require.NoError(db.Close())
+
+	for _, name := range []string{"notes.txt", "0001"} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		require.True(os.IsNotExist(err))
+		_, err = os.Stat(filepath.Join(dir, QuarantineDir, name))
+		require.NoError(err)
+	}
+	report, err := ioutil.ReadFile(filepath.Join(dir, QuarantineDir, QuarantineReport))
+	require.NoError(err)
+	require.Equal(2, strings.Count(string(report), "\n"))
+	require.Contains(string(report), "invalid magic")
+
+	db, err = Open(dir)
+	require.NoError(err)
+	v, err := db.Get([]byte("foo"))
+	require.NoError(err)
+	require.Equal([]byte("bar"), v)
+	require.NoError(db.Close())
+}
+
+func TestOpen_QuarantineMiddleSegment(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	db, err := Open(dir)
+	require.NoError(err)
+	for i, key := range []string{"k0", "k1", "k2"} {
+		if i > 0 {
+			_, err := db.SealActiveSegment()
+			require.NoError(err)
+		}
+		require.NoError(db.Put([]byte(key), []byte("v"+key)))
+	}
+	require.NoError(db.Close())
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, segmentFilename(1)), []byte("NotASegment"), 0644))
+
+	for i := 0; i < 2; i++ {
+		db, err = Open(dir, QuarantineOption(true))
+		require.NoError(err)
+		v, err := db.Get([]byte("k0"))
+		require.NoError(err)
+		require.Equal([]byte("vk0"), v)
+		_, err = db.Get([]byte("k1"))
+		require.Error(err)
+		require.NotErrorIs(err, ErrKeyMismatch)
+		v, err = db.Get([]byte("k2"))
+		require.NoError(err)
+		require.Equal([]byte("vk2"), v)
+
+		require.NoError(db.Put([]byte("k3"), []byte("vk3")))
+		v, err = db.Get([]byte("k3"))
+		require.NoError(err)
+		require.Equal([]byte("vk3"), v)
+		require.NoError(db.Close())
+	}
+}
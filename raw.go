@@ -0,0 +1,155 @@
+package archivedb
+
+import "time"
+
+// EntryFilter selects the entries visited by ForEachRaw. Zero fields don't
+// filter.
+type EntryFilter struct {
+	// Flag selects entries with this flag, EntryInsertFlag or
+	// EntryDeleteFlag.
+	Flag uint8
+	// MinSeq and MaxSeq bound the sequence numbers of entries, inclusive.
+	// A zero MaxSeq is unbounded.
+	MinSeq, MaxSeq uint64
+	// Since and Until bound when entries were written. Entries carry no
+	// timestamps, so this selects whole segments: those that were active
+	// at some point in [Since, Until). A zero time is unbounded.
+	Since, Until time.Time
+	// Segments restricts the walk to the segments with these ids.
+	Segments []uint32
+}
+
+// RawEntry is an entry visited by ForEachRaw.
+type RawEntry struct {
+	// Seq is the position of the entry in the database's write history,
+	// as in AuditRecord.Seq.
+	Seq     uint64
+	Segment uint32
+	Offset  uint32
+	Header  EntryHeader
+	Key     []byte
+	Value   []byte
+	// Expires is when the value expires, or zero if it doesn't.
+	Expires time.Time
+}
+
+// ForEachRaw calls fn for every entry written to the database that passes
+// filter, in write order, including overwritten entries and tombstones.
+// Segments the filter rules out are skipped without being read. Keys are
+// decoded with the key transform and values decompressed, but values
+// aren't verified. The chunks of chunked values take sequence numbers but
+// aren't visited; the entry listing them has the whole value. Key and
+// Value are only valid during the call, and fn must not modify the
+// database. Detached segments are skipped.
+func (db *DB) ForEachRaw(filter EntryFilter, fn func(e RawEntry) error) error {
+	return db.forEachRaw(filter, func(raw RawEntry, e *entry) error {
+		if err := db.decodeValue(e); err != nil {
+			return err
+		}
+		raw.Value = e.data
+		return fn(raw)
+	})
+}
+
+// forEachRaw is ForEachRaw for callers that decode the values they need
+// themselves: raw has no Value, and e is the entry it was read from, with
+// its value still encoded.
+func (db *DB) forEachRaw(filter EntryFilter, fn func(raw RawEntry, e *entry) error) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return ErrDatabaseClosed
+	}
+
+	var segments map[uint32]bool
+	if filter.Segments != nil {
+		segments = make(map[uint32]bool, len(filter.Segments))
+		for _, id := range filter.Segments {
+			segments[id] = true
+		}
+	}
+	var seq uint64
+	for i, s := range db.segments {
+		// Entries removed by Compact keep their sequence numbers.
+		sc, _ := db.manifest.sealed(s.ID())
+		seq += uint64(sc.Compacted)
+		first := seq + 1
+		if s.offline() {
+			seq += uint64(sc.Entries)
+			continue
+		}
+		seq += uint64(s.stats.Entries)
+		if (segments != nil && !segments[s.ID()]) || seq < filter.MinSeq ||
+			(filter.MaxSeq != 0 && first > filter.MaxSeq) || !db.segmentActiveDuring(i, filter.Since, filter.Until) {
+			continue
+		}
+		if err := s.sequentially(func() error {
+			return db.forEachRawInSegment(s, first, filter, fn)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forEachRawInSegment calls fn for the entries of s that pass filter. first
+// is the sequence number of the segment's first entry.
+func (db *DB) forEachRawInSegment(s *segment, first uint64, filter EntryFilter, fn func(raw RawEntry, e *entry) error) error {
+	seq := first
+	for off := uint32(SegmentHeaderSize); off < s.Size(); seq++ {
+		e, err := s.ReadEntry(off)
+		if err != nil {
+			return err
+		}
+		entryOff := off
+		off += e.Size()
+		if e.hdr.Flag == EntryHoleFlag {
+			seq += uint64(e.hdr.Entries()) - 1
+			continue
+		} else if seq < filter.MinSeq || e.hdr.Flag == EntryChunkFlag || (filter.Flag != 0 && e.hdr.Flag != filter.Flag) {
+			continue
+		} else if filter.MaxSeq != 0 && seq > filter.MaxSeq {
+			return nil
+		}
+		raw := RawEntry{
+			Seq:     seq,
+			Segment: s.ID(),
+			Offset:  entryOff,
+			Header:  e.hdr,
+			Key:     db.decodeKey(e.key),
+		}
+		if e.expires != 0 {
+			raw.Expires = time.Unix(0, e.expires)
+		}
+		if err := fn(raw, &e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// segmentActiveDuring returns true if the segment at position i of
+// db.segments may hold entries written in [since, until). A segment is
+// active from when the one before it was sealed until it was sealed
+// itself; segments sealed before seal times were recorded are always
+// included. The caller must hold db.mu.
+func (db *DB) segmentActiveDuring(i int, since, until time.Time) bool {
+	if since.IsZero() && until.IsZero() {
+		return true
+	}
+	var start time.Time
+	if i == 0 {
+		start = db.manifest.Created
+	} else if sc, ok := db.manifest.sealed(db.segments[i-1].ID()); ok {
+		start = sc.Sealed
+	}
+	end := db.now()
+	if i < len(db.segments)-1 {
+		sc, _ := db.manifest.sealed(db.segments[i].ID())
+		end = sc.Sealed
+	}
+	if end.IsZero() {
+		return true
+	}
+	return (since.IsZero() || !end.Before(since)) && (until.IsZero() || start.Before(until))
+}
@@ -0,0 +1,76 @@
+package archivedb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_ForEachRaw(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	clock := newFakeClock()
+	db, err := Open(dir, ClockOption(clock))
+	require.NoError(err)
+	defer db.Close()
+
+	start := clock.Now()
+	require.NoError(db.Put([]byte("a"), []byte("1")))
+	require.NoError(db.Put([]byte("b"), []byte("2")))
+	clock.Add(time.Hour)
+	mustRollover(t, db)
+	require.NoError(db.Delete([]byte("a")))
+	require.NoError(db.Put([]byte("c"), []byte("3")))
+	clock.Add(time.Hour)
+	mustRollover(t, db)
+	require.NoError(db.Put([]byte("d"), []byte("4")))
+	clock.Add(time.Hour)
+
+	collect := func(filter EntryFilter) (seqs []uint64, keys []string) {
+		require.NoError(db.ForEachRaw(filter, func(e RawEntry) error {
+			seqs = append(seqs, e.Seq)
+			keys = append(keys, string(e.Key))
+			return nil
+		}))
+		return seqs, keys
+	}
+
+	seqs, keys := collect(EntryFilter{})
+	require.Equal([]uint64{1, 2, 3, 4, 5}, seqs)
+	require.Equal([]string{"a", "b", "a", "c", "d"}, keys)
+
+	seqs, _ = collect(EntryFilter{Flag: EntryDeleteFlag})
+	require.Equal([]uint64{3}, seqs)
+	seqs, _ = collect(EntryFilter{Flag: EntryInsertFlag, MinSeq: 2, MaxSeq: 4})
+	require.Equal([]uint64{2, 4}, seqs)
+	seqs, _ = collect(EntryFilter{Segments: []uint32{1, 2}})
+	require.Equal([]uint64{3, 4, 5}, seqs)
+	seqs, _ = collect(EntryFilter{Segments: []uint32{}})
+	require.Empty(seqs)
+
+	// Time filters select the segments active during the range.
+	seqs, _ = collect(EntryFilter{Until: start.Add(30 * time.Minute)})
+	require.Equal([]uint64{1, 2}, seqs)
+	seqs, _ = collect(EntryFilter{Since: start.Add(90 * time.Minute)})
+	require.Equal([]uint64{3, 4, 5}, seqs)
+	seqs, _ = collect(EntryFilter{Since: start.Add(150 * time.Minute)})
+	require.Equal([]uint64{5}, seqs)
+	seqs, _ = collect(EntryFilter{Since: start.Add(4 * time.Hour)})
+	require.Empty(seqs)
+
+	var raw RawEntry
+	require.NoError(db.ForEachRaw(EntryFilter{MinSeq: 4, MaxSeq: 4}, func(e RawEntry) error {
+		raw = e
+		return nil
+	}))
+	require.Equal(uint32(1), raw.Segment)
+	require.Equal(uint32(SegmentHeaderSize+EntryHeaderSize+1), raw.Offset)
+	require.Equal([]byte("3"), raw.Value)
+	require.Equal(EntryInsertFlag, raw.Header.Flag)
+
+	require.NoError(db.Close())
+	require.ErrorIs(db.ForEachRaw(EntryFilter{}, nil), ErrDatabaseClosed)
+}
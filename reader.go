@@ -0,0 +1,217 @@
+package archivedb
+
+import (
+	"hash/crc32"
+	"io"
+	"os"
+	"runtime/debug"
+
+	"github.com/millken/archivedb/format"
+)
+
+// GetReader returns a reader of the value of key and its size. Values
+// stored as written are read straight from the segment mapping, without
+// copying them to the heap first, and checked against their checksum as
+// they are read: the reader returns ErrChecksumFailed instead of io.EOF if
+// they don't match. Compressed or encrypted values are decoded in memory,
+// one chunk at a time for chunked values.
+//
+// The segments of the value are held as by AcquireSegmentRef until the
+// reader is closed, so compaction can't move them. Reads fail with
+// ErrDatabaseClosed once the database is closed.
+func (db *DB) GetReader(key []byte) (io.ReadCloser, int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil, 0, ErrDatabaseClosed
+	}
+	key, err := db.encodeKey(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	it, ok := db.index.Get(db.opts.hashFunc(key))
+	if !ok {
+		return nil, 0, ErrKeyNotFound
+	}
+	s := db.segment(it.ID())
+	if s == nil {
+		return nil, 0, ErrSegmentNotFound
+	}
+	e, err := s.ReadEntry(it.Offset())
+	if err != nil {
+		return nil, 0, err
+	} else if err := e.matches(key); err != nil {
+		return nil, 0, err
+	} else if e.hdr.Flag == EntryDeleteFlag {
+		return nil, 0, ErrKeyDeleted
+	} else if e.expired(db.now()) {
+		return nil, 0, ErrKeyExpired
+	}
+
+	r := &valueReader{db: db, key: key}
+	if e.hdr.Attrs&format.AttrChunked == 0 {
+		r.parts = []format.ChunkRef{{Segment: it.ID(), Offset: it.Offset(), Checksum: e.hdr.Checksum}}
+		if err := r.next(); err != nil {
+			return nil, 0, err
+		}
+		r.size = int64(len(r.buf)) + int64(r.end-r.pos)
+	} else {
+		if err := e.verify(key); err != nil {
+			return nil, 0, err
+		} else if err := db.decrypt(&e); err != nil {
+			return nil, 0, err
+		} else if err := db.decompress(&e); err != nil {
+			return nil, 0, err
+		}
+		l, err := chunkList(&e)
+		if err != nil {
+			return nil, 0, err
+		}
+		r.parts, r.chunked = l.Chunks, true
+		r.size, r.valueSum = int64(l.Size), l.Checksum
+	}
+	r.hold()
+	return r, r.size, nil
+}
+
+// valueReader reads a value part by part: the entry holding it, or its
+// chunks.
+type valueReader struct {
+	db      *DB
+	key     []byte
+	parts   []format.ChunkRef // parts not read yet
+	chunked bool
+	size    int64
+	held    []uint32 // segments held until Close
+	closed  bool
+
+	// The current part is either buf, decoded in memory, or the bytes
+	// from pos to end of the mapping of segment, checked as they are read
+	// against want, with sum the checksum so far.
+	buf      []byte
+	segment  uint32
+	pos, end int
+	sum      uint32
+	want     uint32
+
+	// read and valueSum track the whole of a chunked value.
+	read     int64
+	valueSum uint32
+	readSum  uint32
+}
+
+// hold keeps the segments of the parts from being compacted. The caller
+// must hold db.mu for writing.
+func (r *valueReader) hold() {
+	seen := make(map[uint32]bool)
+	for _, ref := range r.parts {
+		seen[ref.Segment] = true
+	}
+	if r.end > r.pos {
+		seen[r.segment] = true
+	}
+	for id := range seen {
+		r.held = append(r.held, id)
+		r.db.holdSegment(id)
+	}
+}
+
+// next makes the first of the remaining parts current. The caller must
+// hold db.mu.
+func (r *valueReader) next() error {
+	ref := r.parts[0]
+	r.parts = r.parts[1:]
+	s := r.db.segment(ref.Segment)
+	if s == nil {
+		return ErrSegmentNotFound
+	} else if s.detached {
+		return ErrSegmentDetached
+	}
+	e, err := s.ReadEntry(ref.Offset)
+	if err != nil {
+		return err
+	} else if e.hdr.Checksum != ref.Checksum || (r.chunked && e.hdr.Flag != EntryChunkFlag) {
+		return ErrInvalidChunk
+	} else if err := e.matches(r.key); err != nil {
+		return err
+	}
+	if e.hdr.Codec() != 0 || e.hdr.Attrs&format.AttrEncrypted != 0 {
+		if err := e.verify(r.key); err != nil {
+			return err
+		} else if err := r.db.decodeValue(&e); err != nil {
+			return err
+		}
+		r.buf = e.data
+		return nil
+	}
+	fields := len(e.value) - len(e.data)
+	r.segment = ref.Segment
+	r.end = int(ref.Offset) + int(e.Size())
+	r.pos = r.end - len(e.data)
+	r.sum = crc32.Checksum(e.value[:fields], CastagnoliCrcTable)
+	r.want = e.hdr.Checksum
+	return nil
+}
+
+func (r *valueReader) Read(p []byte) (n int, err error) {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+	if r.closed {
+		return 0, os.ErrClosed
+	} else if r.db.closed {
+		return 0, ErrDatabaseClosed
+	}
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer recoverFault(&err, ErrReadFault)
+
+	for len(r.buf) == 0 && r.pos == r.end {
+		if r.sum != r.want {
+			return 0, ErrChecksumFailed
+		} else if len(r.parts) == 0 {
+			if r.chunked && (r.read != r.size || r.readSum != r.valueSum) {
+				return 0, ErrChecksumFailed
+			}
+			return 0, io.EOF
+		} else if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	var b []byte
+	if len(r.buf) > 0 {
+		n = copy(p, r.buf)
+		b, r.buf = r.buf[:n], r.buf[n:]
+	} else {
+		if n = len(p); n > r.end-r.pos {
+			n = r.end - r.pos
+		}
+		s := r.db.segment(r.segment)
+		if b, err = s.mmap.ReadOff(r.pos, n); err != nil {
+			return 0, err
+		}
+		copy(p, b)
+		r.pos += n
+		r.sum = crc32.Update(r.sum, CastagnoliCrcTable, b)
+	}
+	if r.chunked {
+		r.read += int64(n)
+		r.readSum = crc32.Update(r.readSum, CastagnoliCrcTable, b)
+	}
+	return n, nil
+}
+
+// Close releases the segments of the value. Closing a closed reader does
+// nothing.
+func (r *valueReader) Close() error {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	for _, id := range r.held {
+		r.db.releaseSegment(id)
+	}
+	return nil
+}
+
+var _ io.ReadCloser = (*valueReader)(nil)
@@ -0,0 +1,136 @@
+package archivedb
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_GetReader(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+
+	value := bytes.Repeat([]byte("streamed "), 100)
+	require.NoError(db.Put([]byte("foo"), value))
+	r, size, err := db.GetReader([]byte("foo"))
+	require.NoError(err)
+	require.Equal(int64(len(value)), size)
+	b, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	require.Equal(value, b)
+
+	// The segment of the value is held until the reader is closed.
+	mustRollover(t, db)
+	require.NoError(db.Delete([]byte("foo")))
+	plan, err := db.PlanCompaction()
+	require.NoError(err)
+	require.Empty(plan.Segments)
+	require.NoError(r.Close())
+	require.NoError(r.Close())
+	_, err = r.Read(b)
+	require.ErrorIs(err, os.ErrClosed)
+	plan, err = db.PlanCompaction()
+	require.NoError(err)
+	require.NotEmpty(plan.Segments)
+
+	_, _, err = db.GetReader([]byte("foo"))
+	require.ErrorIs(err, ErrKeyDeleted)
+	_, _, err = db.GetReader([]byte("bar"))
+	require.ErrorIs(err, ErrKeyNotFound)
+
+	require.NoError(db.Put([]byte("bar"), value))
+	r, _, err = db.GetReader([]byte("bar"))
+	require.NoError(err)
+	defer r.Close()
+	require.NoError(db.Close())
+	_, err = r.Read(b)
+	require.ErrorIs(err, ErrDatabaseClosed)
+	_, _, err = db.GetReader([]byte("bar"))
+	require.ErrorIs(err, ErrDatabaseClosed)
+}
+
+func TestDB_GetReaderCorrupt(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+
+	require.NoError(db.Put([]byte("foo"), bytes.Repeat([]byte("x"), 40)))
+	require.NoError(db.Put([]byte("bar"), []byte("intact")))
+	require.NoError(db.Close())
+
+	f, err := os.OpenFile(filepath.Join(dir, segmentFilename(0)), os.O_RDWR, 0)
+	require.NoError(err)
+	_, err = f.WriteAt([]byte{'y'}, SegmentHeaderSize+EntryHeaderSize+3+20)
+	require.NoError(err)
+	require.NoError(f.Close())
+
+	db, err = Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	r, _, err := db.GetReader([]byte("foo"))
+	require.NoError(err)
+	defer r.Close()
+	// The corrupt byte is only noticed at the end of the value.
+	b := make([]byte, 30)
+	_, err = io.ReadFull(r, b)
+	require.NoError(err)
+	_, err = ioutil.ReadAll(r)
+	require.ErrorIs(err, ErrChecksumFailed)
+}
+
+func TestDB_GetReaderEncoded(t *testing.T) {
+	require := require.New(t)
+	withChunkSize(t, 64)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	secret := bytes.Repeat([]byte{7}, 16)
+	db, err := Open(dir, EncryptionOption(secret), CompressionOption(DeflateCodec, 32))
+	require.NoError(err)
+	defer db.Close()
+
+	small := []byte("short")
+	big := bytes.Repeat([]byte("plaintext chunk "), 40)
+	require.NoError(db.Put([]byte("small"), small))
+	require.NoError(db.Put([]byte("big"), big))
+	for key, value := range map[string][]byte{"small": small, "big": big} {
+		r, size, err := db.GetReader([]byte(key))
+		require.NoError(err)
+		require.Equal(int64(len(value)), size)
+		b, err := ioutil.ReadAll(r)
+		require.NoError(err)
+		require.Equal(value, b)
+		require.NoError(r.Close())
+	}
+}
+
+func TestDB_GetReaderChunked(t *testing.T) {
+	require := require.New(t)
+	withChunkSize(t, 16)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+
+	big := bytes.Repeat([]byte("0123456789"), 10)
+	require.NoError(db.Put([]byte("big"), big))
+	r, size, err := db.GetReader([]byte("big"))
+	require.NoError(err)
+	defer r.Close()
+	require.Equal(int64(len(big)), size)
+	b, err := ioutil.ReadAll(r)
+	require.NoError(err)
+	require.Equal(big, b)
+}
@@ -0,0 +1,177 @@
+package archivedb
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrWrittenAfterSnapshot is returned by GetWithOptions when the key was
+// written after the snapshot it reads from.
+var ErrWrittenAfterSnapshot = errors.New("key written after snapshot")
+
+// ReadOptions control a single read. The zero value reads without
+// verifying the checksum.
+type ReadOptions struct {
+	// VerifyChecksum checks the value against the checksum in its entry
+	// header, retrying and reporting corruption as Get does. Without it,
+	// only the entry's lengths and key are checked, which saves hashing
+	// the value on hot paths that trust the disk.
+	VerifyChecksum bool
+	// FillCache asks for the value to be kept in the value cache of the
+	// Env the database is opened with, if it has one (see EnvValueCache),
+	// when VerifyChecksum is set too. Cached values are returned whether
+	// or not FillCache is set.
+	FillCache bool
+	// Snapshot, if not nil, makes the read fail with
+	// ErrWrittenAfterSnapshot if the key was written or deleted after the
+	// snapshot was taken, so a caller reading several keys can tell they
+	// were not changed in between.
+	Snapshot *Snapshot
+}
+
+// Snapshot is a position in the database's write history.
+type Snapshot struct {
+	segment uint32
+	size    uint32
+}
+
+// Snapshot returns the current position in the write history.
+func (db *DB) Snapshot() (*Snapshot, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrDatabaseClosed
+	}
+	s := db.activeSegment()
+	return &Snapshot{segment: s.ID(), size: s.Size()}, nil
+}
+
+// includes returns true if the entry at off in segment id was written
+// before the snapshot was taken.
+func (s *Snapshot) includes(id uint32, off uint32) bool {
+	return id < s.segment || (id == s.segment && off < s.size)
+}
+
+// GetWithOptions gets the value of the key as Get does, with the cost and
+// safety of the read chosen by opts. Get is GetWithOptions with
+// VerifyChecksum and FillCache set.
+func (db *DB) GetWithOptions(key []byte, opts ReadOptions) ([]byte, error) {
+	if db.access != nil {
+		db.access.sample(key)
+	}
+	if opts.Snapshot != nil {
+		return db.get(key, opts)
+	} else if db.flights == nil {
+		return db.getOrLoad(key, opts)
+	}
+	// Unverified reads mustn't stand in for verified ones. The mode goes
+	// in front of the key so no key can look like another key's mode.
+	flight := "u" + string(key)
+	if opts.VerifyChecksum {
+		flight = "v" + string(key)
+	}
+	value, _, err := db.flights.do(flight, func() ([]byte, error) {
+		return db.getOrLoad(key, opts)
+	})
+	return value, err
+}
+
+// getOrLoad reads the value of key, calling the loader set by LoaderOption
+// if the key is missing, deleted or expired and storing what it returns.
+func (db *DB) getOrLoad(key []byte, opts ReadOptions) ([]byte, error) {
+	value, err := db.get(key, opts)
+	if !isMissing(err) {
+		return value, err
+	}
+	db.mu.RLock()
+	load := db.opts.loader
+	db.mu.RUnlock()
+	if load == nil {
+		return nil, err
+	}
+	if value, err = load(key); err != nil {
+		return nil, errors.Wrap(err, "load")
+	}
+	if err := db.Put(key, value); err != nil {
+		db.warn(Warning{Op: "store loaded value", Path: db.path, Err: err})
+	}
+	return value, nil
+}
+
+// get reads the value of key, without calling the loader or sampling the
+// access.
+func (db *DB) get(key []byte, opts ReadOptions) ([]byte, error) {
+	defer db.stats.gets.since(time.Now())
+	db.rlockFor(lockGet)
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrDatabaseClosed
+	}
+	key, err := db.encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	hashKey := db.opts.hashFunc(key)
+	item, ok := db.index.Get(hashKey)
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	atomic.AddInt64(&db.stats.reads, 1)
+	if opts.Snapshot != nil && !opts.Snapshot.includes(item.ID(), item.Offset()) {
+		return nil, ErrWrittenAfterSnapshot
+	}
+	segment := db.segment(item.ID())
+	if segment == nil {
+		return nil, ErrSegmentNotFound
+	}
+	cache, id := db.opts.env.valueCache(db)
+	ck := cacheKey{db: id, segment: item.ID(), offset: item.Offset()}
+	if cache != nil {
+		if value, ok, err := db.cachedValue(cache, ck, segment, key); ok || err != nil {
+			return value, err
+		}
+	}
+	entry, err := db.readEntry(segment, item.Offset(), key, opts.VerifyChecksum)
+	if err != nil {
+		return nil, err
+	}
+	if entry.hdr.Flag == EntryDeleteFlag {
+		return nil, ErrKeyDeleted
+	} else if entry.expired(db.now()) {
+		return nil, ErrKeyExpired
+	}
+	if cache != nil && opts.FillCache && opts.VerifyChecksum {
+		cache.add(ck, key, entry.hdr.Checksum, entry.data, entry.expires)
+	}
+	// Compaction, detaching and Close unmap segments while the caller may
+	// still hold the value.
+	if entry.mapped() {
+		value := make([]byte, len(entry.data))
+		copy(value, entry.data)
+		return value, nil
+	}
+	return entry.data, nil
+}
+
+// cachedValue returns a copy of the value cached for the entry of key at
+// ck in segment, if the entry there is still the one cached.
+func (db *DB) cachedValue(cache *valueCache, ck cacheKey, segment *segment, key []byte) ([]byte, bool, error) {
+	hdr, err := segment.ReadEntryHeader(ck.offset)
+	if err != nil {
+		return nil, false, nil
+	}
+	value, expires, ok := cache.get(ck, key, hdr.Checksum)
+	if !ok {
+		return nil, false, nil
+	} else if expires != 0 && db.now().UnixNano() >= expires {
+		return nil, true, ErrKeyExpired
+	}
+	return append([]byte(nil), value...), true, nil
+}
+
+// isMissing returns true if err means the key has no value.
+func isMissing(err error) bool {
+	return errors.Is(err, ErrKeyNotFound) || errors.Is(err, ErrKeyDeleted) || errors.Is(err, ErrKeyExpired)
+}
@@ -0,0 +1,65 @@
+package archivedb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_GetWithOptions(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	var fault *faultFile
+	injectFaults(t, func(_ string, f *faultFile) { fault = f })
+	db, err := Open(dir, ReadRetryOption(0, 0))
+	require.NoError(err)
+	defer db.Close()
+	require.NoError(db.Put([]byte("foo"), []byte("bar")))
+
+	// Only a verified read notices the damaged value.
+	fault.corruptOff = SegmentHeaderSize + EntryHeaderSize + 3
+	fault.corruptReads = 2
+	_, err = db.GetWithOptions([]byte("foo"), ReadOptions{VerifyChecksum: true})
+	require.ErrorIs(err, ErrChecksumFailed)
+	v, err := db.GetWithOptions([]byte("foo"), ReadOptions{})
+	require.NoError(err)
+	require.Equal([]byte{'b' ^ 0xff, 'a', 'r'}, v)
+
+	_, err = db.GetWithOptions([]byte("missing"), ReadOptions{})
+	require.ErrorIs(err, ErrKeyNotFound)
+	require.NoError(db.Delete([]byte("foo")))
+	_, err = db.GetWithOptions([]byte("foo"), ReadOptions{})
+	require.ErrorIs(err, ErrKeyDeleted)
+}
+
+func TestDB_GetWithOptionsSnapshot(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	db, err := Open(dir)
+	require.NoError(err)
+	require.NoError(db.Put([]byte("a"), []byte("1")))
+	require.NoError(db.Put([]byte("b"), []byte("1")))
+	snap, err := db.Snapshot()
+	require.NoError(err)
+
+	require.NoError(db.Put([]byte("b"), []byte("2")))
+	require.NoError(db.Put([]byte("c"), []byte("1")))
+	mustRollover(t, db)
+	require.NoError(db.Put([]byte("d"), []byte("1")))
+	opts := ReadOptions{VerifyChecksum: true, Snapshot: snap}
+	v, err := db.GetWithOptions([]byte("a"), opts)
+	require.NoError(err)
+	require.Equal([]byte("1"), v)
+	for _, key := range []string{"b", "c", "d"} {
+		_, err = db.GetWithOptions([]byte(key), opts)
+		require.ErrorIs(err, ErrWrittenAfterSnapshot, key)
+	}
+
+	require.NoError(db.Close())
+	_, err = db.Snapshot()
+	require.ErrorIs(err, ErrDatabaseClosed)
+}
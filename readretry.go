@@ -0,0 +1,88 @@
+package archivedb
+
+import (
+	"runtime/debug"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultReadRetries is how many times a failed entry read is retried.
+	DefaultReadRetries = 3
+	// DefaultReadRetryBackoff is the wait before the first retry; it doubles
+	// after every attempt.
+	DefaultReadRetryBackoff = time.Millisecond
+)
+
+// ErrReadFault is returned when reading a mapped segment raised a memory
+// fault, as happens when the disk returns an I/O error for the page.
+var ErrReadFault = errors.New("fault reading segment")
+
+// readEntry reads the entry of key at off in s, checking its checksum if
+// verify is set. Faults, short reads and I/O errors are retried with
+// backoff, raising a Warning each time, since they may be transient: a
+// flaky disk or a segment still being written by another process. Once the
+// retries are used up the error is treated as corruption. Checksum
+// failures are returned at once, as the data on disk won't change. Delete
+// entries are returned without being checked. The caller must hold db.mu,
+// which stays held while waiting to retry.
+func (db *DB) readEntry(s *segment, off uint32, key []byte, verify bool) (e entry, err error) {
+	backoff := db.opts.readRetryBackoff
+	for i := 0; ; i++ {
+		e, err = readEntryOnce(s, off, key, verify)
+		if errors.Is(err, ErrChecksumFailed) {
+			atomic.AddInt64(&db.stats.checksums, 1)
+		}
+		if err == nil {
+			return e, db.decodeValue(&e)
+		} else if !isTransientReadError(err) {
+			return e, err
+		} else if i == db.opts.readRetries {
+			return e, errors.Wrapf(err, "segment %04x offset %d: corrupt after %d attempts", s.ID(), off, i+1)
+		}
+		db.warn(Warning{Op: "read", Path: s.path, Err: err})
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// readEntryOnce reads and checks an entry, turning a memory fault on the
+// mapping into ErrReadFault.
+func readEntryOnce(s *segment, off uint32, key []byte, verify bool) (e entry, err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer recoverFault(&err, ErrReadFault)
+
+	if e, err = s.ReadEntry(off); err != nil {
+		return e, err
+	} else if e.hdr.Flag == EntryDeleteFlag {
+		return e, nil
+	} else if !verify {
+		return e, e.matches(key)
+	}
+	// Touch every byte while faults are still recovered.
+	return e, e.verify(key)
+}
+
+// isTransientReadError returns true if a read failing with err may succeed
+// when retried.
+func isTransientReadError(err error) bool {
+	return errors.Is(err, ErrReadFault) || errors.Is(err, ErrLengthMismatch) ||
+		errors.Is(err, syscall.EIO) || errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR)
+}
+
+// recoverFault, deferred by a function that enabled debug.SetPanicOnFault,
+// turns a memory fault into target wrapped in *err. Other panics continue.
+func recoverFault(err *error, target error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	fault, ok := r.(interface{ Addr() uintptr })
+	if !ok {
+		panic(r)
+	}
+	*err = errors.Wrapf(target, "address %#x", fault.Addr())
+}
@@ -0,0 +1,59 @@
+package archivedb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadRetryOption(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	_, err := Open(dir, ReadRetryOption(-1, 0))
+	require.Error(err)
+	_, err = Open(dir, ReadRetryOption(1, -time.Second))
+	require.Error(err)
+}
+
+func TestDB_GetDoesNotRetryCorruptEntry(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	db, err := Open(dir)
+	require.NoError(err)
+	require.NoError(db.Put([]byte("a"), []byte("hello")))
+	require.NoError(db.Put([]byte("b"), []byte("world")))
+	require.NoError(db.Close())
+
+	// Flip the last byte of a's value. Open only checks the tail entry, so
+	// the damage is found by Get.
+	path := filepath.Join(dir, segmentFilename(0))
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	require.NoError(err)
+	off := int64(SegmentHeaderSize + EntryHeaderSize + 1 + 4)
+	_, err = f.WriteAt([]byte{'O'}, off)
+	require.NoError(err)
+	require.NoError(f.Close())
+
+	var warnings []Warning
+	db, err = Open(dir, ReadRetryOption(2, 0), WarningHandlerOption(func(w Warning) {
+		warnings = append(warnings, w)
+	}))
+	require.NoError(err)
+	defer db.Close()
+
+	_, err = db.Get([]byte("a"))
+	require.ErrorIs(err, ErrChecksumFailed)
+	require.Empty(warnings)
+
+	v, err := db.Get([]byte("b"))
+	require.NoError(err)
+	require.Equal([]byte("world"), v)
+	require.Empty(warnings)
+}
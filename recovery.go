@@ -0,0 +1,92 @@
+package archivedb
+
+import (
+	"fmt"
+	"time"
+)
+
+// RecoveryReport describes what Open found while opening the database and
+// what it repaired.
+type RecoveryReport struct {
+	Segments      int           // existing segments opened
+	Entries       int64         // complete entries found in segments
+	Tombstones    int64         // delete entries found in segments
+	TornEntries   int           // partially written tail entries cleared
+	TornBytes     int64         // bytes cleared with the torn entries
+	IndexItems    int64         // items loaded from the index file
+	Dangling      int64         // index items removed because their entry was torn
+	Unavailable   int64         // index items kept whose segment is missing or quarantined
+	Quarantined   []string      // files moved to the quarantine directory
+	EmptySegments int           // sealed segments without entries holding preallocated space
+	Duration      time.Duration // time spent in Open
+}
+
+// RecoveryReport returns the report of what happened when the database was
+// opened.
+func (db *DB) RecoveryReport() RecoveryReport {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	r := db.recovery
+	r.Quarantined = append([]string(nil), r.Quarantined...)
+	return r
+}
+
+// recordSegment adds what was found opening s to the recovery report.
+func (r *RecoveryReport) recordSegment(s *segment) {
+	r.Segments++
+	r.Entries += s.stats.Entries
+	r.Tombstones += s.stats.Tombstones
+	if s.stats.TornBytes > 0 {
+		r.TornEntries++
+		r.TornBytes += s.stats.TornBytes
+	}
+}
+
+// removeDanglingItems removes index items that point past the end of a
+// segment's data, which happens when entries are torn. Items in segments
+// that are missing or quarantined are only counted, since their files may
+// be restored. Their ids stay reserved: if the active segment is missing,
+// a new one is created after the last id in use.
+func (db *DB) removeDanglingItems() error {
+	var dangling []uint64
+	var last uint32
+	if err := db.index.ForEach(func(k uint64, it item) error {
+		if int(it.ID()) >= len(db.segments) || db.segments[it.ID()].missing {
+			db.recovery.Unavailable++
+			if it.ID() > last {
+				last = it.ID()
+			}
+		} else if s := db.segments[it.ID()]; !s.offline() && it.Offset() >= s.Size() {
+			dangling = append(dangling, k)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, k := range dangling {
+		if err := db.removeKey(k); err != nil {
+			return err
+		}
+	}
+	db.recovery.Dangling = int64(len(dangling))
+	if len(dangling) > 0 {
+		db.event(EventRecovery, fmt.Sprintf("removed %d dangling index items", len(dangling)), db.IndexPath(), nil)
+	}
+	if db.recovery.Unavailable > 0 {
+		db.event(EventRecovery, fmt.Sprintf("%d index items refer to missing segments", db.recovery.Unavailable), db.IndexPath(), nil)
+	}
+	if int(last) >= len(db.segments) {
+		// Segments are missing from the end of the log; continue after
+		// them.
+		if active := db.activeSegment(); !active.missing {
+			if err := db.sealSegment(active); err != nil {
+				return err
+			}
+		}
+		db.addMissingSegments(last + 1)
+	} else if !db.activeSegment().missing {
+		return nil
+	}
+	_, err := db.createSegment()
+	return err
+}
@@ -0,0 +1,117 @@
+package archivedb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_RecoveryReport(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	db, err := Open(dir)
+	require.NoError(err)
+	require.Zero(db.RecoveryReport().Segments)
+	require.NoError(db.Put([]byte("foo"), []byte("bar")))
+	require.NoError(db.Delete([]byte("foo")))
+	require.NoError(db.Put([]byte("baz"), []byte("qux")))
+	require.NoError(db.Close())
+
+	db, err = Open(dir)
+	require.NoError(err)
+	r := db.RecoveryReport()
+	require.Equal(1, r.Segments)
+	require.Equal(int64(3), r.Entries)
+	require.Equal(int64(1), r.Tombstones)
+	require.Equal(int64(3), r.IndexItems)
+	require.Zero(r.TornEntries)
+	require.Zero(r.Dangling)
+	require.NoError(db.Close())
+
+	// Damage the value of the last entry, as if the write was torn.
+	entrySize, tombstoneSize := int64(EntryHeaderSize+6), int64(EntryHeaderSize+3)
+	f, err := os.OpenFile(filepath.Join(dir, segmentFilename(0)), os.O_RDWR, 0)
+	require.NoError(err)
+	_, err = f.WriteAt([]byte("!"), SegmentHeaderSize+2*entrySize+tombstoneSize-1)
+	require.NoError(err)
+	require.NoError(f.Close())
+
+	db, err = Open(dir)
+	require.NoError(err)
+	r = db.RecoveryReport()
+	require.Equal(int64(2), r.Entries)
+	require.Equal(1, r.TornEntries)
+	require.Equal(entrySize, r.TornBytes)
+	require.Equal(int64(1), r.Dangling)
+	_, err = db.Get([]byte("baz"))
+	require.ErrorIs(err, ErrKeyNotFound)
+
+	// The torn entry's space is reused.
+	require.NoError(db.Put([]byte("new"), []byte("v")))
+	require.NoError(db.Close())
+
+	db, err = Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	r = db.RecoveryReport()
+	require.Equal(int64(3), r.Entries)
+	require.Zero(r.TornEntries)
+	require.Zero(r.Dangling)
+	_, err = db.Get([]byte("baz"))
+	require.ErrorIs(err, ErrKeyNotFound)
+	v, err := db.Get([]byte("new"))
+	require.NoError(err)
+	require.Equal([]byte("v"), v)
+}
+
+func TestDB_RecoveryReport_MissingSegments(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	db, err := Open(dir)
+	require.NoError(err)
+	for i, key := range []string{"k0", "k1", "k2"} {
+		if i > 0 {
+			_, err := db.SealActiveSegment()
+			require.NoError(err)
+		}
+		require.NoError(db.Put([]byte(key), []byte("v")))
+	}
+	require.NoError(db.Close())
+	// The segment is moved aside rather than read, as it is 1GB long.
+	segment1 := dir + "." + segmentFilename(1)
+	defer os.Remove(segment1)
+	require.NoError(os.Rename(filepath.Join(dir, segmentFilename(1)), segment1))
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, segmentFilename(1)), []byte("NotASegment"), 0644))
+	require.NoError(os.Remove(filepath.Join(dir, segmentFilename(2))))
+
+	db, err = Open(dir, QuarantineOption(true))
+	require.NoError(err)
+	r := db.RecoveryReport()
+	require.Zero(r.Dangling)
+	require.Equal(int64(2), r.Unavailable)
+	for _, key := range []string{"k1", "k2"} {
+		_, err = db.Get([]byte(key))
+		require.ErrorIs(err, ErrSegmentNotFound)
+	}
+	require.NoError(db.Put([]byte("k3"), []byte("v")))
+	require.NoError(db.Close())
+
+	// Putting the quarantined file back brings its keys back.
+	require.NoError(os.Rename(segment1, filepath.Join(dir, segmentFilename(1))))
+	db, err = Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	require.Equal(int64(1), db.RecoveryReport().Unavailable)
+	for _, key := range []string{"k0", "k1", "k3"} {
+		v, err := db.Get([]byte(key))
+		require.NoError(err)
+		require.Equal([]byte("v"), v)
+	}
+}
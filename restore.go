@@ -0,0 +1,354 @@
+package archivedb
+
+import (
+	"archive/tar"
+	"bytes"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/millken/archivedb/format"
+	"github.com/pkg/errors"
+)
+
+// RestoreOptions controls RestoreWithOptions.
+type RestoreOptions struct {
+	// Force replaces the database, or other files, at the path with the
+	// one restored. A database open for writing is never replaced.
+	Force bool
+}
+
+// Restore creates the database at path from a tar stream written by Backup
+// or BackupSince, or applies an incremental stream from BackupSince to the
+// database at path restored from the backups before it. Restore is
+// RestoreWithOptions without Force.
+func Restore(path string, r io.Reader) error {
+	return RestoreWithOptions(path, r, RestoreOptions{})
+}
+
+// RestoreWithOptions is Restore with the behaviour chosen by opts.
+//
+// Every segment in the stream is checked as it is copied: its header, and
+// the checksum of each entry; the sealed segments are then checked against
+// the checksums in the manifest. A full backup is restored into a
+// directory beside path, which replaces path once everything checks out;
+// path must not hold a database, or any file, unless opts.Force is set. An
+// incremental backup is applied in place, the manifest last, and fails if
+// the database was written to after the backup it follows was restored.
+// It fails with ErrDatabaseLocked if the database is open for writing, and
+// with ErrBackupCorrupt if the stream doesn't check out.
+func RestoreWithOptions(path string, r io.Reader, opts RestoreOptions) error {
+	path = filepath.Clean(path)
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil {
+		return errors.Wrapf(ErrBackupCorrupt, "manifest: %v", err)
+	} else if hdr.Name != ManifestFileName {
+		return errors.Wrapf(ErrBackupCorrupt, "stream starts with %q, not the manifest", hdr.Name)
+	}
+	buf, err := ioutil.ReadAll(tr)
+	if err != nil {
+		return errors.Wrapf(ErrBackupCorrupt, "manifest: %v", err)
+	}
+	m, err := decodeManifest(buf)
+	if err != nil {
+		return errors.Wrapf(ErrBackupCorrupt, "manifest: %v", err)
+	}
+
+	existing, err := readManifest(filepath.Join(path, ManifestFileName))
+	if err != nil {
+		return err
+	}
+	unlock := func() {}
+	if existing != nil {
+		f, err := lockDirectory(path)
+		if err != nil {
+			return err
+		}
+		unlock = func() {
+			unlockFile(f)
+			f.Close()
+		}
+		defer func() { unlock() }()
+	}
+
+	rs := &restore{tr: tr, manifest: m}
+	if s, ok := hdr.PAXRecords[PAXSince]; ok {
+		if rs.since, err = ParseWatermark(s); err != nil {
+			return errors.Wrap(ErrBackupCorrupt, err.Error())
+		} else if existing == nil {
+			return errors.Errorf("%s holds no database to apply the incremental backup to", path)
+		} else if existing.ID != m.ID {
+			return errors.Wrapf(ErrBackupCorrupt, "backup of database %q, not %q", m.ID, existing.ID)
+		}
+		rs.dir = path
+		return rs.apply()
+	}
+
+	if existing != nil && !opts.Force {
+		return errors.Wrapf(os.ErrExist, "%s holds a database", path)
+	} else if fis, err := ioutil.ReadDir(path); err != nil && !os.IsNotExist(err) {
+		return err
+	} else if len(fis) > 0 && !opts.Force {
+		return errors.Wrapf(os.ErrExist, "%s holds files", path)
+	}
+	rs.dir = path + ".restoring"
+	if err := os.RemoveAll(rs.dir); err != nil {
+		return err
+	} else if err := os.MkdirAll(rs.dir, 0777); err != nil {
+		return err
+	}
+	if err := rs.apply(); err != nil {
+		os.RemoveAll(rs.dir)
+		return err
+	}
+	// Windows can't remove the lock file while it is open.
+	unlock()
+	unlock = func() {}
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	return os.Rename(rs.dir, path)
+}
+
+// lockDirectory takes the lock of the database in dir, as Open does, and
+// returns the locked file.
+func lockDirectory(dir string) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, LockFileName), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	} else if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// restore writes the files of a backup stream into a database directory.
+type restore struct {
+	tr       *tar.Reader
+	dir      string
+	manifest *Manifest
+	since    Watermark // zero for a full backup
+	written  []uint32  // segments written
+}
+
+// apply writes the rest of the stream into rs.dir, then checks the sealed
+// segments written and writes the manifest.
+func (rs *restore) apply() error {
+	var index bool
+	for {
+		hdr, err := rs.tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrap(ErrBackupCorrupt, err.Error())
+		}
+		var off int64
+		if s, ok := hdr.PAXRecords[PAXOffset]; ok {
+			if off, err = strconv.ParseInt(s, 10, 64); err != nil || off < SegmentHeaderSize {
+				return errors.Wrapf(ErrBackupCorrupt, "%s: offset %q", hdr.Name, s)
+			}
+		}
+		name := filepath.FromSlash(hdr.Name)
+		switch {
+		case name == "index" && !index:
+			index = true
+			err = rs.restoreIndex(hdr.Size)
+		case name == ManifestFileName || name == "index":
+			err = errors.Wrap(ErrBackupCorrupt, "duplicate file")
+		default:
+			err = rs.restoreSegment(name, off, hdr.Size)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "restore %s", hdr.Name)
+		}
+	}
+	if !index {
+		return errors.Wrap(ErrBackupCorrupt, "no index in stream")
+	}
+	for _, id := range rs.written {
+		sc, ok := rs.manifest.sealed(id)
+		if !ok || sc.Detached || sc.Punching {
+			continue
+		}
+		if err := verifySegmentFile(filepath.Join(rs.dir, sc.Dir, segmentFilename(id)), sc); err != nil {
+			return errors.Wrapf(ErrBackupCorrupt, "segment %s: %v", segmentFilename(id), err)
+		}
+	}
+	return rs.manifest.Write(filepath.Join(rs.dir, ManifestFileName))
+}
+
+// restoreSegment writes the size bytes of the segment file name, starting
+// at off in the file, checking them on the way.
+func (rs *restore) restoreSegment(name string, off, size int64) error {
+	id, err := parseSegmentFilename(filepath.Base(name))
+	if err != nil || filepath.IsAbs(name) || strings.HasPrefix(filepath.Clean(name), "..") {
+		return errors.Wrap(ErrBackupCorrupt, "not a segment file")
+	}
+	path := filepath.Join(rs.dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	flag := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if off > 0 {
+		// The segment was partitioned after the backup that restored it.
+		if root := filepath.Join(rs.dir, filepath.Base(name)); root != path {
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				if err := os.Rename(root, path); err != nil {
+					return err
+				}
+			}
+		}
+		flag = os.O_RDWR
+	}
+	f, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = rs.tr
+	if off > 0 {
+		if err := readSegmentHeader(f); err != nil {
+			return err
+		}
+		// The next entry must not have been written since.
+		first := make([]byte, EntryHeaderSize)
+		if size < EntryHeaderSize {
+			first = first[:size]
+		}
+		if _, err := io.ReadFull(rs.tr, first); err != nil {
+			return errors.Wrap(ErrBackupCorrupt, err.Error())
+		}
+		next := make([]byte, len(first))
+		if _, err := f.ReadAt(next, off); err != nil && err != io.EOF {
+			return err
+		} else if !bytes.Equal(next, first) && !bytes.Equal(next, make([]byte, len(next))) {
+			return errors.Errorf("segment was written to after the backup at %s", rs.since)
+		} else if _, err := f.Seek(off, io.SeekStart); err != nil {
+			return err
+		}
+		r = io.MultiReader(bytes.NewReader(first), rs.tr)
+	}
+	r = io.TeeReader(io.LimitReader(r, size), f)
+	if off == 0 {
+		if err := readSegmentHeader(r); err != nil {
+			return errors.Wrap(ErrBackupCorrupt, err.Error())
+		}
+		off, size = SegmentHeaderSize, size-SegmentHeaderSize
+	}
+	if err := verifyEntries(r, off, size); err != nil {
+		return err
+	} else if err := f.Sync(); err != nil {
+		return err
+	}
+	rs.written = append(rs.written, id)
+	return f.Close()
+}
+
+// verifyEntries reads the entries in the size bytes of r, which start at
+// off in their segment, checking their checksums.
+func verifyEntries(r io.Reader, off, size int64) error {
+	var buf [EntryHeaderSize + MaxKeySize]byte
+	h := crc32.New(CastagnoliCrcTable)
+	for end := off + size; off < end; {
+		if end-off < EntryHeaderSize {
+			return errors.Wrapf(ErrBackupCorrupt, "truncated entry at offset %d", off)
+		} else if _, err := io.ReadFull(r, buf[:EntryHeaderSize]); err != nil {
+			return errors.Wrap(ErrBackupCorrupt, err.Error())
+		}
+		hdr, err := readEntryHeader(buf[:EntryHeaderSize])
+		if err != nil || !isValidEntryFlag(hdr.Flag) {
+			return errors.Wrapf(ErrBackupCorrupt, "invalid entry header at offset %d", off)
+		} else if off+int64(hdr.EntrySize()) > end {
+			return errors.Wrapf(ErrBackupCorrupt, "truncated entry at offset %d", off)
+		} else if _, err := io.ReadFull(r, buf[:hdr.KeySize]); err != nil {
+			return errors.Wrap(ErrBackupCorrupt, err.Error())
+		}
+		h.Reset()
+		if _, err := io.CopyN(h, r, int64(hdr.ValueSize)); err != nil {
+			return errors.Wrap(ErrBackupCorrupt, err.Error())
+		} else if h.Sum32() != hdr.Checksum {
+			return errors.Wrapf(ErrBackupCorrupt, "entry at offset %d: %v", off, ErrChecksumFailed)
+		}
+		off += int64(hdr.EntrySize())
+	}
+	return nil
+}
+
+// restoreIndex writes the size bytes of the index file of the stream; the
+// records of an incremental backup go after the records of the index file
+// in rs.dir.
+func (rs *restore) restoreIndex(size int64) error {
+	buf := make([]byte, IndexHeaderSize)
+	if _, err := io.ReadFull(rs.tr, buf); err != nil {
+		return errors.Wrap(ErrBackupCorrupt, err.Error())
+	} else if hdr, err := format.ParseIndexHeader(buf); err != nil || hdr.Version != IndexVersion {
+		return errors.Wrap(ErrBackupCorrupt, "invalid index header")
+	} else if (size-IndexHeaderSize)%indexItemSize != 0 {
+		return errors.Wrapf(ErrBackupCorrupt, "index of %d bytes", size)
+	}
+
+	path := filepath.Join(rs.dir, "index")
+	flag := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if rs.since != (Watermark{}) {
+		flag = os.O_RDWR
+	}
+	f, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	end, err := indexEnd(f)
+	if err != nil {
+		return err
+	} else if end == 0 {
+		if _, err := f.Write(buf); err != nil {
+			return err
+		}
+	} else if _, err := f.Seek(end, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(f, rs.tr, size-IndexHeaderSize); err != nil {
+		return err
+	} else if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// indexEnd returns the offset after the last record of the index file f,
+// or 0 if it is empty.
+func indexEnd(f *os.File) (int64, error) {
+	buf := make([]byte, IndexHeaderSize)
+	if _, err := io.ReadFull(f, buf); err == io.EOF {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	} else if hdr, err := format.ParseIndexHeader(buf); err != nil {
+		return 0, errors.Wrap(ErrInvalidIndex, err.Error())
+	} else if hdr.Version != IndexVersion {
+		return 0, errors.Wrapf(ErrInvalidIndexVersion, "version %d", hdr.Version)
+	}
+	off := int64(IndexHeaderSize)
+	rec := make([]byte, indexItemSize)
+	for {
+		if _, err := io.ReadFull(f, rec); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return off, nil
+		} else if err != nil {
+			return 0, err
+		}
+		r, err := format.ParseIndexRecord(rec)
+		if err != nil {
+			return 0, errors.Wrap(ErrInvalidIndex, err.Error())
+		} else if r.Zero() {
+			return off, nil
+		}
+		off += indexItemSize
+	}
+}
@@ -0,0 +1,191 @@
+package archivedb
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestore(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	target, cleanupTarget := MustTempDir()
+	defer cleanupTarget()
+	path := filepath.Join(target, "db")
+
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("v1")))
+	}
+	mustRollover(t, db)
+	require.NoError(db.Put([]byte("key0"), []byte("v2")))
+	var buf bytes.Buffer
+	require.NoError(db.Backup(&buf))
+	backup := buf.Bytes()
+
+	require.NoError(Restore(path, bytes.NewReader(backup)))
+	_, err = os.Stat(path + ".restoring")
+	require.True(os.IsNotExist(err))
+	restored, err := Open(path)
+	require.NoError(err)
+	defer restored.Close()
+	v, err := restored.Get([]byte("key0"))
+	require.NoError(err)
+	require.Equal("v2", string(v))
+	v, err = restored.Get([]byte("key99"))
+	require.NoError(err)
+	require.Equal("v1", string(v))
+
+	// An existing database is only replaced when forced, and never while
+	// it is open.
+	err = RestoreWithOptions(path, bytes.NewReader(backup), RestoreOptions{Force: true})
+	require.ErrorIs(err, ErrDatabaseLocked)
+	require.NoError(restored.Put([]byte("key0"), []byte("v3")))
+	require.NoError(restored.Close())
+	require.ErrorIs(Restore(path, bytes.NewReader(backup)), os.ErrExist)
+	require.NoError(RestoreWithOptions(path, bytes.NewReader(backup), RestoreOptions{Force: true}))
+	restored, err = Open(path)
+	require.NoError(err)
+	defer restored.Close()
+	v, err = restored.Get([]byte("key0"))
+	require.NoError(err)
+	require.Equal("v2", string(v))
+
+	// Other files aren't replaced either.
+	other := filepath.Join(target, "other")
+	require.NoError(os.MkdirAll(other, 0777))
+	require.NoError(ioutil.WriteFile(filepath.Join(other, "file"), nil, 0644))
+	require.ErrorIs(Restore(other, bytes.NewReader(backup)), os.ErrExist)
+}
+
+func TestRestore_TrailingSlash(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	target, cleanupTarget := MustTempDir()
+	defer cleanupTarget()
+	path := filepath.Join(target, "db") + string(filepath.Separator)
+
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	require.NoError(db.Put([]byte("foo"), []byte("bar")))
+	var buf bytes.Buffer
+	require.NoError(db.Backup(&buf))
+
+	require.NoError(Restore(path, bytes.NewReader(buf.Bytes())))
+	require.NoError(RestoreWithOptions(path, bytes.NewReader(buf.Bytes()), RestoreOptions{Force: true}))
+	_, err = os.Stat(filepath.Join(target, "db.restoring"))
+	require.True(os.IsNotExist(err))
+	restored, err := Open(path)
+	require.NoError(err)
+	defer restored.Close()
+	v, err := restored.Get([]byte("foo"))
+	require.NoError(err)
+	require.Equal("bar", string(v))
+}
+
+func TestRestore_Corrupt(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	target, cleanupTarget := MustTempDir()
+	defer cleanupTarget()
+	path := filepath.Join(target, "db")
+
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	require.NoError(db.Put([]byte("foo"), []byte("a value to corrupt")))
+	var buf bytes.Buffer
+	require.NoError(db.Backup(&buf))
+
+	i := bytes.Index(buf.Bytes(), []byte("a value to corrupt"))
+	require.Greater(i, 0)
+	corrupt := append([]byte(nil), buf.Bytes()...)
+	corrupt[i] ^= 1
+	require.ErrorIs(Restore(path, bytes.NewReader(corrupt)), ErrBackupCorrupt)
+	_, err = os.Stat(path)
+	require.True(os.IsNotExist(err))
+	_, err = os.Stat(path + ".restoring")
+	require.True(os.IsNotExist(err))
+
+	require.ErrorIs(Restore(path, bytes.NewReader(buf.Bytes()[:buf.Len()/2])), ErrBackupCorrupt)
+	require.ErrorIs(Restore(path, bytes.NewReader(nil)), ErrBackupCorrupt)
+	require.NoError(Restore(path, &buf))
+}
+
+func TestRestore_Incremental(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	target, cleanupTarget := MustTempDir()
+	defer cleanupTarget()
+	path := filepath.Join(target, "db")
+
+	db, err := Open(dir, PartitionOption(true))
+	require.NoError(err)
+	defer db.Close()
+	require.NoError(db.Put([]byte("foo"), []byte("1")))
+	var buf bytes.Buffer
+	w, err := db.BackupSince(&buf, Watermark{})
+	require.NoError(err)
+	require.NoError(Restore(path, &buf))
+
+	// The restored database takes the next increment after being opened.
+	restored, err := Open(path)
+	require.NoError(err)
+	require.NoError(restored.Close())
+	require.NoError(db.Put([]byte("foo"), []byte("2")))
+	mustRollover(t, db)
+	require.NoError(db.Put([]byte("bar"), []byte("3")))
+	buf.Reset()
+	w, err = db.BackupSince(&buf, w)
+	require.NoError(err)
+	incremental := buf.Bytes()
+	require.NoError(Restore(path, bytes.NewReader(incremental)))
+	// Applying it again changes nothing.
+	require.NoError(Restore(path, bytes.NewReader(incremental)))
+
+	restored, err = Open(path)
+	require.NoError(err)
+	for k, want := range map[string]string{"foo": "2", "bar": "3"} {
+		v, err := restored.Get([]byte(k))
+		require.NoError(err)
+		require.Equal(want, string(v))
+	}
+	report, err := restored.Verify(nil)
+	require.NoError(err)
+	require.Empty(report.Corrupt)
+	require.NoError(db.VerifyBackups(path))
+
+	// Not once the restored database was written to.
+	require.NoError(restored.Put([]byte("baz"), []byte("4")))
+	require.NoError(restored.Close())
+	require.NoError(db.Put([]byte("qux"), []byte("5")))
+	buf.Reset()
+	_, err = db.BackupSince(&buf, w)
+	require.NoError(err)
+	require.Error(Restore(path, &buf))
+
+	// Nor to another database.
+	other, err := Open(filepath.Join(target, "other"))
+	require.NoError(err)
+	defer other.Close()
+	buf.Reset()
+	_, err = other.BackupSince(&buf, Watermark{})
+	require.NoError(err)
+	require.NoError(other.Put([]byte("foo"), []byte("1")))
+	buf.Reset()
+	_, err = other.BackupSince(&buf, Watermark{Segment: 0, Offset: SegmentHeaderSize})
+	require.NoError(err)
+	require.ErrorIs(Restore(path, &buf), ErrBackupCorrupt)
+}
@@ -0,0 +1,87 @@
+package archivedb
+
+import "time"
+
+// windowEnded returns true if the active segment holds entries from an
+// earlier rollover window than the current time. The caller must hold
+// db.mu.
+func (db *DB) windowEnded() bool {
+	window := db.opts.rollover
+	if window <= 0 || db.activeStart.IsZero() {
+		return false
+	}
+	return !db.now().Truncate(window).Equal(db.activeStart.Truncate(window))
+}
+
+// initActiveStart estimates when the first entry of a non-empty active
+// segment was written: when the previous segment was sealed, or else when
+// the database was created. The caller must hold db.mu.
+func (db *DB) initActiveStart() {
+	active := db.activeSegment()
+	if active == nil || active.Size() <= SegmentHeaderSize {
+		return
+	}
+	var start time.Time
+	if n := len(db.manifest.Segments); n > 0 {
+		start = db.manifest.Segments[n-1].Sealed
+	}
+	if start.IsZero() {
+		start = db.manifest.Created
+	}
+	if start.IsZero() {
+		start = db.now()
+	}
+	db.activeStart = start
+}
+
+// SealActiveSegment flushes and seals the active segment and starts a new
+// one, so every entry written so far is in a sealed segment file that is
+// never written again, as needed before taking a filesystem snapshot of
+// the directory. It returns the checksum record of the segment sealed, as
+// kept in the manifest. An active segment without entries is left alone,
+// and the record of the last sealed segment is returned, or a zero record
+// if there is none.
+func (db *DB) SealActiveSegment() (SegmentChecksum, error) {
+	db.lockFor(lockWrite)
+	defer db.mu.Unlock()
+	if err := db.checkWritable(); err != nil {
+		return SegmentChecksum{}, err
+	}
+	return db.sealActiveSegment()
+}
+
+// sealActiveSegment is SealActiveSegment for a caller holding db.mu.
+func (db *DB) sealActiveSegment() (SegmentChecksum, error) {
+	active := db.activeSegment()
+	if active.Size() > SegmentHeaderSize {
+		if err := db.flushSegment(active); err != nil {
+			return SegmentChecksum{}, err
+		} else if _, err := db.createSegment(); err != nil {
+			return SegmentChecksum{}, err
+		}
+	}
+	if n := len(db.manifest.Segments); n > 0 {
+		return db.manifest.Segments[n-1], nil
+	}
+	return SegmentChecksum{}, nil
+}
+
+// WithFilesystemSnapshot seals the active segment, flushes the database
+// and calls fn with writes blocked, for fn to snapshot the filesystem
+// holding the directory, with ZFS or btrfs for instance. The snapshot then
+// holds every entry written before the call in sealed segments, which a
+// database opened from it finds intact. Reads are blocked as well while fn
+// runs, so it should only trigger the snapshot and return. Its error is
+// returned.
+func (db *DB) WithFilesystemSnapshot(fn func() error) error {
+	db.lockFor(lockWrite)
+	defer db.mu.Unlock()
+	if err := db.checkWritable(); err != nil {
+		return err
+	} else if _, err := db.sealActiveSegment(); err != nil {
+		return err
+	} else if err := db.flush(); err != nil {
+		return err
+	}
+	return fn()
+}
@@ -0,0 +1,149 @@
+package archivedb
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRolloverOption(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	clock := newFakeClock()
+	clock.Add(23 * time.Hour)
+	db, err := Open(dir, ClockOption(clock), RolloverOption(24*time.Hour))
+	require.NoError(err)
+	require.NoError(db.Put([]byte("a"), []byte("1")))
+	clock.Add(30 * time.Minute)
+	require.NoError(db.Put([]byte("b"), []byte("2")))
+	require.Equal(uint32(0), db.activeSegment().ID())
+
+	// The next day starts a new segment, on the first write only.
+	clock.Add(time.Hour)
+	require.Equal(uint32(0), db.activeSegment().ID())
+	require.NoError(db.Put([]byte("c"), []byte("3")))
+	require.Equal(uint32(1), db.activeSegment().ID())
+	require.Equal(clock.Now(), db.manifest.Segments[0].Sealed)
+	require.NoError(db.Close())
+
+	// After reopening, the active segment is dated from the last seal.
+	db, err = Open(dir, ClockOption(clock), RolloverOption(24*time.Hour))
+	require.NoError(err)
+	defer db.Close()
+	require.Equal(clock.Now(), db.activeStart)
+	clock.Add(time.Hour)
+	require.NoError(db.Put([]byte("d"), []byte("4")))
+	require.Equal(uint32(1), db.activeSegment().ID())
+	clock.Add(24 * time.Hour)
+	require.NoError(db.Put([]byte("e"), []byte("5")))
+	require.Equal(uint32(2), db.activeSegment().ID())
+}
+
+func TestDB_SealActiveSegment(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+
+	sc, err := db.SealActiveSegment()
+	require.NoError(err)
+	require.Zero(sc)
+	require.Equal(uint32(0), db.activeSegment().ID())
+
+	require.NoError(db.Put([]byte("a"), []byte("1")))
+	sc, err = db.SealActiveSegment()
+	require.NoError(err)
+	require.Equal(uint32(0), sc.ID)
+	require.Equal(uint32(1), db.activeSegment().ID())
+	require.NoError(verifySegmentFile(filepath.Join(dir, segmentFilename(0)), sc))
+
+	// Nothing was written since, so nothing is sealed.
+	again, err := db.SealActiveSegment()
+	require.NoError(err)
+	require.Equal(sc, again)
+	require.Equal(uint32(1), db.activeSegment().ID())
+
+	v, err := db.Get([]byte("a"))
+	require.NoError(err)
+	require.Equal([]byte("1"), v)
+}
+
+func TestDB_WithFilesystemSnapshot(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	snap, cleanupSnap := MustTempDir()
+	defer cleanupSnap()
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+
+	require.NoError(db.Put([]byte("a"), []byte("1")))
+	require.NoError(db.Put([]byte("b"), []byte("2")))
+	// Copying the files stands in for a filesystem snapshot. Segments
+	// are copied up to the end of their data, leaving out the space
+	// preallocated for them.
+	require.NoError(db.WithFilesystemSnapshot(func() error {
+		require.Equal(uint32(1), db.activeSegment().ID())
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, fi := range fis {
+			if fi.IsDir() || fi.Name() == LockFileName {
+				continue
+			}
+			size := fi.Size()
+			if id, err := parseSegmentFilename(fi.Name()); err == nil {
+				size = int64(db.segment(id).Size())
+			}
+			if err := copyFileN(filepath.Join(snap, fi.Name()), filepath.Join(dir, fi.Name()), size); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	require.NoError(db.Put([]byte("c"), []byte("3")))
+
+	sdb, err := Open(snap)
+	require.NoError(err)
+	defer sdb.Close()
+	v, err := sdb.Get([]byte("b"))
+	require.NoError(err)
+	require.Equal([]byte("2"), v)
+	_, err = sdb.Get([]byte("c"))
+	require.ErrorIs(err, ErrKeyNotFound)
+
+	errSnap := errors.New("snapshot failed")
+	require.Equal(errSnap, db.WithFilesystemSnapshot(func() error { return errSnap }))
+	require.NoError(db.Close())
+	require.ErrorIs(db.WithFilesystemSnapshot(func() error { return nil }), ErrDatabaseClosed)
+}
+
+// copyFileN copies the first n bytes of the file src to dst.
+func copyFileN(dst, src string, n int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.CopyN(out, in, n); err != nil {
+		return err
+	}
+	return out.Close()
+}
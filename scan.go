@@ -0,0 +1,136 @@
+package archivedb
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultGetPrefixBudget is the default byte budget of GetPrefix.
+const DefaultGetPrefixBudget = 16 << 20
+
+// ErrPrefixTooLarge is returned by GetPrefix when the keys under the prefix
+// exceed its limit or byte budget.
+var ErrPrefixTooLarge = errors.New("prefix holds too much data")
+
+// errStopScan ends the walk of scanKeys once it has enough keys.
+var errStopScan = errors.New("stop scan")
+
+// scanMatch is a live key found by Scan.
+type scanMatch struct {
+	key     []byte // decoded with the key transform
+	encoded []byte
+	it      item
+}
+
+// Scan calls fn with every live key starting with prefix and its value, in
+// lexical order of the keys, skipping expired keys. Every value is
+// verified against its checksum before fn is called. The index is keyed by
+// hash, so finding the keys reads the entry of every live key; only
+// matching keys are held in memory. The database is locked while fn runs,
+// so fn must not write to it. Key and value are only valid during the
+// call.
+func (db *DB) Scan(prefix []byte, fn func(key, value []byte) error) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return ErrDatabaseClosed
+	}
+	matches, err := db.scanKeys(prefix, 0)
+	if err != nil {
+		return err
+	}
+	for _, m := range matches {
+		e, err := db.readMatch(m)
+		if err != nil {
+			return err
+		} else if err := fn(m.key, e.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetPrefix returns copies of the values of every live key starting with
+// prefix, by key, for reading small namespaces such as configuration trees
+// at once. It fails with ErrPrefixTooLarge, without reading any value, if
+// more than limit keys match, and once the keys and values read pass the
+// byte budget set by GetPrefixBudgetOption, so a mistaken prefix can't
+// materialize the whole database. Finding the keys reads the entry of
+// every live key, as Scan does.
+func (db *DB) GetPrefix(prefix []byte, limit int) (map[string][]byte, error) {
+	if limit <= 0 {
+		return nil, errors.Errorf("limit %d must be positive", limit)
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrDatabaseClosed
+	}
+	matches, err := db.scanKeys(prefix, limit+1)
+	if err != nil {
+		return nil, err
+	} else if len(matches) > limit {
+		return nil, errors.Wrapf(ErrPrefixTooLarge, "more than %d keys", limit)
+	}
+	budget := db.opts.getPrefixBudget
+	values := make(map[string][]byte, len(matches))
+	for _, m := range matches {
+		e, err := db.readMatch(m)
+		if err != nil {
+			return nil, err
+		}
+		if budget -= len(m.key) + len(e.data); budget < 0 {
+			return nil, errors.Wrapf(ErrPrefixTooLarge, "over budget of %d bytes", db.opts.getPrefixBudget)
+		}
+		values[string(m.key)] = append([]byte(nil), e.data...)
+	}
+	return values, nil
+}
+
+// scanKeys returns the live, unexpired keys starting with prefix, in
+// lexical order. If max is positive, it stops once max keys match,
+// returning those found first, in no particular relation to the others.
+// The caller must hold db.mu.
+func (db *DB) scanKeys(prefix []byte, max int) ([]scanMatch, error) {
+	now := db.now()
+	var matches []scanMatch
+	if err := db.index.ForEach(func(_ uint64, it item) error {
+		if max > 0 && len(matches) == max {
+			return errStopScan
+		}
+		segment := db.segment(it.ID())
+		if segment == nil && db.segmentMissing(it.ID()) {
+			return nil
+		} else if segment == nil {
+			return ErrSegmentNotFound
+		}
+		e, err := segment.ReadEntry(it.Offset())
+		if err != nil {
+			return err
+		} else if e.hdr.Flag == EntryDeleteFlag || e.expired(now) {
+			return nil
+		}
+		if key := db.decodeKey(e.key); bytes.HasPrefix(key, prefix) {
+			matches = append(matches, scanMatch{
+				key:     append([]byte(nil), key...),
+				encoded: append([]byte(nil), e.key...),
+				it:      it,
+			})
+		}
+		return nil
+	}); err != nil && err != errStopScan {
+		return nil, err
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return bytes.Compare(matches[i].key, matches[j].key) < 0
+	})
+	return matches, nil
+}
+
+// readMatch reads and verifies the entry of a key found by scanKeys. The
+// caller must hold db.mu.
+func (db *DB) readMatch(m scanMatch) (entry, error) {
+	return db.readEntry(db.segment(m.it.ID()), m.it.Offset(), m.encoded, true)
+}
@@ -0,0 +1,84 @@
+package archivedb
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_Scan(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	db, err := Open(dir, KeyTransformOption(PrefixKeyTransform([]byte("tenant/"))))
+	require.NoError(err)
+	defer db.Close()
+	for _, k := range []string{"user/3", "user/1", "group/1", "user/2", "user"} {
+		require.NoError(db.Put([]byte("tenant/"+k), []byte(k)))
+	}
+	require.NoError(db.Delete([]byte("tenant/user/2")))
+
+	scan := func(prefix string) (keys []string) {
+		require.NoError(db.Scan([]byte(prefix), func(key, value []byte) error {
+			require.Equal(key[len("tenant/"):], value)
+			keys = append(keys, string(key))
+			return nil
+		}))
+		return keys
+	}
+	require.Equal([]string{"tenant/user/1", "tenant/user/3"}, scan("tenant/user/"))
+	require.Equal([]string{"tenant/group/1", "tenant/user", "tenant/user/1", "tenant/user/3"}, scan(""))
+	require.Empty(scan("other/"))
+
+	stop := errors.New("stop")
+	calls := 0
+	require.Equal(stop, db.Scan(nil, func(_, _ []byte) error {
+		calls++
+		return stop
+	}))
+	require.Equal(1, calls)
+
+	require.NoError(db.Close())
+	require.ErrorIs(db.Scan(nil, nil), ErrDatabaseClosed)
+}
+
+func TestDB_GetPrefix(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	db, err := Open(dir, GetPrefixBudgetOption(40))
+	require.NoError(err)
+	defer db.Close()
+	for _, k := range []string{"config/a", "config/b", "config/c", "other"} {
+		require.NoError(db.Put([]byte(k), []byte("v"+k)))
+	}
+	require.NoError(db.Delete([]byte("config/c")))
+
+	values, err := db.GetPrefix([]byte("config/"), 2)
+	require.NoError(err)
+	require.Equal(map[string][]byte{"config/a": []byte("vconfig/a"), "config/b": []byte("vconfig/b")}, values)
+	values, err = db.GetPrefix([]byte("missing/"), 1)
+	require.NoError(err)
+	require.Empty(values)
+
+	_, err = db.GetPrefix([]byte("config/"), 1)
+	require.ErrorIs(err, ErrPrefixTooLarge)
+	_, err = db.GetPrefix(nil, 0)
+	require.Error(err)
+
+	// The keys and values now take 43 bytes.
+	require.NoError(db.Put([]byte("config/c"), []byte("v")))
+	_, err = db.GetPrefix([]byte("config/"), 10)
+	require.ErrorIs(err, ErrPrefixTooLarge)
+	require.NoError(db.SetOption(GetPrefixBudgetOption(64)))
+	values, err = db.GetPrefix([]byte("config/"), 10)
+	require.NoError(err)
+	require.Len(values, 3)
+	// A limited call stops collecting keys past the limit.
+	matches, err := db.scanKeys([]byte("config/"), 2)
+	require.NoError(err)
+	require.Len(matches, 2)
+}
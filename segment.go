@@ -3,26 +3,33 @@ package archivedb
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
 	"os"
+	"runtime/debug"
 	"strconv"
+	"sync/atomic"
 
+	"github.com/millken/archivedb/format"
 	"github.com/millken/archivedb/internal/mmap"
 	"github.com/pkg/errors"
 )
 
 const (
-	SegmentVersion        = 1
-	SegmentMagic          = "ArSeG"
+	SegmentVersion        = format.SegmentVersion
+	SegmentMagic          = format.SegmentMagic
 	SegmentSize    uint32 = 1 << 30 // 1GB
 
-	SegmentHeaderSize = 6 // magic + version
+	SegmentHeaderSize = format.SegmentHeaderSize // magic + version
 )
 
 var (
 	ErrInvalidSegment        = errors.New("invalid segment")
 	ErrInvalidSegmentVersion = errors.New("invalid segment version")
 	ErrSegmentNotWritable    = errors.New("segment not writable")
+	ErrSegmentIDsExhausted   = errors.New("segment ids exhausted")
 )
 
 type segmentHeader struct {
@@ -42,26 +49,70 @@ func (hdr *segmentHeader) WriteTo(w io.Writer) (n int64, err error) {
 }
 
 func decodeSegmentHeader(b []byte) (hdr segmentHeader, err error) {
-	if len(b) < SegmentHeaderSize {
+	fh, err := format.ParseSegmentHeader(b)
+	if err == format.ErrShortBuffer {
 		return hdr, errors.Wrap(ErrInvalidSegment, "invalid segment header")
-	}
-	magic := b[0:len(SegmentMagic)]
-	if !bytes.Equal(magic, []byte(SegmentMagic)) {
+	} else if err != nil {
 		return hdr, errors.Wrap(ErrInvalidSegment, "invalid magic")
 	}
-	hdr.Version = b[len(SegmentMagic)]
+	hdr.Version = fh.Version
 	return hdr, nil
 }
 
+// regionFile is the memory-mapped file a segment reads and writes
+// through. Tests substitute implementations that inject faults.
+type regionFile interface {
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	// ReadOff returns the length bytes at off without copying them.
+	ReadOff(off, length int) ([]byte, error)
+	Len() int
+	Sync() error
+	Close() error
+}
+
+// openRegionFile maps the file at path for segments. On error the file is
+// a nil *mmap.File, whose methods fail rather than panic, so a segment that
+// failed to open stays safe to use.
+var openRegionFile = func(path string, flag mmap.Flag) (regionFile, error) {
+	f, err := mmap.OpenFile(path, flag)
+	return f, err
+}
+
 type segment struct {
-	mmap *mmap.File
-	path string
-	size uint32
-	id   uint16
+	mmap     regionFile
+	path     string
+	size     uint32
+	id       uint32
+	stats    segmentScan
+	readOnly bool
+	detached bool // offline: not opened and holds no indexed keys
+	// missing is set on the placeholder of a segment whose file was gone
+	// or quarantined at Open. It isn't opened, but index items may still
+	// refer to it.
+	missing bool
+	// sealedSize is the size recorded when the segment was sealed, or
+	// zero. Open trusts it and stats instead of scanning the entries.
+	sealedSize uint32
+	// dict holds the []byte dictionary written first in the segment once
+	// it is read, nil if it has none.
+	dict atomic.Value
+	// dirty is 1 if entries were written since the last Flush. It is
+	// accessed atomically, as readers of the database may flush.
+	dirty int32
+}
+
+// segmentScan records what a segment holds.
+type segmentScan struct {
+	Entries    int64 // complete entries
+	Tombstones int64 // delete entries
+	TornBytes  int64 // bytes of a partially written tail entry that were cleared
 }
 
 // newSegment returns a new instance of segment.
-func newSegment(id uint16, path string) *segment {
+func newSegment(id uint32, path string) *segment {
 	return &segment{
 		id:   id,
 		path: path,
@@ -69,28 +120,15 @@ func newSegment(id uint16, path string) *segment {
 }
 
 // createSegment generates an empty segment at path.
-func createSegment(id uint16, path string) (*segment, error) {
+func createSegment(id uint32, path string) (*segment, error) {
 	// Generate segment in temp location.
-	f, err := os.Create(path + ".initializing")
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-
-	// Write header to file and close.
-	hdr := newSegmentHeader()
-	if _, err := hdr.WriteTo(f); err != nil {
-		return nil, err
-	} else if err := f.Sync(); err != nil {
-		return nil, err
-	} else if err := f.Truncate(int64(SegmentSize)); err != nil {
-		return nil, err
-	} else if err := f.Close(); err != nil {
+	tmp := path + ".initializing"
+	if err := initSegmentFile(tmp); err != nil {
 		return nil, err
 	}
 
 	// Swap with target path.
-	if err := os.Rename(f.Name(), path); err != nil {
+	if err := os.Rename(tmp, path); err != nil {
 		return nil, err
 	}
 
@@ -102,16 +140,52 @@ func createSegment(id uint16, path string) (*segment, error) {
 	return segment, nil
 }
 
+// initSegmentFile writes an empty, full size segment file at path.
+func initSegmentFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Write header to file and close.
+	hdr := newSegmentHeader()
+	if _, err := hdr.WriteTo(f); err != nil {
+		return err
+	} else if err := f.Sync(); err != nil {
+		return err
+	} else if err := f.Truncate(int64(SegmentSize)); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// offline returns true if the segment isn't opened: it is detached or
+// missing.
+func (s *segment) offline() bool { return s.detached || s.missing }
+
 // ID returns the id the segment was initialized with.
-func (s *segment) ID() uint16 { return s.id }
+func (s *segment) ID() uint32 { return s.id }
 
 // Size returns the size of the data in the segment.
 // This is only populated once InitForWrite() is called.
 func (s *segment) Size() uint32 { return s.size }
 
+// MappedSize returns the number of bytes mapped for the segment.
+func (s *segment) MappedSize() int64 {
+	if s.mmap == nil {
+		return 0
+	}
+	return int64(s.mmap.Len())
+}
+
 func (s *segment) Open() error {
 	if err := func() (err error) {
-		if s.mmap, err = mmap.OpenFile(s.path, mmap.Read|mmap.Write); err != nil {
+		flag := mmap.Read | mmap.Write
+		if s.readOnly {
+			flag = mmap.Read
+		}
+		if s.mmap, err = openRegionFile(s.path, flag); err != nil {
 			return err
 		}
 
@@ -126,19 +200,13 @@ func (s *segment) Open() error {
 		} else if hdr.Version != SegmentVersion {
 			return ErrInvalidSegmentVersion
 		}
-		for s.size = uint32(SegmentHeaderSize); s.size < uint32(s.mmap.Len()); {
-			buf, err := s.mmap.ReadOff(int(s.size), EntryHeaderSize)
-			if err != nil {
-				return err
-			}
-			hdr, err := readEntryHeader(buf)
-			if err != nil {
+		if s.sealedSize > 0 && int(s.sealedSize) <= s.mmap.Len() {
+			s.size = s.sealedSize
+		} else {
+			s.size, s.stats = 0, segmentScan{}
+			if err := s.scan(); err != nil {
 				return err
 			}
-			if !isValidEntryFlag(hdr.Flag) {
-				break
-			}
-			s.size += hdr.EntrySize()
 		}
 		if n, err := s.mmap.Seek(int64(s.size), io.SeekStart); err != nil {
 			return err
@@ -154,10 +222,114 @@ func (s *segment) Open() error {
 	return nil
 }
 
-func (s *segment) WriteEntry(e entry) error {
+// scan walks the entries from the end of the known data to find the end of
+// the segment. A partially written entry at the tail, either running past
+// the end of the file or failing its checksum, is cleared so later appends
+// don't leave fragments of it behind.
+func (s *segment) scan() error {
+	end := uint64(s.mmap.Len())
+	var last uint32 // offset of the last complete entry
+	var found int64 // entries found by this scan
+	torn := uint64(0)
+	if s.size < SegmentHeaderSize {
+		s.size = SegmentHeaderSize
+	}
+	for uint64(s.size)+EntryHeaderSize <= end {
+		buf, err := s.mmap.ReadOff(int(s.size), EntryHeaderSize)
+		if err != nil {
+			return err
+		}
+		hdr, err := readEntryHeader(buf)
+		if err != nil {
+			return err
+		}
+		if !isValidEntryFlag(hdr.Flag) {
+			break
+		}
+		if next := uint64(s.size) + uint64(hdr.EntrySize()); next > end {
+			torn = end
+			break
+		}
+		last = s.size
+		found++
+		s.stats.Entries += hdr.Entries()
+		if hdr.Flag == EntryDeleteFlag {
+			s.stats.Tombstones++
+		}
+		s.size += hdr.EntrySize()
+	}
+
+	if torn == 0 && found > 0 {
+		e, err := s.ReadEntry(last)
+		if err != nil {
+			return err
+		}
+		if e.hdr.Checksum != crc32.Checksum(e.value, CastagnoliCrcTable) {
+			torn = uint64(s.size)
+			s.size = last
+			s.stats.Entries -= e.hdr.Entries()
+			if e.hdr.Flag == EntryDeleteFlag {
+				s.stats.Tombstones--
+			}
+		}
+	}
+	if torn > 0 && !s.readOnly {
+		s.stats.TornBytes = int64(torn) - int64(s.size)
+		return s.zero(s.size, uint32(torn))
+	}
+	return nil
+}
+
+// Refresh picks up entries appended to the segment by another process. An
+// incomplete entry at the tail is left for a later Refresh.
+func (s *segment) Refresh() error {
+	return s.scan()
+}
+
+// zero clears the bytes in [from, to), skipping pages that are already
+// zero so holes in the preallocated file aren't materialized.
+func (s *segment) zero(from, to uint32) error {
+	const pageSize = 4096
+	zeros := make([]byte, pageSize)
+	for off := from; off < to; {
+		n := uint32(pageSize)
+		if to-off < n {
+			n = to - off
+		}
+		buf, err := s.mmap.ReadOff(int(off), int(n))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(buf, zeros[:n]) {
+			if _, err := s.mmap.WriteAt(zeros[:n], int64(off)); err != nil {
+				return err
+			}
+		}
+		off += n
+	}
+	return nil
+}
+
+// WriteEntry appends e to the segment. If the write fails part way, the
+// segment is rolled back to its previous size. A memory fault on the
+// mapping, raised when the filesystem can't back the written page, is
+// returned as ErrWriteFault.
+func (s *segment) WriteEntry(e entry) (err error) {
 	if !s.CanWrite(e) {
 		return ErrSegmentNotWritable
 	}
+	start := s.size
+	atomic.StoreInt32(&s.dirty, 1)
+	defer func() {
+		if err != nil && s.size != start {
+			s.size = start
+			if _, serr := s.mmap.Seek(int64(start), io.SeekStart); serr != nil {
+				err = errors.Wrapf(err, "roll back: %v", serr)
+			}
+		}
+	}()
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer recoverFault(&err, ErrWriteFault)
 
 	// Write entry header.
 	n, err := s.mmap.Write(e.hdr.Encode())
@@ -183,9 +355,31 @@ func (s *segment) WriteEntry(e entry) error {
 		return errors.Wrapf(ErrInvalidEntryHeader, "write value length %d", n)
 	}
 	s.size += uint32(n)
+	s.stats.Entries++
+	if e.hdr.Flag == EntryDeleteFlag {
+		s.stats.Tombstones++
+	}
 	return nil
 }
 
+// ReadEntryHeader reads the header of the entry at off.
+func (s *segment) ReadEntryHeader(off uint32) (EntryHeader, error) {
+	if off >= s.size {
+		return EntryHeader{}, errors.Wrap(ErrInvalidOffset, "request offset exceeds segment size")
+	}
+	buf, err := s.mmap.ReadOff(int(off), EntryHeaderSize)
+	if err != nil {
+		return EntryHeader{}, err
+	}
+	hdr, err := readEntryHeader(buf)
+	if err != nil {
+		return hdr, err
+	} else if !isValidEntryFlag(hdr.Flag) {
+		return hdr, errors.Wrap(ErrInvalidOffset, "invalid entry flag")
+	}
+	return hdr, nil
+}
+
 func (s *segment) ReadEntry(off uint32) (e entry, err error) {
 	if off >= s.size {
 		return e, errors.Wrap(ErrInvalidOffset, "request offset exceeds segment size")
@@ -212,7 +406,8 @@ func (s *segment) ReadEntry(off uint32) (e entry, err error) {
 	if err != nil {
 		return e, err
 	}
-	return
+	e.seg = s.ID()
+	return e, e.split()
 }
 
 func (s *segment) ForEachEntry(fn func(e entry) error) error {
@@ -229,6 +424,9 @@ func (s *segment) ForEachEntry(fn func(e entry) error) error {
 		}
 		if !isValidEntryFlag(hdr.Flag) {
 			break
+		} else if hdr.Flag == EntryHoleFlag {
+			i += hdr.EntrySize()
+			continue
 		}
 		start := i + EntryHeaderSize
 		key := make([]byte, hdr.KeySize)
@@ -244,8 +442,10 @@ func (s *segment) ForEachEntry(fn func(e entry) error) error {
 		} else if n != int(hdr.ValueSize) {
 			return errors.Wrapf(ErrInvalidEntryHeader, "read value length %d", n)
 		}
-		e := createEntry(hdr.Flag, key, value)
-		if err := fn(e); err != nil {
+		e := entry{key: key, value: value, hdr: hdr, seg: s.ID()}
+		if err := e.split(); err != nil {
+			return err
+		} else if err := fn(e); err != nil {
 			return err
 		}
 		i += hdr.EntrySize()
@@ -253,9 +453,63 @@ func (s *segment) ForEachEntry(fn func(e entry) error) error {
 	return nil
 }
 
-// Close unmaps the segment.
-func (s *segment) Close() (err error) {
+// forEachKey calls fn with the offset, header and stored key of every
+// entry of s before end, skipping holes and chunks, which have no key.
+// key is only valid during the call.
+func (s *segment) forEachKey(end uint32, fn func(off uint32, hdr EntryHeader, key []byte) error) error {
+	for off := uint32(SegmentHeaderSize); off < end; {
+		hdr, err := s.ReadEntryHeader(off)
+		if err != nil {
+			return err
+		}
+		entryOff := off
+		off += hdr.EntrySize()
+		if hdr.Flag == EntryHoleFlag || hdr.Flag == EntryChunkFlag {
+			continue
+		}
+		key, err := s.mmap.ReadOff(int(entryOff+EntryHeaderSize), int(hdr.KeySize))
+		if err != nil {
+			return err
+		} else if err := fn(entryOff, hdr, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sequentially calls fn with the kernel advised that the segment is read
+// from start to end, restoring random access advice afterwards. Files that
+// can't take advice are read as they are.
+func (s *segment) sequentially(fn func() error) error {
+	a, ok := s.mmap.(interface{ Advise(mmap.Advice) error })
+	if !ok {
+		return fn()
+	}
+	if err := a.Advise(mmap.Sequential); err != nil {
+		return err
+	}
+	err := fn()
+	if aerr := a.Advise(mmap.Random); aerr != nil && err == nil {
+		err = aerr
+	}
+	return err
+}
+
+// Checksum returns the CRC-32C of the segment data, including its header.
+func (s *segment) Checksum() (uint32, error) {
+	buf, err := s.mmap.ReadOff(0, int(s.size))
+	if err != nil {
+		return 0, err
+	}
+	return crc32.Checksum(buf, CastagnoliCrcTable), nil
+}
 
+// Close unmaps the segment. It is safe to call on a segment that failed to
+// open.
+func (s *segment) Close() (err error) {
+	if s.mmap == nil {
+		return nil
+	}
 	return s.mmap.Close()
 }
 
@@ -266,11 +520,71 @@ func (s *segment) CanWrite(e entry) bool {
 
 // Flush flushes the buffer to disk.
 func (s *segment) Flush() error {
-	return s.mmap.Sync()
+	atomic.StoreInt32(&s.dirty, 0)
+	if err := s.mmap.Sync(); err != nil {
+		atomic.StoreInt32(&s.dirty, 1)
+		return err
+	}
+	return nil
+}
+
+// Dirty returns true if entries were written since the last Flush.
+func (s *segment) Dirty() bool { return atomic.LoadInt32(&s.dirty) == 1 }
+
+// validateSegmentFile checks that the file at path starts with a valid
+// segment header without mapping it.
+func validateSegmentFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return readSegmentHeader(f)
+}
+
+// readSegmentHeader reads a segment header from r and checks it.
+func readSegmentHeader(r io.Reader) error {
+	buf := make([]byte, SegmentHeaderSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return errors.Wrap(ErrInvalidSegment, "truncated segment header")
+	}
+	hdr, err := decodeSegmentHeader(buf)
+	if err != nil {
+		return err
+	} else if hdr.Version != SegmentVersion {
+		return ErrInvalidSegmentVersion
+	}
+	return nil
+}
+
+// extendFile grows the file at path to size bytes, if it is smaller.
+func extendFile(path string, size int64) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	} else if fi.Size() >= size {
+		return nil
+	}
+	return os.Truncate(path, size)
+}
+
+// segmentFilename returns the hexadecimal filename for a segment id: 4
+// digits, or 8 for ids that don't fit.
+func segmentFilename(id uint32) string {
+	if id > math.MaxUint16 {
+		return fmt.Sprintf("%08x", id)
+	}
+	return fmt.Sprintf("%04x", id)
 }
 
 // parseSegmentFilename returns the id represented by the hexadecimal filename.
-func parseSegmentFilename(filename string) (uint16, error) {
+func parseSegmentFilename(filename string) (uint32, error) {
+	if len(filename) != 4 && len(filename) != 8 {
+		return 0, errors.Errorf("invalid segment filename %q", filename)
+	}
 	i, err := strconv.ParseUint(filename, 16, 32)
-	return uint16(i), err
+	if err == nil && segmentFilename(uint32(i)) != filename {
+		return 0, errors.Errorf("invalid segment filename %q", filename)
+	}
+	return uint32(i), err
 }
@@ -2,8 +2,11 @@ package archivedb
 
 import (
 	"bytes"
+	"math"
 	"path/filepath"
 	"testing"
+
+	"github.com/stretchr/testify/require"
 )
 
 func TestSegment(t *testing.T) {
@@ -68,3 +71,41 @@ func TestSegment(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestSegment_OpenFailure(t *testing.T) {
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	segment := newSegment(0, filepath.Join(dir, "missing"))
+	if err := segment.Open(); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := segment.ReadEntry(0); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := segment.WriteEntry(createEntry(EntryInsertFlag, []byte("foo"), nil)); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := segment.Flush(); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := segment.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSegmentFilename(t *testing.T) {
+	require := require.New(t)
+	for _, id := range []uint32{0, 0xffff, 0x10000, math.MaxUint32} {
+		name := segmentFilename(id)
+		parsed, err := parseSegmentFilename(name)
+		require.NoError(err)
+		require.Equal(id, parsed, name)
+	}
+	require.Equal("ffff", segmentFilename(0xffff))
+	require.Equal("00010000", segmentFilename(0x10000))
+	for _, name := range []string{"0000ffff", "001", "0000000g", "index"} {
+		_, err := parseSegmentFilename(name)
+		require.Error(err, name)
+	}
+}
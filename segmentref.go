@@ -0,0 +1,87 @@
+package archivedb
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ErrSegmentReferenced is returned when detaching a segment held by a
+// SegmentRef.
+var ErrSegmentReferenced = errors.New("segment is referenced")
+
+// SegmentRef holds a sealed segment file in place, so it can be read
+// directly, for instance to upload it elsewhere, without being replaced
+// by a compaction or detached while it is read. Compaction skips held
+// segments until they are released.
+type SegmentRef struct {
+	db       *DB
+	id       uint32
+	path     string
+	size     int64
+	checksum uint32
+	release  sync.Once
+}
+
+// AcquireSegmentRef returns a SegmentRef holding the sealed segment id.
+// It must be released with Release once the file isn't read anymore.
+func (db *DB) AcquireSegmentRef(id uint32) (*SegmentRef, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil, ErrDatabaseClosed
+	}
+	s := db.segment(id)
+	if s == nil {
+		return nil, ErrSegmentNotFound
+	} else if s.detached {
+		return nil, ErrSegmentDetached
+	}
+	sc, ok := db.manifest.sealed(id)
+	if !ok {
+		return nil, errors.Errorf("segment %s is not sealed", segmentFilename(id))
+	}
+	db.holdSegment(id)
+	return &SegmentRef{db: db, id: id, path: s.path, size: int64(sc.Size), checksum: sc.Checksum}, nil
+}
+
+// ID returns the id of the segment.
+func (r *SegmentRef) ID() uint32 { return r.id }
+
+// Path returns the path of the segment file.
+func (r *SegmentRef) Path() string { return r.path }
+
+// Size returns the size of the segment file.
+func (r *SegmentRef) Size() int64 { return r.size }
+
+// Checksum returns the CRC-32C of the segment file recorded in the
+// manifest, to check copies of it against.
+func (r *SegmentRef) Checksum() uint32 { return r.checksum }
+
+// Release lets the segment be compacted and detached again. Releasing a
+// released ref does nothing.
+func (r *SegmentRef) Release() {
+	r.release.Do(func() {
+		r.db.mu.Lock()
+		defer r.db.mu.Unlock()
+		r.db.releaseSegment(r.id)
+	})
+}
+
+// holdSegment keeps segment id from being compacted, punched or detached
+// until releaseSegment is called for it. The caller must hold db.mu for
+// writing.
+func (db *DB) holdSegment(id uint32) {
+	if db.segmentRefs == nil {
+		db.segmentRefs = make(map[uint32]int)
+	}
+	db.segmentRefs[id]++
+}
+
+// releaseSegment undoes a call to holdSegment. The caller must hold db.mu
+// for writing.
+func (db *DB) releaseSegment(id uint32) {
+	if db.segmentRefs[id]--; db.segmentRefs[id] == 0 {
+		delete(db.segmentRefs, id)
+	}
+}
@@ -0,0 +1,54 @@
+package archivedb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_AcquireSegmentRef(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+
+	for i := 0; i < 4; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value")))
+	}
+	_, err = db.AcquireSegmentRef(0)
+	require.Error(err, "active segment")
+	_, err = db.AcquireSegmentRef(7)
+	require.ErrorIs(err, ErrSegmentNotFound)
+	mustRollover(t, db)
+	for i := 0; i < 4; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value")))
+	}
+
+	ref, err := db.AcquireSegmentRef(0)
+	require.NoError(err)
+	ref2, err := db.AcquireSegmentRef(0)
+	require.NoError(err)
+	require.Equal(uint32(0), ref.ID())
+	require.NoError(verifySegmentFile(ref.Path(), SegmentChecksum{Size: uint32(ref.Size()), Checksum: ref.Checksum()}))
+	require.Equal(int64(db.segment(0).Size()), ref.Size())
+
+	plan, err := db.PlanCompaction()
+	require.NoError(err)
+	require.Empty(plan.Segments)
+	require.ErrorIs(db.DetachSegment(0), ErrSegmentReferenced)
+
+	// Both refs must be released; releasing twice counts once.
+	ref.Release()
+	ref.Release()
+	plan, err = db.PlanCompaction()
+	require.NoError(err)
+	require.Empty(plan.Segments)
+	ref2.Release()
+	plan, err = db.PlanCompaction()
+	require.NoError(err)
+	require.Len(plan.Segments, 1)
+	require.NoError(db.Compact())
+}
@@ -0,0 +1,44 @@
+package archivedb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_ScanSequential(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	clock := newFakeClock()
+	db, err := Open(dir, ClockOption(clock))
+	require.NoError(err)
+	defer db.Close()
+
+	require.NoError(db.Put([]byte("a"), []byte("1")))
+	require.NoError(db.Put([]byte("b"), []byte("2")))
+	require.NoError(db.Put([]byte("e"), []byte("5")))
+	mustRollover(t, db)
+	require.NoError(db.Put([]byte("a"), []byte("3")))
+	require.NoError(db.Put([]byte("c"), []byte("4")))
+	require.NoError(db.Delete([]byte("b")))
+	require.NoError(db.PutWithTTL([]byte("d"), []byte("x"), time.Minute))
+	clock.Add(time.Hour)
+
+	type pos struct {
+		seq     uint64
+		segment uint32
+		key     string
+		value   string
+	}
+	var got []pos
+	require.NoError(db.ScanSequential(func(e RawEntry) error {
+		got = append(got, pos{e.Seq, e.Segment, string(e.Key), string(e.Value)})
+		return nil
+	}))
+	require.Equal([]pos{{3, 0, "e", "5"}, {4, 1, "a", "3"}, {5, 1, "c", "4"}}, got)
+
+	require.NoError(db.Close())
+	require.ErrorIs(db.ScanSequential(func(e RawEntry) error { return nil }), ErrDatabaseClosed)
+}
@@ -0,0 +1,182 @@
+package archivedb
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrDatabaseExists = errors.New("database already exists")
+
+// Split copies the live entries of the database at src into two new
+// databases: keys lower than splitKey go to lo, the others to hi. The
+// source is opened read-only and left untouched; it must exist. lo and hi
+// must not already contain data.
+func Split(src, lo, hi string, splitKey []byte, options ...Option) error {
+	for _, path := range []string{lo, hi} {
+		if empty, err := isEmptyDir(path); err != nil {
+			return err
+		} else if !empty {
+			return errors.Wrap(ErrDatabaseExists, path)
+		}
+	}
+
+	sdb, err := openSource(src, options...)
+	if err != nil {
+		return errors.Wrap(err, "open source")
+	}
+	defer sdb.Close()
+	ldb, err := Open(lo, options...)
+	if err != nil {
+		return errors.Wrap(err, "open lower shard")
+	}
+	defer ldb.Close()
+	hdb, err := Open(hi, options...)
+	if err != nil {
+		return errors.Wrap(err, "open upper shard")
+	}
+	defer hdb.Close()
+
+	sdb.mu.RLock()
+	defer sdb.mu.RUnlock()
+	if err := sdb.forEachLiveEntry(true, func(e entry) error {
+		if bytes.Compare(e.key, splitKey) < 0 {
+			return copyEntry(ldb, e, e.data)
+		}
+		return copyEntry(hdb, e, e.data)
+	}); err != nil {
+		return err
+	}
+
+	if err := ldb.Close(); err != nil {
+		return err
+	}
+	return hdb.Close()
+}
+
+// mergeWinner is the source holding the newest entry of a key found by
+// Merge.
+type mergeWinner struct {
+	src     int
+	seq     uint64
+	deleted bool
+}
+
+// Merge copies the live entries of the databases in srcs into a new
+// database at dst. A key written in several sources gets the value of the
+// entry with the highest sequence number, the later source winning a tie,
+// and is left out if that entry is a tombstone. Sequence numbers count the
+// writes of each database, so this picks the newest write when the
+// sources share a history, as the shards made by Split do, or were written
+// at similar rates. The sources are opened read-only and left untouched;
+// they must exist. dst must not already contain data.
+func Merge(dst string, srcs []string, options ...Option) error {
+	if empty, err := isEmptyDir(dst); err != nil {
+		return err
+	} else if !empty {
+		return errors.Wrap(ErrDatabaseExists, dst)
+	}
+	sdbs := make([]*DB, 0, len(srcs))
+	defer func() {
+		for _, sdb := range sdbs {
+			sdb.Close()
+		}
+	}()
+	for _, src := range srcs {
+		sdb, err := openSource(src, options...)
+		if err != nil {
+			return errors.Wrapf(err, "open source %s", src)
+		}
+		sdbs = append(sdbs, sdb)
+	}
+
+	// Find the source with the newest entry of every key. Values are only
+	// decoded for the entries copied.
+	winners := make(map[string]mergeWinner)
+	for i, sdb := range sdbs {
+		if err := sdb.forEachRaw(EntryFilter{}, func(e RawEntry, _ *entry) error {
+			if e.Header.Flag != EntryInsertFlag && e.Header.Flag != EntryDeleteFlag {
+				return nil
+			}
+			if w, ok := winners[string(e.Key)]; !ok || e.Seq >= w.seq {
+				winners[string(e.Key)] = mergeWinner{i, e.Seq, e.Header.Flag == EntryDeleteFlag}
+			}
+			return nil
+		}); err != nil {
+			return errors.Wrapf(err, "read source %s", srcs[i])
+		}
+	}
+
+	ddb, err := Open(dst, options...)
+	if err != nil {
+		return errors.Wrap(err, "open destination")
+	}
+	defer ddb.Close()
+	for i, sdb := range sdbs {
+		if err := sdb.forEachRaw(EntryFilter{Flag: EntryInsertFlag}, func(raw RawEntry, e *entry) error {
+			if w := winners[string(raw.Key)]; w.src != i || w.seq != raw.Seq || w.deleted {
+				return nil
+			}
+			if err := sdb.decodeValue(e); err != nil {
+				return err
+			}
+			raw.Value = e.data
+			return copyRawEntry(ddb, raw)
+		}); err != nil {
+			return errors.Wrapf(err, "merge %s", srcs[i])
+		}
+	}
+	return ddb.Close()
+}
+
+// openSource opens the existing database at path read-only.
+func openSource(path string, options ...Option) (*DB, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return Open(path, append(options, FollowerOption(0))...)
+}
+
+// copyRawEntry puts the value of e into db, keeping what is left of its
+// TTL. An entry that expired is skipped.
+func copyRawEntry(db *DB, e RawEntry) error {
+	var opts WriteOptions
+	if !e.Expires.IsZero() {
+		if opts.TTL = e.Expires.Sub(db.now()); opts.TTL <= 0 {
+			return nil
+		}
+	}
+	return db.PutWithOptions(e.Key, e.Value, opts)
+}
+
+// copyEntry puts value under the key of e into db, keeping what is left of
+// the TTL of e. An entry that expired since it was read is skipped.
+func copyEntry(db *DB, e entry, value []byte) error {
+	var opts WriteOptions
+	if e.expires != 0 {
+		if opts.TTL = time.Unix(0, e.expires).Sub(db.now()); opts.TTL <= 0 {
+			return nil
+		}
+	}
+	return db.PutWithOptions(e.key, value, opts)
+}
+
+// isEmptyDir returns true if path doesn't exist or is an empty directory.
+func isEmptyDir(path string) (bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	if _, err := f.Readdirnames(1); err == io.EOF {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return false, nil
+}
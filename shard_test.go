@@ -0,0 +1,103 @@
+package archivedb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplit(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	src := filepath.Join(dir, "src")
+
+	db, err := Open(src)
+	require.NoError(err)
+	for i := 0; i < 10; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))))
+	}
+	require.NoError(db.Delete([]byte("key1")))
+	require.NoError(db.Close())
+
+	lo, hi := filepath.Join(dir, "lo"), filepath.Join(dir, "hi")
+	missing := filepath.Join(dir, "missing")
+	require.Error(Split(missing, lo, hi, []byte("key5")))
+	_, err = os.Stat(missing)
+	require.True(os.IsNotExist(err))
+	require.NoError(Split(src, lo, hi, []byte("key5")))
+	require.ErrorIs(Split(src, lo, hi, []byte("key5")), ErrDatabaseExists)
+
+	ldb, err := Open(lo)
+	require.NoError(err)
+	defer ldb.Close()
+	hdb, err := Open(hi)
+	require.NoError(err)
+	defer hdb.Close()
+
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		in, out := ldb, hdb
+		if i >= 5 {
+			in, out = hdb, ldb
+		}
+		_, err := out.Get(key)
+		require.ErrorIs(err, ErrKeyNotFound)
+		v, err := in.Get(key)
+		if i == 1 {
+			require.ErrorIs(err, ErrKeyNotFound)
+			continue
+		}
+		require.NoError(err)
+		require.Equal([]byte(fmt.Sprintf("value%d", i)), v)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	a, b, dst := filepath.Join(dir, "a"), filepath.Join(dir, "b"), filepath.Join(dir, "dst")
+
+	// a: k1, k2, k2 deleted, k4, k3 with seqs 1-5; b: k2, k3, k1, k4, k1
+	// deleted with seqs 1-5.
+	db, err := Open(a)
+	require.NoError(err)
+	require.NoError(db.Put([]byte("k1"), []byte("a1")))
+	require.NoError(db.Put([]byte("k2"), []byte("a2")))
+	require.NoError(db.Delete([]byte("k2")))
+	require.NoError(db.Put([]byte("k4"), []byte("a4")))
+	require.NoError(db.Put([]byte("k3"), []byte("a3")))
+	require.NoError(db.Close())
+	db, err = Open(b)
+	require.NoError(err)
+	require.NoError(db.Put([]byte("k2"), []byte("b2")))
+	require.NoError(db.Put([]byte("k3"), []byte("b3")))
+	require.NoError(db.Put([]byte("k1"), []byte("b1")))
+	require.NoError(db.Put([]byte("k4"), []byte("b4")))
+	require.NoError(db.Delete([]byte("k1")))
+	require.NoError(db.Close())
+
+	require.Error(Merge(dst, []string{a, filepath.Join(dir, "missing")}))
+	_, err = os.Stat(filepath.Join(dir, "missing"))
+	require.True(os.IsNotExist(err))
+	require.NoError(Merge(dst, []string{a, b}))
+	require.ErrorIs(Merge(dst, []string{a, b}), ErrDatabaseExists)
+
+	db, err = Open(dst)
+	require.NoError(err)
+	defer db.Close()
+	// k4 is written fourth in both, so the later source wins.
+	for k, want := range map[string]string{"k1": "", "k2": "", "k3": "a3", "k4": "b4"} {
+		v, err := db.Get([]byte(k))
+		if want == "" {
+			require.ErrorIs(err, ErrKeyNotFound, k)
+			continue
+		}
+		require.NoError(err)
+		require.Equal(want, string(v))
+	}
+}
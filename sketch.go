@@ -0,0 +1,102 @@
+package archivedb
+
+import (
+	"math"
+	"math/bits"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// sketchPrecision is the number of hash bits that pick a register of
+	// the key sketch. 2^12 registers give a standard error of about 1.6%
+	// and keep the manifest small.
+	sketchPrecision = 12
+	sketchRegisters = 1 << sketchPrecision
+)
+
+// keySketch is a HyperLogLog of key hashes: register i holds the highest
+// rank, the position of the first set bit after the register bits, of the
+// hashes picking it.
+type keySketch []byte
+
+// newKeySketch returns an empty sketch.
+func newKeySketch() keySketch { return make(keySketch, sketchRegisters) }
+
+// add records the key with hash k and returns true if the sketch changed.
+func (s keySketch) add(k uint64) bool {
+	h := mix64(k)
+	i := h >> (64 - sketchPrecision)
+	rank := uint8(bits.LeadingZeros64(h<<sketchPrecision|1<<(sketchPrecision-1))) + 1
+	if rank <= s[i] {
+		return false
+	}
+	s[i] = rank
+	return true
+}
+
+// estimate returns the approximate number of distinct hashes added.
+func (s keySketch) estimate() int64 {
+	m := float64(len(s))
+	var sum float64
+	zeros := 0
+	for _, r := range s {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		// Linear counting is more accurate for small counts.
+		e = m * math.Log(m/float64(zeros))
+	}
+	return int64(e + 0.5)
+}
+
+// mix64 spreads the bits of a key hash, which may come from a weak
+// HashFuncOption, over the whole word.
+func mix64(k uint64) uint64 {
+	k ^= k >> 30
+	k *= 0xbf58476d1ce4e5b9
+	k ^= k >> 27
+	k *= 0x94d049bb133111eb
+	return k ^ k>>31
+}
+
+// openKeySketch makes sure the manifest has a key sketch and adds the keys
+// in the index to it, which covers keys written after the manifest was
+// last saved.
+func (db *DB) openKeySketch() error {
+	switch len(db.manifest.KeysEver) {
+	case 0:
+		db.manifest.KeysEver = newKeySketch()
+	case sketchRegisters:
+	default:
+		return errors.Wrapf(ErrInvalidManifest, "key sketch of %d registers", len(db.manifest.KeysEver))
+	}
+	return db.index.ForEach(func(k uint64, _ item) error {
+		db.addKeySketch(k)
+		return nil
+	})
+}
+
+// addKeySketch records that the key with hash k was written. The caller
+// must hold db.mu for writing.
+func (db *DB) addKeySketch(k uint64) {
+	if keySketch(db.manifest.KeysEver).add(k) {
+		db.sketchChanged = true
+	}
+}
+
+// ApproxTotalKeysEver returns an estimate, within a few percent, of the
+// number of distinct keys ever put or deleted, purged keys included. The
+// estimate is kept in the manifest, which is saved when a segment is sealed
+// and on Close; Open adds back the keys in the index, so only keys purged
+// since the manifest was last saved can be lost in a crash. A follower
+// counts the keys it saw when it was opened.
+func (db *DB) ApproxTotalKeysEver() int64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return keySketch(db.manifest.KeysEver).estimate()
+}
@@ -0,0 +1,67 @@
+package archivedb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeySketch(t *testing.T) {
+	require := require.New(t)
+	s := newKeySketch()
+	require.Zero(s.estimate())
+	require.True(s.add(1))
+	require.False(s.add(1))
+	require.Equal(int64(1), s.estimate())
+
+	for i := uint64(0); i < 100000; i++ {
+		s.add(DefaultHashFunc([]byte(fmt.Sprintf("key%d", i))))
+	}
+	require.InEpsilon(100000, s.estimate(), 0.05)
+}
+
+func TestDB_ApproxTotalKeysEver(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+
+	require.Zero(db.ApproxTotalKeysEver())
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		require.NoError(db.Put(key, []byte("v1")))
+		require.NoError(db.Put(key, []byte("v2")))
+	}
+	for i := 0; i < 500; i++ {
+		require.NoError(db.Delete([]byte(fmt.Sprintf("key%d", i))))
+	}
+	n := db.ApproxTotalKeysEver()
+	require.InEpsilon(1000, n, 0.05)
+
+	// The sketch is saved in the manifest on Close.
+	require.NoError(db.Close())
+	m, err := readManifest(db.ManifestPath())
+	require.NoError(err)
+	require.Len(m.KeysEver, sketchRegisters)
+	db, err = Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	require.Equal(n, db.ApproxTotalKeysEver())
+
+	for i := 0; i < 1000; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("new%d", i)), []byte("v")))
+	}
+	require.InEpsilon(2000, db.ApproxTotalKeysEver(), 0.05)
+
+	// A manifest without a sketch is seeded from the index.
+	require.NoError(db.Close())
+	m.KeysEver = nil
+	require.NoError(m.Write(db.ManifestPath()))
+	db, err = Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	require.InEpsilon(2000, db.ApproxTotalKeysEver(), 0.05)
+}
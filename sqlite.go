@@ -0,0 +1,338 @@
+package archivedb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+// The SQLite database file written by ExportSQLite. See
+// https://www.sqlite.org/fileformat.html for the format.
+const (
+	sqlitePageSize = 4096
+	// sqliteFanout is the most children an interior page is given: with
+	// the largest cells, 2 bytes of cell pointer, a 4 byte child and a 9
+	// byte rowid, the cells of the others fit in the page.
+	sqliteFanout = (sqlitePageSize-12)/15 + 1
+	// sqliteTable defines the table ExportSQLite fills. It has no primary
+	// key, which would need an index b-tree too; keys are unique anyway.
+	sqliteTable = "CREATE TABLE archive (key BLOB NOT NULL, value BLOB NOT NULL, timestamp INTEGER, flag INTEGER NOT NULL)"
+)
+
+// B-tree page types.
+const (
+	sqliteInteriorTable = 0x05
+	sqliteLeafTable     = 0x0d
+)
+
+// sqliteExportWriter writes the rows as a SQLite database file with a
+// single table b-tree. Its pages, from page 2 on, are written in order to
+// a temporary file as leaves fill up; the interior pages are added at the
+// end, and then page 1, which holds the database header and the schema
+// naming the root page, is written to w followed by the others.
+type sqliteExportWriter struct {
+	w     io.Writer
+	spool *os.File
+	buf   *bufio.Writer
+	pages uint32 // pages written to spool
+	rowid int64
+	// cells are the cells of the leaf being filled, and used the bytes
+	// of the leaf they and its header take.
+	cells  [][]byte
+	used   int
+	leaves []sqliteChild
+}
+
+// sqliteChild is a page of the table b-tree and the largest rowid in it.
+type sqliteChild struct {
+	page  uint32
+	rowid int64
+}
+
+func (w *sqliteExportWriter) Begin() (err error) {
+	if w.spool, err = os.CreateTemp("", "archivedb-export-*.sqlite"); err != nil {
+		return err
+	}
+	w.buf = bufio.NewWriter(w.spool)
+	w.used = 8
+	return nil
+}
+
+func (w *sqliteExportWriter) Write(row exportRow) error {
+	cell, err := w.cell(w.rowid+1, sqliteRecord(row))
+	if err != nil {
+		return err
+	}
+	if w.used+2+len(cell) > sqlitePageSize {
+		if err := w.flushLeaf(); err != nil {
+			return err
+		}
+	}
+	w.rowid++
+	w.cells = append(w.cells, cell)
+	w.used += 2 + len(cell)
+	return nil
+}
+
+func (w *sqliteExportWriter) End() error {
+	// An empty table is a single empty leaf.
+	if len(w.cells) > 0 || len(w.leaves) == 0 {
+		if err := w.flushLeaf(); err != nil {
+			return err
+		}
+	}
+	children := w.leaves
+	for len(children) > 1 {
+		var err error
+		if children, err = w.addInteriorLevel(children); err != nil {
+			return err
+		}
+	}
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+
+	if _, err := w.w.Write(w.firstPage(children[0].page)); err != nil {
+		return err
+	} else if _, err := w.spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.Copy(w.w, w.spool)
+	return err
+}
+
+// Close removes the temporary file.
+func (w *sqliteExportWriter) Close() error {
+	if w.spool == nil {
+		return nil
+	}
+	w.spool.Close()
+	err := os.Remove(w.spool.Name())
+	w.spool = nil
+	return err
+}
+
+// writePage appends page to the spool and returns its page number.
+func (w *sqliteExportWriter) writePage(page []byte) (uint32, error) {
+	if _, err := w.buf.Write(page); err != nil {
+		return 0, err
+	}
+	w.pages++
+	return w.pages + 1, nil
+}
+
+// cell returns the leaf cell of a row, writing the part of its payload
+// that doesn't fit in the leaf to overflow pages.
+func (w *sqliteExportWriter) cell(rowid int64, payload []byte) ([]byte, error) {
+	// The most and least of a payload kept in the leaf, from the format.
+	const (
+		maxLocal = sqlitePageSize - 35
+		minLocal = (sqlitePageSize-12)*32/255 - 23
+	)
+	local := len(payload)
+	if local > maxLocal {
+		local = minLocal + (len(payload)-minLocal)%(sqlitePageSize-4)
+		if local > maxLocal {
+			local = minLocal
+		}
+	}
+	cell := appendSqliteVarint(nil, uint64(len(payload)))
+	cell = appendSqliteVarint(cell, uint64(rowid))
+	cell = append(cell, payload[:local]...)
+	if local == len(payload) {
+		return cell, nil
+	}
+
+	// Overflow pages are written in a run, each pointing at the next.
+	first := w.pages + 2
+	for rest := payload[local:]; len(rest) > 0; {
+		page := make([]byte, sqlitePageSize)
+		n := copy(page[4:], rest)
+		if rest = rest[n:]; len(rest) > 0 {
+			binary.BigEndian.PutUint32(page, w.pages+3)
+		}
+		if _, err := w.writePage(page); err != nil {
+			return nil, err
+		}
+	}
+	return appendUint32(cell, first), nil
+}
+
+// flushLeaf writes the leaf being filled, which ends with the last row
+// added.
+func (w *sqliteExportWriter) flushLeaf() error {
+	page := make([]byte, sqlitePageSize)
+	fillSqlitePage(page, 0, sqliteLeafTable, w.cells, 0)
+	n, err := w.writePage(page)
+	if err != nil {
+		return err
+	}
+	w.leaves = append(w.leaves, sqliteChild{page: n, rowid: w.rowid})
+	w.cells, w.used = nil, 8
+	return nil
+}
+
+// addInteriorLevel writes interior pages over children, spread evenly so
+// that none is left with a single child, and returns them.
+func (w *sqliteExportWriter) addInteriorLevel(children []sqliteChild) ([]sqliteChild, error) {
+	n := (len(children) + sqliteFanout - 1) / sqliteFanout
+	parents := make([]sqliteChild, 0, n)
+	for i := 0; i < n; i++ {
+		group := children[len(children)*i/n : len(children)*(i+1)/n]
+		cells := make([][]byte, 0, len(group)-1)
+		for _, c := range group[:len(group)-1] {
+			cell := appendUint32(nil, c.page)
+			cells = append(cells, appendSqliteVarint(cell, uint64(c.rowid)))
+		}
+		last := group[len(group)-1]
+		page := make([]byte, sqlitePageSize)
+		fillSqlitePage(page, 0, sqliteInteriorTable, cells, last.page)
+		p, err := w.writePage(page)
+		if err != nil {
+			return nil, err
+		}
+		parents = append(parents, sqliteChild{page: p, rowid: last.rowid})
+	}
+	return parents, nil
+}
+
+// firstPage returns page 1: the database header and the schema table,
+// which holds the archive table with its b-tree rooted at root.
+func (w *sqliteExportWriter) firstPage(root uint32) []byte {
+	page := make([]byte, sqlitePageSize)
+	copy(page, "SQLite format 3\x00")
+	binary.BigEndian.PutUint16(page[16:], sqlitePageSize)
+	page[18], page[19] = 1, 1 // legacy journaling
+	page[21], page[22], page[23] = 64, 32, 32
+	binary.BigEndian.PutUint32(page[24:], 1) // change counter
+	binary.BigEndian.PutUint32(page[28:], w.pages+1)
+	binary.BigEndian.PutUint32(page[40:], 1) // schema cookie
+	binary.BigEndian.PutUint32(page[44:], 4) // schema format
+	binary.BigEndian.PutUint32(page[56:], 1) // UTF-8
+	binary.BigEndian.PutUint32(page[92:], 1) // valid for change counter 1
+	binary.BigEndian.PutUint32(page[96:], 3039000)
+
+	schema := sqliteRecordOf([]interface{}{"table", "archive", "archive", int64(root), sqliteTable})
+	cell := appendSqliteVarint(nil, uint64(len(schema)))
+	cell = appendSqliteVarint(cell, 1)
+	cell = append(cell, schema...)
+	fillSqlitePage(page, 100, sqliteLeafTable, [][]byte{cell}, 0)
+	return page
+}
+
+// fillSqlitePage writes a b-tree page header at off in page, followed by
+// pointers to cells, which are placed at the end of the page. right is the
+// rightmost child of an interior page.
+func fillSqlitePage(page []byte, off int, typ byte, cells [][]byte, right uint32) {
+	page[off] = typ
+	binary.BigEndian.PutUint16(page[off+3:], uint16(len(cells)))
+	ptr := off + 8
+	if typ == sqliteInteriorTable {
+		binary.BigEndian.PutUint32(page[off+8:], right)
+		ptr += 4
+	}
+	content := len(page)
+	for _, cell := range cells {
+		content -= len(cell)
+		copy(page[content:], cell)
+		binary.BigEndian.PutUint16(page[ptr:], uint16(content))
+		ptr += 2
+	}
+	binary.BigEndian.PutUint16(page[off+5:], uint16(content))
+}
+
+// sqliteRecord returns the record of row in the archive table.
+func sqliteRecord(row exportRow) []byte {
+	var timestamp interface{}
+	if !row.written.IsZero() {
+		timestamp = row.written.UnixNano()
+	}
+	return sqliteRecordOf([]interface{}{row.key, row.value, timestamp, int64(row.flag)})
+}
+
+// sqliteRecordOf encodes values, each nil, int64, string or []byte, as a
+// record.
+func sqliteRecordOf(values []interface{}) []byte {
+	var types, body []byte
+	for _, v := range values {
+		switch v := v.(type) {
+		case nil:
+			types = appendSqliteVarint(types, 0)
+		case int64:
+			t, b := sqliteInt(v)
+			types = appendSqliteVarint(types, t)
+			body = append(body, b...)
+		case string:
+			types = appendSqliteVarint(types, uint64(len(v))*2+13)
+			body = append(body, v...)
+		case []byte:
+			types = appendSqliteVarint(types, uint64(len(v))*2+12)
+			body = append(body, v...)
+		}
+	}
+	// The header size counts its own varint.
+	size := len(types) + 1
+	for size != len(types)+len(appendSqliteVarint(nil, uint64(size))) {
+		size++
+	}
+	record := appendSqliteVarint(make([]byte, 0, size+len(body)), uint64(size))
+	record = append(record, types...)
+	return append(record, body...)
+}
+
+// sqliteInt returns the serial type of v and its encoding, the shortest
+// one that holds it.
+func sqliteInt(v int64) (uint64, []byte) {
+	switch {
+	case v == 0:
+		return 8, nil
+	case v == 1:
+		return 9, nil
+	}
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	for _, t := range []struct {
+		serial uint64
+		size   int
+	}{{1, 1}, {2, 2}, {3, 3}, {4, 4}, {5, 6}} {
+		bits := uint(t.size * 8)
+		if v >= -1<<(bits-1) && v < 1<<(bits-1) {
+			return t.serial, b[8-t.size:]
+		}
+	}
+	return 6, b[:]
+}
+
+// appendSqliteVarint appends the big-endian varint encoding of v, in which
+// all bytes but the last have the high bit set, and a ninth byte holds 8
+// bits.
+func appendSqliteVarint(b []byte, v uint64) []byte {
+	if v > 1<<56-1 {
+		var buf [9]byte
+		buf[8] = byte(v)
+		v >>= 8
+		for i := 7; i >= 0; i-- {
+			buf[i] = byte(v&0x7f) | 0x80
+			v >>= 7
+		}
+		return append(b, buf[:]...)
+	}
+	var buf [8]byte
+	n := 0
+	for {
+		buf[n] = byte(v & 0x7f)
+		n++
+		if v >>= 7; v == 0 {
+			break
+		}
+	}
+	for i := n - 1; i >= 0; i-- {
+		c := buf[i]
+		if i > 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+	}
+	return b
+}
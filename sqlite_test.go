@@ -0,0 +1,234 @@
+package archivedb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_ExportSQLite(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	clock := newFakeClock()
+	db, err := Open(dir, ClockOption(clock), RolloverOption(time.Hour))
+	require.NoError(err)
+	defer db.Close()
+
+	// Enough rows for interior pages, and values that overflow.
+	value := func(i int) []byte {
+		v := bytes.Repeat([]byte{byte(i)}, i%40)
+		if i%500 == 0 {
+			v = bytes.Repeat([]byte{byte(i)}, 10000+i)
+		}
+		return v
+	}
+	const n = 5000
+	for i := 0; i < n; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("key%05d", i)), value(i)))
+		if i == n/2 {
+			clock.Add(2 * time.Hour)
+		}
+	}
+	sealed := clock.Now().UnixNano()
+
+	var buf bytes.Buffer
+	require.NoError(db.Export(&buf, ExportSQLite))
+	file := buf.Bytes()
+	require.Equal("SQLite format 3\x00", string(file[:16]))
+	require.Zero(len(file) % sqlitePageSize)
+	require.Equal(uint32(len(file)/sqlitePageSize), binary.BigEndian.Uint32(file[28:]))
+
+	schema := readSqliteTable(t, file, 1)
+	require.Len(schema, 1)
+	require.Equal([]interface{}{"table", "archive", "archive"}, schema[0][:3])
+	require.Equal(sqliteTable, schema[0][4])
+	rows := readSqliteTable(t, file, uint32(schema[0][3].(int64)))
+	require.Len(rows, n)
+	for i, row := range rows {
+		require.Equal([]byte(fmt.Sprintf("key%05d", i)), row[0])
+		require.Equal(value(i), row[1], i)
+		if i <= n/2 {
+			require.Equal(sealed, row[2])
+		} else {
+			require.Nil(row[2])
+		}
+		require.Equal(int64(EntryInsertFlag), row[3])
+	}
+
+	// An empty database has an empty table.
+	buf.Reset()
+	dir2, cleanup2 := MustTempDir()
+	defer cleanup2()
+	empty, err := Open(dir2)
+	require.NoError(err)
+	defer empty.Close()
+	require.NoError(empty.Export(&buf, ExportSQLite))
+	schema = readSqliteTable(t, buf.Bytes(), 1)
+	require.Empty(readSqliteTable(t, buf.Bytes(), uint32(schema[0][3].(int64))))
+}
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// TestDB_ExportSQLite_Golden compares an export with testdata/export.sqlite,
+// which was checked with the sqlite3 shell rather than readSqliteTable:
+//
+//	sqlite3 testdata/export.sqlite 'PRAGMA integrity_check' \
+//		'SELECT key, length(value), timestamp, flag FROM archive'
+//
+// reports ok and the rows a|1|1577840400000000000|1, b|5000||1 and c|0||1.
+// Rewrite it with -update, and check it again, when the format changes.
+func TestDB_ExportSQLite_Golden(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	clock := newFakeClock()
+	db, err := Open(dir, ClockOption(clock), RolloverOption(time.Hour))
+	require.NoError(err)
+	defer db.Close()
+
+	require.NoError(db.Put([]byte("a"), []byte("1")))
+	clock.Add(time.Hour)
+	require.NoError(db.Put([]byte("b"), bytes.Repeat([]byte("v"), 5000)))
+	require.NoError(db.Put([]byte("c"), nil))
+
+	var buf bytes.Buffer
+	require.NoError(db.Export(&buf, ExportSQLite))
+	golden := filepath.Join("testdata", "export.sqlite")
+	if *updateGolden {
+		require.NoError(ioutil.WriteFile(golden, buf.Bytes(), 0644))
+	}
+	want, err := ioutil.ReadFile(golden)
+	require.NoError(err)
+	require.Equal(want, buf.Bytes())
+}
+
+func TestSqliteVarint(t *testing.T) {
+	for _, v := range []uint64{0, 127, 128, 1<<14 - 1, 1 << 14, 1<<56 - 1, 1 << 56, 1<<64 - 1} {
+		b := appendSqliteVarint(nil, v)
+		got, n := readSqliteVarint(b)
+		require.Equal(t, v, got)
+		require.Equal(t, len(b), n)
+	}
+}
+
+func TestSqliteInt(t *testing.T) {
+	for _, v := range []int64{0, 1, 2, -1, 127, 128, -129, 1 << 20, -1 << 31, 1 << 40, 1 << 47, 1 << 50, -1 << 63} {
+		typ, b := sqliteInt(v)
+		require.Equal(t, v, decodeSqliteInt(typ, b), v)
+	}
+}
+
+// readSqliteTable returns the rows of the table b-tree rooted at root in
+// the SQLite database file, in rowid order.
+func readSqliteTable(t *testing.T, file []byte, root uint32) [][]interface{} {
+	page := file[(root-1)*sqlitePageSize : root*sqlitePageSize]
+	hdr := page
+	if root == 1 {
+		hdr = page[100:]
+	}
+	cells := int(binary.BigEndian.Uint16(hdr[3:]))
+	ptrs := hdr[8:]
+	if hdr[0] == sqliteInteriorTable {
+		ptrs = hdr[12:]
+	}
+	var rows [][]interface{}
+	for i := 0; i < cells; i++ {
+		cell := page[binary.BigEndian.Uint16(ptrs[2*i:]):]
+		switch hdr[0] {
+		case sqliteInteriorTable:
+			rows = append(rows, readSqliteTable(t, file, binary.BigEndian.Uint32(cell))...)
+		case sqliteLeafTable:
+			size, n := readSqliteVarint(cell)
+			_, m := readSqliteVarint(cell[n:])
+			cell = cell[n+m:]
+			local := int(size)
+			if local > sqlitePageSize-35 {
+				min := (sqlitePageSize-12)*32/255 - 23
+				if local = min + (int(size)-min)%(sqlitePageSize-4); local > sqlitePageSize-35 {
+					local = min
+				}
+			}
+			payload := append([]byte(nil), cell[:local]...)
+			var next uint32
+			if local < int(size) {
+				next = binary.BigEndian.Uint32(cell[local:])
+			}
+			for len(payload) < int(size) {
+				overflow := file[(next-1)*sqlitePageSize : next*sqlitePageSize]
+				rest := int(size) - len(payload)
+				if rest > sqlitePageSize-4 {
+					rest = sqlitePageSize - 4
+				}
+				payload = append(payload, overflow[4:4+rest]...)
+				next = binary.BigEndian.Uint32(overflow)
+			}
+			rows = append(rows, readSqliteRecord(payload))
+		default:
+			t.Fatalf("page %d has type %#x", root, hdr[0])
+		}
+	}
+	if hdr[0] == sqliteInteriorTable {
+		rows = append(rows, readSqliteTable(t, file, binary.BigEndian.Uint32(hdr[8:]))...)
+	}
+	return rows
+}
+
+func readSqliteRecord(b []byte) []interface{} {
+	size, n := readSqliteVarint(b)
+	types, body := b[n:size], b[size:]
+	var values []interface{}
+	for len(types) > 0 {
+		typ, n := readSqliteVarint(types)
+		types = types[n:]
+		switch {
+		case typ == 0:
+			values = append(values, nil)
+		case typ >= 13 && typ%2 == 1:
+			l := (typ - 13) / 2
+			values = append(values, string(body[:l]))
+			body = body[l:]
+		case typ >= 12:
+			l := (typ - 12) / 2
+			values = append(values, body[:l])
+			body = body[l:]
+		default:
+			l := map[uint64]int{1: 1, 2: 2, 3: 3, 4: 4, 5: 6, 6: 8}[typ]
+			values = append(values, decodeSqliteInt(typ, body[:l]))
+			body = body[l:]
+		}
+	}
+	return values
+}
+
+func decodeSqliteInt(typ uint64, b []byte) int64 {
+	switch typ {
+	case 8:
+		return 0
+	case 9:
+		return 1
+	}
+	v := int64(int8(b[0]))
+	for _, c := range b[1:] {
+		v = v<<8 | int64(c)
+	}
+	return v
+}
+
+func readSqliteVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < 8; i++ {
+		v = v<<7 | uint64(b[i]&0x7f)
+		if b[i] < 0x80 {
+			return v, i + 1
+		}
+	}
+	return v<<8 | uint64(b[8]), 9
+}
@@ -0,0 +1,93 @@
+package archivedb
+
+import (
+	"os"
+	"path/filepath"
+)
+
+const (
+	// StandbySegmentName is the file the next segment is prepared in
+	// before the active segment fills up.
+	StandbySegmentName = "standby"
+
+	// DefaultPreallocateThreshold is the fill ratio of the active segment
+	// at which the next segment is prepared.
+	DefaultPreallocateThreshold = 0.9
+)
+
+// standbySegment is a segment file being prepared in the background.
+type standbySegment struct {
+	done chan struct{}
+	err  error
+}
+
+// StandbyPath returns the path of the standby segment file.
+func (db *DB) StandbyPath() string { return filepath.Join(db.path, StandbySegmentName) }
+
+// maybePrepareStandby starts preparing the next segment file in the
+// background once active is filled past the preallocation threshold, so
+// rolling over doesn't have to create a 1GB file inline. The caller must
+// hold db.mu.
+func (db *DB) maybePrepareStandby(active *segment) {
+	if db.standby != nil || db.opts.preallocate == 0 ||
+		float64(active.Size()) < db.opts.preallocate*float64(SegmentSize) {
+		return
+	}
+	// Without room for the segment, leave the rollover to report it.
+	if db.checkSpace(uint64(SegmentSize)) != nil {
+		return
+	}
+	sb := &standbySegment{done: make(chan struct{})}
+	db.standby = sb
+	path := db.StandbyPath()
+	db.background(func() {
+		defer close(sb.done)
+		sb.err = initSegmentFile(path)
+	})
+}
+
+// recoverStandby adopts a standby segment prepared before the database was
+// last closed, or removes it if it is damaged.
+func (db *DB) recoverStandby() {
+	path := db.StandbyPath()
+	if _, err := os.Stat(path); err != nil {
+		return
+	}
+	if err := validateSegmentFile(path); err != nil {
+		db.event(EventRecovery, "removed damaged standby segment", path, err)
+		os.Remove(path)
+		return
+	}
+	sb := &standbySegment{done: make(chan struct{})}
+	close(sb.done)
+	db.standby = sb
+}
+
+// takeStandby moves the standby segment to path if it is ready. It returns
+// false if there is none, it is still being prepared or it couldn't be
+// used, in which case the caller creates the segment itself. One still
+// being prepared is kept for the next rollover rather than waited for, so
+// writers never wait on the workers under the write lock. The caller must
+// hold db.mu.
+func (db *DB) takeStandby(path string) bool {
+	sb := db.standby
+	if sb == nil {
+		return false
+	}
+	select {
+	case <-sb.done:
+	default:
+		return false
+	}
+	db.standby = nil
+	err := sb.err
+	if err == nil {
+		err = os.Rename(db.StandbyPath(), path)
+	}
+	if err != nil {
+		db.warn(Warning{Op: "use standby segment", Path: db.StandbyPath(), Err: err})
+		os.Remove(db.StandbyPath())
+		return false
+	}
+	return true
+}
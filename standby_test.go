@@ -0,0 +1,81 @@
+package archivedb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_StandbySegment(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	db, err := Open(dir, PreallocateOption(1e-9))
+	require.NoError(err)
+	require.NoError(db.Put([]byte("a"), []byte("1")))
+	require.NoError(db.Close())
+	_, err = os.Stat(db.StandbyPath())
+	require.NoError(err)
+
+	// The standby segment is adopted on open and used for the next segment.
+	db, err = Open(dir, PreallocateOption(0))
+	require.NoError(err)
+	defer db.Close()
+	require.NotNil(db.standby)
+	mustRollover(t, db)
+	_, err = os.Stat(db.StandbyPath())
+	require.True(os.IsNotExist(err))
+	require.NoError(db.Put([]byte("b"), []byte("2")))
+	require.Equal(uint32(1), db.activeSegment().ID())
+	v, err := db.Get([]byte("b"))
+	require.NoError(err)
+	require.Equal("2", string(v))
+	require.Nil(db.standby)
+}
+
+func TestDB_StandbySegmentDamaged(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, StandbySegmentName), []byte("junk"), 0644))
+
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	require.Nil(db.standby)
+	_, err = os.Stat(db.StandbyPath())
+	require.True(os.IsNotExist(err))
+}
+
+func TestDB_StandbySegmentNotReady(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	db, err := Open(dir, PreallocateOption(0))
+	require.NoError(err)
+	defer db.Close()
+
+	// Rolling over doesn't wait for a standby segment still being prepared,
+	// and keeps it for the next rollover.
+	sb := &standbySegment{done: make(chan struct{})}
+	db.standby = sb
+	mustRollover(t, db)
+	require.Equal(uint32(1), db.activeSegment().ID())
+	require.Equal(sb, db.standby)
+
+	require.NoError(initSegmentFile(db.StandbyPath()))
+	close(sb.done)
+	mustRollover(t, db)
+	require.Nil(db.standby)
+	_, err = os.Stat(db.StandbyPath())
+	require.True(os.IsNotExist(err))
+	require.NoError(db.Put([]byte("a"), []byte("1")))
+	v, err := db.Get([]byte("a"))
+	require.NoError(err)
+	require.Equal("1", string(v))
+}
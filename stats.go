@@ -0,0 +1,378 @@
+package archivedb
+
+import (
+	"bytes"
+	"math"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// ValueSizeBuckets is the number of buckets in the value size histogram.
+	ValueSizeBuckets = 33
+	// LatencyBuckets is the number of buckets in latency histograms.
+	LatencyBuckets = 32
+)
+
+// Stats holds counters describing the database since it was opened, and
+// the size of its data.
+type Stats struct {
+	// LogicalBytes is the key and value bytes accepted by Put and Delete.
+	LogicalBytes int64
+	// PhysicalBytes is the bytes written to segments and the index,
+	// including entry headers and tombstones.
+	PhysicalBytes int64
+	// ValueSizes is a histogram of the sizes of values put: bucket 0
+	// counts empty values and bucket i values of 2^(i-1) to 2^i-1 bytes.
+	ValueSizes [ValueSizeBuckets]int64
+	// Reads counts the Gets that found the key in the index, Writes the
+	// entries written by Put, Delete and batches, and Syncs the times a
+	// segment and the index were synced to stable storage.
+	Reads  int64
+	Writes int64
+	Syncs  int64
+	// Rollovers counts the segments sealed to start a new one, and
+	// ChecksumFailures the entries and chunked values read that didn't
+	// match their checksum, retries included.
+	Rollovers        int64
+	ChecksumFailures int64
+	// Compactions counts the segments Compact emptied and ReclaimedBytes
+	// the bytes they held.
+	Compactions    int64
+	ReclaimedBytes int64
+	// LastCompaction is when Compact last emptied a segment, or zero if
+	// it didn't since the database was opened.
+	LastCompaction time.Time
+	// PutLatency, GetLatency and DeleteLatency time Put, Get and Delete,
+	// waiting for locks and syncing included.
+	PutLatency    LatencyStats
+	GetLatency    LatencyStats
+	DeleteLatency LatencyStats
+
+	// Segments is the number of attached segments, the active one
+	// included.
+	Segments int
+	// DiskBytes is the bytes of the entries in those segments and of the
+	// records in the index file, leaving out the unused, preallocated tail
+	// of the files.
+	DiskBytes int64
+	// Keys is the number of keys that aren't deleted, expired keys
+	// included until they are purged.
+	Keys int64
+	// DeadBytes is the bytes of entries no key refers to anymore, plus the
+	// tombstones of deleted keys, TombstoneBytes, which Compact reclaims.
+	DeadBytes      int64
+	TombstoneBytes int64
+	// IndexMemory is the estimate of IndexMemoryUsage.
+	IndexMemory int64
+
+	// HotKeys are the most read keys, or key prefixes, of the Gets
+	// sampled since the database was opened with AccessStatsOption, most
+	// read first; nil without it.
+	HotKeys []KeyAccess
+}
+
+// WriteAmplification returns the ratio of physical to logical bytes
+// written, or 0 if nothing has been written.
+func (s Stats) WriteAmplification() float64 {
+	if s.LogicalBytes == 0 {
+		return 0
+	}
+	return float64(s.PhysicalBytes) / float64(s.LogicalBytes)
+}
+
+// ValueSizeQuantile returns an upper bound on the size of the smallest
+// fraction q of values put, from the histogram, or 0 if none were put. It
+// overestimates by less than a factor of two.
+func (s Stats) ValueSizeQuantile(q float64) uint32 {
+	var total int64
+	for _, n := range s.ValueSizes {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(total)))
+	if rank < 1 {
+		rank = 1
+	}
+	var i int
+	for ; i < ValueSizeBuckets-1; i++ {
+		if rank -= s.ValueSizes[i]; rank <= 0 {
+			break
+		}
+	}
+	return uint32(uint64(1)<<uint(i) - 1)
+}
+
+// LatencyStats describes how long an operation took.
+type LatencyStats struct {
+	Count int64
+	Total time.Duration
+	// Buckets is a histogram of latencies: bucket 0 counts operations
+	// that took under a microsecond and bucket i those that took 2^(i-1)
+	// to 2^i microseconds.
+	Buckets [LatencyBuckets]int64
+}
+
+// Mean returns the average latency, or 0 if there were no operations.
+func (l LatencyStats) Mean() time.Duration {
+	if l.Count == 0 {
+		return 0
+	}
+	return l.Total / time.Duration(l.Count)
+}
+
+// Quantile returns an upper bound on the latency of the fastest fraction q
+// of operations, from the histogram, or 0 if there were none. It
+// overestimates by less than a factor of two.
+func (l LatencyStats) Quantile(q float64) time.Duration {
+	var total int64
+	for _, n := range l.Buckets {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(total)))
+	if rank < 1 {
+		rank = 1
+	}
+	var i int
+	for ; i < LatencyBuckets-1; i++ {
+		if rank -= l.Buckets[i]; rank <= 0 {
+			break
+		}
+	}
+	return time.Duration(1<<uint(i)) * time.Microsecond
+}
+
+// latency holds the counters behind LatencyStats, updated atomically.
+type latency struct {
+	count   int64
+	total   int64
+	buckets [LatencyBuckets]int64
+}
+
+// since records an operation started at start.
+func (l *latency) since(start time.Time) {
+	d := time.Since(start)
+	if d < 0 {
+		d = 0
+	}
+	i := bits.Len64(uint64(d / time.Microsecond))
+	if i >= LatencyBuckets {
+		i = LatencyBuckets - 1
+	}
+	atomic.AddInt64(&l.count, 1)
+	atomic.AddInt64(&l.total, int64(d))
+	atomic.AddInt64(&l.buckets[i], 1)
+}
+
+func (l *latency) load() LatencyStats {
+	s := LatencyStats{
+		Count: atomic.LoadInt64(&l.count),
+		Total: time.Duration(atomic.LoadInt64(&l.total)),
+	}
+	for i := range s.Buckets {
+		s.Buckets[i] = atomic.LoadInt64(&l.buckets[i])
+	}
+	return s
+}
+
+// stats holds the counters behind Stats, updated atomically.
+type stats struct {
+	logicalBytes  int64
+	physicalBytes int64
+	valueSizes    [ValueSizeBuckets]int64
+	reads         int64
+	writes        int64
+	syncs         int64
+	rollovers     int64
+	checksums     int64 // checksum failures
+	compactions   int64
+	reclaimed     int64
+	// lastCompaction is in Unix nanoseconds.
+	lastCompaction int64
+	puts, gets     latency
+	deletes        latency
+	// unsynced is the bytes written since the last sync, for
+	// SyncEveryNBytes.
+	unsynced int64
+}
+
+// addValueSize records a value of n bytes in the histogram.
+func (s *stats) addValueSize(n int) {
+	atomic.AddInt64(&s.valueSizes[bits.Len32(uint32(n))], 1)
+}
+
+// Stats returns a snapshot of the database counters and sizes. Keys,
+// DeadBytes and TombstoneBytes are counted by reading the header of the
+// current entry of every key, so the cost is proportional to the number of
+// keys; they are left zero if that fails, as it does once the database is
+// closed.
+func (db *DB) Stats() Stats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	s := db.quickStats()
+	if db.closed {
+		return s
+	}
+	usage, liveKeys, err := db.segmentUsage()
+	if err != nil {
+		return s
+	}
+	for _, u := range usage {
+		s.DeadBytes += u.Size - u.LiveBytes
+		s.TombstoneBytes += u.tombstoneBytes
+	}
+	for _, n := range liveKeys {
+		s.Keys += n
+	}
+	return s
+}
+
+// QuickStats is Stats without Keys, DeadBytes and TombstoneBytes, so its
+// cost doesn't grow with the number of keys. It suits metrics collected
+// often, such as those of the metrics package.
+func (db *DB) QuickStats() Stats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.quickStats()
+}
+
+// quickStats implements QuickStats. The caller must hold db.mu.
+func (db *DB) quickStats() Stats {
+	s := Stats{
+		LogicalBytes:     atomic.LoadInt64(&db.stats.logicalBytes),
+		PhysicalBytes:    atomic.LoadInt64(&db.stats.physicalBytes),
+		Reads:            atomic.LoadInt64(&db.stats.reads),
+		Writes:           atomic.LoadInt64(&db.stats.writes),
+		Syncs:            atomic.LoadInt64(&db.stats.syncs),
+		Rollovers:        atomic.LoadInt64(&db.stats.rollovers),
+		ChecksumFailures: atomic.LoadInt64(&db.stats.checksums),
+		Compactions:      atomic.LoadInt64(&db.stats.compactions),
+		ReclaimedBytes:   atomic.LoadInt64(&db.stats.reclaimed),
+		PutLatency:       db.stats.puts.load(),
+		GetLatency:       db.stats.gets.load(),
+		DeleteLatency:    db.stats.deletes.load(),
+	}
+	for i := range s.ValueSizes {
+		s.ValueSizes[i] = atomic.LoadInt64(&db.stats.valueSizes[i])
+	}
+	if db.access != nil {
+		s.HotKeys = db.access.top()
+	}
+	if t := atomic.LoadInt64(&db.stats.lastCompaction); t != 0 {
+		s.LastCompaction = time.Unix(0, t)
+	}
+	if db.closed {
+		return s
+	}
+	for _, seg := range db.segments {
+		if !seg.detached {
+			s.Segments++
+			s.DiskBytes += int64(seg.Size())
+		}
+	}
+	s.DiskBytes += IndexHeaderSize + int64(db.index.Length())*indexItemSize
+	s.IndexMemory = db.index.MemoryUsage()
+	return s
+}
+
+// PrefixStats describes the live keys sharing a common prefix.
+type PrefixStats struct {
+	// Keys is the number of live keys with the prefix.
+	Keys int64
+	// LiveBytes is the on-disk size of the current entries of those keys,
+	// including entry headers.
+	LiveBytes int64
+	// Sampled is true if the counts are extrapolated from a sample of the
+	// keys rather than counted exactly.
+	Sampled bool
+}
+
+// StatsSampleKeys is how many keys StatsPrefix and EstimateSize read at
+// least to extrapolate their counts from. Databases with fewer keys are counted
+// exactly.
+const StatsSampleKeys = 4096
+
+// StatsPrefix returns the number of live keys starting with prefix and the
+// bytes their current entries occupy. An empty prefix matches every key.
+//
+// The index only holds key hashes, so keys are read from their segments:
+// those of a random sample of about StatsSampleKeys keys, whose counts are
+// scaled up to the whole database, so the cost doesn't grow with it. The
+// result is exact if the database has fewer keys.
+func (db *DB) StatsPrefix(prefix []byte) (PrefixStats, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var keys, size int64
+	scale, err := db.sampleLiveEntries(StatsSampleKeys, func(e entry) {
+		if bytes.HasPrefix(e.key, prefix) {
+			keys++
+			size += int64(e.Size())
+		}
+	})
+	if err != nil {
+		return PrefixStats{}, err
+	}
+	return PrefixStats{
+		Keys:      int64(math.Round(float64(keys) * scale)),
+		LiveBytes: int64(math.Round(float64(size) * scale)),
+		Sampled:   scale != 1,
+	}, nil
+}
+
+// sampleLiveEntries calls fn with the live entries of a random sample of
+// at least n keys, or of every key, and returns the factor counts over
+// the sample are scaled by to estimate them over every key. The caller
+// must hold db.mu.
+func (db *DB) sampleLiveEntries(n int, fn func(e entry)) (float64, error) {
+	if db.closed {
+		return 0, ErrDatabaseClosed
+	}
+	now := db.now()
+	fraction, err := db.index.Sample(n, func(_ uint64, it item) error {
+		e, ok, err := db.liveEntry(it, now, false)
+		if ok {
+			fn(e)
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return 1 / fraction, nil
+}
+
+// EstimateSize returns the bytes occupied by live entries whose keys fall in
+// the range [start, end), and the number of such keys. A nil end means the
+// range is unbounded above.
+//
+// Like StatsPrefix, this extrapolates from a random sample of about
+// StatsSampleKeys keys, so its cost doesn't grow with the database; the
+// result is exact if the database has fewer keys.
+func (db *DB) EstimateSize(start, end []byte) (size int64, keys int64, err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	scale, err := db.sampleLiveEntries(StatsSampleKeys, func(e entry) {
+		if keyInRange(e.key, start, end) {
+			keys++
+			size += int64(e.Size())
+		}
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return int64(math.Round(float64(size) * scale)), int64(math.Round(float64(keys) * scale)), nil
+}
+
+// keyInRange returns true if start <= key < end. A nil end is unbounded.
+func keyInRange(key, start, end []byte) bool {
+	if bytes.Compare(key, start) < 0 {
+		return false
+	}
+	return end == nil || bytes.Compare(key, end) < 0
+}
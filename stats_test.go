@@ -0,0 +1,311 @@
+package archivedb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_StatsPrefix(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("tenant1/%d", i)), []byte("value")))
+		require.NoError(db.Put([]byte(fmt.Sprintf("tenant2/%d", i)), []byte("v")))
+	}
+	require.NoError(db.Delete([]byte("tenant1/0")))
+
+	stats, err := db.StatsPrefix([]byte("tenant1/"))
+	require.NoError(err)
+	require.Equal(int64(9), stats.Keys)
+	require.Equal(int64(9*(EntryHeaderSize+9+5)), stats.LiveBytes)
+
+	stats, err = db.StatsPrefix([]byte("tenant2/"))
+	require.NoError(err)
+	require.Equal(int64(10), stats.Keys)
+
+	stats, err = db.StatsPrefix(nil)
+	require.NoError(err)
+	require.Equal(int64(19), stats.Keys)
+
+	stats, err = db.StatsPrefix([]byte("tenant3/"))
+	require.NoError(err)
+	require.Equal(PrefixStats{}, stats)
+}
+
+func TestDB_StatsPrefix_Sampled(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+
+	const n = 20000
+	for i := 0; i < n; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("tenant%d/%05d", i%4, i)), []byte("value")))
+	}
+	stats, err := db.StatsPrefix([]byte("tenant1/"))
+	require.NoError(err)
+	require.True(stats.Sampled)
+	require.InEpsilon(n/4, stats.Keys, 0.15)
+	require.InEpsilon(n/4*(EntryHeaderSize+13+5), stats.LiveBytes, 0.15)
+
+	stats, err = db.StatsPrefix(nil)
+	require.NoError(err)
+	require.InEpsilon(n, stats.Keys, 0.15)
+}
+
+func TestDB_EstimateSize(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+
+	for _, k := range []string{"a", "b", "c", "d"} {
+		require.NoError(db.Put([]byte(k), []byte("value")))
+	}
+	entrySize := int64(EntryHeaderSize + 1 + 5)
+
+	n, keys, err := db.EstimateSize([]byte("b"), []byte("d"))
+	require.NoError(err)
+	require.Equal(int64(2), keys)
+	require.Equal(2*entrySize, n)
+
+	n, keys, err = db.EstimateSize([]byte("b"), nil)
+	require.NoError(err)
+	require.Equal(int64(3), keys)
+	require.Equal(3*entrySize, n)
+
+	n, keys, err = db.EstimateSize([]byte("x"), nil)
+	require.NoError(err)
+	require.Zero(keys)
+	require.Zero(n)
+}
+
+func TestDB_EstimateSize_Sampled(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+
+	const n = 20000
+	for i := 0; i < n; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("k%05d", i)), []byte("value")))
+	}
+	size, keys, err := db.EstimateSize([]byte("k05000"), []byte("k15000"))
+	require.NoError(err)
+	require.InEpsilon(n/2, keys, 0.15)
+	require.InEpsilon(n/2*(EntryHeaderSize+6+5), size, 0.15)
+}
+
+func TestDB_Stats(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+
+	require.Zero(db.Stats().WriteAmplification())
+	require.NoError(db.Put([]byte("foo"), []byte("bar")))
+	require.NoError(db.Delete([]byte("foo")))
+
+	stats := db.Stats()
+	require.Equal(int64(3+3+3), stats.LogicalBytes)
+	require.Equal(int64(2*(EntryHeaderSize+indexItemSize)+3+3+3), stats.PhysicalBytes)
+	require.Greater(stats.WriteAmplification(), 1.0)
+}
+
+func TestDB_StatsSizes(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir, FsyncOption(true), CompactionRatioOption(0.01))
+	require.NoError(err)
+	defer db.Close()
+
+	require.NoError(db.Put([]byte("foo"), []byte("bar")))
+	require.NoError(db.Put([]byte("baz"), []byte("qux")))
+	mustRollover(t, db)
+	require.NoError(db.Put([]byte("foo"), []byte("new")))
+	require.NoError(db.Delete([]byte("baz")))
+	_, err = db.Get([]byte("foo"))
+	require.NoError(err)
+	_, err = db.Get([]byte("missing"))
+	require.ErrorIs(err, ErrKeyNotFound)
+
+	entrySize := int64(EntryHeaderSize + 3 + 3)
+	tombstoneSize := int64(EntryHeaderSize + 3)
+	stats := db.Stats()
+	require.Equal(int64(1), stats.Reads)
+	require.Equal(int64(4), stats.Writes)
+	require.GreaterOrEqual(stats.Syncs, int64(4))
+	require.True(stats.LastCompaction.IsZero())
+	require.Equal(2, stats.Segments)
+	require.Equal(int64(1), stats.Keys)
+	require.Equal(2*entrySize+tombstoneSize, stats.DeadBytes)
+	require.Equal(tombstoneSize, stats.TombstoneBytes)
+	require.Equal(2*SegmentHeaderSize+3*entrySize+tombstoneSize+IndexHeaderSize+4*indexItemSize, stats.DiskBytes)
+	require.Equal(db.IndexMemoryUsage(), stats.IndexMemory)
+
+	require.NoError(db.Compact())
+	stats = db.Stats()
+	require.False(stats.LastCompaction.IsZero())
+	require.Equal(int64(1), stats.Keys)
+
+	require.NoError(db.Close())
+	stats = db.Stats()
+	require.Equal(int64(1), stats.Reads)
+	require.Zero(stats.Segments)
+}
+
+func TestDB_StatsCounters(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir, ReadRetryOption(1, 0))
+	require.NoError(err)
+	defer db.Close()
+
+	require.NoError(db.Put([]byte("foo"), []byte("bar")))
+	require.NoError(db.Put([]byte("baz"), []byte("qux")))
+	require.NoError(db.Delete([]byte("baz")))
+	_, err = db.Get([]byte("foo"))
+	require.NoError(err)
+	mustRollover(t, db)
+
+	stats := db.QuickStats()
+	require.Equal(int64(2), stats.PutLatency.Count)
+	require.Equal(int64(1), stats.DeleteLatency.Count)
+	require.Equal(int64(1), stats.GetLatency.Count)
+	require.LessOrEqual(stats.PutLatency.Mean(), stats.PutLatency.Quantile(1))
+	require.Equal(int64(1), stats.Rollovers)
+	require.Equal(2, stats.Segments)
+	require.Zero(stats.Keys)
+	require.Equal(int64(1), db.Stats().Keys)
+	require.NoError(db.Close())
+
+	// Flip a byte of the value of foo.
+	f, err := os.OpenFile(filepath.Join(dir, segmentFilename(0)), os.O_RDWR, 0)
+	require.NoError(err)
+	_, err = f.WriteAt([]byte{'x'}, SegmentHeaderSize+EntryHeaderSize+3)
+	require.NoError(err)
+	require.NoError(f.Close())
+	db, err = Open(dir, ReadRetryOption(1, 0))
+	require.NoError(err)
+	defer db.Close()
+	_, err = db.GetWithOptions([]byte("foo"), ReadOptions{VerifyChecksum: true})
+	require.ErrorIs(err, ErrChecksumFailed)
+	require.Equal(int64(1), db.QuickStats().ChecksumFailures)
+}
+
+func TestLatencyStats(t *testing.T) {
+	require := require.New(t)
+	var l latency
+	require.Zero(l.load().Mean())
+	require.Zero(l.load().Quantile(0.5))
+	start := time.Now()
+	// A start in the future counts as no time at all.
+	l.since(start.Add(time.Hour))
+	l.since(start.Add(-3 * time.Millisecond))
+	s := l.load()
+	require.Equal(int64(2), s.Count)
+	require.Equal(int64(1), s.Buckets[0])
+	require.Equal(time.Microsecond, s.Quantile(0.5))
+	require.Equal(4096*time.Microsecond, s.Quantile(1))
+}
+
+func TestDB_StatsValueSizes(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+
+	require.Zero(db.Stats().ValueSizeQuantile(0.5))
+	for _, n := range []int{0, 1, 3, 100, 100, 100, 1000} {
+		require.NoError(db.Put([]byte("foo"), make([]byte, n)))
+	}
+	require.NoError(db.Delete([]byte("foo")))
+
+	stats := db.Stats()
+	var want [ValueSizeBuckets]int64
+	want[0], want[1], want[2], want[7], want[10] = 1, 1, 1, 3, 1
+	require.Equal(want, stats.ValueSizes)
+	require.Equal(uint32(0), stats.ValueSizeQuantile(0))
+	require.Equal(uint32(127), stats.ValueSizeQuantile(0.5))
+	require.Equal(uint32(1023), stats.ValueSizeQuantile(1))
+}
+
+func TestDB_HotKeys(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir, AccessStatsOption(1, 0))
+	require.NoError(err)
+	defer db.Close()
+
+	require.Empty(db.Stats().HotKeys)
+	require.NoError(db.Put([]byte("hot"), []byte("v")))
+	for i := 0; i < 100; i++ {
+		_, err := db.Get([]byte("hot"))
+		require.NoError(err)
+	}
+	for i := 0; i < 10; i++ {
+		db.Get([]byte("missing"))
+	}
+	hot := db.Stats().HotKeys
+	require.Equal([]KeyAccess{{Key: []byte("hot"), Reads: 100}, {Key: []byte("missing"), Reads: 10}}, hot)
+
+	// Past the size of the table, the least read keys give way.
+	for i := 0; i < 2*accessTableSize; i++ {
+		db.Get([]byte(fmt.Sprintf("cold%d", i)))
+	}
+	hot = db.QuickStats().HotKeys
+	require.Len(hot, accessTableSize)
+	require.Equal(KeyAccess{Key: []byte("hot"), Reads: 100}, hot[0])
+	require.Equal("missing", string(hot[1].Key))
+	require.Equal(int64(2), hot[len(hot)-1].Reads)
+	require.Equal(int64(1), hot[len(hot)-1].Overcount)
+
+	_, err = Open(dir, AccessStatsOption(-1, 0))
+	require.Error(err)
+}
+
+func TestDB_HotKeysPrefix(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir, AccessStatsOption(2, 5))
+	require.NoError(err)
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		db.Get([]byte(fmt.Sprintf("user/%d", i)))
+	}
+	for i := 0; i < 10; i++ {
+		db.Get([]byte(fmt.Sprintf("item/%d", i%2)))
+	}
+	db.Get([]byte("a"))
+	db.Get([]byte("a"))
+	require.Equal([]KeyAccess{
+		{Key: []byte("item/"), Reads: 10},
+		{Key: []byte("user/"), Reads: 10},
+		{Key: []byte("a"), Reads: 2},
+	}, db.Stats().HotKeys)
+}
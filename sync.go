@@ -0,0 +1,56 @@
+package archivedb
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SyncPolicy decides when writes are synced to stable storage, for
+// SyncPolicyOption. Writes that aren't synced yet survive a crash of the
+// process, but not of the machine. WriteOptions.Sync syncs a write
+// whatever the policy.
+type SyncPolicy struct {
+	always   bool
+	interval time.Duration
+	bytes    int64
+}
+
+var (
+	// SyncAlways syncs every write before Put returns, as FsyncOption does.
+	SyncAlways = SyncPolicy{always: true}
+	// SyncNever leaves syncing to the operating system, and to rollovers,
+	// which sync the segment they seal, and Close.
+	SyncNever = SyncPolicy{}
+)
+
+// SyncInterval syncs the writes made in the last interval d in the
+// background, so a crash of the machine loses at most about d of writes.
+// A failed sync raises a Warning.
+func SyncInterval(d time.Duration) SyncPolicy {
+	return SyncPolicy{interval: d}
+}
+
+// SyncEveryNBytes syncs the write that brings the bytes written since the
+// last sync to n or more, before it returns.
+func SyncEveryNBytes(n int64) SyncPolicy {
+	return SyncPolicy{bytes: n}
+}
+
+// addUnsynced counts n more bytes written and returns true if the write
+// should be synced under SyncEveryNBytes.
+func (db *DB) addUnsynced(n int64) bool {
+	total := atomic.AddInt64(&db.stats.unsynced, n)
+	return db.opts.syncBytes > 0 && total >= db.opts.syncBytes
+}
+
+// syncUnsynced syncs the active segment and the index if anything was
+// written since the last sync, for SyncInterval. Segments sealed since
+// were synced by the rollover.
+func (db *DB) syncUnsynced() error {
+	db.rlockFor(lockSync)
+	defer db.mu.RUnlock()
+	if db.closed || atomic.LoadInt64(&db.stats.unsynced) == 0 {
+		return nil
+	}
+	return db.flush()
+}
@@ -0,0 +1,87 @@
+package archivedb
+
+import (
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncPolicyOption(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir, SyncPolicyOption(SyncEveryNBytes(100)))
+	require.NoError(err)
+	defer db.Close()
+
+	unsynced := func() int64 { return atomic.LoadInt64(&db.stats.unsynced) }
+	require.NoError(db.Put([]byte("a"), make([]byte, 20)))
+	require.NotZero(unsynced())
+	require.NoError(db.Put([]byte("b"), make([]byte, 20)))
+	require.NotZero(unsynced())
+	require.NoError(db.Put([]byte("c"), make([]byte, 20)))
+	require.Zero(unsynced())
+
+	b := db.NewWriteBatch()
+	for _, k := range []string{"d", "e", "f"} {
+		b.Put([]byte(k), make([]byte, 20))
+	}
+	require.NoError(b.Commit())
+	require.Zero(unsynced())
+
+	require.NoError(db.SetOption(SyncPolicyOption(SyncAlways)))
+	require.True(db.opts.fsync)
+	require.NoError(db.SetOption(SyncPolicyOption(SyncNever)))
+	require.NoError(db.Put([]byte("g"), make([]byte, 400)))
+	require.NotZero(unsynced())
+	require.ErrorIs(db.SetOption(SyncPolicyOption(SyncInterval(time.Second))), ErrImmutableOption)
+	require.Error(db.SetOption(SyncPolicyOption(SyncEveryNBytes(-1))))
+}
+
+func TestSyncInterval(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir, SyncPolicyOption(SyncInterval(10*time.Millisecond)))
+	require.NoError(err)
+	defer db.Close()
+
+	require.NoError(db.Put([]byte("a"), []byte("1")))
+	require.Eventually(func() bool {
+		return atomic.LoadInt64(&db.stats.unsynced) == 0
+	}, 5*time.Second, 5*time.Millisecond)
+}
+
+// TestSyncEveryNBytes_Rollover checks writes to a segment are synced when
+// it is sealed, before the manifest records it, and the active segment's
+// when the database is closed.
+func TestSyncEveryNBytes_Rollover(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	files := map[string]*faultFile{}
+	injectFaults(t, func(path string, f *faultFile) { files[filepath.Base(path)] = f })
+	clock := newFakeClock()
+	db, err := Open(dir, ClockOption(clock), RolloverOption(time.Hour), SyncPolicyOption(SyncEveryNBytes(1<<20)))
+	require.NoError(err)
+
+	require.NoError(db.Put([]byte("a"), []byte("1")))
+	seg0 := files[segmentFilename(0)]
+	require.Zero(seg0.syncs)
+	clock.Add(2 * time.Hour)
+	require.NoError(db.Put([]byte("b"), []byte("2")))
+	require.Equal(uint32(1), db.activeSegment().ID())
+	require.Equal(1, seg0.syncs)
+	require.False(db.segments[0].Dirty())
+
+	seg1 := files[segmentFilename(1)]
+	require.Zero(seg1.syncs)
+	require.True(db.segments[1].Dirty())
+	require.NoError(db.Close())
+	require.Equal(1, seg1.syncs)
+	require.Equal(1, seg0.syncs)
+}
@@ -0,0 +1,122 @@
+package archivedb
+
+import "github.com/pkg/errors"
+
+var ErrInvalidTag = errors.New("invalid tag")
+
+// tagIndex maps a tag to the hashes of keys written with it. It is built on
+// the first LookupTag and may hold keys since overwritten or deleted, which
+// LookupTag drops as it finds them.
+type tagIndex map[uint32]map[uint64]struct{}
+
+func (t tagIndex) add(tag uint32, hashKey uint64) {
+	keys, ok := t[tag]
+	if !ok {
+		keys = make(map[uint64]struct{})
+		t[tag] = keys
+	}
+	keys[hashKey] = struct{}{}
+}
+
+// PutTagged is like Put but attaches tag to the entry, such as the id of
+// the tenant or source that wrote it. Tag zero means untagged.
+func (db *DB) PutTagged(key, value []byte, tag uint32) error {
+	return db.set(key, value, EntryInsertFlag, WriteOptions{Tag: tag})
+}
+
+// LookupTag calls fn with every live, unexpired key whose current value was
+// written with tag, in no particular order. Keys whose segment is missing
+// or quarantined are skipped. The database is locked while fn runs, so fn
+// must not call into it.
+//
+// The tag index is built from the entries on the first call and kept up to
+// date by later writes; a follower rebuilds it on every call, as it doesn't
+// see the writes.
+func (db *DB) LookupTag(tag uint32, fn func(key, value []byte) error) error {
+	if tag == 0 {
+		return errors.Wrap(ErrInvalidTag, "tag must not be zero")
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return ErrDatabaseClosed
+	}
+	db.tagsMu.Lock()
+	defer db.tagsMu.Unlock()
+	if db.tags == nil || db.opts.readOnly {
+		if err := db.buildTagIndex(); err != nil {
+			return err
+		}
+	}
+	keys := db.tags[tag]
+	now := db.now()
+	for hashKey := range keys {
+		it, ok := db.index.Get(hashKey)
+		if !ok {
+			delete(keys, hashKey)
+			continue
+		}
+		segment := db.segment(it.ID())
+		if segment == nil && db.segmentMissing(it.ID()) {
+			continue
+		} else if segment == nil {
+			return ErrSegmentNotFound
+		}
+		e, err := segment.ReadEntry(it.Offset())
+		if err != nil {
+			return err
+		}
+		if e.hdr.Flag == EntryDeleteFlag || e.hdr.Tag != tag {
+			delete(keys, hashKey)
+			continue
+		} else if e.expired(now) {
+			continue
+		}
+		if err := e.verify(e.key); err != nil {
+			return err
+		} else if err := db.decodeValue(&e); err != nil {
+			return err
+		}
+		if err := fn(db.decodeKey(e.key), e.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addTag records that the key with the given hash was written with tag, if
+// the tag index has been built. Writers call it after publishing the entry
+// to the index, so LookupTag never drops a tag it is about to see.
+func (db *DB) addTag(tag uint32, hashKey uint64) {
+	db.tagsMu.Lock()
+	defer db.tagsMu.Unlock()
+	if db.tags != nil {
+		db.tags.add(tag, hashKey)
+	}
+}
+
+// buildTagIndex indexes the tags of the current entries. The caller must
+// hold db.mu and db.tagsMu.
+func (db *DB) buildTagIndex() error {
+	tags := make(tagIndex)
+	if err := db.index.ForEach(func(hashKey uint64, it item) error {
+		segment := db.segment(it.ID())
+		if segment == nil && db.segmentMissing(it.ID()) {
+			return nil
+		} else if segment == nil {
+			return ErrSegmentNotFound
+		}
+		hdr, err := segment.ReadEntryHeader(it.Offset())
+		if err != nil {
+			return err
+		}
+		if hdr.Tag != 0 && hdr.Flag != EntryDeleteFlag {
+			tags.add(hdr.Tag, hashKey)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	db.tags = tags
+	return nil
+}
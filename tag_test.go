@@ -0,0 +1,85 @@
+package archivedb
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_LookupTag(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+
+	lookup := func(tag uint32) []string {
+		var keys []string
+		require.NoError(db.LookupTag(tag, func(key, value []byte) error {
+			require.Equal("v"+string(key), string(value))
+			keys = append(keys, string(key))
+			return nil
+		}))
+		sort.Strings(keys)
+		return keys
+	}
+
+	require.NoError(db.PutTagged([]byte("a"), []byte("va"), 1))
+	require.NoError(db.PutTagged([]byte("b"), []byte("vb"), 2))
+	require.NoError(db.Put([]byte("c"), []byte("vc")))
+	require.Equal([]string{"a"}, lookup(1))
+
+	// Writes after the index is built are picked up, and overwritten or
+	// deleted keys drop out.
+	require.NoError(db.PutTagged([]byte("d"), []byte("vd"), 1))
+	require.NoError(db.PutTagged([]byte("b"), []byte("vb"), 1))
+	require.NoError(db.PutTagged([]byte("a"), []byte("va"), 3))
+	require.Equal([]string{"b", "d"}, lookup(1))
+	require.NoError(db.Delete([]byte("d")))
+	require.Equal([]string{"b"}, lookup(1))
+	require.Empty(lookup(2))
+
+	// Tags survive reopening.
+	require.NoError(db.Close())
+	db, err = Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	require.Equal([]string{"b"}, lookup(1))
+	require.Equal([]string{"a"}, lookup(3))
+	require.ErrorIs(db.LookupTag(0, nil), ErrInvalidTag)
+}
+
+func TestDB_LookupTag_MissingSegment(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+
+	require.NoError(db.PutTagged([]byte("a"), []byte("va"), 1))
+	_, err = db.SealActiveSegment()
+	require.NoError(err)
+	require.NoError(db.PutTagged([]byte("b"), []byte("vb"), 1))
+	var keys []string
+	lookup := func(key, value []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	}
+	require.NoError(db.LookupTag(1, lookup))
+	require.Len(keys, 2)
+
+	// The keys of a segment lost after the tag index was built are
+	// skipped, not an error.
+	db.mu.Lock()
+	sealed := db.segments[0]
+	db.segments[0] = db.missingSegment(0)
+	db.mu.Unlock()
+	keys = nil
+	require.NoError(db.LookupTag(1, lookup))
+	require.Equal([]string{"b"}, keys)
+	db.mu.Lock()
+	db.segments[0] = sealed
+	db.mu.Unlock()
+}
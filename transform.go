@@ -0,0 +1,74 @@
+package archivedb
+
+import (
+	"bytes"
+	"encoding/hex"
+
+	"github.com/pkg/errors"
+)
+
+var ErrKeyTransform = errors.New("key transform failed")
+
+// KeyTransform rewrites keys before they are hashed and written to segments,
+// and restores them when they are read back. Encode and Decode must be exact
+// inverses. Name identifies the transform and its parameters; it is recorded
+// in the manifest so a database can't be reopened with a different transform.
+type KeyTransform interface {
+	Name() string
+	Encode(key []byte) ([]byte, error)
+	Decode(key []byte) []byte
+}
+
+type prefixTransform struct {
+	prefix []byte
+}
+
+// PrefixKeyTransform returns a KeyTransform that strips prefix from every key.
+// Keys without the prefix are rejected with ErrKeyTransform.
+func PrefixKeyTransform(prefix []byte) KeyTransform {
+	return &prefixTransform{prefix: append([]byte(nil), prefix...)}
+}
+
+func (t *prefixTransform) Name() string {
+	return "prefix:" + hex.EncodeToString(t.prefix)
+}
+
+func (t *prefixTransform) Encode(key []byte) ([]byte, error) {
+	if !bytes.HasPrefix(key, t.prefix) {
+		return nil, errors.Wrapf(ErrKeyTransform, "key %q lacks prefix %q", key, t.prefix)
+	}
+	return key[len(t.prefix):], nil
+}
+
+func (t *prefixTransform) Decode(key []byte) []byte {
+	b := make([]byte, 0, len(t.prefix)+len(key))
+	b = append(b, t.prefix...)
+	return append(b, key...)
+}
+
+// encodeKey validates key and applies the configured key transform. The
+// limit set by MaxKeySizeOption is left to checkEntry, so keys written
+// before it was lowered can still be read and deleted.
+func (db *DB) encodeKey(key []byte) ([]byte, error) {
+	if err := validateKey(key); err != nil {
+		return nil, err
+	}
+	if db.opts.keyTransform == nil {
+		return key, nil
+	}
+	k, err := db.opts.keyTransform.Encode(key)
+	if err != nil {
+		return nil, err
+	} else if len(k) > MaxKeySize {
+		return nil, ErrKeyTooLarge
+	}
+	return k, nil
+}
+
+// decodeKey reverses the configured key transform.
+func (db *DB) decodeKey(key []byte) []byte {
+	if db.opts.keyTransform == nil {
+		return key
+	}
+	return db.opts.keyTransform.Decode(key)
+}
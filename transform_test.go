@@ -0,0 +1,63 @@
+package archivedb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyTransform(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	tr := PrefixKeyTransform([]byte("tenant/"))
+	db, err := Open(dir, KeyTransformOption(tr))
+	require.NoError(err)
+	require.NoError(db.Put([]byte("tenant/foo"), []byte("bar")))
+	require.ErrorIs(db.Put([]byte("other/foo"), []byte("bar")), ErrKeyTransform)
+
+	v, err := db.Get([]byte("tenant/foo"))
+	require.NoError(err)
+	require.Equal([]byte("bar"), v)
+
+	stats, err := db.StatsPrefix([]byte("tenant/f"))
+	require.NoError(err)
+	require.Equal(int64(1), stats.Keys)
+	require.Equal(int64(EntryHeaderSize+3+3), stats.LiveBytes)
+
+	require.NoError(db.Delete([]byte("tenant/foo")))
+	_, err = db.Get([]byte("tenant/foo"))
+	require.ErrorIs(err, ErrKeyDeleted)
+	require.NoError(db.Close())
+
+	_, err = Open(dir)
+	require.ErrorIs(err, ErrManifestMismatch)
+	_, err = Open(dir, KeyTransformOption(PrefixKeyTransform([]byte("x"))))
+	require.ErrorIs(err, ErrManifestMismatch)
+
+	db, err = Open(dir, KeyTransformOption(tr))
+	require.NoError(err)
+	require.NoError(db.Close())
+}
+
+// sliceTransform is a transform whose values can't be compared.
+type sliceTransform struct{ prefix []byte }
+
+func (t sliceTransform) Name() string                      { return "slice" }
+func (t sliceTransform) Encode(key []byte) ([]byte, error) { return key, nil }
+func (t sliceTransform) Decode(key []byte) []byte          { return key }
+
+func TestKeyTransform_Uncomparable(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	tr := sliceTransform{prefix: []byte("p")}
+	db, err := Open(dir, KeyTransformOption(tr))
+	require.NoError(err)
+	defer db.Close()
+	require.NoError(db.SetOption(FsyncOption(true)))
+	require.ErrorIs(db.SetOption(KeyTransformOption(tr)), ErrImmutableOption)
+	require.ErrorIs(db.SetOption(KeyTransformOption(nil)), ErrImmutableOption)
+}
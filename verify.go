@@ -0,0 +1,104 @@
+package archivedb
+
+import (
+	"hash/crc32"
+	"time"
+)
+
+// VerifyReport is the result of Verify.
+type VerifyReport struct {
+	// Segments is the number of segments checked.
+	Segments int
+	// Entries is the number of entries checked.
+	Entries int64
+	// Bytes is the size of the segments checked.
+	Bytes int64
+	// Corrupt lists what failed verification, in segment order.
+	Corrupt []CorruptEntry
+	// Duration is how long Verify took.
+	Duration time.Duration
+}
+
+// CorruptEntry is an entry, or a whole sealed segment, failing Verify, or
+// an entry Compact left out as corrupt.
+type CorruptEntry struct {
+	Segment uint32
+	// Offset is the offset of the entry, or 0 if the checksum of the
+	// sealed segment doesn't match the manifest.
+	Offset uint32
+	Err    error
+}
+
+// Verify reads every entry of every segment and checks it against its
+// checksum, and checks every sealed segment against the checksum recorded
+// in the manifest. Detached segments are skipped. Open only checks the last
+// entry of the active segment, so Verify is the way to find entries that
+// rotted on disk before they are read.
+//
+// A header that can't be read ends the check of its segment, since the
+// entries after it can't be found. progress, if not nil, is called after
+// each segment with the bytes checked so far and in total. The database is
+// only locked while a segment is checked, so writes can proceed between
+// segments; entries written meanwhile may not be checked.
+func (db *DB) Verify(progress func(done, total int64)) (VerifyReport, error) {
+	start := time.Now()
+	db.mu.RLock()
+	if db.closed {
+		db.mu.RUnlock()
+		return VerifyReport{}, ErrDatabaseClosed
+	}
+	segments := append([]*segment(nil), db.segments...)
+	db.mu.RUnlock()
+
+	var report VerifyReport
+	var total int64
+	for _, s := range segments {
+		if !s.detached {
+			total += int64(s.Size())
+		}
+	}
+	for _, s := range segments {
+		if s.detached {
+			continue
+		}
+		if err := db.verifySegment(s, &report); err != nil {
+			return report, err
+		}
+		if progress != nil {
+			progress(report.Bytes, total)
+		}
+	}
+	report.Duration = time.Since(start)
+	return report, nil
+}
+
+// verifySegment checks the entries of s, and its checksum if it is
+// sealed, adding the results to report.
+func (db *DB) verifySegment(s *segment, report *VerifyReport) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return ErrDatabaseClosed
+	}
+	report.Segments++
+	size := s.Size()
+	report.Bytes += int64(size)
+	if sc, ok := db.manifest.sealed(s.ID()); ok {
+		if err := verifySegmentFile(s.path, sc); err != nil {
+			report.Corrupt = append(report.Corrupt, CorruptEntry{Segment: s.ID(), Err: err})
+		}
+	}
+	for off := uint32(SegmentHeaderSize); off < size; {
+		e, err := s.ReadEntry(off)
+		if err != nil {
+			report.Corrupt = append(report.Corrupt, CorruptEntry{Segment: s.ID(), Offset: off, Err: err})
+			return nil
+		}
+		report.Entries++
+		if e.hdr.Checksum != crc32.Checksum(e.value, CastagnoliCrcTable) {
+			report.Corrupt = append(report.Corrupt, CorruptEntry{Segment: s.ID(), Offset: off, Err: ErrChecksumFailed})
+		}
+		off += e.Size()
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package archivedb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_Verify(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	require.NoError(db.Put([]byte("a"), []byte("1")))
+	require.NoError(db.Put([]byte("b"), []byte("2")))
+	mustRollover(t, db)
+	require.NoError(db.Put([]byte("c"), []byte("3")))
+	require.NoError(db.Put([]byte("d"), []byte("4")))
+
+	var calls int
+	report, err := db.Verify(func(done, total int64) {
+		calls++
+		require.LessOrEqual(done, total)
+	})
+	require.NoError(err)
+	require.Equal(2, report.Segments)
+	require.Equal(int64(4), report.Entries)
+	require.Empty(report.Corrupt)
+	require.Equal(2, calls)
+	require.NoError(db.Close())
+
+	// Corrupt the value of "a" in the sealed segment and of "c" in the
+	// active one; Open only checks the last entry, "d".
+	for _, id := range []uint32{0, 1} {
+		f, err := os.OpenFile(filepath.Join(dir, segmentFilename(id)), os.O_WRONLY, 0)
+		require.NoError(err)
+		_, err = f.WriteAt([]byte("!"), SegmentHeaderSize+EntryHeaderSize+1)
+		require.NoError(err)
+		require.NoError(f.Close())
+	}
+	db, err = Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	report, err = db.Verify(nil)
+	require.NoError(err)
+	require.Equal(int64(4), report.Entries)
+	require.Len(report.Corrupt, 3)
+	require.Equal(CorruptEntry{Segment: 0, Offset: 0, Err: report.Corrupt[0].Err}, report.Corrupt[0])
+	require.Error(report.Corrupt[0].Err)
+	require.Equal(CorruptEntry{Segment: 0, Offset: SegmentHeaderSize, Err: ErrChecksumFailed}, report.Corrupt[1])
+	require.Equal(CorruptEntry{Segment: 1, Offset: SegmentHeaderSize, Err: ErrChecksumFailed}, report.Corrupt[2])
+
+	require.NoError(db.Close())
+	_, err = db.Verify(nil)
+	require.ErrorIs(err, ErrDatabaseClosed)
+}
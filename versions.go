@@ -0,0 +1,235 @@
+package archivedb
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/millken/archivedb/format"
+	"github.com/pkg/errors"
+)
+
+// ErrVersionNotFound is returned by GetAt for a version that doesn't
+// address an entry of the key.
+var ErrVersionNotFound = errors.New("version not found")
+
+// lastWritesSize bounds DB.lastWrites. Writes are published right after
+// the write lock is released, so only the last few can be missing from
+// the index.
+const lastWritesSize = 4096
+
+// Version is a value a key held.
+type Version struct {
+	// ID identifies the entry holding the version; IDs grow in write
+	// order. Compact moves the latest entry of a key, changing its ID.
+	ID uint64
+	// Value is nil for a deletion.
+	Value   []byte
+	Deleted bool
+	// Expires is when the value expires, or zero if it doesn't.
+	Expires time.Time
+}
+
+// GetVersions returns up to limit versions of key, newest first, deletions
+// included, by following the links VersionsOption records from the current
+// entry of the key back. The chain ends at an entry written without
+// VersionsOption, at the first write after the key was purged, at entries
+// in segments that were compacted or detached, and at entries PunchHoles
+// removed. Values are verified against their checksums and are copies.
+func (db *DB) GetVersions(key []byte, limit int) ([]Version, error) {
+	if limit <= 0 {
+		return nil, errors.Errorf("limit %d must be positive", limit)
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrDatabaseClosed
+	}
+	key, err := db.encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	it, ok := db.index.Get(db.opts.hashFunc(key))
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	var versions []Version
+	for len(versions) < limit {
+		e, err := db.readVersion(it, key)
+		if err == ErrVersionNotFound {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		versions = append(versions, newVersion(it, e))
+		if e.prev.off == 0 || !e.prev.before(it) {
+			break
+		}
+		it = e.prev
+	}
+	if len(versions) == 0 {
+		return nil, ErrKeyNotFound
+	}
+	return versions, nil
+}
+
+// GetAt returns a copy of the value key held at version, an ID returned
+// by GetVersions, whether or not it is still current and regardless of its
+// expiry. It returns ErrKeyNotFound if the version is a deletion and
+// ErrVersionNotFound if it isn't an entry of key.
+func (db *DB) GetAt(key []byte, version uint64) ([]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrDatabaseClosed
+	}
+	key, err := db.encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	e, err := db.readVersion(item{uint32(version >> 32), uint32(version)}, key)
+	if err != nil {
+		return nil, err
+	} else if e.hdr.Flag == EntryDeleteFlag {
+		return nil, ErrKeyNotFound
+	}
+	return append([]byte(nil), e.data...), nil
+}
+
+// GetAsOf returns a copy of the value key held at t, following the links
+// VersionsOption records. Entries carry no timestamps, so this is the
+// value at the end of the last segment sealed by t, as OpenAtTime sees
+// it. The seal times of segments tell which entries are too new without
+// reading them: only the header, key and link of the versions written
+// since are read on the way back, and the version found is verified
+// against its checksum. It returns ErrKeyNotFound if the key was deleted
+// at t, ErrKeyExpired if its value had expired, and ErrVersionNotFound if
+// the chain ends after t, as described for GetVersions, which includes a
+// key first written after t.
+func (db *DB) GetAsOf(key []byte, t time.Time) ([]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrDatabaseClosed
+	}
+	key, err := db.encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	it, ok := db.index.Get(db.opts.hashFunc(key))
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	at := db.manifest.watermarkAt(t).item()
+	for !it.before(at) {
+		prev, linked, err := db.readLink(it, key)
+		if err != nil {
+			return nil, err
+		} else if !linked || !prev.before(it) {
+			return nil, ErrVersionNotFound
+		}
+		it = prev
+	}
+	e, err := db.readVersion(it, key)
+	if err != nil {
+		return nil, err
+	} else if e.hdr.Flag == EntryDeleteFlag {
+		return nil, ErrKeyNotFound
+	} else if e.expired(t) {
+		return nil, ErrKeyExpired
+	}
+	return append([]byte(nil), e.data...), nil
+}
+
+// readLink returns the previous entry of the encoded key recorded in its
+// entry at it, reading no more of the value than the link. linked is false
+// if the entry was written without VersionsOption; it returns
+// ErrVersionNotFound if it doesn't address an entry of key. The caller
+// must hold db.mu.
+func (db *DB) readLink(it item, key []byte) (prev item, linked bool, err error) {
+	s := db.segment(it.ID())
+	if s == nil || s.detached || it.Offset() < SegmentHeaderSize || it.Offset() >= s.Size() {
+		return item{}, false, ErrVersionNotFound
+	}
+	hdr, err := s.ReadEntryHeader(it.Offset())
+	if err != nil {
+		return item{}, false, ErrVersionNotFound
+	} else if hdr.Attrs&(format.AttrPrev|format.AttrPrevWide) == 0 {
+		return item{}, false, nil
+	}
+	n := format.ExpirySize + format.PrevWideSize + format.NonceSize
+	if n > int(hdr.ValueSize) {
+		n = int(hdr.ValueSize)
+	}
+	buf, err := s.mmap.ReadOff(int(it.Offset()+EntryHeaderSize), int(hdr.KeySize)+n)
+	if err != nil {
+		return item{}, false, err
+	} else if !bytes.Equal(buf[:hdr.KeySize], key) {
+		return item{}, false, ErrVersionNotFound
+	}
+	f, _, err := format.SplitValue(hdr, buf[hdr.KeySize:])
+	if err != nil {
+		return item{}, false, errors.Wrapf(ErrInvalidEntryHeader, "attributes %#x: %v", hdr.Attrs, err)
+	}
+	return item{f.PrevSegment, f.PrevOffset}, true, nil
+}
+
+// readVersion reads and verifies the entry of the encoded key at it. It
+// returns ErrVersionNotFound if it doesn't address an entry of key. The
+// caller must hold db.mu.
+func (db *DB) readVersion(it item, key []byte) (entry, error) {
+	s := db.segment(it.ID())
+	if s == nil || s.detached || it.Offset() < SegmentHeaderSize || it.Offset() >= s.Size() {
+		return entry{}, ErrVersionNotFound
+	}
+	e, err := db.readEntry(s, it.Offset(), key, true)
+	switch {
+	case errors.Is(err, ErrKeyMismatch) || errors.Is(err, ErrInvalidOffset) || errors.Is(err, ErrInvalidEntryHeader):
+		return entry{}, ErrVersionNotFound
+	case err != nil:
+		return entry{}, err
+	case !bytes.Equal(e.key, key):
+		// Deletions are returned unchecked.
+		return entry{}, ErrVersionNotFound
+	}
+	return e, nil
+}
+
+func newVersion(it item, e entry) Version {
+	v := Version{ID: uint64(it.ID())<<32 | uint64(it.Offset())}
+	if e.hdr.Flag == EntryDeleteFlag {
+		v.Deleted = true
+	} else {
+		v.Value = append([]byte(nil), e.data...)
+	}
+	if e.expires != 0 {
+		v.Expires = time.Unix(0, e.expires)
+	}
+	return v
+}
+
+// previousEntry returns the latest entry written for hashKey, which the
+// next entry of the key links to, or a zero item. The caller must hold
+// db.mu for writing.
+func (db *DB) previousEntry(hashKey uint64) item {
+	prev, _ := db.index.Get(hashKey)
+	if last, ok := db.lastWrites[hashKey]; ok && prev.before(last) {
+		prev = last
+	}
+	return prev
+}
+
+// rememberWrite records the entry just written for hashKey until it is
+// surely published. The caller must hold db.mu for writing.
+func (db *DB) rememberWrite(hashKey uint64, it item) {
+	if db.lastWrites == nil || len(db.lastWrites) >= lastWritesSize {
+		db.lastWrites = make(map[uint64]item)
+	}
+	db.lastWrites[hashKey] = it
+}
+
+// removeKey removes hashKey from the index, so the next entry of the key
+// starts a new chain of versions. The caller must hold db.mu for writing.
+func (db *DB) removeKey(hashKey uint64) error {
+	delete(db.lastWrites, hashKey)
+	return db.index.Remove(hashKey)
+}
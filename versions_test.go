@@ -0,0 +1,250 @@
+package archivedb
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_GetVersions(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+
+	// The first value is written without links, so it ends the chain.
+	require.NoError(db.Put([]byte("foo"), []byte("v0")))
+	require.NoError(db.SetOption(VersionsOption(true)))
+	require.NoError(db.Put([]byte("foo"), []byte("v1")))
+	mustRollover(t, db)
+	require.NoError(db.Delete([]byte("foo")))
+	b := db.NewWriteBatch()
+	b.Put([]byte("foo"), []byte("v2"))
+	b.Put([]byte("foo"), []byte("v3"))
+	require.NoError(b.Commit())
+	require.NoError(db.Put([]byte("bar"), []byte("x")))
+
+	versions, err := db.GetVersions([]byte("foo"), 10)
+	require.NoError(err)
+	require.Len(versions, 5)
+	var values []string
+	for i, v := range versions {
+		if i > 0 {
+			require.Less(v.ID, versions[i-1].ID)
+		}
+		require.Zero(v.Expires)
+		if v.Deleted {
+			require.Nil(v.Value)
+			values = append(values, "deleted")
+		} else {
+			values = append(values, string(v.Value))
+		}
+	}
+	require.Equal([]string{"v3", "v2", "deleted", "v1", "v0"}, values)
+
+	versions, err = db.GetVersions([]byte("foo"), 2)
+	require.NoError(err)
+	require.Len(versions, 2)
+
+	v, err := db.GetAt([]byte("foo"), versions[1].ID)
+	require.NoError(err)
+	require.Equal([]byte("v2"), v)
+	all, err := db.GetVersions([]byte("foo"), 10)
+	require.NoError(err)
+	_, err = db.GetAt([]byte("foo"), all[2].ID)
+	require.ErrorIs(err, ErrKeyNotFound)
+	_, err = db.GetAt([]byte("bar"), all[0].ID)
+	require.ErrorIs(err, ErrVersionNotFound)
+	_, err = db.GetAt([]byte("foo"), 1<<40)
+	require.ErrorIs(err, ErrVersionNotFound)
+
+	_, err = db.GetVersions([]byte("missing"), 1)
+	require.ErrorIs(err, ErrKeyNotFound)
+	_, err = db.GetVersions([]byte("foo"), 0)
+	require.Error(err)
+
+	// Versions survive reopening.
+	require.NoError(db.Close())
+	db, err = Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	versions, err = db.GetVersions([]byte("foo"), 10)
+	require.NoError(err)
+	require.Equal(all, versions)
+}
+
+func TestDB_GetVersions_Compacted(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir, VersionsOption(true), CompactionRatioOption(0.1))
+	require.NoError(err)
+	defer db.Close()
+
+	require.NoError(db.Put([]byte("foo"), []byte("v0")))
+	require.NoError(db.Put([]byte("foo"), []byte("v1")))
+	mustRollover(t, db)
+	require.NoError(db.Put([]byte("foo"), []byte("v2")))
+	mustRollover(t, db)
+	require.NoError(db.Compact())
+
+	// The versions in the compacted segment are gone.
+	versions, err := db.GetVersions([]byte("foo"), 10)
+	require.NoError(err)
+	require.Len(versions, 1)
+	require.Equal([]byte("v2"), versions[0].Value)
+}
+
+func TestDB_GetAsOf(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	clock := newFakeClock()
+	db, err := Open(dir, ClockOption(clock), VersionsOption(true))
+	require.NoError(err)
+	defer db.Close()
+	start := clock.Now()
+	seal := func() {
+		clock.Add(time.Hour)
+		_, err := db.SealActiveSegment()
+		require.NoError(err)
+	}
+
+	require.NoError(db.Put([]byte("k"), []byte("1")))
+	require.NoError(db.PutWithTTL([]byte("ttl"), []byte("1"), 90*time.Minute))
+	seal() // start+1h
+	require.NoError(db.Put([]byte("k"), []byte("2")))
+	require.NoError(db.Put([]byte("k"), []byte("3")))
+	seal() // start+2h
+	require.NoError(db.Delete([]byte("k")))
+	seal() // start+3h
+	require.NoError(db.Put([]byte("k"), []byte("4")))
+
+	for _, c := range []struct {
+		t    time.Duration
+		want string
+		err  error
+	}{
+		{30 * time.Minute, "", ErrVersionNotFound},
+		{time.Hour, "1", nil},
+		{90 * time.Minute, "1", nil},
+		{2 * time.Hour, "3", nil},
+		{3 * time.Hour, "", ErrKeyNotFound},
+		{5 * time.Hour, "", ErrKeyNotFound},
+	} {
+		v, err := db.GetAsOf([]byte("k"), start.Add(c.t))
+		if c.err != nil {
+			require.ErrorIs(err, c.err, c.t)
+		} else {
+			require.NoError(err, c.t)
+			require.Equal(c.want, string(v), c.t)
+		}
+	}
+	v, err := db.GetAsOf([]byte("ttl"), start.Add(time.Hour))
+	require.NoError(err)
+	require.Equal("1", string(v))
+	_, err = db.GetAsOf([]byte("ttl"), start.Add(2*time.Hour))
+	require.ErrorIs(err, ErrKeyExpired)
+
+	// Entries written without versions end the chain.
+	require.NoError(db.Close())
+	db, err = Open(dir, ClockOption(clock))
+	require.NoError(err)
+	require.NoError(db.Put([]byte("k"), []byte("5")))
+	seal()
+	_, err = db.GetAsOf([]byte("k"), start.Add(2*time.Hour))
+	require.ErrorIs(err, ErrVersionNotFound)
+	v, err = db.GetAsOf([]byte("k"), clock.Now())
+	require.NoError(err)
+	require.Equal("5", string(v))
+}
+
+func TestDeltaEncodingOption(t *testing.T) {
+	for name, opts := range map[string][]Option{
+		"plain":     nil,
+		"deflate":   {CompressionOption(DeflateCodec, 64)},
+		"encrypted": {EncryptionOption(bytes.Repeat([]byte("k"), 32))},
+	} {
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+			dir, cleanup := MustTempDir()
+			defer cleanup()
+			db, err := Open(dir, append(opts, VersionsOption(true), DeltaEncodingOption(true), CompactionRatioOption(0.1))...)
+			require.NoError(err)
+			defer db.Close()
+
+			var values [][]byte
+			for i := 0; i < 20; i++ {
+				v := []byte(fmt.Sprintf("%s%04d%s", bytes.Repeat([]byte("a"), 1000), i, bytes.Repeat([]byte("z"), 1000)))
+				require.NoError(db.Put([]byte("doc"), v))
+				values = append(values, v)
+			}
+			var codecs []uint8
+			require.NoError(db.ForEachRaw(EntryFilter{}, func(e RawEntry) error {
+				codecs = append(codecs, e.Header.Codec())
+				return nil
+			}))
+			// Every ninth version in a row is stored in full.
+			for i, id := range codecs {
+				if i%9 == 0 {
+					require.NotEqual(uint8(deltaCodecID), id, "version %d", i)
+				} else {
+					require.Equal(uint8(deltaCodecID), id, "version %d", i)
+				}
+			}
+			stats := db.Stats()
+			require.Less(stats.PhysicalBytes, stats.LogicalBytes/4)
+
+			check := func() {
+				v, err := db.Get([]byte("doc"))
+				require.NoError(err)
+				require.Equal(values[len(values)-1], v)
+			}
+			check()
+			versions, err := db.GetVersions([]byte("doc"), 100)
+			require.NoError(err)
+			require.Len(versions, len(values))
+			for i, v := range versions {
+				require.Equal(values[len(values)-1-i], v.Value)
+			}
+
+			// Compact moves the latest version out of the segment of its
+			// base.
+			mustRollover(t, db)
+			require.NoError(db.Compact())
+			check()
+			require.NoError(db.ForEachRaw(EntryFilter{}, func(e RawEntry) error {
+				require.NotEqual(uint8(deltaCodecID), e.Header.Codec())
+				return nil
+			}))
+		})
+	}
+}
+
+func TestDeltaEncodingOption_PunchHoles(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir, VersionsOption(true), DeltaEncodingOption(true))
+	require.NoError(err)
+	defer db.Close()
+
+	value := bytes.Repeat([]byte("x"), 64<<10)
+	for i := 0; i < 3; i++ {
+		value[0] = byte('0' + i)
+		require.NoError(db.Put([]byte("doc"), value))
+	}
+	mustRollover(t, db)
+
+	// The earlier versions are dead but hold the latest value.
+	holes, _ := mustPunchHoles(t, db)
+	require.Zero(holes)
+	v, err := db.Get([]byte("doc"))
+	require.NoError(err)
+	require.Equal(value, v)
+}
@@ -0,0 +1,62 @@
+package archivedb
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	tooManyFilesRetries = 5
+	tooManyFilesBackoff = 10 * time.Millisecond
+)
+
+var ErrTooManyOpenFiles = errors.New("too many open files")
+
+// Warning describes a recoverable problem the database worked around.
+type Warning struct {
+	Op   string // operation that hit the problem
+	Path string // file involved, if any
+	Err  error
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("archivedb: %s %s: %v", w.Op, w.Path, w.Err)
+}
+
+// warn records w in the event log and passes it to the warning handler, if
+// one is set.
+func (db *DB) warn(w Warning) {
+	db.event(EventWarning, w.Op, w.Path, w.Err)
+	if db.opts.warningHandler != nil {
+		db.opts.warningHandler(w)
+	}
+}
+
+// retryTooManyFiles calls fn, retrying with backoff while it fails because
+// the process or system is out of file descriptors. Before each retry a GC
+// is forced so finalizers can release descriptors of unreachable files, and
+// a Warning is raised.
+func (db *DB) retryTooManyFiles(op, path string, fn func() error) error {
+	backoff := tooManyFilesBackoff
+	for i := 0; ; i++ {
+		err := fn()
+		if err == nil || !isTooManyFiles(err) {
+			return err
+		} else if i == tooManyFilesRetries {
+			return errors.Wrapf(ErrTooManyOpenFiles, "%s %s: %v", op, path, err)
+		}
+		db.warn(Warning{Op: op, Path: path, Err: err})
+		runtime.GC()
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// isTooManyFiles returns true if err was caused by descriptor exhaustion.
+func isTooManyFiles(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
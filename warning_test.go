@@ -0,0 +1,43 @@
+package archivedb
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_RetryTooManyFiles(t *testing.T) {
+	require := require.New(t)
+	var warnings []Warning
+	db := &DB{opts: &option{warningHandler: func(w Warning) {
+		warnings = append(warnings, w)
+	}}}
+
+	calls := 0
+	err := db.retryTooManyFiles("open segment", "0000", func() error {
+		if calls++; calls < 3 {
+			return &os.PathError{Op: "open", Path: "0000", Err: syscall.EMFILE}
+		}
+		return nil
+	})
+	require.NoError(err)
+	require.Equal(3, calls)
+	require.Len(warnings, 2)
+	require.Equal("open segment", warnings[0].Op)
+	require.Equal("0000", warnings[0].Path)
+
+	err = db.retryTooManyFiles("open segment", "0000", func() error {
+		return syscall.ENFILE
+	})
+	require.ErrorIs(err, ErrTooManyOpenFiles)
+
+	calls = 0
+	err = db.retryTooManyFiles("open segment", "0000", func() error {
+		calls++
+		return os.ErrNotExist
+	})
+	require.ErrorIs(err, os.ErrNotExist)
+	require.Equal(1, calls)
+}
@@ -0,0 +1,307 @@
+package archivedb
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultWatchBuffer is how many events a Watch queues by default.
+const DefaultWatchBuffer = 1024
+
+// ErrWatchOverflow is returned by Watch.Err for a watch with WatchCancel
+// whose queue overflowed.
+var ErrWatchOverflow = errors.New("watch queue overflowed")
+
+// WatchOverflow is what a Watch does with a write when its queue is full.
+type WatchOverflow int
+
+const (
+	// WatchBlock queues the event anyway and makes the writer wait, once
+	// it has released the database lock, until Next has made room, so a
+	// slow reader slows down writes but misses nothing. The reader must
+	// not write to the database itself, or it may wait on its own watch.
+	WatchBlock WatchOverflow = iota
+	// WatchDropOldest drops the oldest queued event to make room. The
+	// event queued after it records the gap in Missed.
+	WatchDropOldest
+	// WatchCancel ends the watch: Next returns the events queued, then
+	// false, and Err returns ErrWatchOverflow.
+	WatchCancel
+)
+
+// WatchOptions selects the writes a Watch reports. The filters are
+// applied as the writes are made, before anything is queued, so a watch
+// on a busy database only holds the events it asked for.
+type WatchOptions struct {
+	// Prefix, if not empty, limits the watch to keys starting with it.
+	Prefix []byte
+	// PutsOnly leaves deletes out.
+	PutsOnly bool
+	// MinValueSize leaves out puts of values shorter than this many
+	// bytes. Deletes are kept unless PutsOnly is set.
+	MinValueSize int
+	// Buffer is how many events the watch queues before Overflow
+	// applies. Zero means DefaultWatchBuffer.
+	Buffer int
+	// Overflow is what happens to a write when the queue is full.
+	Overflow WatchOverflow
+}
+
+// matches returns true if a write of a value of size bytes to key with
+// flag passes the filters of o.
+func (o *WatchOptions) matches(flag uint8, key []byte, size int) bool {
+	if !bytes.HasPrefix(key, o.Prefix) {
+		return false
+	} else if flag == EntryDeleteFlag {
+		return !o.PutsOnly
+	}
+	return size >= o.MinValueSize
+}
+
+// WatchEvent is a write reported by a Watch.
+type WatchEvent struct {
+	// Seq is the position of the entry in the database's write history,
+	// as in RawEntry.Seq.
+	Seq  uint64
+	Flag uint8 // EntryInsertFlag or EntryDeleteFlag
+	Key  []byte
+	// Value is the value put, or nil for deletes and for values PutReader
+	// streamed in chunks. ValueSize is its size in both cases.
+	Value     []byte
+	ValueSize int
+	Tag       uint32
+	// Expires is when the value expires, or zero if it doesn't.
+	Expires time.Time
+	// Missed is the number of events dropped right before this one by
+	// WatchDropOldest.
+	Missed uint64
+}
+
+// Watch reports the writes made through a DB after it was created, in
+// the order they were made. Events wait in a queue of WatchOptions.Buffer
+// events until Next takes them; WatchOptions.Overflow decides what a full
+// queue does. It is created with DB.Watch and read like an iterator:
+//
+//	w, err := db.Watch(WatchOptions{Prefix: []byte("orders/")})
+//	if err != nil { ... }
+//	defer w.Close()
+//	for w.Next() {
+//		handle(w.Event())
+//	}
+//	if err := w.Err(); err != nil { ... }
+//
+// Writes made by other processes, such as the writer a follower follows,
+// are not reported.
+type Watch struct {
+	db    *DB
+	opts  WatchOptions
+	mu    sync.Mutex
+	cond  sync.Cond // signalled when events are queued or the watch ends
+	queue []WatchEvent
+	event WatchEvent
+	err   error
+	done  bool
+}
+
+// Watch returns a watch reporting the writes that pass the filters of
+// opts, from now until it is closed or the database is. It fails if the
+// buffer size or overflow policy is invalid.
+func (db *DB) Watch(opts WatchOptions) (*Watch, error) {
+	if opts.Buffer < 0 {
+		return nil, errors.Errorf("watch buffer %d must not be negative", opts.Buffer)
+	} else if opts.Buffer == 0 {
+		opts.Buffer = DefaultWatchBuffer
+	}
+	if opts.Overflow < WatchBlock || opts.Overflow > WatchCancel {
+		return nil, errors.Errorf("unknown watch overflow policy %d", opts.Overflow)
+	}
+	w := &Watch{db: db, opts: opts}
+	w.opts.Prefix = append([]byte(nil), opts.Prefix...)
+	w.cond.L = &w.mu
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		w.done, w.err = true, ErrDatabaseClosed
+		return w, nil
+	}
+	db.watches = append(db.watches, w)
+	if opts.Overflow == WatchBlock {
+		atomic.AddInt32(&db.blockingWatches, 1)
+	}
+	return w, nil
+}
+
+// Next waits for the next event and returns true, or returns false once
+// the watch is closed or has ended; Err then tells why.
+func (w *Watch) Next() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for len(w.queue) == 0 && !w.done {
+		w.cond.Wait()
+	}
+	if len(w.queue) == 0 {
+		w.event = WatchEvent{}
+		return false
+	}
+	w.event = w.queue[0]
+	w.queue[0] = WatchEvent{}
+	w.queue = w.queue[1:]
+	// Writers may be waiting for room.
+	w.cond.Broadcast()
+	return true
+}
+
+// Event returns the event Next moved to. Its key and value must not be
+// modified.
+func (w *Watch) Event() WatchEvent { return w.event }
+
+// Err returns why the watch ended: ErrDatabaseClosed if the database was
+// closed, ErrWatchOverflow if it overflowed with WatchCancel, or nil if
+// the watch was closed.
+func (w *Watch) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Close ends the watch, dropping the events it holds, and wakes a Next
+// waiting on it.
+func (w *Watch) Close() error {
+	w.db.mu.Lock()
+	defer w.db.mu.Unlock()
+	w.db.removeWatch(w)
+	w.end(nil)
+	w.mu.Lock()
+	w.queue = nil
+	w.mu.Unlock()
+	return nil
+}
+
+// end stops the watch from taking events, leaving those it holds to Next,
+// with err as the reason.
+func (w *Watch) end(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.done {
+		w.done, w.err = true, err
+		w.cond.Broadcast()
+	}
+}
+
+// push queues e, applying the overflow policy if the queue is full. It
+// returns false if the watch overflowed with WatchCancel.
+func (w *Watch) push(e WatchEvent) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.done {
+		return true
+	}
+	if len(w.queue) >= w.opts.Buffer {
+		switch w.opts.Overflow {
+		case WatchDropOldest:
+			missed := w.queue[0].Missed + 1
+			w.queue[0] = WatchEvent{}
+			if w.queue = w.queue[1:]; len(w.queue) > 0 {
+				w.queue[0].Missed += missed
+			} else {
+				e.Missed += missed
+			}
+		case WatchCancel:
+			w.done, w.err = true, ErrWatchOverflow
+			w.cond.Broadcast()
+			return false
+		}
+	}
+	w.queue = append(w.queue, e)
+	w.cond.Broadcast()
+	return true
+}
+
+// wait waits until the queue of a watch with WatchBlock is no longer
+// over its buffer, or the watch ended.
+func (w *Watch) wait() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for !w.done && len(w.queue) > w.opts.Buffer {
+		w.cond.Wait()
+	}
+}
+
+// notifyWatches reports a write of the entry of the encoded key with flag
+// to the watches whose filters it passes. value is nil for a value
+// streamed in chunks, which is size bytes long. The caller must hold db.mu
+// for writing.
+func (db *DB) notifyWatches(flag uint8, key, value []byte, size int, tag uint32, expires int64) {
+	if len(db.watches) == 0 {
+		return
+	}
+	key = db.decodeKey(key)
+	var e *WatchEvent
+	var cancelled []*Watch
+	for _, w := range db.watches {
+		if !w.opts.matches(flag, key, size) {
+			continue
+		}
+		if e == nil {
+			// Copied once, as the caller may reuse them.
+			e = &WatchEvent{Seq: db.seq, Flag: flag, Key: append([]byte(nil), key...), ValueSize: size, Tag: tag}
+			if flag != EntryDeleteFlag && value != nil {
+				e.Value = append([]byte{}, value...)
+			}
+			if expires != 0 {
+				e.Expires = time.Unix(0, expires)
+			}
+		}
+		if !w.push(*e) {
+			cancelled = append(cancelled, w)
+		}
+	}
+	for _, w := range cancelled {
+		db.removeWatch(w)
+	}
+}
+
+// waitWatches waits for the watches with WatchBlock to have room for the
+// events of the writes made before. Writers call it once they have
+// released db.mu, so the readers of those watches can use the database.
+func (db *DB) waitWatches() {
+	if atomic.LoadInt32(&db.blockingWatches) == 0 {
+		return
+	}
+	db.mu.RLock()
+	watches := append([]*Watch(nil), db.watches...)
+	db.mu.RUnlock()
+	for _, w := range watches {
+		if w.opts.Overflow == WatchBlock {
+			w.wait()
+		}
+	}
+}
+
+// removeWatch stops reporting writes to w. The caller must hold db.mu for
+// writing.
+func (db *DB) removeWatch(w *Watch) {
+	for i, o := range db.watches {
+		if o == w {
+			db.watches = append(db.watches[:i], db.watches[i+1:]...)
+			if w.opts.Overflow == WatchBlock {
+				atomic.AddInt32(&db.blockingWatches, -1)
+			}
+			return
+		}
+	}
+}
+
+// endWatches ends every watch with err. The caller must hold db.mu for
+// writing.
+func (db *DB) endWatches(err error) {
+	for _, w := range db.watches {
+		w.end(err)
+	}
+	db.watches = nil
+	atomic.StoreInt32(&db.blockingWatches, 0)
+}
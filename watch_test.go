@@ -0,0 +1,231 @@
+package archivedb
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// mustNextEvent returns the next event of w, failing if there is none
+// within a few seconds.
+func mustNextEvent(t *testing.T, w *Watch) WatchEvent {
+	t.Helper()
+	next := make(chan bool, 1)
+	go func() { next <- w.Next() }()
+	select {
+	case ok := <-next:
+		require.True(t, ok, "watch ended: %v", w.Err())
+		return w.Event()
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+		return WatchEvent{}
+	}
+}
+
+func TestDB_Watch(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+
+	require.NoError(db.Put([]byte("before"), []byte("0")))
+	all, err := db.Watch(WatchOptions{})
+	require.NoError(err)
+	defer all.Close()
+	orders, err := db.Watch(WatchOptions{Prefix: []byte("orders/"), PutsOnly: true, MinValueSize: 2})
+	require.NoError(err)
+	defer orders.Close()
+
+	require.NoError(db.Put([]byte("orders/1"), []byte("a")))
+	require.NoError(db.PutWithTTL([]byte("orders/2"), []byte("bb"), time.Hour))
+	require.NoError(db.Delete([]byte("orders/2")))
+	b := db.NewWriteBatch()
+	b.Put([]byte("users/1"), []byte("cc"))
+	b.Put([]byte("orders/3"), []byte("ccc"))
+	require.NoError(b.Commit())
+	require.NoError(db.PutWithOptions([]byte("tagged"), []byte("d"), WriteOptions{Tag: 7}))
+
+	var got []string
+	var seq uint64
+	for i := 0; i < 6; i++ {
+		e := mustNextEvent(t, all)
+		require.Greater(e.Seq, seq)
+		seq = e.Seq
+		got = append(got, string(e.Key)+"="+string(e.Value))
+		switch string(e.Key) {
+		case "tagged":
+			require.Equal(uint32(7), e.Tag)
+		case "users/1":
+			require.Equal(2, e.ValueSize)
+		}
+	}
+	require.Equal([]string{"orders/1=a", "orders/2=bb", "orders/2=", "users/1=cc", "orders/3=ccc", "tagged=d"}, got)
+	require.Equal(seq, db.Seq())
+
+	e := mustNextEvent(t, orders)
+	require.Equal("orders/2", string(e.Key))
+	require.Equal(EntryInsertFlag, e.Flag)
+	require.False(e.Expires.IsZero())
+	e = mustNextEvent(t, orders)
+	require.Equal("orders/3", string(e.Key))
+
+	// Closing the database ends the watches, which are drained first.
+	require.NoError(db.Put([]byte("orders/4"), []byte("dd")))
+	require.NoError(db.Close())
+	e = mustNextEvent(t, orders)
+	require.Equal("orders/4", string(e.Key))
+	require.False(orders.Next())
+	require.ErrorIs(orders.Err(), ErrDatabaseClosed)
+	w, err := db.Watch(WatchOptions{})
+	require.NoError(err)
+	require.False(w.Next())
+	require.ErrorIs(w.Err(), ErrDatabaseClosed)
+}
+
+func TestDB_WatchKeyTransformAndStreams(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir, KeyTransformOption(PrefixKeyTransform([]byte("t/"))))
+	require.NoError(err)
+	defer db.Close()
+	defer func(n int) { streamChunkSize = n }(streamChunkSize)
+	streamChunkSize = 16
+
+	w, err := db.Watch(WatchOptions{Prefix: []byte("t/b")})
+	require.NoError(err)
+	defer w.Close()
+	require.NoError(db.Put([]byte("t/a"), []byte("1")))
+	value := bytes.Repeat([]byte("x"), 40)
+	require.NoError(db.PutReader([]byte("t/big"), bytes.NewReader(value), int64(len(value))))
+	e := mustNextEvent(t, w)
+	require.Equal("t/big", string(e.Key))
+	require.Nil(e.Value)
+	require.Equal(40, e.ValueSize)
+}
+
+func TestDB_WatchClose(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+
+	w, err := db.Watch(WatchOptions{})
+	require.NoError(err)
+	next := make(chan bool, 1)
+	go func() { next <- w.Next() }()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(w.Close())
+	select {
+	case ok := <-next:
+		require.False(ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close didn't wake Next")
+	}
+	require.NoError(w.Err())
+	require.NoError(db.Put([]byte("a"), []byte("1")))
+	require.Empty(db.watches)
+}
+
+func TestDB_WatchOverflow(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+
+	_, err = db.Watch(WatchOptions{Buffer: -1})
+	require.Error(err)
+	_, err = db.Watch(WatchOptions{Overflow: WatchCancel + 1})
+	require.Error(err)
+
+	drop, err := db.Watch(WatchOptions{Buffer: 2, Overflow: WatchDropOldest})
+	require.NoError(err)
+	defer drop.Close()
+	cancel, err := db.Watch(WatchOptions{Buffer: 2, Overflow: WatchCancel})
+	require.NoError(err)
+	defer cancel.Close()
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		require.NoError(db.Put([]byte(k), []byte("1")))
+	}
+
+	// a, b and c were dropped to make room for c, d and e.
+	e := mustNextEvent(t, drop)
+	require.Equal("d", string(e.Key))
+	require.Equal(uint64(3), e.Missed)
+	e = mustNextEvent(t, drop)
+	require.Equal("e", string(e.Key))
+	require.Zero(e.Missed)
+	require.NoError(db.Put([]byte("f"), []byte("1")))
+	e = mustNextEvent(t, drop)
+	require.Equal("f", string(e.Key))
+	require.Zero(e.Missed)
+
+	// The cancelled watch keeps what it queued before overflowing.
+	require.Equal("a", string(mustNextEvent(t, cancel).Key))
+	require.Equal("b", string(mustNextEvent(t, cancel).Key))
+	require.False(cancel.Next())
+	require.ErrorIs(cancel.Err(), ErrWatchOverflow)
+	db.mu.RLock()
+	require.Len(db.watches, 1)
+	db.mu.RUnlock()
+}
+
+func TestDB_WatchBlock(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+
+	w, err := db.Watch(WatchOptions{Buffer: 1})
+	require.NoError(err)
+	defer w.Close()
+	require.NoError(db.Put([]byte("a"), []byte("1")))
+
+	// The queue is full, so the next write waits for the reader, without
+	// holding the database lock.
+	done := make(chan error, 1)
+	go func() {
+		b := db.NewWriteBatch()
+		b.Put([]byte("b"), []byte("2"))
+		done <- b.Commit()
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("write didn't wait: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	v, err := db.Get([]byte("b"))
+	require.NoError(err)
+	require.Equal([]byte("2"), v)
+
+	require.Equal("a", string(mustNextEvent(t, w).Key))
+	select {
+	case err := <-done:
+		require.NoError(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("write still waiting")
+	}
+	require.Equal("b", string(mustNextEvent(t, w).Key))
+
+	// Closing the watch releases a waiting writer too.
+	require.NoError(db.Put([]byte("c"), []byte("3")))
+	go func() { done <- db.Put([]byte("d"), []byte("4")) }()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(w.Close())
+	select {
+	case err := <-done:
+		require.NoError(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("write still waiting")
+	}
+}
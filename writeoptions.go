@@ -0,0 +1,43 @@
+package archivedb
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrSeqMismatch is returned by PutWithOptions when the database was
+// written since the sequence number the caller expected.
+var ErrSeqMismatch = errors.New("sequence number mismatch")
+
+// WriteOptions control a single write. The zero value writes as Put does.
+type WriteOptions struct {
+	// Sync commits the entry to stable storage before returning, even if
+	// the sync policy of the database wouldn't sync it.
+	Sync bool
+	// TTL, if not zero, is how long the value lives, as by PutWithTTL.
+	TTL time.Duration
+	// Tag is attached to the entry, as by PutTagged. Zero means untagged.
+	Tag uint32
+	// ExpectedSeq, if not zero, makes the write fail with ErrSeqMismatch
+	// unless Seq still returns it, that is, unless nothing was written
+	// since the caller read it.
+	ExpectedSeq uint64
+}
+
+// PutWithOptions puts the value of the key as Put does, with the write
+// shaped by opts.
+func (db *DB) PutWithOptions(key, value []byte, opts WriteOptions) error {
+	if opts.TTL < 0 {
+		return errors.Wrapf(ErrInvalidTTL, "ttl %v", opts.TTL)
+	}
+	return db.set(key, value, EntryInsertFlag, opts)
+}
+
+// Seq returns the sequence number of the last entry written to the
+// database, as in AuditRecord.Seq, or zero if it is empty.
+func (db *DB) Seq() uint64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.seq
+}
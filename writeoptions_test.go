@@ -0,0 +1,45 @@
+package archivedb
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDB_PutWithOptions(t *testing.T) {
+	require := require.New(t)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+
+	var fault *faultFile
+	injectFaults(t, func(_ string, f *faultFile) { fault = f })
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+	require.Zero(db.Seq())
+
+	require.NoError(db.PutWithOptions([]byte("foo"), []byte("bar"), WriteOptions{Tag: 7}))
+	var keys []string
+	require.NoError(db.LookupTag(7, func(key, _ []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	}))
+	require.Equal([]string{"foo"}, keys)
+
+	seq := db.Seq()
+	require.Equal(uint64(1), seq)
+	require.NoError(db.PutWithOptions([]byte("foo"), []byte("baz"), WriteOptions{ExpectedSeq: seq}))
+	require.ErrorIs(db.PutWithOptions([]byte("foo"), []byte("qux"), WriteOptions{ExpectedSeq: seq}), ErrSeqMismatch)
+	v, err := db.Get([]byte("foo"))
+	require.NoError(err)
+	require.Equal([]byte("baz"), v)
+
+	require.ErrorIs(db.PutWithOptions([]byte("foo"), []byte("bar"), WriteOptions{TTL: -time.Hour}), ErrInvalidTTL)
+
+	// Only a synced write notices a failing sync.
+	fault.syncErr = syscall.EIO
+	require.NoError(db.Put([]byte("a"), []byte("1")))
+	require.ErrorIs(db.PutWithOptions([]byte("b"), []byte("2"), WriteOptions{Sync: true}), syscall.EIO)
+}
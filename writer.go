@@ -0,0 +1,113 @@
+package archivedb
+
+import (
+	"hash/crc32"
+	"io"
+
+	"github.com/millken/archivedb/format"
+	"github.com/pkg/errors"
+)
+
+// streamChunkSize is the most of a value PutReader holds in memory. Tests
+// lower it.
+var streamChunkSize = 4 << 20
+
+// PutReader puts the value of key as Put does, reading its size bytes from
+// r. A value larger than 4MB is never held in memory whole: it is written
+// as a chunked value, a chunk at a time, its checksum computed as it is
+// read, and only becomes visible once it is all written. The database
+// isn't locked while r is read. If r fails or ends early, the key keeps
+// its previous value and the chunks written are left for compaction.
+func (db *DB) PutReader(key []byte, r io.Reader, size int64) error {
+	if size < 0 {
+		return errors.Errorf("negative value size %d", size)
+	} else if size <= int64(streamChunkSize) {
+		value := make([]byte, size)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return errors.Wrap(err, "read value")
+		}
+		return db.Put(key, value)
+	}
+	key, err := db.checkStream(key, size)
+	if err != nil {
+		return err
+	}
+	var held []uint32
+	defer func() {
+		db.lockFor(lockWrite)
+		defer db.mu.Unlock()
+		for _, id := range held {
+			db.releaseSegment(id)
+		}
+	}()
+
+	n := streamChunkSize
+	if n > chunkSize {
+		n = chunkSize
+	}
+	buf := make([]byte, n)
+	list := format.ChunkList{Size: uint64(size)}
+	for left := size; left > 0; left -= int64(n) {
+		if int64(n) > left {
+			n = int(left)
+		}
+		if _, err := io.ReadFull(r, buf[:n]); err != nil {
+			return errors.Wrap(err, "read value")
+		}
+		list.Checksum = crc32.Update(list.Checksum, CastagnoliCrcTable, buf[:n])
+		ref, err := db.streamChunk(key, buf[:n], &held)
+		if err != nil {
+			return err
+		}
+		list.Chunks = append(list.Chunks, ref)
+	}
+	w, err := db.appendChunkList(key, list)
+	return db.publish(w, 0, err)
+}
+
+// checkStream returns the encoded key of a value of size bytes put by
+// PutReader, or an error if it can't be stored.
+func (db *DB) checkStream(key []byte, size int64) ([]byte, error) {
+	db.lockFor(lockWrite)
+	defer db.mu.Unlock()
+	if err := db.checkWritable(); err != nil {
+		return nil, err
+	} else if size > int64(db.opts.maxValueSize) && db.opts.maxValueSize < MaxValueSize {
+		return nil, ErrValueTooLarge
+	}
+	return db.checkEntry(key, nil, EntryInsertFlag, 0)
+}
+
+// streamChunk writes a chunk of a value streamed by PutReader. The segment
+// written to is held, and added to held, as nothing refers to the chunk
+// until the chunk list is written and compaction would drop it.
+func (db *DB) streamChunk(key, data []byte, held *[]uint32) (format.ChunkRef, error) {
+	db.lockFor(lockWrite)
+	defer db.mu.Unlock()
+	if err := db.checkWritable(); err != nil {
+		return format.ChunkRef{}, err
+	}
+	ref, err := db.writeChunk(key, data)
+	if err != nil {
+		return ref, db.degrade(err)
+	}
+	if n := len(*held); n == 0 || (*held)[n-1] != ref.Segment {
+		db.holdSegment(ref.Segment)
+		*held = append(*held, ref.Segment)
+	}
+	return ref, nil
+}
+
+// appendChunkList writes list as the value of key, as appendEntry does.
+func (db *DB) appendChunkList(key []byte, list format.ChunkList) (*pendingWrite, error) {
+	db.lockFor(lockWrite)
+	defer db.mu.Unlock()
+	if err := db.checkWritable(); err != nil {
+		return nil, err
+	}
+	w, err := db.writeValue(EntryInsertFlag, key, list.Encode(), format.AttrChunked, int(list.Size), 0, 0)
+	if w != nil {
+		db.notifyWatches(EntryInsertFlag, key, nil, int(list.Size), 0, 0)
+	}
+	return w, err
+}
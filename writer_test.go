@@ -0,0 +1,83 @@
+package archivedb
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// withStreamChunkSize lowers the chunk size of PutReader for the duration
+// of a test.
+func withStreamChunkSize(t *testing.T, n int) {
+	old := streamChunkSize
+	streamChunkSize = n
+	t.Cleanup(func() { streamChunkSize = old })
+}
+
+func TestDB_PutReader(t *testing.T) {
+	require := require.New(t)
+	withStreamChunkSize(t, 16)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir, EncryptionOption(bytes.Repeat([]byte{7}, 16)))
+	require.NoError(err)
+	defer db.Close()
+
+	small := []byte("small value")
+	require.NoError(db.PutReader([]byte("small"), bytes.NewReader(small), int64(len(small))))
+	require.Equal(uint64(1), db.Seq())
+	big := bytes.Repeat([]byte("0123456789"), 10)
+	require.NoError(db.PutReader([]byte("big"), bytes.NewReader(big), int64(len(big))))
+	// The 100 byte value takes 7 chunks and its chunk list.
+	require.Equal(uint64(9), db.Seq())
+	require.Empty(db.segmentRefs)
+
+	check := func(db *DB) {
+		for key, value := range map[string][]byte{"small": small, "big": big} {
+			v, err := db.Get([]byte(key))
+			require.NoError(err)
+			require.Equal(value, v)
+		}
+		r, size, err := db.GetReader([]byte("big"))
+		require.NoError(err)
+		defer r.Close()
+		require.Equal(int64(len(big)), size)
+		b, err := ioutil.ReadAll(r)
+		require.NoError(err)
+		require.Equal(big, b)
+	}
+	check(db)
+	require.Equal(int64(len("big")+len(big)+len("small")+len(small)), db.Stats().LogicalBytes)
+	require.NoError(db.Close())
+	db, err = Open(dir, EncryptionOption(bytes.Repeat([]byte{7}, 16)))
+	require.NoError(err)
+	defer db.Close()
+	check(db)
+}
+
+func TestDB_PutReaderShort(t *testing.T) {
+	require := require.New(t)
+	withStreamChunkSize(t, 16)
+	dir, cleanup := MustTempDir()
+	defer cleanup()
+	db, err := Open(dir)
+	require.NoError(err)
+	defer db.Close()
+
+	require.NoError(db.Put([]byte("big"), []byte("old")))
+	big := bytes.Repeat([]byte("x"), 100)
+	err = db.PutReader([]byte("big"), bytes.NewReader(big), 200)
+	require.ErrorIs(err, io.ErrUnexpectedEOF)
+	require.Empty(db.segmentRefs)
+	v, err := db.Get([]byte("big"))
+	require.NoError(err)
+	require.Equal([]byte("old"), v)
+
+	require.Error(db.PutReader([]byte("big"), bytes.NewReader(nil), -1))
+	require.ErrorIs(db.PutReader(nil, bytes.NewReader(big), 100), ErrEmptyKey)
+	require.NoError(db.Close())
+	require.ErrorIs(db.PutReader([]byte("big"), bytes.NewReader(big), 100), ErrDatabaseClosed)
+}